@@ -0,0 +1,232 @@
+package datanode
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/storage"
+	"github.com/tiglabs/baudstorage/util"
+	"github.com/tiglabs/baudstorage/util/log"
+)
+
+const (
+	CompactCheckInterval    = time.Minute
+	DefaultCompactBandwidth = 10 // MB/s
+	CompactReadDeadlineTime = 60
+	CompactPaceBytes        = util.MB
+)
+
+// CompactStats is the progress of the tiny store compaction on this DataNode.
+type CompactStats struct {
+	Running        bool
+	CurrentVol     uint32
+	CurrentChunk   int
+	CompactedCount uint64
+	FailedCount    uint64
+	ReclaimedBytes uint64
+	LastError      string
+	sync.Mutex
+}
+
+func (s *CompactStats) start(volId uint32, chunkId int) {
+	s.Lock()
+	s.Running = true
+	s.CurrentVol = volId
+	s.CurrentChunk = chunkId
+	s.Unlock()
+}
+
+func (s *CompactStats) finish(reclaimed int64, err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.Running = false
+	if err != nil {
+		s.FailedCount++
+		s.LastError = err.Error()
+		return
+	}
+	s.CompactedCount++
+	if reclaimed > 0 {
+		s.ReclaimedBytes += uint64(reclaimed)
+	}
+}
+
+func (s *CompactStats) get() (stats *CompactStats) {
+	s.Lock()
+	defer s.Unlock()
+	stats = &CompactStats{
+		Running:        s.Running,
+		CurrentVol:     s.CurrentVol,
+		CurrentChunk:   s.CurrentChunk,
+		CompactedCount: s.CompactedCount,
+		FailedCount:    s.FailedCount,
+		ReclaimedBytes: s.ReclaimedBytes,
+		LastError:      s.LastError,
+	}
+
+	return
+}
+
+// compactScheduler compacts the chunks of the tiny volumes led by this
+// DataNode one by one, the copy of the compaction is paced at
+// compactBandwidth.
+func (n *DataNode) compactScheduler() {
+	ticker := time.NewTicker(CompactCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stopC:
+			return
+		case <-ticker.C:
+		}
+		for _, v := range n.getAllVols() {
+			if v.storeType != proto.TinyStoreMode || !v.isLeader() || !v.enter() {
+				continue
+			}
+			store := v.getTinyStore()
+			for chunkId := 1; chunkId <= storage.ChunkCount; chunkId++ {
+				if !store.IsReadyToCompact(chunkId) {
+					continue
+				}
+				n.compactChunk(v, chunkId)
+			}
+			v.exit()
+		}
+	}
+}
+
+// pacer paces the IO at bandwidth MB/s, the bytes are slept for once they add
+// up to CompactPaceBytes, not object by object.
+type pacer struct {
+	bandwidth int
+	pending   int64
+}
+
+func (p *pacer) pace(size int64) {
+	p.pending += size
+	if p.pending >= CompactPaceBytes {
+		throttle(p.pending, p.bandwidth)
+		p.pending = 0
+	}
+}
+
+func (n *DataNode) newCompactPacer() *pacer {
+	return &pacer{bandwidth: n.compactBandwidth}
+}
+
+// throttle sleeps for the time of size bytes at bandwidth MB/s.
+func throttle(size int64, bandwidth int) {
+	if size <= 0 || bandwidth <= 0 {
+		return
+	}
+	time.Sleep(time.Duration(size) * time.Second / time.Duration(bandwidth*util.MB))
+}
+
+// compactChunk sends the deleted objects of the chunk to every follower of
+// the volume, so the replicas compact the same object set. The chunk on the
+// leader is compacted after all the followers have done.
+func (n *DataNode) compactChunk(v *Vol, chunkId int) (copied int64, err error) {
+	n.compactStats.start(v.volId, chunkId)
+	store := v.getTinyStore()
+	before := v.getChunkSize(chunkId)
+	defer func() {
+		n.compactStats.finish(before-copied, err)
+		if err != nil {
+			log.LogError(fmt.Sprintf("action[compactChunk] vol[%v] chunk[%v] err[%v]", v.volId, chunkId, err))
+		} else {
+			log.LogInfo(fmt.Sprintf("action[compactChunk] vol[%v] chunk[%v] size[%v->%v]", v.volId, chunkId, before, copied))
+		}
+	}()
+
+	objects := store.GetDelObjects(uint32(chunkId))
+	for _, host := range v.getFollowers() {
+		if err = n.notifyCompact(v, host, chunkId, objects); err != nil {
+			return
+		}
+	}
+	if err = store.DoCompactWork(chunkId, n.newCompactPacer().pace); err != nil {
+		return
+	}
+	copied = v.getChunkSize(chunkId)
+
+	return
+}
+
+func (n *DataNode) notifyCompact(v *Vol, host string, chunkId int, objects []uint64) (err error) {
+	var conn net.Conn
+	if conn, err = n.connPool.Get(host); err != nil {
+		return
+	}
+	p := newRepairPacket(proto.OpNotifyCompact, v, uint64(chunkId))
+	p.Data = make([]byte, 8*len(objects))
+	for i, oid := range objects {
+		binary.BigEndian.PutUint64(p.Data[i*8:(i+1)*8], oid)
+	}
+	p.Size = uint32(len(p.Data))
+	if err = p.WriteToConn(conn); err != nil {
+		conn.Close()
+		return
+	}
+	// The follower copies the chunk paced at the bandwidth before it replies.
+	deadline := time.Duration(CompactReadDeadlineTime)
+	if n.compactBandwidth > 0 {
+		deadline += time.Duration(v.getChunkSize(chunkId) / int64(n.compactBandwidth*util.MB))
+	}
+	reply := NewPacket()
+	if err = reply.ReadFromConn(conn, deadline); err != nil {
+		conn.Close()
+		return
+	}
+	n.connPool.Put(conn)
+	if reply.Opcode != proto.OpOk {
+		err = fmt.Errorf("host[%v] compact err[%v]", host, string(reply.Data[:reply.Size]))
+	}
+
+	return
+}
+
+// Handle OpNotifyCompact, deletes the objects deleted on the leader and
+// compacts the chunk.
+func (n *DataNode) handleNotifyCompact(pkg *Packet, v *Vol) (err error) {
+	if pkg.StoreType != proto.TinyStoreMode || pkg.Size%8 != 0 {
+		return storage.ErrorUnmatchPara
+	}
+	var copied int64
+	chunkId := int(pkg.FileID)
+	store := v.getTinyStore()
+	n.compactStats.start(v.volId, chunkId)
+	before := v.getChunkSize(chunkId)
+	defer func() {
+		n.compactStats.finish(before-copied, err)
+	}()
+
+	objects := make([]uint64, pkg.Size/8)
+	for i := range objects {
+		objects[i] = binary.BigEndian.Uint64(pkg.Data[i*8 : (i+1)*8])
+	}
+	if err = store.ApplyDelObjects(uint32(chunkId), objects); err != nil {
+		return
+	}
+	if err = store.DoCompactWork(chunkId, n.newCompactPacer().pace); err != nil {
+		return
+	}
+	copied = v.getChunkSize(chunkId)
+	pkg.PackOkReply()
+
+	return
+}
+
+func (v *Vol) getChunkSize(chunkId int) (size int64) {
+	if finfo, err := os.Stat(path.Join(v.path, strconv.Itoa(chunkId))); err == nil {
+		size = finfo.Size()
+	}
+
+	return
+}
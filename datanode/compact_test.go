@@ -0,0 +1,108 @@
+package datanode
+
+import (
+	"hash/crc32"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/util"
+)
+
+// writeTestObjects writes the objects of the same ids to the chunk on every
+// node.
+func writeTestObjects(t *testing.T, chunkId uint32, count int, nodes ...*testDataNode) {
+	for oid := uint64(1); oid <= uint64(count); oid++ {
+		data := testData(8*util.KB + int(oid))
+		for _, n := range nodes {
+			if err := n.getVol(1).getTinyStore().Write(chunkId, int64(oid), int64(len(data)), data, crc32.ChecksumIEEE(data)); err != nil {
+				t.Fatalf("write object[%v]: %v", oid, err)
+			}
+		}
+	}
+}
+
+// The leader sends its deleted objects to the follower, both compact the same
+// object set.
+func TestCompactChunk(t *testing.T) {
+	leader, follower := newTestDataNode(t), newTestDataNode(t)
+	defer leader.stop()
+	defer follower.stop()
+	v := leader.createVol(t, proto.ChunkVol, 1, 0)
+	follower.createVol(t, proto.ChunkVol, 1, 0)
+	const chunkId = 1
+	writeTestObjects(t, chunkId, 40, leader, follower)
+	store := v.getTinyStore()
+	for oid := int64(1); oid <= 40; oid++ {
+		if oid%4 == 0 {
+			continue
+		}
+		if err := store.MarkDelete(chunkId, oid, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !store.IsReadyToCompact(chunkId) {
+		t.Fatal("chunk of 3/4 objects deleted not ready to compact")
+	}
+	before := v.getChunkSize(chunkId)
+	v.setLeader(true, []string{follower.addr})
+	if _, err := leader.compactChunk(v, chunkId); err != nil {
+		t.Fatal(err)
+	}
+
+	expected, _ := store.GetLiveObjects(chunkId)
+	if len(expected) != 10 {
+		t.Fatalf("%v objects live after the compaction, expected 10", len(expected))
+	}
+	for _, n := range []*testDataNode{leader, follower} {
+		nv := n.getVol(1)
+		live, err := nv.getTinyStore().GetLiveObjects(chunkId)
+		if err != nil || !reflect.DeepEqual(live, expected) {
+			t.Fatalf("node[%v] live objects %v err[%v], expected %v", n.addr, live, err, expected)
+		}
+		if size := nv.getChunkSize(chunkId); size >= before/2 {
+			t.Fatalf("node[%v] chunk size %v after the compaction, before %v", n.addr, size, before)
+		}
+		if stats := n.compactStats.get(); stats.CompactedCount != 1 || stats.ReclaimedBytes == 0 {
+			t.Fatalf("node[%v] compact stats %+v", n.addr, stats)
+		}
+		for _, oid := range live {
+			if _, err := nv.getTinyStore().VerifyObject(chunkId, oid); err != nil {
+				t.Fatalf("node[%v] object[%v] after the compaction: %v", n.addr, oid, err)
+			}
+		}
+	}
+}
+
+// The leadership follows the view of master, the volume left out of it leads
+// no more.
+func TestUpdateLeaders(t *testing.T) {
+	n := newTestDataNode(t)
+	defer n.stop()
+	v1 := n.createVol(t, proto.ChunkVol, 1, 0)
+	v2 := n.createVol(t, proto.ChunkVol, 2, 0)
+	n.updateLeaders([]*proto.VolView{{VolID: 1, Leader: true, Followers: []string{"a", "b"}}, {VolID: 2}})
+	if !v1.isLeader() || v2.isLeader() || !reflect.DeepEqual(v1.getFollowers(), []string{"a", "b"}) {
+		t.Fatalf("vol 1 leader[%v] followers%v, vol 2 leader[%v]", v1.isLeader(), v1.getFollowers(), v2.isLeader())
+	}
+	if elected := v1.setLeader(true, []string{"a", "b"}); elected {
+		t.Fatal("leader elected again")
+	}
+	n.updateLeaders([]*proto.VolView{{VolID: 2, Leader: true}})
+	if v1.isLeader() || len(v1.getFollowers()) != 0 || !v2.isLeader() {
+		t.Fatalf("vol 1 leader[%v] followers%v, vol 2 leader[%v]", v1.isLeader(), v1.getFollowers(), v2.isLeader())
+	}
+}
+
+// The pacer sleeps for the bytes it is given at its bandwidth.
+func TestCompactPacer(t *testing.T) {
+	p := &pacer{bandwidth: 100}
+	start := time.Now()
+	for i := 0; i < 16*util.MB/(64*util.KB); i++ {
+		p.pace(64 * util.KB)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("16MB paced at 100MB/s in %v", elapsed)
+	}
+}
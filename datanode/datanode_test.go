@@ -0,0 +1,139 @@
+package datanode
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/storage"
+	"github.com/tiglabs/baudstorage/util/log"
+)
+
+// The tests run the DataNodes in process, every DataNode listens on a port of
+// the loopback and keeps its volumes in a temporary disk.
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "datanode-log")
+	if err != nil {
+		panic(err)
+	}
+	if _, err = log.NewLog(dir, "DataNode", log.DebugLevel); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+type testDataNode struct {
+	*DataNode
+	addr string
+	disk *Disk
+}
+
+func newTestDataNode(t *testing.T) (n *testDataNode) {
+	dir, err := ioutil.TempDir("", "datanode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n = &testDataNode{DataNode: NewServer(), disk: NewDisk(dir)}
+	n.port = "0"
+	n.extentBlockSize = storage.BlockSize
+	if err = n.startTcpService(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	n.addr = "127.0.0.1:" + strconv.Itoa(n.listener.Addr().(*net.TCPAddr).Port)
+
+	return
+}
+
+func (n *testDataNode) stop() {
+	close(n.stopC)
+	n.listener.Close()
+	for _, v := range n.getAllVols() {
+		v.syncAll()
+	}
+	os.RemoveAll(n.disk.Path)
+}
+
+func (n *testDataNode) createVol(t *testing.T, volType string, volId uint32, extentBlockSize int) (v *Vol) {
+	v, err := NewVol(n.disk, volType, volId, 1<<30, extentBlockSize, 0, storage.IoModeBuffered, storage.NewStoreMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.putVol(v)
+
+	return
+}
+
+// send writes the packet to the DataNode and reads the reply.
+func (n *testDataNode) send(t *testing.T, p *Packet) (reply *Packet) {
+	conn, err := net.Dial("tcp", n.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = p.WriteToConn(conn); err != nil {
+		t.Fatal(err)
+	}
+	reply = NewPacket()
+	if err = reply.ReadFromConn(conn, proto.ReadDeadlineTime); err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+func testData(size int) (data []byte) {
+	data = make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + i/4096)
+	}
+
+	return
+}
+
+func writeTestExtent(t *testing.T, s *storage.ExtentStore, extentId uint64, offset int64, data []byte) {
+	if err := s.Write(extentId, offset, int64(len(data)), data, crc32.ChecksumIEEE(data)); err != nil {
+		t.Fatalf("write extent[%v] offset[%v]: %v", extentId, offset, err)
+	}
+}
+
+func readTestExtent(t *testing.T, s *storage.ExtentStore, extentId uint64) (data []byte) {
+	size, err := s.GetWatermark(extentId)
+	if err != nil {
+		t.Fatalf("watermark of extent[%v]: %v", extentId, err)
+	}
+	data = make([]byte, size)
+	if size == 0 {
+		return
+	}
+	if _, err = s.Read(extentId, 0, size, data); err != nil {
+		t.Fatalf("read extent[%v]: %v", extentId, err)
+	}
+
+	return
+}
+
+// writeTestV1Extent writes the extent file in the vol the way the v1 store
+// did, the crc of the last partial block is the crc padded with zeros.
+func writeTestV1Extent(t *testing.T, v *Vol, extentId uint64, data []byte) {
+	header := make([]byte, storage.BlockCrcHeaderSize)
+	for blockNo := 0; blockNo*storage.BlockSize < len(data); blockNo++ {
+		block := make([]byte, storage.BlockSize)
+		copy(block, data[blockNo*storage.BlockSize:])
+		binary.BigEndian.PutUint32(header[blockNo*storage.PerBlockCrcSize:], crc32.ChecksumIEEE(block))
+	}
+	header[storage.MarkDeleteIndex] = storage.UnMarkDelete
+	name := path.Join(v.path, strconv.FormatUint(extentId, 10))
+	if err := ioutil.WriteFile(name, append(header, data...), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
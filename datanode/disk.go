@@ -0,0 +1,126 @@
+package datanode
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/util"
+	"github.com/tiglabs/baudstorage/util/log"
+)
+
+const (
+	DiskRecoverFreeSpace = 10 * util.GB // a full disk is writable again with it
+)
+
+// Disk is a mount point of this DataNode. The volumes on it are readonly
+// after an ENOSPC, and unavailable after an EIO until the DataNode restarts.
+type Disk struct {
+	Path   string
+	Status int
+	sync.RWMutex
+}
+
+func NewDisk(path string) (d *Disk) {
+	return &Disk{Path: path, Status: proto.VolReadWrite}
+}
+
+func (d *Disk) getStatus() (status int) {
+	d.RLock()
+	status = d.Status
+	d.RUnlock()
+
+	return
+}
+
+// setStatus moves the disk to a worse status only, a disk is writable again
+// by recover.
+func (d *Disk) setStatus(status int) {
+	d.Lock()
+	defer d.Unlock()
+	if d.Status == proto.VolUnavailable || (d.Status == proto.VolReadOnly && status == proto.VolReadWrite) {
+		return
+	}
+	if d.Status != status {
+		log.LogError(fmt.Sprintf("action[setStatus] disk[%v] status[%v->%v]", d.Path, d.Status, status))
+	}
+	d.Status = status
+}
+
+// recover makes a readonly disk writable again if it has enough free space.
+func (d *Disk) recover() {
+	d.Lock()
+	defer d.Unlock()
+	if d.Status != proto.VolReadOnly {
+		return
+	}
+	if _, _, avail, err := getDiskSpace(d.Path); err == nil && avail >= DiskRecoverFreeSpace {
+		log.LogInfo(fmt.Sprintf("action[recover] disk[%v] avail[%v] writable again", d.Path, avail))
+		d.Status = proto.VolReadWrite
+	}
+}
+
+// getDiskSpace returns the capacity of the file system the disk is mounted on.
+func getDiskSpace(disk string) (total, used, avail uint64, err error) {
+	fs := syscall.Statfs_t{}
+	if err = syscall.Statfs(disk, &fs); err != nil {
+		return
+	}
+	total = fs.Blocks * uint64(fs.Bsize)
+	used = (fs.Blocks - fs.Bfree) * uint64(fs.Bsize)
+	avail = fs.Bavail * uint64(fs.Bsize)
+
+	return
+}
+
+// getDiskDevice returns the id of the device the disk is on.
+func getDiskDevice(disk string) (dev uint64, err error) {
+	st := syscall.Stat_t{}
+	if err = syscall.Stat(disk, &st); err != nil {
+		return
+	}
+
+	return uint64(st.Dev), nil
+}
+
+// chooseDisk returns the writable disk which has the most space left for a
+// new volume of volSize bytes. The space left is the available space minus
+// the space the volumes already on the disk may still take, so the new
+// volumes are spread across the disks.
+func (n *DataNode) chooseDisk(volSize int) (disk *Disk, err error) {
+	reserved := make(map[*Disk]int64)
+	for _, v := range n.getAllVols() {
+		if used, _ := v.usedSize(); used < int64(v.volSize) {
+			reserved[v.disk] += int64(v.volSize) - used
+		}
+	}
+	var maxLeft int64
+	for _, d := range n.disks {
+		if d.getStatus() != proto.VolReadWrite {
+			continue
+		}
+		_, _, avail, e := getDiskSpace(d.Path)
+		if e != nil || avail < uint64(volSize) {
+			continue
+		}
+		left := int64(avail) - reserved[d]
+		if disk != nil && left <= maxLeft {
+			continue
+		}
+		disk = d
+		maxLeft = left
+	}
+	if disk == nil {
+		err = fmt.Errorf("no disk has space for vol size[%v]", volSize)
+	}
+
+	return
+}
+
+// checkDisks makes the full disks writable again after their space is freed.
+func (n *DataNode) checkDisks() {
+	for _, d := range n.disks {
+		d.recover()
+	}
+}
@@ -0,0 +1,174 @@
+package datanode
+
+import (
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/storage"
+)
+
+// newTestDisks makes the disks of the DataNode count directories of its
+// temporary disk, they are on the same file system.
+func newTestDisks(t *testing.T, n *testDataNode, count int) (disks []*Disk) {
+	for i := 0; i < count; i++ {
+		dir := path.Join(n.disk.Path, "disk"+string('a'+byte(i)))
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		disks = append(disks, NewDisk(dir))
+	}
+	n.disks = disks
+
+	return
+}
+
+// The new volumes go to the disks with the most space left after the space
+// the volumes on them may still take, the disks not writable take none.
+func TestChooseDisk(t *testing.T) {
+	n := newTestDataNode(t)
+	defer n.stop()
+	disks := newTestDisks(t, n, 3)
+	const volSize = 1 << 20
+
+	chosen := make(map[*Disk]bool)
+	for volId := uint32(1); volId <= 3; volId++ {
+		d, err := n.chooseDisk(volSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chosen[d] {
+			t.Fatalf("vol[%v] on disk[%v] taken already", volId, d.Path)
+		}
+		chosen[d] = true
+		v, err := NewVol(d, proto.ExtentVol, volId, volSize, storage.BlockSize, 0, storage.IoModeBuffered, storage.NewStoreMode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.putVol(v)
+	}
+
+	disks[0].setStatus(proto.VolReadOnly)
+	disks[2].setStatus(proto.VolUnavailable)
+	if d, err := n.chooseDisk(volSize); err != nil || d != disks[1] {
+		t.Fatalf("disk[%v] err[%v], expected[%v]", d, err, disks[1].Path)
+	}
+	disks[1].setStatus(proto.VolUnavailable)
+	if d, err := n.chooseDisk(volSize); err == nil {
+		t.Fatalf("disk[%v] chosen of no writable disk", d.Path)
+	}
+	disks[0].setStatus(proto.VolReadWrite)
+	if d, err := n.chooseDisk(volSize); err == nil {
+		t.Fatalf("disk[%v] chosen, the readonly disk set writable", d.Path)
+	}
+}
+
+// The EIO isolates the disk, its volumes are unavailable and every operation
+// on them fails with OpDiskErr until the DataNode restarts.
+func TestDiskIoErrorIsolates(t *testing.T) {
+	n := newTestDataNode(t)
+	defer n.stop()
+	v := n.createVol(t, proto.ExtentVol, 1, storage.BlockSize)
+	if err := v.getExtentStore().CreateWithId(1); err != nil {
+		t.Fatal(err)
+	}
+	data := testData(4096)
+	writeTestExtent(t, v.getExtentStore(), 1, 0, data)
+
+	ioErr := errors.Trace(&os.PathError{Op: "read", Path: v.path, Err: syscall.EIO})
+	if err := v.checkDiskErr(ioErr); err != storage.ErrSyscallIO {
+		t.Fatalf("disk err[%v]", err)
+	}
+	if status := n.disk.getStatus(); status != proto.VolUnavailable {
+		t.Fatalf("disk status[%v]", status)
+	}
+	if status := v.refreshStatus(); status != proto.VolUnavailable {
+		t.Fatalf("vol status[%v]", status)
+	}
+	if reply := n.send(t, newExtentReadPacket(0, len(data))); reply.Opcode != proto.OpDiskErr {
+		t.Fatalf("read: reply opcode[%v]", reply.Opcode)
+	}
+	if reply := n.send(t, newChainWritePacket("", 4096, data)); reply.Opcode != proto.OpDiskErr {
+		t.Fatalf("write: reply opcode[%v]", reply.Opcode)
+	}
+	n.disk.setStatus(proto.VolReadWrite)
+	n.checkDisks()
+	if status := n.disk.getStatus(); status != proto.VolUnavailable {
+		t.Fatalf("isolated disk status[%v]", status)
+	}
+}
+
+// The ENOSPC makes the disk readonly, the writes to its volumes fail with
+// OpDiskNoSpaceErr and the reads are still served.
+func TestDiskNoSpaceReadOnly(t *testing.T) {
+	n := newTestDataNode(t)
+	defer n.stop()
+	n.disks = []*Disk{n.disk}
+	v := n.createVol(t, proto.ExtentVol, 1, storage.BlockSize)
+	if err := v.getExtentStore().CreateWithId(1); err != nil {
+		t.Fatal(err)
+	}
+	data := testData(4096)
+	writeTestExtent(t, v.getExtentStore(), 1, 0, data)
+
+	other := errors.New("other")
+	if err := v.checkDiskErr(other); err != other || n.disk.getStatus() != proto.VolReadWrite {
+		t.Fatalf("disk err[%v] status[%v] of other error", err, n.disk.getStatus())
+	}
+	if err := v.checkDiskErr(os.NewSyscallError("fallocate", syscall.ENOSPC)); err != storage.ErrSyscallNoSpace {
+		t.Fatalf("disk err[%v]", err)
+	}
+	if status := v.refreshStatus(); status != proto.VolReadOnly {
+		t.Fatalf("vol status[%v]", status)
+	}
+	if reply := n.send(t, newChainWritePacket("", 4096, data)); reply.Opcode != proto.OpDiskNoSpaceErr {
+		t.Fatalf("write: reply opcode[%v]", reply.Opcode)
+	}
+	if reply := n.send(t, newExtentReadPacket(0, len(data))); reply.Opcode != proto.OpOk {
+		t.Fatalf("read: reply opcode[%v] data[%s]", reply.Opcode, reply.Data)
+	}
+	n.disk.setStatus(proto.VolReadWrite)
+	if status := n.disk.getStatus(); status != proto.VolReadOnly {
+		t.Fatalf("full disk status[%v] set writable", status)
+	}
+	// The full disk is writable again once it has the space.
+	_, _, avail, err := getDiskSpace(n.disk.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.checkDisks()
+	if recovered := n.disk.getStatus() == proto.VolReadWrite; recovered != (avail >= DiskRecoverFreeSpace) {
+		t.Fatalf("disk status[%v] avail[%v]", n.disk.getStatus(), avail)
+	}
+}
+
+// The disks isolated for errors or full are left out of the available weight
+// of the heartbeat, master places no volume on them.
+func TestHeartbeatIsolatedDisk(t *testing.T) {
+	n := newTestDataNode(t)
+	defer n.stop()
+	disks := newTestDisks(t, n, 2)
+	heartbeat := func() *proto.DataNodeHeartBeatResponse {
+		task := proto.NewAdminTask(proto.OpDataNodeHeartbeat, "", &proto.HeartBeatRequest{})
+		return n.heartbeat(task)
+	}
+
+	if resp := heartbeat(); resp.MaxDiskAvailWeight <= 0 {
+		t.Fatalf("max disk avail weight[%v]", resp.MaxDiskAvailWeight)
+	}
+	disks[0].setStatus(proto.VolUnavailable)
+	if resp := heartbeat(); resp.MaxDiskAvailWeight <= 0 {
+		t.Fatalf("max disk avail weight[%v] of a writable disk", resp.MaxDiskAvailWeight)
+	}
+	disks[1].setStatus(proto.VolReadOnly)
+	resp := heartbeat()
+	if resp.MaxDiskAvailWeight != 0 {
+		t.Fatalf("max disk avail weight[%v] of isolated disks", resp.MaxDiskAvailWeight)
+	}
+	if resp.Total == 0 {
+		t.Fatal("isolated disks left out of the capacity")
+	}
+}
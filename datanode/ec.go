@@ -0,0 +1,408 @@
+package datanode
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"strconv"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/storage"
+	"github.com/tiglabs/baudstorage/util"
+	"github.com/tiglabs/baudstorage/util/ec"
+	"github.com/tiglabs/baudstorage/util/log"
+)
+
+const (
+	DefaultEcBandwidth = 20 // MB/s
+)
+
+var (
+	ErrExtentNotSealed = errors.New("ExtentNotSealedErr")
+	ErrReplicaUnmatch  = errors.New("ReplicaUnmatchErr")
+	ErrShardUnmatch    = errors.New("ShardUnmatchErr")
+)
+
+// The shards of an erasure coded volume are extent volumes of the ec type, the
+// extent of a shard has the id of the source extent and keeps one cell of
+// every stripe, see package ec. Every shard host is a chain of its own, so
+// the packets to it carry no follower.
+
+// Handle OpConvertToEc, the extents of the volume are encoded into the shards
+// on the ec hosts one by one, the encoding is throttled by ecBandwidth. Only
+// a cold volume is converted: every extent not deleted must be sealed and the
+// same on all the replicas, else the conversion fails and nothing is written.
+// The volume refuses the new extents since, master deletes it after every ec
+// host reports the shards.
+func (n *DataNode) convertToEc(task *proto.AdminTask) (resp *proto.ConvertToEcResponse) {
+	var (
+		extents map[uint64]int64
+		encoder *ec.Encoder
+		err     error
+	)
+	req := &proto.ConvertToEcRequest{}
+	resp = &proto.ConvertToEcResponse{}
+	defer func() {
+		resp.Status, resp.Result = setTaskStatus(task, err)
+		log.LogInfo(fmt.Sprintf("action[convertToEc] vol[%v] extents[%v] ec hosts[%v] err[%v]",
+			req.VolId, len(extents), req.EcHosts, err))
+	}()
+	if err = unmarshalTaskRequest(task, req); err != nil {
+		return
+	}
+	resp.VolId = req.VolId
+	v := n.acquireVol(uint32(req.VolId))
+	if v == nil {
+		err = ErrVolNotExist
+		return
+	}
+	defer v.exit()
+	if v.volType != proto.ExtentVol {
+		err = ErrStoreTypeUnmatch
+		return
+	}
+	if len(req.EcHosts) != req.DataNum+req.ParityNum {
+		err = ErrBadNodes
+		return
+	}
+	if encoder, err = ec.NewEncoder(req.DataNum, req.ParityNum); err != nil {
+		return
+	}
+	// The extents are listed after the volume is sealed, no extent is created
+	// after them.
+	v.seal()
+	defer func() {
+		if err != nil {
+			v.unseal()
+		}
+	}()
+	if extents, err = n.getSealedExtents(v, req.Replicas); err != nil {
+		return
+	}
+	resp.Extents = make(map[string]uint32, len(extents))
+	for extentId, size := range extents {
+		if err = n.convertExtentToEc(v, extentId, size, encoder, req.EcHosts); err != nil {
+			err = errors.Annotatef(err, "extent[%v]", extentId)
+			return
+		}
+		resp.Extents[strconv.FormatUint(extentId, 10)] = uint32(ec.ShardSize(req.DataNum, size))
+	}
+
+	return
+}
+
+// getSealedExtents returns the size of every extent not deleted, it fails if
+// any of them is not sealed or differs on a replica.
+func (n *DataNode) getSealedExtents(v *Vol, replicas []string) (extents map[uint64]int64, err error) {
+	var all []*storage.ExtentInfo
+	store := v.getExtentStore()
+	if all, err = store.GetAllWatermark(); err != nil {
+		return
+	}
+	extents = make(map[uint64]int64, len(all))
+	for _, ei := range all {
+		var index *storage.BlockCrcIndex
+		if index, err = store.GetBlockCrcIndex(ei.ExtentId); err != nil {
+			return
+		}
+		if index.MarkDel {
+			continue
+		}
+		if !index.Sealed {
+			return nil, errors.Annotatef(ErrExtentNotSealed, "extent[%v]", ei.ExtentId)
+		}
+		for _, host := range replicas {
+			var remote *storage.BlockCrcIndex
+			if remote, err = n.getRemoteBlockCrc(v, host, ei.ExtentId); err != nil {
+				return nil, errors.Annotatef(err, "extent[%v]", ei.ExtentId)
+			}
+			if !remote.Sealed || !index.SameData(remote) {
+				return nil, errors.Annotatef(ErrReplicaUnmatch, "extent[%v] on[%v]", ei.ExtentId, host)
+			}
+		}
+		extents[ei.ExtentId] = index.Size
+	}
+
+	return
+}
+
+// convertExtentToEc writes the cells of every stripe of the sealed extent to
+// the shard hosts and seals the shards, then decodes the shards read back to
+// check them against the extent.
+func (n *DataNode) convertExtentToEc(v *Vol, extentId uint64, size int64, encoder *ec.Encoder, hosts []string) (err error) {
+	for _, host := range hosts {
+		if err = n.sendEcPacket(host, newRepairPacket(proto.OpCreateFile, v, extentId)); err != nil {
+			return
+		}
+	}
+	for s := int64(0); s < ec.StripeCount(encoder.DataNum(), size); s++ {
+		var shards [][]byte
+		if shards, err = readStripe(v, extentId, size, s, encoder); err != nil {
+			return
+		}
+		if err = encoder.Encode(shards); err != nil {
+			return
+		}
+		for j, host := range hosts {
+			p := newRepairPacket(proto.OpWrite, v, extentId)
+			p.Offset = s * ec.CellSize
+			p.Data = shards[j]
+			p.Size = uint32(len(p.Data))
+			p.Crc = crc32.ChecksumIEEE(p.Data)
+			if err = n.sendEcPacket(host, p); err != nil {
+				return
+			}
+		}
+		throttle(int64(len(shards)*ec.CellSize), n.ecBandwidth)
+	}
+	for _, host := range hosts {
+		if err = n.sendEcPacket(host, newRepairPacket(proto.OpSealFile, v, extentId)); err != nil {
+			return
+		}
+	}
+
+	return n.verifyEcExtent(v, extentId, size, encoder, hosts)
+}
+
+// readStripe reads the stripe of the extent into the data shards, the last
+// stripe is padded with zeros.
+func readStripe(v *Vol, extentId uint64, size, stripe int64, encoder *ec.Encoder) (shards [][]byte, err error) {
+	dataNum := encoder.DataNum()
+	data := make([]byte, dataNum*ec.CellSize)
+	offset := stripe * int64(len(data))
+	readSize := util.Min(len(data), int(size-offset))
+	if _, err = v.getExtentStore().Read(extentId, offset, int64(readSize), data); err != nil {
+		return
+	}
+	shards = make([][]byte, dataNum+encoder.ParityNum())
+	for j := 0; j < dataNum; j++ {
+		shards[j] = data[j*ec.CellSize : (j+1)*ec.CellSize]
+	}
+
+	return
+}
+
+// verifyEcExtent reads every stripe back from all the shard hosts. The data
+// shards must be the extent, and the extent decoded without the first
+// ParityNum data shards must be the extent too, so the parity shards are
+// checked as well.
+func (n *DataNode) verifyEcExtent(v *Vol, extentId uint64, size int64, encoder *ec.Encoder, hosts []string) (err error) {
+	dataNum := encoder.DataNum()
+	for s := int64(0); s < ec.StripeCount(dataNum, size); s++ {
+		var expected [][]byte
+		if expected, err = readStripe(v, extentId, size, s, encoder); err != nil {
+			return
+		}
+		shards := make([][]byte, len(hosts))
+		for j, host := range hosts {
+			if shards[j], err = n.readEcShard(v, host, extentId, s*ec.CellSize, ec.CellSize); err != nil {
+				return
+			}
+		}
+		for j := 0; j < dataNum; j++ {
+			if !bytes.Equal(shards[j], expected[j]) {
+				return errors.Annotatef(ErrShardUnmatch, "stripe[%v] shard[%v]", s, j)
+			}
+		}
+		for j := 0; j < encoder.ParityNum() && j < dataNum; j++ {
+			shards[j] = nil
+		}
+		if err = encoder.Reconstruct(shards); err != nil {
+			return
+		}
+		for j := 0; j < dataNum; j++ {
+			if !bytes.Equal(shards[j], expected[j]) {
+				return errors.Annotatef(ErrShardUnmatch, "stripe[%v] decoded shard[%v]", s, j)
+			}
+		}
+		throttle(int64(len(hosts)*ec.CellSize), n.ecBandwidth)
+	}
+
+	return
+}
+
+func (n *DataNode) sendEcPacket(host string, p *Packet) (err error) {
+	var conn net.Conn
+	if conn, err = n.connPool.Get(host); err != nil {
+		return
+	}
+	if err = p.WriteToConn(conn); err != nil {
+		conn.Close()
+		return
+	}
+	reply := NewPacket()
+	if err = reply.ReadFromConn(conn, proto.ReadDeadlineTime); err != nil {
+		conn.Close()
+		return
+	}
+	n.connPool.Put(conn)
+	if reply.Opcode != proto.OpOk {
+		err = fmt.Errorf("host[%v] op[%v] err[%v]", host, proto.GetOpMesg(p.Opcode), string(reply.Data[:reply.Size]))
+	}
+
+	return
+}
+
+// Handle OpEcRepair, every extent of the lost shard is rebuilt from DataNum
+// other shards of the volume. The shard extents are of the same size on every
+// shard host.
+func (n *DataNode) ecRepair(task *proto.AdminTask) (resp *proto.EcRepairResponse) {
+	var (
+		encoder *ec.Encoder
+		local   map[uint64]int64
+		peers   []int
+		err     error
+	)
+	req := &proto.EcRepairRequest{}
+	resp = &proto.EcRepairResponse{}
+	defer func() {
+		resp.Status, resp.Result = setTaskStatus(task, err)
+		log.LogInfo(fmt.Sprintf("action[ecRepair] vol[%v] shard[%v] hosts[%v] err[%v]",
+			req.VolId, req.ShardIndex, req.Hosts, err))
+	}()
+	if err = unmarshalTaskRequest(task, req); err != nil {
+		return
+	}
+	resp.VolId = req.VolId
+	resp.ShardIndex = req.ShardIndex
+	v := n.acquireVol(uint32(req.VolId))
+	if v == nil {
+		err = ErrVolNotExist
+		return
+	}
+	defer v.exit()
+	if v.volType != proto.EcVol {
+		err = ErrStoreTypeUnmatch
+		return
+	}
+	if len(req.Hosts) != req.DataNum+req.ParityNum || req.ShardIndex < 0 || req.ShardIndex >= len(req.Hosts) {
+		err = ErrBadNodes
+		return
+	}
+	if encoder, err = ec.NewEncoder(req.DataNum, req.ParityNum); err != nil {
+		return
+	}
+	if local, err = v.getLocalWatermarks(); err != nil {
+		return
+	}
+
+	sources := make(map[uint64]int64)
+	for i, host := range req.Hosts {
+		if i == req.ShardIndex {
+			continue
+		}
+		watermarks, e := n.getRemoteWatermarks(v, host)
+		if e != nil {
+			log.LogWarn(fmt.Sprintf("action[ecRepair] vol[%v] shard[%v] on[%v] err[%v]", v.volId, i, host, e))
+			continue
+		}
+		peers = append(peers, i)
+		for extentId, size := range watermarks {
+			if srcSize, ok := sources[extentId]; !ok || srcSize < size {
+				sources[extentId] = size
+			}
+		}
+	}
+	if len(peers) < req.DataNum {
+		err = ec.ErrTooFewShards
+		return
+	}
+	for extentId, size := range sources {
+		localSize, exist := local[extentId]
+		if exist && localSize >= size {
+			continue
+		}
+		if err = n.repairEcExtent(v, extentId, localSize, size, exist, encoder, req, peers); err != nil {
+			err = errors.Annotatef(err, "extent[%v]", extentId)
+			return
+		}
+	}
+
+	return
+}
+
+// repairEcExtent rebuilds the shard extent cell by cell from [localSize,
+// size), the extent deleted on the other shards is skipped.
+func (n *DataNode) repairEcExtent(v *Vol, extentId uint64, localSize, size int64, exist bool,
+	encoder *ec.Encoder, req *proto.EcRepairRequest, peers []int) (err error) {
+	store := v.getExtentStore()
+	if !exist {
+		if err = store.CreateWithId(extentId); err != nil {
+			return
+		}
+	}
+	for offset := localSize - localSize%ec.CellSize; offset < size; {
+		var (
+			readSize = util.Min(ec.CellSize, int(size-offset))
+			shards   = make([][]byte, len(req.Hosts))
+			readable int
+			notExist int
+		)
+		for _, i := range peers {
+			if readable == req.DataNum {
+				break
+			}
+			data, e := n.readEcShard(v, req.Hosts[i], extentId, offset, readSize)
+			if e == storage.ErrorHasDelete {
+				notExist++
+			}
+			if e != nil {
+				continue
+			}
+			shards[i] = data
+			readable++
+		}
+		if readable < req.DataNum {
+			if notExist > 0 {
+				log.LogWarn(fmt.Sprintf("action[repairEcExtent] vol[%v] extent[%v] deleted on %v shards, skipped",
+					v.volId, extentId, notExist))
+				return
+			}
+			return ec.ErrTooFewShards
+		}
+		if err = encoder.Reconstruct(shards); err != nil {
+			return
+		}
+		data := shards[req.ShardIndex]
+		if err = store.Write(extentId, offset, int64(readSize), data, crc32.ChecksumIEEE(data)); err != nil {
+			return
+		}
+		offset += int64(readSize)
+	}
+
+	return store.Seal(extentId, size)
+}
+
+// readEcShard reads the range of the shard extent on host, a deleted or
+// missing extent is returned as storage.ErrorHasDelete.
+func (n *DataNode) readEcShard(v *Vol, host string, extentId uint64, offset int64, size int) (data []byte, err error) {
+	var conn net.Conn
+	if conn, err = n.connPool.Get(host); err != nil {
+		return
+	}
+	p := newRepairPacket(proto.OpRead, v, extentId)
+	p.Offset = offset
+	p.Size = uint32(size)
+	if err = p.WriteToConn(conn); err != nil {
+		conn.Close()
+		return
+	}
+	reply := NewPacket()
+	if err = reply.ReadFromConn(conn, RepairReadDeadlineTime); err != nil {
+		conn.Close()
+		return
+	}
+	n.connPool.Put(conn)
+	switch {
+	case reply.Opcode == proto.OpNotExistErr:
+		return nil, storage.ErrorHasDelete
+	case reply.Opcode != proto.OpOk:
+		return nil, fmt.Errorf("read from[%v] err[%v]", host, string(reply.Data[:reply.Size]))
+	case reply.Size != uint32(size) || crc32.ChecksumIEEE(reply.Data[:reply.Size]) != reply.Crc:
+		return nil, ErrCrcUnmatch
+	}
+
+	return reply.Data[:reply.Size], nil
+}
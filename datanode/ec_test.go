@@ -0,0 +1,140 @@
+package datanode
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/storage"
+	"github.com/tiglabs/baudstorage/util/ec"
+)
+
+// newEcTestNodes starts the two replicas of the extent volume and the ec hosts
+// of its shards.
+func newEcTestNodes(t *testing.T) (leader, replica *testDataNode, hosts []*testDataNode) {
+	leader, replica = newTestDataNode(t), newTestDataNode(t)
+	leader.createVol(t, proto.ExtentVol, 1, storage.BlockSize)
+	replica.createVol(t, proto.ExtentVol, 1, storage.BlockSize)
+	for i := 0; i < ec.DefaultDataNum+ec.DefaultParityNum; i++ {
+		host := newTestDataNode(t)
+		host.createVol(t, proto.EcVol, 1, storage.BlockSize)
+		hosts = append(hosts, host)
+	}
+
+	return
+}
+
+func convertTestVol(leader, replica *testDataNode, hosts []*testDataNode) *proto.ConvertToEcResponse {
+	req := &proto.ConvertToEcRequest{
+		VolId:     1,
+		DataNum:   ec.DefaultDataNum,
+		ParityNum: ec.DefaultParityNum,
+		Replicas:  []string{replica.addr},
+	}
+	for _, host := range hosts {
+		req.EcHosts = append(req.EcHosts, host.addr)
+	}
+
+	return leader.convertToEc(proto.NewAdminTask(proto.OpConvertToEc, leader.addr, req))
+}
+
+func writeTestReplicas(t *testing.T, extentId uint64, data []byte, nodes ...*testDataNode) {
+	for _, n := range nodes {
+		store := n.getVol(1).getExtentStore()
+		if err := store.CreateWithId(extentId); err != nil {
+			t.Fatal(err)
+		}
+		writeTestExtent(t, store, extentId, 0, data)
+	}
+}
+
+func sealTestReplicas(t *testing.T, extentId uint64, nodes ...*testDataNode) {
+	for _, n := range nodes {
+		store := n.getVol(1).getExtentStore()
+		size, err := store.GetWatermark(extentId)
+		if err == nil {
+			err = store.Seal(extentId, size)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkConvertFailed(t *testing.T, leader *testDataNode, resp *proto.ConvertToEcResponse, expected error) {
+	if resp.Status != proto.CmdFailed || !strings.Contains(resp.Result, expected.Error()) {
+		t.Fatalf("convert status[%v] result[%v], expected %v", resp.Status, resp.Result, expected)
+	}
+	if leader.getVol(1).isSealed() {
+		t.Fatal("vol left sealed by the conversion failed")
+	}
+}
+
+// Only the volume of every extent sealed and the same on all the replicas is
+// converted, the shards written decode to the extents.
+func TestConvertToEc(t *testing.T) {
+	leader, replica, hosts := newEcTestNodes(t)
+	defer leader.stop()
+	defer replica.stop()
+	for _, host := range hosts {
+		defer host.stop()
+	}
+	data := testData(3*ec.DefaultDataNum*ec.CellSize + 100)
+	writeTestReplicas(t, 1, data, leader, replica)
+	writeTestReplicas(t, 2, data[:1000], leader, replica)
+	sealTestReplicas(t, 1, leader, replica)
+	checkConvertFailed(t, leader, convertTestVol(leader, replica, hosts), ErrExtentNotSealed)
+
+	// The replica sealed short differs from the leader.
+	sealTestReplicas(t, 2, leader)
+	if err := replica.getVol(1).getExtentStore().Seal(2, 500); err != nil {
+		t.Fatal(err)
+	}
+	checkConvertFailed(t, leader, convertTestVol(leader, replica, hosts), ErrReplicaUnmatch)
+
+	// The deleted extent is not converted.
+	leaderStore := leader.getVol(1).getExtentStore()
+	if err := leaderStore.MarkDelete(2, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	resp := convertTestVol(leader, replica, hosts)
+	if resp.Status != proto.CmdSuccess {
+		t.Fatalf("convert: %v", resp.Result)
+	}
+	if !leader.getVol(1).isSealed() {
+		t.Fatal("vol converted not sealed")
+	}
+	shardSize := ec.ShardSize(ec.DefaultDataNum, int64(len(data)))
+	if len(resp.Extents) != 1 || int64(resp.Extents["1"]) != shardSize {
+		t.Fatalf("extents converted %v, expected extent 1 of shard size %v", resp.Extents, shardSize)
+	}
+
+	// Any DataNum shards decode to the extent.
+	shards := make([][]byte, len(hosts))
+	for i, host := range hosts {
+		store := host.getVol(1).getExtentStore()
+		if sealed, err := store.IsSealed(1); err != nil || !sealed {
+			t.Fatalf("shard[%v] sealed[%v] err[%v]", i, sealed, err)
+		}
+		shards[i] = readTestExtent(t, store, 1)
+	}
+	encoder, _ := ec.NewEncoder(ec.DefaultDataNum, ec.DefaultParityNum)
+	shards[0], shards[3] = nil, nil
+	if err := encoder.Reconstruct(shards); err != nil {
+		t.Fatal(err)
+	}
+	decoded := make([]byte, 0, len(data))
+	for s := int64(0); s < ec.StripeCount(ec.DefaultDataNum, int64(len(data))); s++ {
+		for j := 0; j < ec.DefaultDataNum; j++ {
+			decoded = append(decoded, shards[j][s*ec.CellSize:(s+1)*ec.CellSize]...)
+		}
+	}
+	if !bytes.Equal(decoded[:len(data)], data) {
+		t.Fatal("shards decoded unmatch the extent")
+	}
+	if _, err := hosts[0].getVol(1).getExtentStore().GetWatermark(2); err == nil {
+		t.Fatal("deleted extent " + strconv.Itoa(2) + " converted")
+	}
+}
@@ -0,0 +1,327 @@
+package datanode
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/storage"
+	"github.com/tiglabs/baudstorage/util"
+	"github.com/tiglabs/baudstorage/util/log"
+)
+
+func (p *Packet) IsMasterCommand() bool {
+	switch p.Opcode {
+	case proto.OpCreateVol, proto.OpDeleteVol, proto.OpLoadVol, proto.OpDataNodeHeartbeat,
+		proto.OpReplicateFile, proto.OpDeleteFile, proto.OpConvertToEc, proto.OpEcRepair, proto.OpSetThrottle:
+		return true
+	}
+
+	return false
+}
+
+// handleMasterCommand acknowledges the AdminTask of master at once, the task
+// is done in background and its result is posted to master by http.
+func (n *DataNode) handleMasterCommand(pkg *Packet, c net.Conn) (err error) {
+	task := &proto.AdminTask{}
+	if opErr := json.Unmarshal(pkg.Data[:pkg.Size], task); opErr != nil {
+		log.LogError(pkg.ActionMesg(proto.GetOpMesg(pkg.OrgOpcode), c.RemoteAddr().String(), pkg.StartT, opErr))
+		pkg.PackErrorBody(opErr)
+		return pkg.WriteToConn(c)
+	}
+	pkg.PackOkReply()
+	if err = pkg.WriteToConn(c); err != nil {
+		return
+	}
+	go n.doMasterCommand(task)
+
+	return
+}
+
+func (n *DataNode) doMasterCommand(task *proto.AdminTask) {
+	switch task.OpCode {
+	case proto.OpCreateVol:
+		task.Response = n.createVol(task)
+	case proto.OpDeleteVol:
+		task.Response = n.deleteVol(task)
+	case proto.OpLoadVol:
+		task.Response = n.loadVol(task)
+	case proto.OpDataNodeHeartbeat:
+		task.Response = n.heartbeat(task)
+	case proto.OpReplicateFile:
+		task.Response = n.replicateFile(task)
+	case proto.OpDeleteFile:
+		task.Response = n.deleteFile(task)
+	case proto.OpConvertToEc:
+		task.Response = n.convertToEc(task)
+	case proto.OpEcRepair:
+		task.Response = n.ecRepair(task)
+	case proto.OpSetThrottle:
+		task.Response = n.setThrottle(task)
+	default:
+		log.LogError(fmt.Sprintf("action[doMasterCommand] task[%v] unknown opcode[%v]", task.ToString(), task.OpCode))
+		return
+	}
+	if n.masterAddr == "" {
+		log.LogWarn(fmt.Sprintf("action[doMasterCommand] task[%v] not replied, no master configured", task.ToString()))
+		return
+	}
+	if err := n.replyToMaster(task); err != nil {
+		log.LogError(fmt.Sprintf("action[doMasterCommand] task[%v] reply to master[%v] err[%v]",
+			task.ToString(), n.masterAddr, err))
+	}
+}
+
+func (n *DataNode) replyToMaster(task *proto.AdminTask) (err error) {
+	data, err := json.Marshal(task)
+	if err != nil {
+		return
+	}
+	_, err = util.PostToNode(data, fmt.Sprintf("http://%s%s", n.masterAddr, proto.DataNodeResponsePath))
+
+	return
+}
+
+func unmarshalTaskRequest(task *proto.AdminTask, req interface{}) (err error) {
+	data, err := json.Marshal(task.Request)
+	if err != nil {
+		return
+	}
+
+	return json.Unmarshal(data, req)
+}
+
+func setTaskStatus(task *proto.AdminTask, err error) (status uint8, result string) {
+	if err != nil {
+		task.Status = proto.TaskFail
+		return proto.CmdFailed, err.Error()
+	}
+	task.Status = proto.TaskSuccess
+
+	return proto.CmdSuccess, ""
+}
+
+// Handle OpCreateVol
+func (n *DataNode) createVol(task *proto.AdminTask) (resp *proto.CreateVolResponse) {
+	var (
+		disk *Disk
+		err  error
+	)
+	req := &proto.CreateVolRequest{}
+	resp = &proto.CreateVolResponse{}
+	defer func() {
+		resp.Status, resp.Result = setTaskStatus(task, err)
+		var diskPath string
+		if disk != nil {
+			diskPath = disk.Path
+		}
+		log.LogInfo(fmt.Sprintf("action[createVol] vol[%v] type[%v] disk[%v] err[%v]", req.VolId, req.VolType, diskPath, err))
+	}()
+	if err = unmarshalTaskRequest(task, req); err != nil {
+		return
+	}
+	resp.VolId = req.VolId
+	v, ok := n.reserveVol(uint32(req.VolId))
+	if !ok {
+		if v == nil {
+			err = fmt.Errorf("vol[%v] is being created", req.VolId)
+		} else if v.volType != req.VolType {
+			err = fmt.Errorf("vol[%v] exist with type[%v]", v.volId, v.volType)
+		}
+		return
+	}
+	// The vol created without an io mode takes the one of the node.
+	ioMode := n.defaultIoMode(req.VolType)
+	if req.IoMode != "" {
+		if ioMode, err = storage.ParseIoMode(req.IoMode); err != nil {
+			n.releaseVol(uint32(req.VolId))
+			return
+		}
+	}
+	if disk, err = n.chooseDisk(req.VolSize); err != nil {
+		n.releaseVol(uint32(req.VolId))
+		return
+	}
+	if v, err = NewVol(disk, req.VolType, uint32(req.VolId), req.VolSize, n.extentBlockSize, n.extentCacheSize, ioMode, storage.NewStoreMode); err != nil {
+		n.releaseVol(uint32(req.VolId))
+		return
+	}
+	v.setSyncMode(n.syncMode, n.commitInterval, n.commitBytes)
+	n.putVol(v)
+
+	return
+}
+
+// Handle OpDeleteVol
+func (n *DataNode) deleteVol(task *proto.AdminTask) (resp *proto.DeleteVolResponse) {
+	var err error
+	req := &proto.DeleteVolRequest{}
+	resp = &proto.DeleteVolResponse{}
+	defer func() {
+		resp.Status, resp.Result = setTaskStatus(task, err)
+		log.LogInfo(fmt.Sprintf("action[deleteVol] vol[%v] err[%v]", req.VolId, err))
+	}()
+	if err = unmarshalTaskRequest(task, req); err != nil {
+		return
+	}
+	resp.VolId = req.VolId
+	v := n.getVol(uint32(req.VolId))
+	if v == nil {
+		return
+	}
+	n.delVol(v.volId)
+	v.delete()
+
+	return
+}
+
+// Handle OpLoadVol
+func (n *DataNode) loadVol(task *proto.AdminTask) (resp *proto.LoadVolResponse) {
+	var err error
+	req := &proto.LoadVolRequest{}
+	resp = &proto.LoadVolResponse{}
+	defer func() {
+		resp.Status, resp.Result = setTaskStatus(task, err)
+		log.LogInfo(fmt.Sprintf("action[loadVol] vol[%v] files[%v] err[%v]", req.VolId, len(resp.VolSnapshot), err))
+	}()
+	if err = unmarshalTaskRequest(task, req); err != nil {
+		return
+	}
+	resp.VolId = req.VolId
+	resp.VolType = req.VolType
+	v := n.acquireVol(uint32(req.VolId))
+	if v == nil {
+		err = ErrVolNotExist
+		return
+	}
+	defer v.exit()
+	if resp.VolSnapshot, err = v.snapshot(); err != nil {
+		return
+	}
+	used, physicalUsed := v.usedSize()
+	resp.Used = uint64(used)
+	resp.PhysicalUsed = uint64(physicalUsed)
+
+	return
+}
+
+// Handle OpDeleteFile, the extent is removed from the disk. It is sent by
+// master for the extent deleted by the client, or corrupt on this DataNode,
+// which is replicated from the good replicas later.
+func (n *DataNode) deleteFile(task *proto.AdminTask) (resp *proto.DeleteFileResponse) {
+	var (
+		err      error
+		extentId uint64
+	)
+	req := &proto.DeleteFileRequest{}
+	resp = &proto.DeleteFileResponse{}
+	defer func() {
+		resp.Status, resp.Result = setTaskStatus(task, err)
+		log.LogInfo(fmt.Sprintf("action[deleteFile] vol[%v] file[%v] err[%v]", req.VolId, req.Name, err))
+	}()
+	if err = unmarshalTaskRequest(task, req); err != nil {
+		return
+	}
+	resp.VolId = req.VolId
+	resp.Name = req.Name
+	v := n.acquireVol(uint32(req.VolId))
+	if v == nil {
+		err = ErrVolNotExist
+		return
+	}
+	defer v.exit()
+	if v.storeType != proto.ExtentStoreMode {
+		err = ErrStoreTypeUnmatch
+		return
+	}
+	if extentId, err = strconv.ParseUint(req.Name, 10, 64); err != nil {
+		return
+	}
+	if err = v.getExtentStore().Delete(extentId); err != nil {
+		return
+	}
+	v.delBadFile(req.Name)
+
+	return
+}
+
+// updateLeaders takes the leadership of the volumes from the view of master,
+// the volume not in the view leads no more. The new leader of an extent
+// volume takes the commit lengths from the replicas.
+func (n *DataNode) updateLeaders(views []*proto.VolView) {
+	leaders := make(map[uint32]*proto.VolView, len(views))
+	for _, view := range views {
+		leaders[uint32(view.VolID)] = view
+	}
+	for _, v := range n.getAllVols() {
+		view, ok := leaders[v.volId]
+		if !ok {
+			v.setLeader(false, nil)
+			continue
+		}
+		if v.setLeader(view.Leader, view.Followers) && v.storeType == proto.ExtentStoreMode {
+			go n.takeCommitLengths(v)
+		}
+	}
+}
+
+// Handle OpDataNodeHeartbeat, reports the capacity of the disks and the
+// status of every volume on this DataNode, and takes the io limits of master.
+// The disks on the same device are counted once, the disk failed to stat is
+// left out of the capacity.
+func (n *DataNode) heartbeat(task *proto.AdminTask) (resp *proto.DataNodeHeartBeatResponse) {
+	var err error
+	req := &proto.HeartBeatRequest{}
+	resp = &proto.DataNodeHeartBeatResponse{RackName: n.rackName}
+	defer func() {
+		resp.Status, resp.Result = setTaskStatus(task, err)
+		log.LogDebug(fmt.Sprintf("action[heartbeat] total[%v] used[%v] maxDiskAvail[%v] vols[%v] err[%v]",
+			resp.Total, resp.Used, resp.MaxDiskAvailWeight, len(resp.VolInfo), err))
+	}()
+	if e := unmarshalTaskRequest(task, req); e == nil {
+		if req.Throttle != nil {
+			n.throttle.setLimits(req.Throttle)
+		}
+		if req.Vols != nil {
+			n.updateLeaders(req.Vols)
+		}
+	}
+	devices := make(map[uint64]bool, len(n.disks))
+	for _, disk := range n.disks {
+		total, used, avail, e := getDiskSpace(disk.Path)
+		if e != nil {
+			log.LogError(fmt.Sprintf("action[heartbeat] disk[%v] err[%v]", disk.Path, e))
+			continue
+		}
+		dev, e := getDiskDevice(disk.Path)
+		if e != nil || !devices[dev] {
+			resp.Total += total
+			resp.Used += used
+		}
+		if e == nil {
+			devices[dev] = true
+		}
+		// The disk isolated for errors can not take new volumes.
+		if disk.getStatus() == proto.VolReadWrite && int64(avail) > resp.MaxDiskAvailWeight {
+			resp.MaxDiskAvailWeight = int64(avail)
+		}
+	}
+	vols := n.getAllVols()
+	resp.VolInfo = make([]*proto.VolReport, 0, len(vols))
+	for _, v := range vols {
+		used, physicalUsed := v.usedSize()
+		vr := &proto.VolReport{
+			VolID:        uint64(v.volId),
+			VolStatus:    v.refreshStatus(),
+			Total:        uint64(v.volSize),
+			Used:         uint64(used),
+			PhysicalUsed: uint64(physicalUsed),
+		}
+		resp.VolInfo = append(resp.VolInfo, vr)
+		resp.BadFiles = append(resp.BadFiles, v.getBadFileReports()...)
+	}
+
+	return
+}
@@ -0,0 +1,137 @@
+package datanode
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/storage"
+)
+
+// The volume created by the tasks racing on the same id is created once.
+func TestCreateVolConcurrent(t *testing.T) {
+	n := newTestDataNode(t)
+	defer n.stop()
+	n.disks = []*Disk{n.disk}
+
+	const tasks = 8
+	var wg sync.WaitGroup
+	for i := 0; i < tasks; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			task := proto.NewAdminTask(proto.OpCreateVol, "", &proto.CreateVolRequest{VolType: proto.ExtentVol, VolId: 1, VolSize: 1 << 20})
+			n.DataNode.createVol(task)
+		}()
+	}
+	wg.Wait()
+	finfos, err := ioutil.ReadDir(n.disk.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(finfos) != 1 || finfos[0].Name() != volDirName(proto.ExtentVol, 1, 1<<20) {
+		t.Fatalf("vol dirs %v", finfos)
+	}
+	if n.getVol(1) == nil {
+		t.Fatal("vol not created")
+	}
+}
+
+// The volume takes the io mode of its create task, or the one of the node if
+// the task has none, and keeps it when it is loaded again.
+func TestCreateVolIoMode(t *testing.T) {
+	n := newTestDataNode(t)
+	defer n.stop()
+	n.disks = []*Disk{n.disk}
+	n.extentIoMode = storage.IoModeDsync
+
+	modes := map[uint64]string{1: "", 2: "buffered", 3: "bogus"}
+	for volId, mode := range modes {
+		task := proto.NewAdminTask(proto.OpCreateVol, "", &proto.CreateVolRequest{VolType: proto.ExtentVol, VolId: volId, VolSize: 1 << 20, IoMode: mode})
+		n.DataNode.createVol(task)
+	}
+	if n.getVol(3) != nil {
+		t.Fatal("vol created with a bad io mode")
+	}
+	check := func(n *DataNode) {
+		if v := n.getVol(1); v == nil || v.ioMode != storage.IoModeDsync {
+			t.Fatalf("vol 1 %+v", v)
+		}
+		if v := n.getVol(2); v == nil || v.ioMode != storage.IoModeBuffered {
+			t.Fatalf("vol 2 %+v", v)
+		}
+	}
+	check(n.DataNode)
+
+	reloaded := NewServer()
+	reloaded.disks = n.disks
+	reloaded.extentBlockSize = storage.BlockSize
+	if err := reloaded.loadVols(); err != nil {
+		t.Fatal(err)
+	}
+	check(reloaded)
+}
+
+// The volume is deleted after the operations in flight on it are done.
+func TestDeleteVolInFlight(t *testing.T) {
+	n := newTestDataNode(t)
+	defer n.stop()
+	v := n.createVol(t, proto.ExtentVol, 1, storage.BlockSize)
+	if n.acquireVol(1) != v {
+		t.Fatal("vol not acquired")
+	}
+	done := make(chan struct{})
+	go func() {
+		task := proto.NewAdminTask(proto.OpDeleteVol, "", &proto.DeleteVolRequest{VolType: proto.ExtentVol, VolId: 1})
+		n.deleteVol(task)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("vol deleted with an operation in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := os.Stat(v.path); err != nil {
+		t.Fatalf("vol path: %v", err)
+	}
+	v.exit()
+	<-done
+	if _, err := os.Stat(v.path); !os.IsNotExist(err) {
+		t.Fatalf("vol path left: %v", err)
+	}
+	if v.enter() || n.acquireVol(1) != nil {
+		t.Fatal("deleted vol entered")
+	}
+}
+
+// The disks on the same device are counted once, and the disk failed to stat
+// does not fail the heartbeat.
+func TestHeartbeatDisks(t *testing.T) {
+	n := newTestDataNode(t)
+	defer n.stop()
+	total, used, _, err := getDiskSpace(n.disk.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := n.disk.Path + "/other"
+	if err = os.Mkdir(other, 0755); err != nil {
+		t.Fatal(err)
+	}
+	n.disks = []*Disk{n.disk, NewDisk(other), NewDisk(n.disk.Path + "/missing")}
+
+	task := proto.NewAdminTask(proto.OpDataNodeHeartbeat, "", &proto.HeartBeatRequest{})
+	resp := n.heartbeat(task)
+	if resp.Status != proto.CmdSuccess {
+		t.Fatalf("heartbeat status[%v] result[%v]", resp.Status, resp.Result)
+	}
+	if resp.Total != total {
+		t.Fatalf("total[%v] expected[%v]", resp.Total, total)
+	}
+	// The space used may change between the two stats.
+	if resp.Used < used/2 || resp.Used > used*3/2+1<<20 {
+		t.Fatalf("used[%v] expected about[%v]", resp.Used, used)
+	}
+}
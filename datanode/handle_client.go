@@ -0,0 +1,348 @@
+package datanode
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"strconv"
+
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/storage"
+	"github.com/tiglabs/baudstorage/util"
+	"github.com/tiglabs/baudstorage/util/log"
+)
+
+// MaxReadSize bounds the size of an OpRead, the data replied is allocated by
+// the size the client asks. The larger ranges are read by OpStreamRead.
+const MaxReadSize = storage.MaxBlockSize
+
+// operatePacket dispatches the packet to the store of its volume and replies
+// the result to the connection.
+func (n *DataNode) operatePacket(pkg *Packet, c net.Conn) (err error) {
+	var opErr error
+	remote := c.RemoteAddr().String()
+	defer func() {
+		if opErr != nil {
+			log.LogError(pkg.ActionMesg(proto.GetOpMesg(pkg.OrgOpcode), remote, pkg.StartT, opErr))
+		} else {
+			log.LogDebug(pkg.ActionMesg(proto.GetOpMesg(pkg.OrgOpcode), remote, pkg.StartT, nil))
+		}
+	}()
+
+	if pkg.IsMasterCommand() {
+		return n.handleMasterCommand(pkg, c)
+	}
+	v := n.acquireVol(pkg.VolID)
+	if v != nil {
+		defer v.exit()
+	}
+	switch {
+	case v == nil:
+		opErr = ErrVolNotExist
+	case v.storeType != pkg.StoreType:
+		opErr = ErrStoreTypeUnmatch
+	case v.diskRefused(pkg):
+		opErr = v.diskErr()
+	case v.writeRefused(pkg):
+		opErr = storage.ErrorVolReadOnly
+	case n.throttled(pkg, remote):
+		opErr = ErrThrottled
+	case pkg.Opcode == proto.OpStreamRead:
+		return n.handleStreamRead(pkg, v, c)
+	case pkg.Opcode == proto.OpERepairRead:
+		return n.handleExtentRepairRead(pkg, v, c)
+	case pkg.Opcode == proto.OpCRepairRead:
+		return n.handleChunkRepairRead(pkg, v, c)
+	case pkg.IsReplicatePkg():
+		opErr = n.replicatePacket(pkg, v)
+	default:
+		opErr = n.operateLocal(pkg, v)
+	}
+	if opErr != nil && v != nil {
+		opErr = v.checkDiskErr(opErr)
+	}
+	if opErr != nil {
+		pkg.PackErrorBody(opErr)
+	}
+
+	return pkg.WriteToConn(c)
+}
+
+func (n *DataNode) operateLocal(pkg *Packet, v *Vol) (err error) {
+	switch pkg.Opcode {
+	case proto.OpCreateFile:
+		err = n.handleCreateFile(pkg, v)
+	case proto.OpWrite:
+		err = n.handleWrite(pkg, v)
+	case proto.OpRead:
+		err = n.handleRead(pkg, v)
+	case proto.OpMarkDelete:
+		err = n.handleMarkDelete(pkg, v)
+	case proto.OpSealFile:
+		err = n.handleSealFile(pkg, v)
+	case proto.OpUnsealFile:
+		err = n.handleUnsealFile(pkg, v)
+	case proto.OpGetWatermark:
+		err = n.handleGetWatermark(pkg, v)
+	case proto.OpGetAllWatermark:
+		err = n.handleGetAllWatermark(pkg, v)
+	case proto.OpGetBlockCrc:
+		err = n.handleGetBlockCrc(pkg, v)
+	case proto.OpNotifyRepair:
+		err = n.handleNotifyRepair(pkg, v)
+	case proto.OpNotifyCompact:
+		err = n.handleNotifyCompact(pkg, v)
+	default:
+		err = ErrUnknownOp
+	}
+
+	return
+}
+
+// Handle OpCreateFile, only extent volumes create files explicitly. The head
+// of the chain allocates the extent id, the followers create the same one.
+func (n *DataNode) handleCreateFile(pkg *Packet, v *Vol) (err error) {
+	if pkg.StoreType != proto.ExtentStoreMode {
+		return ErrStoreTypeUnmatch
+	}
+	store := v.getExtentStore()
+	if pkg.FileID == 0 {
+		pkg.FileID, err = store.Create()
+	} else {
+		err = store.CreateWithId(pkg.FileID)
+	}
+	if err != nil {
+		return
+	}
+	pkg.PackOkReply()
+
+	return
+}
+
+// Handle OpWrite
+func (n *DataNode) handleWrite(pkg *Packet, v *Vol) (err error) {
+	if pkg.Size == 0 || int(pkg.Size) > len(pkg.Data) {
+		return storage.ErrorUnmatchPara
+	}
+	if crc32.ChecksumIEEE(pkg.Data[:pkg.Size]) != pkg.Crc {
+		return ErrCrcUnmatch
+	}
+	switch pkg.StoreType {
+	case proto.TinyStoreMode:
+		err = v.getTinyStore().Write(uint32(pkg.FileID), pkg.Offset, int64(pkg.Size), pkg.Data, pkg.Crc)
+	case proto.ExtentStoreMode:
+		err = v.getExtentStore().Write(pkg.FileID, pkg.Offset, int64(pkg.Size), pkg.Data, pkg.Crc)
+	}
+	if err != nil {
+		return
+	}
+	pkg.PackOkReply()
+
+	return
+}
+
+// Handle OpRead
+func (n *DataNode) handleRead(pkg *Packet, v *Vol) (err error) {
+	if pkg.Size == 0 || pkg.Size > MaxReadSize {
+		return storage.ErrorUnmatchPara
+	}
+	pkg.Data = make([]byte, pkg.Size)
+	switch pkg.StoreType {
+	case proto.TinyStoreMode:
+		err = n.readObject(pkg, v)
+	case proto.ExtentStoreMode:
+		if err = v.checkCommitted(pkg.FileID, pkg.Offset, int64(pkg.Size)); err != nil {
+			return
+		}
+		pkg.Crc, err = v.getExtentStore().Read(pkg.FileID, pkg.Offset, int64(pkg.Size), pkg.Data)
+	}
+	if err != nil {
+		return
+	}
+	pkg.PackOkReadReply()
+
+	return
+}
+
+// readObject reads the object of a tiny volume. The object found corrupt is
+// marked suspect for the repair, and is read from the other replicas instead,
+// which are the addresses in the Arg of the packet and the followers known
+// as the head of the chain.
+func (n *DataNode) readObject(pkg *Packet, v *Vol) (err error) {
+	chunkId := uint32(pkg.FileID)
+	oid := uint64(pkg.Offset)
+	pkg.Crc, err = v.getTinyStore().Read(chunkId, pkg.Offset, int64(pkg.Size), pkg.Data)
+	if err != storage.ErrorObjectCorrupt {
+		return
+	}
+	v.addBadBlock(strconv.Itoa(int(chunkId)), oid)
+	log.LogError(fmt.Sprintf("action[readObject] vol[%v] chunk[%v] object[%v] corrupt",
+		v.volId, chunkId, oid))
+
+	tried := make(map[string]bool)
+	for _, host := range append(pkg.ReadAddrs(), v.getFollowers()...) {
+		if tried[host] {
+			continue
+		}
+		tried[host] = true
+		data, crc, e := n.fetchObject(v, host, uint64(chunkId), oid)
+		if e == nil && len(data) == int(pkg.Size) {
+			copy(pkg.Data, data)
+			pkg.Crc = crc
+			return nil
+		}
+		log.LogWarn(fmt.Sprintf("action[readObject] vol[%v] chunk[%v] object[%v] from[%v] size[%v] err[%v]",
+			v.volId, chunkId, oid, host, len(data), e))
+	}
+
+	return
+}
+
+// Handle OpStreamRead, the extent is replied block by block and every block
+// is sent as a separate packet, split at the block size of the extent as the
+// repair read is.
+func (n *DataNode) handleStreamRead(pkg *Packet, v *Vol, c net.Conn) (err error) {
+	var opErr error
+	if pkg.StoreType != proto.ExtentStoreMode {
+		opErr = ErrStoreTypeUnmatch
+		pkg.PackErrorBody(opErr)
+		return pkg.WriteToConn(c)
+	}
+	if opErr = v.checkCommitted(pkg.FileID, pkg.Offset, int64(pkg.Size)); opErr != nil {
+		pkg.PackErrorBody(opErr)
+		return pkg.WriteToConn(c)
+	}
+	store := v.getExtentStore()
+	blockSize, opErr := store.GetBlockSize(pkg.FileID)
+	if opErr != nil {
+		pkg.PackErrorBody(opErr)
+		return pkg.WriteToConn(c)
+	}
+	needReplySize := pkg.Size
+	offset := pkg.Offset
+	for needReplySize > 0 {
+		currReadSize := uint32(util.Min(int(needReplySize), int(blockSize-offset%blockSize)))
+		pkg.Data = make([]byte, currReadSize)
+		pkg.Offset = offset
+		if pkg.Crc, opErr = store.Read(pkg.FileID, offset, int64(currReadSize), pkg.Data); opErr != nil {
+			opErr = v.checkDiskErr(opErr)
+			log.LogError(pkg.ActionMesg(proto.GetOpMesg(pkg.OrgOpcode), c.RemoteAddr().String(), pkg.StartT, opErr))
+			pkg.PackErrorBody(opErr)
+			return pkg.WriteToConn(c)
+		}
+		pkg.Size = currReadSize
+		pkg.PackOkReadReply()
+		if err = pkg.WriteToConn(c); err != nil {
+			return
+		}
+		needReplySize -= currReadSize
+		offset += int64(currReadSize)
+	}
+
+	return
+}
+
+// Handle OpMarkDelete
+func (n *DataNode) handleMarkDelete(pkg *Packet, v *Vol) (err error) {
+	switch pkg.StoreType {
+	case proto.TinyStoreMode:
+		err = v.getTinyStore().MarkDelete(uint32(pkg.FileID), pkg.Offset, int64(pkg.Size))
+	case proto.ExtentStoreMode:
+		err = v.getExtentStore().MarkDelete(pkg.FileID, pkg.Offset, int64(pkg.Size))
+	}
+	if err != nil {
+		return
+	}
+	pkg.PackOkReply()
+
+	return
+}
+
+// Handle OpSealFile, the extent is cut to the offset of the packet, which is
+// set to the commit length by the head of the chain.
+func (n *DataNode) handleSealFile(pkg *Packet, v *Vol) (err error) {
+	if pkg.StoreType != proto.ExtentStoreMode {
+		return ErrStoreTypeUnmatch
+	}
+	if err = v.getExtentStore().Seal(pkg.FileID, pkg.Offset); err != nil {
+		return
+	}
+	pkg.PackOkReply()
+
+	return
+}
+
+// Handle OpUnsealFile
+func (n *DataNode) handleUnsealFile(pkg *Packet, v *Vol) (err error) {
+	if pkg.StoreType != proto.ExtentStoreMode {
+		return ErrStoreTypeUnmatch
+	}
+	if err = v.getExtentStore().Unseal(pkg.FileID); err != nil {
+		return
+	}
+	pkg.PackOkReply()
+
+	return
+}
+
+// Handle OpGetWatermark
+func (n *DataNode) handleGetWatermark(pkg *Packet, v *Vol) (err error) {
+	var size int64
+	switch pkg.StoreType {
+	case proto.TinyStoreMode:
+		size, err = v.getTinyStore().GetWatermark(uint32(pkg.FileID))
+	case proto.ExtentStoreMode:
+		size, err = v.getExtentStore().GetWatermark(pkg.FileID)
+	}
+	if err != nil {
+		return
+	}
+	pkg.PackOkGetWatermarkReply(size)
+
+	return
+}
+
+// Handle OpGetAllWatermark
+func (n *DataNode) handleGetAllWatermark(pkg *Packet, v *Vol) (err error) {
+	var (
+		buf   []byte
+		infos interface{}
+	)
+	switch pkg.StoreType {
+	case proto.TinyStoreMode:
+		infos, err = v.getTinyStore().GetAllWatermark()
+	case proto.ExtentStoreMode:
+		infos, err = v.getExtentStore().GetAllWatermark()
+	}
+	if err != nil {
+		return
+	}
+	if buf, err = json.Marshal(infos); err != nil {
+		return fmt.Errorf("marshal watermarks err[%v]", err)
+	}
+	pkg.PackOkGetInfoReply(buf)
+
+	return
+}
+
+// Handle OpGetBlockCrc, the block crc index of the extent is replied for the
+// replica repairing the extent from this one.
+func (n *DataNode) handleGetBlockCrc(pkg *Packet, v *Vol) (err error) {
+	var (
+		buf   []byte
+		index *storage.BlockCrcIndex
+	)
+	if pkg.StoreType != proto.ExtentStoreMode {
+		return ErrStoreTypeUnmatch
+	}
+	if index, err = v.getExtentStore().GetBlockCrcIndex(pkg.FileID); err != nil {
+		return
+	}
+	if buf, err = json.Marshal(index); err != nil {
+		return fmt.Errorf("marshal block crc err[%v]", err)
+	}
+	pkg.PackOkGetInfoReply(buf)
+
+	return
+}
@@ -0,0 +1,231 @@
+package datanode
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/storage"
+)
+
+// operateTestPacket dispatches the packet over a pipe and returns the reply.
+func operateTestPacket(t *testing.T, n *testDataNode, p *Packet) (reply *Packet) {
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		n.operatePacket(p, server)
+	}()
+	reply = NewPacket()
+	if err := reply.ReadFromConn(client, proto.ReadDeadlineTime); err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+// The packet to a volume not found, of the store type of the other volume
+// type, or reading more than MaxReadSize at once is refused before it reaches
+// the store.
+func TestOperatePacketRefused(t *testing.T) {
+	n := newTestDataNode(t)
+	defer n.stop()
+	v := n.createVol(t, proto.ExtentVol, 1, storage.BlockSize)
+	if err := v.getExtentStore().CreateWithId(1); err != nil {
+		t.Fatal(err)
+	}
+	writeTestExtent(t, v.getExtentStore(), 1, 0, testData(4096))
+
+	notExist := newExtentReadPacket(0, 4096)
+	notExist.VolID = 2
+	typeUnmatch := newExtentReadPacket(0, 4096)
+	typeUnmatch.StoreType = proto.TinyStoreMode
+	cases := []struct {
+		name     string
+		p        *Packet
+		expected uint8
+	}{
+		{"vol not exist", notExist, proto.OpNotExistErr},
+		{"store type unmatch", typeUnmatch, proto.OpArgMismatchErr},
+		{"read too large", newExtentReadPacket(0, MaxReadSize+1), proto.OpArgMismatchErr},
+		{"read", newExtentReadPacket(0, 4096), proto.OpOk},
+	}
+	for _, c := range cases {
+		if reply := operateTestPacket(t, n, c.p); reply.Opcode != c.expected {
+			t.Fatalf("%v: reply opcode[%v] data[%s], expected[%v]", c.name, reply.Opcode, reply.Data, c.expected)
+		}
+	}
+}
+
+// corruptTestObject overwrites a part of the data of the object in the chunk
+// file, and returns the object.
+func corruptTestObject(t *testing.T, v *Vol, chunkId uint32, oid uint64) (o *storage.Object) {
+	o, err := v.getTinyStore().GetObject(chunkId, oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp, err := os.OpenFile(path.Join(v.path, strconv.Itoa(int(chunkId))), os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fp.WriteAt(make([]byte, 100), int64(o.Offset)+10)
+	fp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+func newObjectReadPacket(chunkId uint32, oid uint64, size uint32) (p *Packet) {
+	p = NewPacket()
+	p.Opcode = proto.OpRead
+	p.StoreType = proto.TinyStoreMode
+	p.VolID = 1
+	p.FileID = uint64(chunkId)
+	p.Offset = int64(oid)
+	p.Size = size
+
+	return
+}
+
+// The corrupt object is read from the follower instead, and is reported bad
+// by the leader.
+func TestReadCorruptObject(t *testing.T) {
+	leader, follower := newTestDataNode(t), newTestDataNode(t)
+	defer leader.stop()
+	defer follower.stop()
+	v := leader.createVol(t, proto.ChunkVol, 1, 0)
+	follower.createVol(t, proto.ChunkVol, 1, 0)
+	const chunkId = 1
+	writeTestObjects(t, chunkId, 1, leader, follower)
+	o := corruptTestObject(t, v, chunkId, 1)
+	v.setLeader(true, []string{follower.addr})
+
+	reply := leader.send(t, newObjectReadPacket(chunkId, 1, o.Size))
+	if reply.Opcode != proto.OpOk {
+		t.Fatalf("reply opcode[%v] data[%s]", reply.Opcode, reply.Data)
+	}
+	data := make([]byte, o.Size)
+	if _, err := follower.getVol(1).getTinyStore().Read(chunkId, 1, int64(o.Size), data); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply.Data[:reply.Size], data) {
+		t.Fatal("data read from the follower unmatch")
+	}
+	if _, err := v.getTinyStore().Read(chunkId, 1, int64(o.Size), data); err != storage.ErrorObjectCorrupt {
+		t.Fatalf("read corrupt object: %v", err)
+	}
+	reports := v.getBadFileReports()
+	if len(reports) != 1 || reports[0].Name != "1" || len(reports[0].Blocks) != 1 || reports[0].Blocks[0] != 1 {
+		t.Fatalf("bad file reports %v", reports)
+	}
+}
+
+// The object corrupt on every replica is replied with OpCorruptErr, and is
+// reported bad by both.
+func TestReadCorruptObjectEverywhere(t *testing.T) {
+	leader, follower := newTestDataNode(t), newTestDataNode(t)
+	defer leader.stop()
+	defer follower.stop()
+	v := leader.createVol(t, proto.ChunkVol, 1, 0)
+	fv := follower.createVol(t, proto.ChunkVol, 1, 0)
+	const chunkId = 1
+	writeTestObjects(t, chunkId, 1, leader, follower)
+	o := corruptTestObject(t, v, chunkId, 1)
+	corruptTestObject(t, fv, chunkId, 1)
+	v.setLeader(true, []string{follower.addr})
+
+	reply := leader.send(t, newObjectReadPacket(chunkId, 1, o.Size))
+	if reply.Opcode != proto.OpCorruptErr {
+		t.Fatalf("reply opcode[%v] data[%s]", reply.Opcode, reply.Data)
+	}
+	for _, vol := range []*Vol{v, fv} {
+		reports := vol.getBadFileReports()
+		if len(reports) != 1 || reports[0].Name != "1" || len(reports[0].Blocks) != 1 || reports[0].Blocks[0] != 1 {
+			t.Fatalf("bad file reports %v", reports)
+		}
+	}
+}
+
+// The writes to the sealed or readonly volume fail fast with
+// OpVolReadOnlyErr, the reads are still served.
+func TestWriteRefused(t *testing.T) {
+	n := newTestDataNode(t)
+	defer n.stop()
+	v := n.createVol(t, proto.ExtentVol, 1, storage.BlockSize)
+	if err := v.getExtentStore().CreateWithId(1); err != nil {
+		t.Fatal(err)
+	}
+	data := testData(4096)
+	writeTestExtent(t, v.getExtentStore(), 1, 0, data)
+
+	v.seal()
+	if reply := n.send(t, newChainWritePacket("", 4096, data)); reply.Opcode != proto.OpVolReadOnlyErr {
+		t.Fatalf("write to sealed vol: reply opcode[%v]", reply.Opcode)
+	}
+	if reply := n.send(t, newExtentReadPacket(0, len(data))); reply.Opcode != proto.OpOk {
+		t.Fatalf("read sealed vol: reply opcode[%v] data[%s]", reply.Opcode, reply.Data)
+	}
+	// The volume is full.
+	v.unseal()
+	v.volSize = len(data)
+	v.refreshStatus()
+	if reply := n.send(t, newChainWritePacket("", 4096, data)); reply.Opcode != proto.OpVolReadOnlyErr {
+		t.Fatalf("write to readonly vol: reply opcode[%v]", reply.Opcode)
+	}
+}
+
+// The stream read of an extent is replied in pieces ending at the blocks of
+// the extent, so the crc of a whole piece is the crc of the block.
+func TestStreamReadBlocks(t *testing.T) {
+	n := newTestDataNode(t)
+	defer n.stop()
+	const blockSize = 16 * 1024
+	v := n.createVol(t, proto.ExtentVol, 1, blockSize)
+	store := v.getExtentStore()
+	if err := store.CreateWithId(1); err != nil {
+		t.Fatal(err)
+	}
+	data := testData(5*blockSize + 100)
+	writeTestExtent(t, store, 1, 0, data)
+
+	conn, err := net.Dial("tcp", n.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	p := newExtentReadPacket(1000, len(data)-1000)
+	p.Opcode = proto.OpStreamRead
+	if err = p.WriteToConn(conn); err != nil {
+		t.Fatal(err)
+	}
+	offset := int64(1000)
+	for offset < int64(len(data)) {
+		reply := NewPacket()
+		if err = reply.ReadFromConn(conn, proto.ReadDeadlineTime); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Opcode != proto.OpOk || reply.Offset != offset {
+			t.Fatalf("offset[%v]: reply opcode[%v] offset[%v] data[%s]", offset, reply.Opcode, reply.Offset, reply.Data)
+		}
+		end := offset + int64(reply.Size)
+		if end != int64(len(data)) && end%blockSize != 0 {
+			t.Fatalf("offset[%v]: reply ends at [%v] within a block", offset, end)
+		}
+		if !bytes.Equal(reply.Data[:reply.Size], data[offset:end]) {
+			t.Fatalf("offset[%v]: data unmatch", offset)
+		}
+		if offset%blockSize == 0 && end%blockSize == 0 {
+			crc, err := store.GetBlockCrc(1, offset/blockSize)
+			if err != nil || crc != reply.Crc {
+				t.Fatalf("block[%v]: crc[%v] reply crc[%v] err[%v]", offset/blockSize, crc, reply.Crc, err)
+			}
+		}
+		offset = end
+	}
+}
@@ -0,0 +1,113 @@
+package datanode
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/storage"
+	"github.com/tiglabs/baudstorage/util/log"
+)
+
+const (
+	// Operator APIs
+	GetCompactStats     = "/stats/compact"
+	GetExtentCacheStats = "/stats/extentCache"
+	GetSyncStats        = "/stats/sync"
+	ExportVolSnapshot   = "/vol/export"
+	ImportVolSnapshot   = "/vol/import"
+)
+
+// startHttpService serves the statistics and the volume snapshots of this
+// DataNode for operators, it is disabled if httpPort is not configured.
+// A volume is moved by piping the export of one DataNode to the import of
+// another, such as
+//
+//	curl http://src/vol/export?id=1 | curl -T - http://dst/vol/import
+func (n *DataNode) startHttpService() {
+	if n.httpPort == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(GetCompactStats, n.getCompactStats)
+	mux.HandleFunc(GetExtentCacheStats, n.getExtentCacheStats)
+	mux.HandleFunc(GetSyncStats, n.getSyncStats)
+	mux.HandleFunc(ExportVolSnapshot, n.exportVolSnapshot)
+	mux.HandleFunc(ImportVolSnapshot, n.importVolSnapshot)
+	go func() {
+		if err := http.ListenAndServe(":"+n.httpPort, mux); err != nil {
+			log.LogError(fmt.Sprintf("action[startHttpService] port[%v] err[%v]", n.httpPort, err))
+		}
+	}()
+}
+
+func (n *DataNode) getCompactStats(w http.ResponseWriter, r *http.Request) {
+	writeStats(w, n.compactStats.get())
+}
+
+// getExtentCacheStats replies the open extent cache stats of every extent
+// volume by the volume id.
+func (n *DataNode) getExtentCacheStats(w http.ResponseWriter, r *http.Request) {
+	stats := make(map[uint32]*storage.ExtentCacheStats)
+	for _, v := range n.getAllVols() {
+		if v.storeType == proto.ExtentStoreMode {
+			stats[v.volId] = v.getExtentStore().GetCacheStats()
+		}
+	}
+	writeStats(w, stats)
+}
+
+// getSyncStats replies the sync mode and the group commit latency of every
+// volume by the volume id.
+func (n *DataNode) getSyncStats(w http.ResponseWriter, r *http.Request) {
+	stats := make(map[uint32]*storage.SyncStats)
+	for _, v := range n.getAllVols() {
+		stats[v.volId] = v.getSyncStats()
+	}
+	writeStats(w, stats)
+}
+
+// exportVolSnapshot streams the snapshot of the volume, the stream cut off by
+// an error is refused by the import as it has no end.
+func (n *DataNode) exportVolSnapshot(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	v := n.acquireVol(uint32(id))
+	if v == nil {
+		http.Error(w, ErrVolNotExist.Error(), http.StatusNotFound)
+		return
+	}
+	defer v.exit()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	err = v.exportSnapshot(w)
+	log.LogInfo(fmt.Sprintf("action[exportVolSnapshot] vol[%v] to[%v] err[%v]", v.volId, r.RemoteAddr, err))
+}
+
+// importVolSnapshot builds the volume from the snapshot in the request body,
+// the vol id is replied.
+func (n *DataNode) importVolSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	v, err := n.importSnapshot(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeStats(w, v.volId)
+}
+
+func writeStats(w http.ResponseWriter, stats interface{}) {
+	body, err := json.Marshal(stats)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(body)
+}
@@ -1,19 +1,24 @@
 package datanode
 
 import (
-	"errors"
 	"fmt"
 	"net"
 	"strings"
 	"time"
 
+	"github.com/juju/errors"
 	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/storage"
 )
 
 var (
 	ErrBadNodes          = errors.New("BadNodesErr")
 	ErrArgLenUnmatch     = errors.New("ArgLenUnmatchErr")
 	ErrAddrsNodesUnmatch = errors.New("AddrsNodesUnmatchErr")
+	ErrCrcUnmatch        = errors.New("CrcUnmatchErr")
+	ErrStoreTypeUnmatch  = errors.New("StoreTypeUnmatchErr")
+	ErrUnknownOp         = errors.New("UnknownOpErr")
+	ErrIntraGroupNet     = errors.New("IntraGroupNetErr")
 )
 
 type Packet struct {
@@ -25,6 +30,43 @@ type Packet struct {
 	isReturn bool
 }
 
+func NewPacket() (p *Packet) {
+	p = new(Packet)
+	p.Magic = proto.ProtoMagic
+	p.StartT = time.Now().UnixNano()
+
+	return
+}
+
+// PackErrorBody turns the packet into an error reply, the opcode tells the
+// client what kind of error happened and the data carries the error message.
+func (p *Packet) PackErrorBody(err error) {
+	switch errors.Cause(err) {
+	case ErrIntraGroupNet:
+		p.Opcode = proto.OpIntraGroupNetErr
+	case storage.ErrorChunkNotFound, storage.ErrorObjNotFound, storage.ErrorHasDelete, ErrVolNotExist:
+		p.Opcode = proto.OpNotExistErr
+	case storage.ErrorUnmatchPara, ErrCrcUnmatch, storage.ErrorCrcUnmatch, ErrStoreTypeUnmatch, ErrUnknownOp,
+		ErrBadNodes, ErrArgLenUnmatch, ErrAddrsNodesUnmatch, storage.ErrorExtentSealed, storage.ErrorExtentVersion:
+		p.Opcode = proto.OpArgMismatchErr
+	case storage.ErrSyscallNoSpace:
+		p.Opcode = proto.OpDiskNoSpaceErr
+	case storage.ErrSyscallIO:
+		p.Opcode = proto.OpDiskErr
+	case storage.ErrorVolReadOnly:
+		p.Opcode = proto.OpVolReadOnlyErr
+	case storage.ErrorObjectCorrupt:
+		p.Opcode = proto.OpCorruptErr
+	case storage.ErrorAgain, storage.ErrorNoAvaliFile, storage.ErrorPastCommit, storage.ErrorStoreFrozen, ErrThrottled:
+		p.Opcode = proto.OpAgain
+	default:
+		p.Opcode = proto.OpErr
+	}
+	p.Data = []byte(err.Error())
+	p.Size = uint32(len(p.Data))
+	p.Arglen = 0
+}
+
 func (p *Packet) UnmarshalAddrs() (addrs []string, err error) {
 	if len(p.Arg) < int(p.Arglen) {
 		return nil, ErrArgLenUnmatch
@@ -39,7 +81,7 @@ func (p *Packet) UnmarshalAddrs() (addrs []string, err error) {
 		err = ErrBadNodes
 		return
 	}
-	copy(p.addrs, addrs)
+	p.addrs = addrs
 
 	return
 }
@@ -63,6 +105,32 @@ func (p *Packet) IsTransitPkg() bool {
 	return r
 }
 
+// ReadAddrs returns the addresses of the other replicas carried in the Arg of
+// a read packet, the DataNode reads the corrupt object from them.
+func (p *Packet) ReadAddrs() (addrs []string) {
+	if p.Arglen == 0 || int(p.Arglen) > len(p.Arg) {
+		return
+	}
+	for _, addr := range strings.Split(string(p.Arg[:p.Arglen]), proto.AddrSplit) {
+		if addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return
+}
+
+// IsReplicatePkg reports whether the packet modifies the store and must be
+// applied by every replica of the volume group.
+func (p *Packet) IsReplicatePkg() bool {
+	switch p.Opcode {
+	case proto.OpCreateFile, proto.OpWrite, proto.OpMarkDelete, proto.OpSealFile, proto.OpUnsealFile:
+		return true
+	}
+
+	return false
+}
+
 func (p *Packet) actionMesg(action, remote string, start int64, err error) (m string) {
 	if err == nil {
 		m = fmt.Sprintf("id[%v] act[%v] remote[%v] op[%v] local[%v] size[%v] "+
@@ -0,0 +1,46 @@
+package datanode
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/util/log"
+)
+
+const (
+	ReclaimInterval          = 10 * time.Minute
+	DefaultDeleteGracePeriod = 24 * 60 * 60 // seconds
+)
+
+// reclaimScheduler unlinks the extents marked deleted for longer than
+// deleteGrace, the data of a deleted extent is kept on disk for a while.
+func (n *DataNode) reclaimScheduler() {
+	ticker := time.NewTicker(ReclaimInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stopC:
+			return
+		case <-ticker.C:
+		}
+		for _, v := range n.getAllVols() {
+			if v.storeType != proto.ExtentStoreMode || !v.enter() {
+				continue
+			}
+			extents, err := v.getExtentStore().DeleteExpired(n.deleteGrace)
+			v.exit()
+			if err != nil {
+				log.LogError(fmt.Sprintf("action[reclaimScheduler] vol[%v] err[%v]", v.volId, err))
+			}
+			for _, extentId := range extents {
+				v.delBadFile(strconv.FormatUint(extentId, 10))
+				log.LogInfo(fmt.Sprintf("action[reclaimScheduler] vol[%v] extent[%v] unlinked", v.volId, extentId))
+			}
+			if n.isStopped() {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,580 @@
+package datanode
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/storage"
+	"github.com/tiglabs/baudstorage/util"
+	"github.com/tiglabs/baudstorage/util/log"
+)
+
+const (
+	RepairReadDeadlineTime = 10
+)
+
+// repairSource is the replica which has the most data of a file.
+type repairSource struct {
+	host string
+	size int64 // watermark of an extent, or last object id of a chunk
+}
+
+func newRepairPacket(opcode uint8, v *Vol, fileId uint64) (p *Packet) {
+	p = NewPacket()
+	p.Opcode = opcode
+	p.StoreType = v.storeType
+	p.VolID = v.volId
+	p.FileID = fileId
+	p.ReqID = proto.GetReqID()
+
+	return
+}
+
+// repairVol compares the watermarks of the local files with every host and
+// fetches the missing data from the most complete replica. If name is not
+// empty, only the file of that name is repaired. The file failed to repair is
+// skipped, the error of the last one is returned with the files failed.
+func (n *DataNode) repairVol(v *Vol, hosts []string, name string) (err error) {
+	var (
+		local   map[uint64]int64
+		sources map[uint64]*repairSource
+		failed  []uint64
+		lastErr error
+	)
+	if local, err = v.getLocalWatermarks(); err != nil {
+		return
+	}
+	if sources, err = n.getRepairSources(v, hosts); err != nil {
+		return
+	}
+	for fileId, src := range sources {
+		if name != "" && name != strconv.FormatUint(fileId, 10) {
+			continue
+		}
+		localSize, exist := local[fileId]
+		if exist && localSize >= src.size {
+			continue
+		}
+		var e error
+		switch v.storeType {
+		case proto.ExtentStoreMode:
+			e = n.repairExtent(v, fileId, localSize, src, exist)
+		case proto.TinyStoreMode:
+			e = n.repairChunk(v, fileId, localSize, src)
+		}
+		if e != nil {
+			log.LogError(fmt.Sprintf("action[repairVol] vol[%v] file[%v] from[%v] err[%v]", v.volId, fileId, src.host, e))
+			failed = append(failed, fileId)
+			lastErr = e
+			continue
+		}
+		log.LogInfo(fmt.Sprintf("action[repairVol] vol[%v] file[%v] from[%v] local[%v] remote[%v] repaired",
+			v.volId, fileId, src.host, localSize, src.size))
+	}
+	if len(failed) != 0 {
+		err = errors.Annotatef(lastErr, "files%v not repaired", failed)
+	}
+
+	return
+}
+
+func (v *Vol) getLocalWatermarks() (watermarks map[uint64]int64, err error) {
+	watermarks = make(map[uint64]int64)
+	switch v.storeType {
+	case proto.ExtentStoreMode:
+		var extents []*storage.ExtentInfo
+		if extents, err = v.getExtentStore().GetAllWatermark(); err != nil {
+			return
+		}
+		for _, ei := range extents {
+			watermarks[ei.ExtentId] = ei.Size
+		}
+	case proto.TinyStoreMode:
+		var chunks []*storage.ChunkInfo
+		if chunks, err = v.getTinyStore().GetAllWatermark(); err != nil {
+			return
+		}
+		for _, ci := range chunks {
+			watermarks[uint64(ci.ChunkId)] = int64(ci.LastOid)
+		}
+	}
+
+	return
+}
+
+// getRepairSources asks every host for its watermarks and keeps the most
+// complete replica of each file.
+func (n *DataNode) getRepairSources(v *Vol, hosts []string) (sources map[uint64]*repairSource, err error) {
+	sources = make(map[uint64]*repairSource)
+	for _, host := range hosts {
+		var watermarks map[uint64]int64
+		if watermarks, err = n.getRemoteWatermarks(v, host); err != nil {
+			return
+		}
+		for fileId, size := range watermarks {
+			if src, ok := sources[fileId]; !ok || src.size < size {
+				sources[fileId] = &repairSource{host: host, size: size}
+			}
+		}
+	}
+
+	return
+}
+
+func (n *DataNode) getRemoteWatermarks(v *Vol, host string) (watermarks map[uint64]int64, err error) {
+	var conn net.Conn
+	if conn, err = n.connPool.Get(host); err != nil {
+		return
+	}
+	p := newRepairPacket(proto.OpGetAllWatermark, v, 0)
+	if err = p.WriteToConn(conn); err != nil {
+		conn.Close()
+		return
+	}
+	reply := NewPacket()
+	if err = reply.ReadFromConn(conn, RepairReadDeadlineTime); err != nil {
+		conn.Close()
+		return
+	}
+	n.connPool.Put(conn)
+	if reply.Opcode != proto.OpOk {
+		return nil, fmt.Errorf("host[%v] get watermarks err[%v]", host, string(reply.Data[:reply.Size]))
+	}
+
+	watermarks = make(map[uint64]int64)
+	switch v.storeType {
+	case proto.ExtentStoreMode:
+		extents := make([]*storage.ExtentInfo, 0)
+		if err = json.Unmarshal(reply.Data[:reply.Size], &extents); err != nil {
+			return
+		}
+		for _, ei := range extents {
+			watermarks[ei.ExtentId] = ei.Size
+		}
+	case proto.TinyStoreMode:
+		chunks := make([]*storage.ChunkInfo, 0)
+		if err = json.Unmarshal(reply.Data[:reply.Size], &chunks); err != nil {
+			return
+		}
+		for _, ci := range chunks {
+			watermarks[uint64(ci.ChunkId)] = int64(ci.LastOid)
+		}
+	}
+
+	return
+}
+
+// repairExtent streams the bytes of [localSize, index.Size) from the source,
+// where the index is the block crc index of the source. Every piece replied
+// ends at a block of the source, the data of the block is checked against
+// the crc of the block in the index before it is written. The extent missing
+// is created with the block size of the source, the block written is verified
+// with its local crc again then. The extent deleted on the source is marked
+// deleted locally instead, the one deleted locally is not repaired, and the
+// one sealed on the source is sealed after it is repaired.
+func (n *DataNode) repairExtent(v *Vol, extentId uint64, localSize int64, src *repairSource, exist bool) (err error) {
+	var (
+		conn           net.Conn
+		index          *storage.BlockCrcIndex
+		localBlockSize int64
+		blockCrc       uint32
+	)
+	store := v.getExtentStore()
+	if index, err = n.getRemoteBlockCrc(v, src.host, extentId); err != nil {
+		return
+	}
+	if index.MarkDel {
+		if exist {
+			err = store.MarkDelete(extentId, 0, 0)
+		}
+		return
+	}
+	if exist {
+		var deleted bool
+		if deleted, err = store.IsMarkDelete(extentId); err != nil || deleted {
+			return
+		}
+	}
+	if index.Size <= localSize {
+		return
+	}
+	if !exist {
+		if err = store.CreateWithBlockSize(extentId, index.BlockSize); err != nil {
+			return
+		}
+	}
+	if localBlockSize, err = store.GetBlockSize(extentId); err != nil {
+		return
+	}
+	// The part of the first block before localSize is not fetched, its crc
+	// comes from the local data.
+	if blockStart := localSize - localSize%index.BlockSize; blockStart < localSize {
+		data := make([]byte, localSize-blockStart)
+		if _, err = store.Read(extentId, blockStart, int64(len(data)), data); err != nil {
+			return
+		}
+		blockCrc = crc32.ChecksumIEEE(data)
+	}
+
+	if conn, err = n.connPool.Get(src.host); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+		} else {
+			n.connPool.Put(conn)
+		}
+	}()
+	p := newRepairPacket(proto.OpERepairRead, v, extentId)
+	p.Offset = localSize
+	p.Size = uint32(index.Size - localSize)
+	if err = p.WriteToConn(conn); err != nil {
+		return
+	}
+
+	for offset := localSize; offset < index.Size; {
+		reply := NewPacket()
+		if err = reply.ReadFromConn(conn, RepairReadDeadlineTime); err != nil {
+			return
+		}
+		if reply.Opcode != proto.OpOk {
+			return fmt.Errorf("read from[%v] err[%v]", src.host, string(reply.Data[:reply.Size]))
+		}
+		blockNo := offset / index.BlockSize
+		end := (blockNo + 1) * index.BlockSize
+		if end > index.Size {
+			end = index.Size
+		}
+		if reply.Offset != offset || offset+int64(reply.Size) != end {
+			return fmt.Errorf("read from[%v] unmatch offset[%v] size[%v] expect offset[%v] size[%v]",
+				src.host, reply.Offset, reply.Size, offset, end-offset)
+		}
+		if crc32.ChecksumIEEE(reply.Data[:reply.Size]) != reply.Crc {
+			return ErrCrcUnmatch
+		}
+		// The crc of a partial block of a v1 source may be padded.
+		blockCrc = crc32.Update(blockCrc, crc32.IEEETable, reply.Data[:reply.Size])
+		if !index.MatchBlock(blockNo, blockCrc, end-blockNo*index.BlockSize) {
+			return errors.Annotatef(ErrCrcUnmatch, "block[%v] of[%v]", blockNo, src.host)
+		}
+		if err = store.Write(extentId, reply.Offset, int64(reply.Size), reply.Data, reply.Crc); err != nil {
+			return
+		}
+		if localBlockSize == index.BlockSize {
+			if _, err = store.VerifyBlock(extentId, blockNo); err != nil {
+				return errors.Annotatef(ErrCrcUnmatch, "block[%v] err[%v]", blockNo, err)
+			}
+		}
+		blockCrc = 0
+		offset = end
+	}
+	if err = store.Sync(extentId); err != nil {
+		return
+	}
+	if index.Sealed {
+		err = store.Seal(extentId, index.Size)
+	}
+
+	return
+}
+
+// getRemoteBlockCrc fetches the block crc index of the extent on the host.
+func (n *DataNode) getRemoteBlockCrc(v *Vol, host string, extentId uint64) (index *storage.BlockCrcIndex, err error) {
+	var conn net.Conn
+	if conn, err = n.connPool.Get(host); err != nil {
+		return
+	}
+	p := newRepairPacket(proto.OpGetBlockCrc, v, extentId)
+	if err = p.WriteToConn(conn); err != nil {
+		conn.Close()
+		return
+	}
+	reply := NewPacket()
+	if err = reply.ReadFromConn(conn, RepairReadDeadlineTime); err != nil {
+		conn.Close()
+		return
+	}
+	n.connPool.Put(conn)
+	if reply.Opcode != proto.OpOk {
+		return nil, fmt.Errorf("host[%v] get block crc err[%v]", host, string(reply.Data[:reply.Size]))
+	}
+	index = new(storage.BlockCrcIndex)
+	if err = json.Unmarshal(reply.Data[:reply.Size], index); err != nil {
+		return
+	}
+	if index.BlockSize <= 0 {
+		return nil, fmt.Errorf("host[%v] error block size[%v]", host, index.BlockSize)
+	}
+
+	return
+}
+
+// repairChunk fetches the objects after the last object id of the local
+// chunk, the objects deleted on the source are written as tombstones.
+func (n *DataNode) repairChunk(v *Vol, chunkId uint64, localLastOid int64, src *repairSource) (err error) {
+	var conn net.Conn
+	store := v.getTinyStore()
+	if conn, err = n.connPool.Get(src.host); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+		} else {
+			n.connPool.Put(conn)
+		}
+	}()
+	p := newRepairPacket(proto.OpCRepairRead, v, chunkId)
+	p.Offset = localLastOid + 1
+	p.Size = uint32(src.size - localLastOid)
+	if err = p.WriteToConn(conn); err != nil {
+		return
+	}
+
+	for oid := localLastOid + 1; oid <= src.size; oid++ {
+		reply := NewPacket()
+		if err = reply.ReadFromConn(conn, RepairReadDeadlineTime); err != nil {
+			return
+		}
+		if reply.Offset != oid {
+			return fmt.Errorf("read from[%v] unmatch object[%v] expect[%v]", src.host, reply.Offset, oid)
+		}
+		switch reply.Opcode {
+		case proto.OpOk:
+			if crc32.ChecksumIEEE(reply.Data[:reply.Size]) != reply.Crc {
+				return errors.Annotatef(ErrCrcUnmatch, "object[%v]", oid)
+			}
+			err = store.Write(uint32(chunkId), oid, int64(reply.Size), reply.Data, reply.Crc)
+		case proto.OpNotExistErr:
+			err = store.WriteDeleteDentry(uint64(oid), int(chunkId))
+		default:
+			err = fmt.Errorf("read from[%v] err[%v]", src.host, string(reply.Data[:reply.Size]))
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	return store.Sync(uint32(chunkId))
+}
+
+// Handle OpERepairRead, the range is replied piece by piece and every piece
+// ends at a block boundary of the extent, so the crc of a whole block comes
+// from the block crc index of the extent.
+func (n *DataNode) handleExtentRepairRead(pkg *Packet, v *Vol, c net.Conn) (err error) {
+	var opErr error
+	if pkg.StoreType != proto.ExtentStoreMode {
+		pkg.PackErrorBody(ErrStoreTypeUnmatch)
+		return pkg.WriteToConn(c)
+	}
+	store := v.getExtentStore()
+	blockSize, opErr := store.GetBlockSize(pkg.FileID)
+	if opErr != nil {
+		pkg.PackErrorBody(opErr)
+		return pkg.WriteToConn(c)
+	}
+	needReplySize := int64(pkg.Size)
+	offset := pkg.Offset
+	for needReplySize > 0 {
+		currReadSize := util.Min(int(needReplySize), int(blockSize-offset%blockSize))
+		pkg.Data = make([]byte, currReadSize)
+		pkg.Offset = offset
+		pkg.Size = uint32(currReadSize)
+		if pkg.Crc, opErr = store.Read(pkg.FileID, offset, int64(currReadSize), pkg.Data); opErr != nil {
+			log.LogError(pkg.ActionMesg(proto.GetOpMesg(pkg.OrgOpcode), c.RemoteAddr().String(), pkg.StartT, opErr))
+			pkg.PackErrorBody(opErr)
+			return pkg.WriteToConn(c)
+		}
+		pkg.PackOkReadReply()
+		if err = pkg.WriteToConn(c); err != nil {
+			return
+		}
+		needReplySize -= int64(currReadSize)
+		offset += int64(currReadSize)
+	}
+
+	return
+}
+
+// Handle OpCRepairRead, one packet is replied for every object id asked, a
+// deleted object is replied with OpNotExistErr.
+func (n *DataNode) handleChunkRepairRead(pkg *Packet, v *Vol, c net.Conn) (err error) {
+	if pkg.StoreType != proto.TinyStoreMode {
+		pkg.PackErrorBody(ErrStoreTypeUnmatch)
+		return pkg.WriteToConn(c)
+	}
+	store := v.getTinyStore()
+	startOid := pkg.Offset
+	count := int64(pkg.Size)
+	for oid := startOid; oid < startOid+count; oid++ {
+		var (
+			o     *storage.Object
+			opErr error
+		)
+		pkg.Offset = oid
+		if o, opErr = store.GetObject(uint32(pkg.FileID), uint64(oid)); opErr == nil {
+			pkg.Data = make([]byte, o.Size)
+			pkg.Crc, opErr = store.Read(uint32(pkg.FileID), oid, int64(o.Size), pkg.Data)
+			pkg.Size = o.Size
+		}
+		if opErr == storage.ErrorObjectCorrupt {
+			v.addBadBlock(strconv.FormatUint(pkg.FileID, 10), uint64(oid))
+		}
+		if opErr != nil {
+			pkg.PackErrorBody(opErr)
+		} else {
+			pkg.PackOkReadReply()
+		}
+		if err = pkg.WriteToConn(c); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Handle OpNotifyRepair, the Arg carries the addresses of the other replicas
+// of the volume. The notification is acknowledged at once and the volume is
+// repaired in background, the one notified again while repaired is not
+// repaired twice.
+func (n *DataNode) handleNotifyRepair(pkg *Packet, v *Vol) (err error) {
+	if int(pkg.Arglen) > len(pkg.Arg) {
+		return ErrArgLenUnmatch
+	}
+	hosts := make([]string, 0)
+	for _, host := range strings.Split(string(pkg.Arg[:pkg.Arglen]), proto.AddrSplit) {
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		return ErrBadNodes
+	}
+	if atomic.CompareAndSwapInt32(&v.repairing, 0, 1) {
+		go n.doNotifiedRepair(v, hosts)
+	}
+	pkg.PackOkReply()
+
+	return
+}
+
+func (n *DataNode) doNotifiedRepair(v *Vol, hosts []string) {
+	defer atomic.StoreInt32(&v.repairing, 0)
+	if !v.enter() {
+		return
+	}
+	defer v.exit()
+	if err := n.repairVol(v, hosts, ""); err != nil {
+		log.LogError(fmt.Sprintf("action[doNotifiedRepair] vol[%v] hosts[%v] err[%v]", v.volId, hosts, err))
+	}
+}
+
+// Handle OpReplicateFile
+func (n *DataNode) replicateFile(task *proto.AdminTask) (resp *proto.ReplicateFileResponse) {
+	var err error
+	req := &proto.ReplicateFileRequest{}
+	resp = &proto.ReplicateFileResponse{}
+	defer func() {
+		resp.Status, resp.Result = setTaskStatus(task, err)
+		log.LogInfo(fmt.Sprintf("action[replicateFile] vol[%v] file[%v] hosts[%v] err[%v]",
+			req.VolId, req.Name, req.Hosts, err))
+	}()
+	if err = unmarshalTaskRequest(task, req); err != nil {
+		return
+	}
+	resp.VolId = req.VolId
+	resp.Name = req.Name
+	v := n.acquireVol(uint32(req.VolId))
+	if v == nil {
+		err = ErrVolNotExist
+		return
+	}
+	defer v.exit()
+	if err = n.repairVol(v, req.Hosts, req.Name); err != nil {
+		return
+	}
+	if v.storeType == proto.TinyStoreMode {
+		err = n.repairBadObjects(v, req.Hosts, req.Name)
+	}
+
+	return
+}
+
+// repairBadObjects fetches the corrupt objects of the chunk found by the
+// scrubber from the other replicas, and writes them in place.
+func (n *DataNode) repairBadObjects(v *Vol, hosts []string, name string) (err error) {
+	var chunkId uint64
+	oids := v.getBadBlocks(name)
+	if len(oids) == 0 {
+		return
+	}
+	if chunkId, err = strconv.ParseUint(name, 10, 32); err != nil {
+		return
+	}
+	for _, oid := range oids {
+		for _, host := range hosts {
+			if err = n.repairObject(v, host, chunkId, oid); err == nil {
+				break
+			}
+			log.LogWarn(fmt.Sprintf("action[repairBadObjects] vol[%v] chunk[%v] object[%v] from[%v] err[%v]",
+				v.volId, chunkId, oid, host, err))
+		}
+		if err != nil {
+			return
+		}
+	}
+	v.delBadFile(name)
+
+	return
+}
+
+func (n *DataNode) repairObject(v *Vol, host string, chunkId, oid uint64) (err error) {
+	var (
+		data []byte
+		crc  uint32
+	)
+	if data, crc, err = n.fetchObject(v, host, chunkId, oid); err != nil {
+		return
+	}
+
+	return v.getTinyStore().RepairObject(uint32(chunkId), oid, data, crc)
+}
+
+// fetchObject reads the object from the replica on host, the replica checks
+// the object with its crc before it replies.
+func (n *DataNode) fetchObject(v *Vol, host string, chunkId, oid uint64) (data []byte, crc uint32, err error) {
+	var conn net.Conn
+	if conn, err = n.connPool.Get(host); err != nil {
+		return
+	}
+	p := newRepairPacket(proto.OpCRepairRead, v, chunkId)
+	p.Offset = int64(oid)
+	p.Size = 1
+	if err = p.WriteToConn(conn); err != nil {
+		conn.Close()
+		return
+	}
+	reply := NewPacket()
+	if err = reply.ReadFromConn(conn, RepairReadDeadlineTime); err != nil {
+		conn.Close()
+		return
+	}
+	n.connPool.Put(conn)
+	if reply.Opcode != proto.OpOk {
+		return nil, 0, fmt.Errorf("read from[%v] err[%v]", host, string(reply.Data[:reply.Size]))
+	}
+	data = reply.Data[:reply.Size]
+	if crc32.ChecksumIEEE(data) != reply.Crc {
+		return nil, 0, ErrCrcUnmatch
+	}
+
+	return data, reply.Crc, nil
+}
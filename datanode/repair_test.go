@@ -0,0 +1,235 @@
+package datanode
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/storage"
+)
+
+func newRepairTestNodes(t *testing.T, srcBlockSize, dstBlockSize int) (src, dst *testDataNode, srcVol, dstVol *Vol) {
+	src, dst = newTestDataNode(t), newTestDataNode(t)
+	srcVol = src.createVol(t, proto.ExtentVol, 1, srcBlockSize)
+	dstVol = dst.createVol(t, proto.ExtentVol, 1, dstBlockSize)
+
+	return
+}
+
+// The extent missing is created with the block size of the source, the one
+// behind is completed from its unaligned size.
+func TestRepairExtent(t *testing.T) {
+	const blockSize = 4 * storage.MinBlockSize
+	src, dst, srcVol, dstVol := newRepairTestNodes(t, blockSize, storage.BlockSize)
+	defer src.stop()
+	defer dst.stop()
+	srcStore, dstStore := srcVol.getExtentStore(), dstVol.getExtentStore()
+	data := testData(5*blockSize + 100)
+	for extentId := uint64(1); extentId <= 2; extentId++ {
+		if err := srcStore.CreateWithId(extentId); err != nil {
+			t.Fatal(err)
+		}
+		writeTestExtent(t, srcStore, extentId, 0, data)
+	}
+	if err := dstStore.CreateWithBlockSize(2, blockSize); err != nil {
+		t.Fatal(err)
+	}
+	writeTestExtent(t, dstStore, 2, 0, data[:blockSize+10])
+
+	if err := dst.repairVol(dstVol, []string{src.addr}, ""); err != nil {
+		t.Fatal(err)
+	}
+	for extentId := uint64(1); extentId <= 2; extentId++ {
+		if !bytes.Equal(readTestExtent(t, dstStore, extentId), data) {
+			t.Fatalf("extent[%v] unmatch after repair", extentId)
+		}
+		if size, err := dstStore.GetBlockSize(extentId); err != nil || size != blockSize {
+			t.Fatalf("extent[%v] block size[%v] err[%v]", extentId, size, err)
+		}
+		srcIndex, _ := srcStore.GetBlockCrcIndex(extentId)
+		dstIndex, _ := dstStore.GetBlockCrcIndex(extentId)
+		if !bytes.Equal(srcIndex.Crcs, dstIndex.Crcs) {
+			t.Fatalf("extent[%v] block crcs unmatch after repair", extentId)
+		}
+	}
+}
+
+// The repair notified is acknowledged before it is done, the volume is
+// repaired in background.
+func TestNotifyRepair(t *testing.T) {
+	src, dst, srcVol, dstVol := newRepairTestNodes(t, storage.BlockSize, storage.BlockSize)
+	defer src.stop()
+	defer dst.stop()
+	srcStore, dstStore := srcVol.getExtentStore(), dstVol.getExtentStore()
+	data := testData(3*storage.BlockSize + 100)
+	if err := srcStore.CreateWithId(1); err != nil {
+		t.Fatal(err)
+	}
+	writeTestExtent(t, srcStore, 1, 0, data)
+
+	p := NewPacket()
+	p.Opcode = proto.OpNotifyRepair
+	p.StoreType = proto.ExtentStoreMode
+	p.VolID = 1
+	p.Arg = []byte(src.addr)
+	p.Arglen = uint32(len(p.Arg))
+	if reply := dst.send(t, p); reply.Opcode != proto.OpOk {
+		t.Fatalf("reply opcode[%v] data[%s]", reply.Opcode, reply.Data)
+	}
+	for i := 0; atomic.LoadInt32(&dstVol.repairing) != 0; i++ {
+		if i == 500 {
+			t.Fatal("repair not done")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !bytes.Equal(readTestExtent(t, dstStore, 1), data) {
+		t.Fatal("extent unmatch after repair")
+	}
+}
+
+// The replica of another block size is repaired too, the blocks of the source
+// are checked with the local data before the size repaired.
+func TestRepairExtentBlockSizeUnmatch(t *testing.T) {
+	src, dst, srcVol, dstVol := newRepairTestNodes(t, storage.BlockSize, 4*storage.MinBlockSize)
+	defer src.stop()
+	defer dst.stop()
+	srcStore, dstStore := srcVol.getExtentStore(), dstVol.getExtentStore()
+	data := testData(3*storage.BlockSize + 100)
+	if err := srcStore.CreateWithId(1); err != nil {
+		t.Fatal(err)
+	}
+	writeTestExtent(t, srcStore, 1, 0, data)
+	if err := dstStore.CreateWithId(1); err != nil {
+		t.Fatal(err)
+	}
+	writeTestExtent(t, dstStore, 1, 0, data[:storage.BlockSize+4*storage.MinBlockSize])
+
+	if err := dst.repairVol(dstVol, []string{src.addr}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readTestExtent(t, dstStore, 1), data) {
+		t.Fatal("extent unmatch after repair")
+	}
+}
+
+// The block of the source corrupt on the disk is not repaired to the replica.
+func TestRepairExtentSourceCorrupt(t *testing.T) {
+	src, dst, srcVol, dstVol := newRepairTestNodes(t, storage.BlockSize, storage.BlockSize)
+	defer src.stop()
+	defer dst.stop()
+	srcStore, dstStore := srcVol.getExtentStore(), dstVol.getExtentStore()
+	data := testData(3 * storage.BlockSize)
+	if err := srcStore.CreateWithId(1); err != nil {
+		t.Fatal(err)
+	}
+	writeTestExtent(t, srcStore, 1, 0, data)
+	fp, err := os.OpenFile(path.Join(srcVol.path, "1"), os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fp.WriteAt([]byte("corrupt"), storage.ExtentHeaderSize+storage.BlockSize+100)
+	fp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dst.repairVol(dstVol, []string{src.addr}, strconv.Itoa(1))
+	if errors.Cause(err) != ErrCrcUnmatch {
+		t.Fatalf("repair from corrupt source: %v", err)
+	}
+	if repaired := readTestExtent(t, dstStore, 1); len(repaired) > storage.BlockSize {
+		t.Fatalf("corrupt block repaired, size[%v]", len(repaired))
+	}
+}
+
+// The legacy v1 extent whose last partial block keeps the crc padded with
+// zeros is repaired, the extent failed to repair does not stop the others.
+func TestRepairExtentV1Source(t *testing.T) {
+	src, dst, srcVol, dstVol := newRepairTestNodes(t, storage.BlockSize, storage.BlockSize)
+	defer src.stop()
+	defer dst.stop()
+	srcStore, dstStore := srcVol.getExtentStore(), dstVol.getExtentStore()
+	corrupt := testData(2 * storage.BlockSize)
+	if err := srcStore.CreateWithId(1); err != nil {
+		t.Fatal(err)
+	}
+	writeTestExtent(t, srcStore, 1, 0, corrupt)
+	fp, err := os.OpenFile(path.Join(srcVol.path, "1"), os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fp.WriteAt([]byte("corrupt"), storage.ExtentHeaderSize+100)
+	fp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := testData(2*storage.BlockSize + 100)
+	writeTestV1Extent(t, srcVol, 2, data)
+
+	err = dst.repairVol(dstVol, []string{src.addr}, "")
+	if errors.Cause(err) != ErrCrcUnmatch {
+		t.Fatalf("repair with a corrupt source: %v", err)
+	}
+	if !bytes.Equal(readTestExtent(t, dstStore, 2), data) {
+		t.Fatal("v1 extent unmatch after repair")
+	}
+}
+
+// The extent deleted on the source is marked deleted on the replica and not
+// created there, the one deleted on the replica is left, and the one sealed on
+// the source is sealed after it is repaired.
+func TestRepairExtentDeletedSealed(t *testing.T) {
+	src, dst, srcVol, dstVol := newRepairTestNodes(t, storage.BlockSize, storage.BlockSize)
+	defer src.stop()
+	defer dst.stop()
+	srcStore, dstStore := srcVol.getExtentStore(), dstVol.getExtentStore()
+	data := testData(2*storage.BlockSize + 100)
+	for extentId := uint64(1); extentId <= 4; extentId++ {
+		if err := srcStore.CreateWithId(extentId); err != nil {
+			t.Fatal(err)
+		}
+		writeTestExtent(t, srcStore, extentId, 0, data)
+	}
+	for _, extentId := range []uint64{1, 4} {
+		if err := dstStore.CreateWithId(extentId); err != nil {
+			t.Fatal(err)
+		}
+		writeTestExtent(t, dstStore, extentId, 0, data[:100])
+	}
+	for _, extentId := range []uint64{1, 2} {
+		if err := srcStore.MarkDelete(extentId, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := srcStore.Seal(3, int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if err := dstStore.MarkDelete(4, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dst.repairVol(dstVol, []string{src.addr}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := dstStore.IsMarkDelete(1); err != nil || !deleted {
+		t.Fatalf("extent deleted on the source deleted[%v] err[%v]", deleted, err)
+	}
+	if _, err := dstStore.GetWatermark(2); err == nil {
+		t.Fatal("extent deleted on the source created")
+	}
+	if sealed, err := dstStore.IsSealed(3); err != nil || !sealed {
+		t.Fatalf("extent sealed on the source sealed[%v] err[%v]", sealed, err)
+	}
+	if !bytes.Equal(readTestExtent(t, dstStore, 3), data) {
+		t.Fatal("sealed extent unmatch after repair")
+	}
+	if size, err := dstStore.GetWatermark(4); err != nil || size != 100 {
+		t.Fatalf("extent deleted on the replica size[%v] err[%v]", size, err)
+	}
+}
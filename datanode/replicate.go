@@ -0,0 +1,178 @@
+package datanode
+
+import (
+	"fmt"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/storage"
+	"github.com/tiglabs/baudstorage/util/log"
+)
+
+// replicatePacket applies a modification packet on every replica of the
+// volume group. The packet is applied locally first, so nothing is forwarded
+// if the local replica fails, then it is forwarded to the next address of the
+// chain and the reply of the downstream is waited. An OpOk reply means every
+// replica after this node has persisted it, an error of the downstream is
+// replied OpIntraGroupNetErr with the failing hop, the replicas before it
+// have applied the packet. The head of the chain commits the extent range
+// written on every replica.
+func (n *DataNode) replicatePacket(pkg *Packet, v *Vol) (err error) {
+	if _, err = pkg.UnmarshalAddrs(); err != nil {
+		return
+	}
+	isHead := pkg.Nodes == pkg.goals
+	// The reply packed by operateLocal drops the opcode, the size and the
+	// addresses of the request, they are kept for the forwarding.
+	opcode, size, arglen := pkg.Opcode, pkg.Size, pkg.Arglen
+	commit := isHead && pkg.Opcode == proto.OpWrite && pkg.StoreType == proto.ExtentStoreMode
+	offset, end := pkg.Offset, pkg.Offset+int64(pkg.Size)
+
+	// The ids of a new object or extent are allocated by the head of the
+	// chain, the followers apply the packet with the same ids.
+	if pkg.isHeadTinyWrite() {
+		store := v.getTinyStore()
+		var chunkId int
+		if chunkId, err = allocObject(pkg, store); err != nil {
+			return
+		}
+		defer func() {
+			if err != nil {
+				store.PutUnAvailChunk(chunkId)
+			} else {
+				store.PutAvailChunk(chunkId)
+			}
+		}()
+	} else if isHead && pkg.Opcode == proto.OpSealFile && pkg.StoreType == proto.ExtentStoreMode {
+		// The extent is sealed at the commit length on every replica.
+		if pkg.Offset, err = v.getExtentStore().GetCommitLength(pkg.FileID); err != nil {
+			return
+		}
+	}
+
+	if err = n.operateLocal(pkg, v); err != nil {
+		return
+	}
+	if pkg.IsTransitPkg() {
+		pkg.Opcode, pkg.Size, pkg.Arglen = opcode, size, arglen
+		if err = n.forwardToNext(pkg); err != nil {
+			return
+		}
+		if err = n.receiveFromNext(pkg); err != nil {
+			return
+		}
+		pkg.PackOkReply()
+	}
+	if commit {
+		if e := v.getExtentStore().Commit(pkg.FileID, offset, end); e != nil {
+			log.LogError(fmt.Sprintf("action[replicatePacket] vol[%v] extent[%v] commit err[%v]", v.volId, pkg.FileID, e))
+		}
+	}
+
+	return
+}
+
+func (p *Packet) isHeadTinyWrite() bool {
+	return p.StoreType == proto.TinyStoreMode && p.Opcode == proto.OpWrite && p.FileID == 0
+}
+
+// allocObject takes an available chunk and allocates the object id for the
+// tiny write, the chunk is owned by the packet until it is put back.
+func allocObject(pkg *Packet, store *storage.TinyStore) (chunkId int, err error) {
+	var objectId uint64
+	if chunkId, err = store.GetAvailChunk(); err != nil {
+		return
+	}
+	if objectId, err = store.AllocObjectId(uint32(chunkId)); err != nil {
+		store.PutUnAvailChunk(chunkId)
+		return
+	}
+	pkg.FileID = uint64(chunkId)
+	pkg.Offset = int64(objectId)
+
+	return
+}
+
+// forwardToNext sends the packet to the next DataNode of the chain with one
+// less node left.
+func (n *DataNode) forwardToNext(pkg *Packet) (err error) {
+	if err = pkg.GetNextAddr(pkg.addrs); err != nil {
+		return
+	}
+	if pkg.nextAddr == "" {
+		return ErrAddrsNodesUnmatch
+	}
+	if pkg.nextConn, err = n.connPool.Get(pkg.nextAddr); err != nil {
+		pkg.nextConn = nil
+		return errors.Annotatef(ErrIntraGroupNet, "hop[%v] connect err[%v]", pkg.nextAddr, err)
+	}
+	pkg.Nodes--
+	err = pkg.WriteToConn(pkg.nextConn)
+	pkg.Nodes++
+	if err != nil {
+		pkg.nextConn.Close()
+		pkg.nextConn = nil
+		return errors.Annotatef(ErrIntraGroupNet, "hop[%v] write err[%v]", pkg.nextAddr, err)
+	}
+
+	return
+}
+
+// receiveFromNext waits the reply of the next DataNode of the chain.
+func (n *DataNode) receiveFromNext(pkg *Packet) (err error) {
+	reply := NewPacket()
+	if err = reply.ReadFromConn(pkg.nextConn, proto.ReadDeadlineTime); err != nil {
+		pkg.nextConn.Close()
+		return errors.Annotatef(ErrIntraGroupNet, "hop[%v] read err[%v]", pkg.nextAddr, err)
+	}
+	if reply.ReqID != pkg.ReqID || reply.VolID != pkg.VolID || reply.FileID != pkg.FileID {
+		pkg.nextConn.Close()
+		return errors.Annotatef(ErrIntraGroupNet, "hop[%v] unmatch reply[%v]", pkg.nextAddr, reply.GetUniqLogId())
+	}
+	n.connPool.Put(pkg.nextConn)
+	if reply.Opcode != proto.OpOk {
+		return errors.Annotatef(ErrIntraGroupNet, "hop[%v] op[%v] err[%v]", pkg.nextAddr,
+			proto.GetOpMesg(reply.Opcode), string(reply.Data[:reply.Size]))
+	}
+
+	return
+}
+
+// takeCommitLengths commits every extent of the new leader up to the least
+// size of it on the replicas, the data before is on every replica though the
+// old leader may not have committed it. The leadership is given up if a
+// follower can not be reached, it is taken again at the next heartbeat.
+func (n *DataNode) takeCommitLengths(v *Vol) {
+	store := v.getExtentStore()
+	extents, err := store.GetAllWatermark()
+	if err != nil {
+		log.LogError(fmt.Sprintf("action[takeCommitLengths] vol[%v] err[%v]", v.volId, err))
+		v.setLeader(false, nil)
+		return
+	}
+	lengths := make(map[uint64]int64, len(extents))
+	for _, ei := range extents {
+		lengths[ei.ExtentId] = ei.Size
+	}
+	for _, host := range v.getFollowers() {
+		watermarks, err := n.getRemoteWatermarks(v, host)
+		if err != nil {
+			log.LogError(fmt.Sprintf("action[takeCommitLengths] vol[%v] host[%v] err[%v]", v.volId, host, err))
+			v.setLeader(false, nil)
+			return
+		}
+		for extentId, length := range lengths {
+			if size := watermarks[extentId]; size < length {
+				lengths[extentId] = size
+			}
+		}
+	}
+	for extentId, length := range lengths {
+		if length == 0 {
+			continue
+		}
+		if err = store.Commit(extentId, 0, length); err != nil {
+			log.LogError(fmt.Sprintf("action[takeCommitLengths] vol[%v] extent[%v] commit err[%v]", v.volId, extentId, err))
+		}
+	}
+}
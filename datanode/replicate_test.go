@@ -0,0 +1,142 @@
+package datanode
+
+import (
+	"hash/crc32"
+	"strings"
+	"testing"
+
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/storage"
+)
+
+func newChainTestNodes(t *testing.T) (leader, follower *testDataNode) {
+	leader, follower = newTestDataNode(t), newTestDataNode(t)
+	for _, n := range []*testDataNode{leader, follower} {
+		v := n.createVol(t, proto.ExtentVol, 1, storage.BlockSize)
+		if err := v.getExtentStore().CreateWithId(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return
+}
+
+// newChainWritePacket writes the data to the head of the chain, the packet is
+// forwarded to the follower.
+func newChainWritePacket(follower string, offset int64, data []byte) (p *Packet) {
+	p = NewPacket()
+	p.Opcode = proto.OpWrite
+	p.StoreType = proto.ExtentStoreMode
+	p.VolID = 1
+	p.FileID = 1
+	p.Offset = offset
+	p.Data = data
+	p.Size = uint32(len(data))
+	p.Crc = crc32.ChecksumIEEE(data)
+	p.Arg = []byte(follower + proto.AddrSplit)
+	p.Arglen = uint32(len(p.Arg))
+	p.Nodes = 1
+
+	return
+}
+
+func newExtentReadPacket(offset int64, size int) (p *Packet) {
+	p = NewPacket()
+	p.Opcode = proto.OpRead
+	p.StoreType = proto.ExtentStoreMode
+	p.VolID = 1
+	p.FileID = 1
+	p.Offset = offset
+	p.Size = uint32(size)
+
+	return
+}
+
+// The head commits every write acked by the chain, the leader reads up to the
+// commit length and no further.
+func TestReplicateCommit(t *testing.T) {
+	leader, follower := newChainTestNodes(t)
+	defer leader.stop()
+	defer follower.stop()
+	v := leader.getVol(1)
+	v.setLeader(true, []string{follower.addr})
+	data := testData(3 * 4096)
+	for offset := 0; offset < len(data); offset += 4096 {
+		p := newChainWritePacket(follower.addr, int64(offset), data[offset:offset+4096])
+		p.ReqID = int64(offset)
+		if reply := leader.send(t, p); reply.Opcode != proto.OpOk {
+			t.Fatalf("write offset[%v] op[%v] err[%v]", offset, proto.GetOpMesg(reply.Opcode), string(reply.Data[:reply.Size]))
+		}
+	}
+	if length, err := v.getExtentStore().GetCommitLength(1); err != nil || length != int64(len(data)) {
+		t.Fatalf("commit length[%v] err[%v], expected[%v]", length, err, len(data))
+	}
+	if reply := leader.send(t, newExtentReadPacket(0, len(data))); reply.Opcode != proto.OpOk {
+		t.Fatalf("read committed op[%v]", proto.GetOpMesg(reply.Opcode))
+	}
+
+	// The write missing on the follower is not committed.
+	writeTestExtent(t, v.getExtentStore(), 1, int64(len(data)), data[:4096])
+	if reply := leader.send(t, newExtentReadPacket(0, len(data)+4096)); reply.Opcode != proto.OpAgain {
+		t.Fatalf("read past commit op[%v]", proto.GetOpMesg(reply.Opcode))
+	}
+	v.setLeader(false, nil)
+	if reply := leader.send(t, newExtentReadPacket(0, len(data)+4096)); reply.Opcode != proto.OpOk {
+		t.Fatalf("read of the follower op[%v]", proto.GetOpMesg(reply.Opcode))
+	}
+}
+
+// The new leader commits the data on every replica, the leadership is given
+// up while a follower can not be reached.
+func TestTakeCommitLengths(t *testing.T) {
+	leader, follower := newChainTestNodes(t)
+	defer leader.stop()
+	defer follower.stop()
+	v := leader.getVol(1)
+	data := testData(3000)
+	writeTestExtent(t, v.getExtentStore(), 1, 0, data)
+	writeTestExtent(t, follower.getVol(1).getExtentStore(), 1, 0, data[:2000])
+
+	v.setLeader(true, []string{"127.0.0.1:1"})
+	leader.takeCommitLengths(v)
+	if v.isLeader() {
+		t.Fatal("leader of an unreachable follower")
+	}
+	if length, _ := v.getExtentStore().GetCommitLength(1); length != 0 {
+		t.Fatalf("commit length[%v] without the follower", length)
+	}
+
+	v.setLeader(true, []string{follower.addr})
+	leader.takeCommitLengths(v)
+	if length, err := v.getExtentStore().GetCommitLength(1); err != nil || length != 2000 {
+		t.Fatalf("commit length[%v] err[%v], expected[2000]", length, err)
+	}
+}
+
+// The packet failed on the head is not forwarded, the packet failed on the
+// follower is replied with the failing hop after the head applied it.
+func TestReplicateLocalFirst(t *testing.T) {
+	leader, follower := newChainTestNodes(t)
+	defer leader.stop()
+	defer follower.stop()
+	data := testData(4096)
+	p := newChainWritePacket(follower.addr, 0, data)
+	p.FileID = 2
+	if reply := leader.send(t, p); reply.Opcode == proto.OpOk || reply.Opcode == proto.OpIntraGroupNetErr {
+		t.Fatalf("write of the extent missing on the head op[%v]", proto.GetOpMesg(reply.Opcode))
+	}
+
+	leader.getVol(1).getExtentStore().CreateWithId(2)
+	p = newChainWritePacket(follower.addr, 0, data)
+	p.FileID = 2
+	reply := leader.send(t, p)
+	if reply.Opcode != proto.OpIntraGroupNetErr || !strings.Contains(string(reply.Data[:reply.Size]), follower.addr) {
+		t.Fatalf("write of the extent missing on the follower op[%v] err[%v]", proto.GetOpMesg(reply.Opcode), string(reply.Data[:reply.Size]))
+	}
+	if size, err := leader.getVol(1).getExtentStore().GetWatermark(2); err != nil || size != int64(len(data)) {
+		t.Fatalf("extent on the head size[%v] err[%v]", size, err)
+	}
+	if length, _ := leader.getVol(1).getExtentStore().GetCommitLength(2); length != 0 {
+		t.Fatalf("commit length[%v] of the write failed on the follower", length)
+	}
+}
@@ -0,0 +1,184 @@
+package datanode
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/storage"
+	"github.com/tiglabs/baudstorage/util/log"
+)
+
+const (
+	ScrubInterval         = 24 * time.Hour
+	DefaultScrubBandwidth = 5 // MB/s
+)
+
+// badFile is a file found corrupt by the scrubber, the blocks are the corrupt
+// blocks of an extent or the corrupt objects of a chunk. It is kept until the
+// file is repaired or deleted.
+type badFile struct {
+	blocks []uint64
+}
+
+// scrubScheduler verifies every extent block and tiny object on this DataNode
+// with its crc once every ScrubInterval, the read is throttled by
+// scrubBandwidth. The corrupt files are reported to master by every heartbeat
+// until they are repaired.
+func (n *DataNode) scrubScheduler() {
+	ticker := time.NewTicker(ScrubInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stopC:
+			return
+		case <-ticker.C:
+		}
+		for _, v := range n.getAllVols() {
+			var err error
+			if !v.enter() {
+				continue
+			}
+			switch v.storeType {
+			case proto.ExtentStoreMode:
+				err = n.scrubExtents(v)
+			case proto.TinyStoreMode:
+				err = n.scrubChunks(v)
+			}
+			v.exit()
+			if err != nil {
+				log.LogError(fmt.Sprintf("action[scrubScheduler] vol[%v] err[%v]", v.volId, err))
+			}
+			if n.isStopped() {
+				return
+			}
+		}
+	}
+}
+
+func (n *DataNode) isStopped() bool {
+	select {
+	case <-n.stopC:
+		return true
+	default:
+		return false
+	}
+}
+
+func (n *DataNode) scrubExtents(v *Vol) (err error) {
+	var extents []*storage.ExtentInfo
+	store := v.getExtentStore()
+	if extents, err = store.GetAllWatermark(); err != nil {
+		return
+	}
+	for _, ei := range extents {
+		index, e := store.GetBlockCrcIndex(ei.ExtentId)
+		if e != nil || index.MarkDel {
+			continue
+		}
+		name := strconv.FormatUint(ei.ExtentId, 10)
+		blocks := (ei.Size + index.BlockSize - 1) / index.BlockSize
+		healthy := true
+		blockNo := int64(0)
+		for ; blockNo < blocks && !n.isStopped(); blockNo++ {
+			size, e := store.VerifyBlock(ei.ExtentId, blockNo)
+			if e == storage.ErrorCrcUnmatch {
+				healthy = false
+				v.addBadBlock(name, uint64(blockNo))
+				log.LogError(fmt.Sprintf("action[scrubExtents] vol[%v] extent[%v] block[%v] crc unmatch",
+					v.volId, ei.ExtentId, blockNo))
+			} else if e != nil {
+				break
+			}
+			throttle(int64(size), n.scrubBandwidth)
+		}
+		// The extent verified whole is reported no more, such as the one
+		// repaired, or a legacy v1 extent reported by the older scrubber.
+		if healthy && blockNo == blocks {
+			v.delBadFile(name)
+		}
+	}
+
+	return
+}
+
+func (n *DataNode) scrubChunks(v *Vol) (err error) {
+	store := v.getTinyStore()
+	for chunkId := 1; chunkId <= storage.ChunkCount; chunkId++ {
+		var oids []uint64
+		if oids, err = store.GetLiveObjects(uint32(chunkId)); err != nil {
+			return
+		}
+		name := strconv.Itoa(chunkId)
+		for _, oid := range oids {
+			if n.isStopped() {
+				return
+			}
+			size, e := store.VerifyObject(uint32(chunkId), oid)
+			if e == storage.ErrorCrcUnmatch {
+				v.addBadBlock(name, oid)
+				log.LogError(fmt.Sprintf("action[scrubChunks] vol[%v] chunk[%v] object[%v] crc unmatch",
+					v.volId, chunkId, oid))
+			}
+			throttle(int64(size), n.scrubBandwidth)
+		}
+	}
+
+	return
+}
+
+func (v *Vol) addBadBlock(name string, blockNo uint64) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	bf, ok := v.badFiles[name]
+	if !ok {
+		bf = &badFile{}
+		v.badFiles[name] = bf
+	}
+	for _, no := range bf.blocks {
+		if no == blockNo {
+			return
+		}
+	}
+	bf.blocks = append(bf.blocks, blockNo)
+}
+
+func (v *Vol) isBadFile(name string) (bad bool) {
+	v.lock.RLock()
+	_, bad = v.badFiles[name]
+	v.lock.RUnlock()
+
+	return
+}
+
+func (v *Vol) getBadBlocks(name string) (blocks []uint64) {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	if bf, ok := v.badFiles[name]; ok {
+		blocks = make([]uint64, len(bf.blocks))
+		copy(blocks, bf.blocks)
+	}
+
+	return
+}
+
+func (v *Vol) delBadFile(name string) {
+	v.lock.Lock()
+	delete(v.badFiles, name)
+	v.lock.Unlock()
+}
+
+// getBadFileReports returns the corrupt files not repaired yet, a heartbeat
+// lost does not lose them since they are reported again by the next one.
+func (v *Vol) getBadFileReports() (reports []*proto.BadFileReport) {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	for name, bf := range v.badFiles {
+		report := &proto.BadFileReport{VolID: uint64(v.volId), Name: name, Blocks: make([]uint64, len(bf.blocks))}
+		copy(report.Blocks, bf.blocks)
+		reports = append(reports, report)
+	}
+
+	return
+}
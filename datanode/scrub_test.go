@@ -0,0 +1,79 @@
+package datanode
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/storage"
+)
+
+// The extent corrupt on the disk is found by the scrubber and reported to
+// master as corrupt, with the crc of its data kept.
+func TestScrubExtentReportsCorrupt(t *testing.T) {
+	n := newTestDataNode(t)
+	defer n.stop()
+	v := n.createVol(t, proto.ExtentVol, 1, storage.BlockSize)
+	store := v.getExtentStore()
+	for extentId := uint64(1); extentId <= 2; extentId++ {
+		if err := store.CreateWithId(extentId); err != nil {
+			t.Fatal(err)
+		}
+		writeTestExtent(t, store, extentId, 0, testData(2*storage.BlockSize))
+	}
+	before, err := v.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp, err := os.OpenFile(path.Join(v.path, "2"), os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fp.WriteAt([]byte("corrupt"), storage.ExtentHeaderSize+storage.BlockSize)
+	fp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = n.scrubExtents(v); err != nil {
+		t.Fatal(err)
+	}
+	files, err := v.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range files {
+		if f.Corrupt != (f.Name == "2") || f.Crc != before[i].Crc {
+			t.Fatalf("file[%v] corrupt[%v] crc[%v], crc before[%v]", f.Name, f.Corrupt, f.Crc, before[i].Crc)
+		}
+	}
+	// The file is reported by every heartbeat until it is repaired.
+	for i := 0; i < 2; i++ {
+		reports := v.getBadFileReports()
+		if len(reports) != 1 || reports[0].Name != "2" || len(reports[0].Blocks) != 1 || reports[0].Blocks[0] != 1 {
+			t.Fatalf("bad file reports %+v", reports)
+		}
+	}
+	v.delBadFile("2")
+	if reports := v.getBadFileReports(); len(reports) != 0 {
+		t.Fatalf("bad file reports after repair %+v", reports)
+	}
+}
+
+// The legacy v1 extent whose last partial block keeps the crc padded with
+// zeros is healthy, the report of it by an older scrub is cleared.
+func TestScrubExtentV1PaddedCrc(t *testing.T) {
+	n := newTestDataNode(t)
+	defer n.stop()
+	v := n.createVol(t, proto.ExtentVol, 1, storage.BlockSize)
+	writeTestV1Extent(t, v, 1, testData(storage.BlockSize+100))
+	v.addBadBlock("1", 1)
+
+	if err := n.scrubExtents(v); err != nil {
+		t.Fatal(err)
+	}
+	if reports := v.getBadFileReports(); len(reports) != 0 {
+		t.Fatalf("bad file reports of the v1 extent %+v", reports)
+	}
+}
@@ -1,24 +1,349 @@
 package datanode
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/storage"
 	"github.com/tiglabs/baudstorage/util/config"
+	"github.com/tiglabs/baudstorage/util/log"
+	"github.com/tiglabs/baudstorage/util/pool"
+)
+
+// Configuration keys
+const (
+	cfgPort             = "port"
+	cfgLogDir           = "logDir"
+	cfgDisks            = "disks"
+	cfgMasterAddr       = "masterAddr"
+	cfgRack             = "rack"
+	cfgHttpPort         = "httpPort"
+	cfgCompactBandwidth = "compactBandwidth"    // MB/s
+	cfgExtentBlockSize  = "extentBlockSize"     // bytes, for the new extents
+	cfgScrubBandwidth   = "scrubBandwidth"      // MB/s
+	cfgDeleteGrace      = "deleteGracePeriod"   // seconds
+	cfgExtentCacheSize  = "extentCacheSize"     // open extents of a volume
+	cfgSyncMode         = "syncMode"            // async or groupCommit
+	cfgCommitInterval   = "groupCommitInterval" // ms
+	cfgCommitBytes      = "groupCommitBytes"    // bytes
+	cfgEcBandwidth      = "ecBandwidth"         // MB/s
+	cfgExtentIoMode     = "extentIoMode"        // the default of the extent vols, buffered, direct, dsync or direct,dsync
+	cfgTinyIoMode       = "tinyIoMode"          // the default of the chunk vols, buffered, direct, dsync or direct,dsync
 )
 
+const (
+	UpdateStoreInfoInterval = time.Minute
+)
+
+var (
+	ErrBadConfig   = errors.New("bad config file")
+	ErrVolNotExist = errors.New("vol not exist")
+)
+
+// State type definition
+type nodeState uint8
+
+// State constants
+const (
+	sReady nodeState = iota
+	sRunning
+)
+
+// The DataNode serves packets of clients and other DataNodes, every packet is
+// dispatched to the TinyStore or ExtentStore of the volume it belongs to.
 type DataNode struct {
+	port       string
+	logDir     string
+	masterAddr string
+	rackName   string
+	httpPort   string
+	disks      []*Disk
+
+	extentBlockSize  int
+	extentCacheSize  int
+	syncMode         storage.SyncMode
+	commitInterval   time.Duration
+	commitBytes      int64
+	extentIoMode     storage.IoMode
+	tinyIoMode       storage.IoMode
+	compactBandwidth int
+	compactStats     CompactStats
+	scrubBandwidth   int
+	ecBandwidth      int
+	deleteGrace      int64
+	throttle         throttler
+
+	vols       map[uint32]*Vol
+	creating   map[uint32]bool // the ids of the volumes being created
+	volLock    sync.RWMutex
+	listener   net.Listener
+	connPool   *pool.ConnPool
+	stopC      chan bool
+	state      nodeState
+	stateMutex sync.RWMutex
+	wg         sync.WaitGroup
 }
 
-func (n *DataNode) Start(cfg *config.Config) error {
-	panic("implement me")
+// Start this DataNode with specified configuration.
+//  1. Load every volume found under the configured disks.
+//  2. Start tcp server and accept connection from clients and DataNodes.
+func (n *DataNode) Start(cfg *config.Config) (err error) {
+	n.stateMutex.Lock()
+	defer n.stateMutex.Unlock()
+	if n.state != sReady {
+		return
+	}
+	if err = n.parseConfig(cfg); err != nil {
+		return
+	}
+	if _, err = log.NewLog(n.logDir, "DataNode", log.DebugLevel); err != nil {
+		return
+	}
+	if err = n.loadVols(); err != nil {
+		return
+	}
+	if err = n.startTcpService(); err != nil {
+		return
+	}
+	n.startHttpService()
+	go n.updateStoreInfo()
+	go n.compactScheduler()
+	go n.scrubScheduler()
+	go n.reclaimScheduler()
+	n.state = sRunning
+	n.wg.Add(1)
+
+	return
 }
 
+// Shutdown stop this DataNode.
 func (n *DataNode) Shutdown() {
-	panic("implement me")
+	n.stateMutex.Lock()
+	defer n.stateMutex.Unlock()
+	if n.state != sRunning {
+		return
+	}
+	close(n.stopC)
+	n.listener.Close()
+	n.syncAllVols()
+	n.state = sReady
+	n.wg.Done()
 }
 
+// Sync will block invoker goroutine until this DataNode shutdown.
 func (n *DataNode) Sync() {
-	panic("implement me")
+	n.wg.Wait()
+}
+
+func (n *DataNode) parseConfig(cfg *config.Config) (err error) {
+	if cfg == nil {
+		return ErrBadConfig
+	}
+	n.port = cfg.GetString(cfgPort)
+	n.logDir = cfg.GetString(cfgLogDir)
+	n.masterAddr = cfg.GetString(cfgMasterAddr)
+	n.rackName = cfg.GetString(cfgRack)
+	n.httpPort = cfg.GetString(cfgHttpPort)
+	n.compactBandwidth = DefaultCompactBandwidth
+	if bandwidth := cfg.GetFloat(cfgCompactBandwidth); bandwidth > 0 {
+		n.compactBandwidth = int(bandwidth)
+	}
+	n.scrubBandwidth = DefaultScrubBandwidth
+	if bandwidth := cfg.GetFloat(cfgScrubBandwidth); bandwidth > 0 {
+		n.scrubBandwidth = int(bandwidth)
+	}
+	n.ecBandwidth = DefaultEcBandwidth
+	if bandwidth := cfg.GetFloat(cfgEcBandwidth); bandwidth > 0 {
+		n.ecBandwidth = int(bandwidth)
+	}
+	n.deleteGrace = DefaultDeleteGracePeriod
+	if grace := cfg.GetFloat(cfgDeleteGrace); grace > 0 {
+		n.deleteGrace = int64(grace)
+	}
+	n.extentBlockSize = storage.BlockSize
+	if blockSize := cfg.GetFloat(cfgExtentBlockSize); blockSize > 0 {
+		n.extentBlockSize = int(blockSize)
+	}
+	n.extentCacheSize = storage.DefaultExtentCacheCapacity
+	if cacheSize := cfg.GetFloat(cfgExtentCacheSize); cacheSize > 0 {
+		n.extentCacheSize = int(cacheSize)
+	}
+	if cfg.GetString(cfgSyncMode) == storage.SyncModeGroupCommit.String() {
+		n.syncMode = storage.SyncModeGroupCommit
+	}
+	n.commitInterval = storage.DefaultGroupCommitInterval
+	if interval := cfg.GetFloat(cfgCommitInterval); interval > 0 {
+		n.commitInterval = time.Duration(interval * float64(time.Millisecond))
+	}
+	n.commitBytes = storage.DefaultGroupCommitBytes
+	if commitBytes := cfg.GetFloat(cfgCommitBytes); commitBytes > 0 {
+		n.commitBytes = int64(commitBytes)
+	}
+	if n.extentIoMode, err = storage.ParseIoMode(cfg.GetString(cfgExtentIoMode)); err != nil {
+		return fmt.Errorf("%v,%v", ErrBadConfig, err)
+	}
+	if n.tinyIoMode, err = storage.ParseIoMode(cfg.GetString(cfgTinyIoMode)); err != nil {
+		return fmt.Errorf("%v,%v", ErrBadConfig, err)
+	}
+	for _, d := range cfg.GetArray(cfgDisks) {
+		if path, ok := d.(string); ok && path != "" {
+			n.disks = append(n.disks, NewDisk(path))
+		}
+	}
+	if n.port == "" || n.logDir == "" || len(n.disks) == 0 {
+		return fmt.Errorf("%v,port[%v] logDir[%v] disks[%v]", ErrBadConfig,
+			n.port, n.logDir, cfg.GetArray(cfgDisks))
+	}
+
+	return
+}
+
+func (n *DataNode) startTcpService() (err error) {
+	log.LogInfo("Start: startTcpService")
+	if n.listener, err = net.Listen("tcp", ":"+n.port); err != nil {
+		log.LogError("failed to listen, err:", err)
+		return
+	}
+	n.stopC = make(chan bool)
+	go func(ln net.Listener, stopC chan bool) {
+		for {
+			conn, err := ln.Accept()
+			select {
+			case <-stopC:
+				return
+			default:
+			}
+			if err != nil {
+				log.LogError("failed to accept, err:", err)
+				continue
+			}
+			go n.serveConn(conn, stopC)
+		}
+	}(n.listener, n.stopC)
+
+	return
+}
+
+// serveConn reads packets from the connection and replies each of them in
+// order until the connection is closed by remote or the DataNode shutdown.
+func (n *DataNode) serveConn(conn net.Conn, stopC chan bool) {
+	c, _ := conn.(*net.TCPConn)
+	c.SetKeepAlive(true)
+	c.SetNoDelay(true)
+	defer c.Close()
+
+	for {
+		select {
+		case <-stopC:
+			return
+		default:
+		}
+		pkg := NewPacket()
+		if err := pkg.ReadFromConn(c, proto.NoReadDeadlineTime); err != nil {
+			connTag := fmt.Sprintf("connection[%v <----> %v] ", c.LocalAddr(), c.RemoteAddr())
+			if err == io.EOF {
+				err = fmt.Errorf("%v was closed by peer", connTag)
+			}
+			log.LogInfo(err.Error())
+			return
+		}
+		if err := n.operatePacket(pkg, c); err != nil {
+			log.LogError(fmt.Sprintf("reply to connection[%v] err[%v]", c.RemoteAddr(), err))
+			return
+		}
+	}
+}
+
+func (n *DataNode) getVol(volId uint32) (v *Vol) {
+	n.volLock.RLock()
+	v = n.vols[volId]
+	n.volLock.RUnlock()
+
+	return
+}
+
+// acquireVol returns the volume with an operation entered on it, the caller
+// exits the volume when done. It returns nil if the volume does not exist or
+// is deleted.
+func (n *DataNode) acquireVol(volId uint32) (v *Vol) {
+	if v = n.getVol(volId); v != nil && !v.enter() {
+		v = nil
+	}
+
+	return
+}
+
+// reserveVol reserves the id of the volume to be created, it fails with the
+// volume found if it exists, or with nil if it is being created by another.
+// The reservation is released by putVol or releaseVol.
+func (n *DataNode) reserveVol(volId uint32) (v *Vol, ok bool) {
+	n.volLock.Lock()
+	defer n.volLock.Unlock()
+	if v = n.vols[volId]; v != nil || n.creating[volId] {
+		return v, false
+	}
+	n.creating[volId] = true
+
+	return nil, true
+}
+
+func (n *DataNode) releaseVol(volId uint32) {
+	n.volLock.Lock()
+	delete(n.creating, volId)
+	n.volLock.Unlock()
+}
+
+func (n *DataNode) putVol(v *Vol) {
+	n.volLock.Lock()
+	n.vols[v.volId] = v
+	delete(n.creating, v.volId)
+	n.volLock.Unlock()
+}
+
+func (n *DataNode) delVol(volId uint32) {
+	n.volLock.Lock()
+	delete(n.vols, volId)
+	n.volLock.Unlock()
+}
+
+func (n *DataNode) getAllVols() (vols []*Vol) {
+	n.volLock.RLock()
+	defer n.volLock.RUnlock()
+	vols = make([]*Vol, 0, len(n.vols))
+	for _, v := range n.vols {
+		vols = append(vols, v)
+	}
+
+	return
+}
+
+func (n *DataNode) syncAllVols() {
+	for _, v := range n.getAllVols() {
+		v.syncAll()
+	}
+}
+
+func (n *DataNode) updateStoreInfo() {
+	ticker := time.NewTicker(UpdateStoreInfoInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stopC:
+			return
+		case <-ticker.C:
+			n.checkDisks()
+			for _, v := range n.getAllVols() {
+				v.updateStoreInfo()
+			}
+		}
+	}
 }
 
 func NewServer() *DataNode {
-	return &DataNode{}
+	return &DataNode{vols: make(map[uint32]*Vol), creating: make(map[uint32]bool), connPool: pool.NewConnPool()}
 }
@@ -0,0 +1,107 @@
+package datanode
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/storage"
+	"github.com/tiglabs/baudstorage/util/log"
+)
+
+// The snapshot of a volume is the snapshot stream of its store labeled with
+// the name of the volume directory, so the import rebuilds the volume with
+// the same type, id and size on another DataNode. The volume refuses the
+// writes while the files of its snapshot are copied, and is reported readonly
+// to master.
+
+// exportSnapshot writes the snapshot of the volume to w.
+func (v *Vol) exportSnapshot(w io.Writer) (err error) {
+	label := volDirName(v.volType, v.volId, v.volSize)
+	switch v.storeType {
+	case proto.ExtentStoreMode:
+		err = v.getExtentStore().Snapshot(w, label)
+	case proto.TinyStoreMode:
+		err = v.getTinyStore().Snapshot(w, label)
+	}
+
+	return
+}
+
+func (v *Vol) isFrozen() bool {
+	switch v.storeType {
+	case proto.ExtentStoreMode:
+		return v.getExtentStore().IsFrozen()
+	case proto.TinyStoreMode:
+		return v.getTinyStore().IsFrozen()
+	}
+
+	return false
+}
+
+// verify checks the data of the volume with the crcs the store keeps.
+func (v *Vol) verify() (err error) {
+	switch v.storeType {
+	case proto.ExtentStoreMode:
+		err = v.getExtentStore().Verify()
+	case proto.TinyStoreMode:
+		err = v.getTinyStore().Verify()
+	}
+
+	return
+}
+
+// importSnapshot builds the volume of the snapshot read from r on the disk
+// with the most space left, the volume is verified before it is served and
+// deleted with its directory if it is bad.
+func (n *DataNode) importSnapshot(r io.Reader) (v *Vol, err error) {
+	var (
+		h       *storage.SnapshotHeader
+		disk    *Disk
+		volType string
+		volId   uint32
+		volSize int
+		volPath string
+	)
+	defer func() {
+		log.LogInfo(fmt.Sprintf("action[importSnapshot] vol[%v] path[%v] err[%v]", volId, volPath, err))
+	}()
+	if h, err = storage.ReadSnapshotHeader(r); err != nil {
+		return
+	}
+	if volType, volId, volSize, err = parseVolDirName(h.Label); err != nil {
+		return
+	}
+	if (volType == proto.ChunkVol) != (h.StoreType == storage.SnapshotTinyStore) {
+		return nil, ErrStoreTypeUnmatch
+	}
+	if _, ok := n.reserveVol(volId); !ok {
+		return nil, fmt.Errorf("vol[%v] exist", volId)
+	}
+	defer func() {
+		if err != nil {
+			n.releaseVol(volId)
+		}
+	}()
+	if disk, err = n.chooseDisk(volSize); err != nil {
+		return
+	}
+	volPath = path.Join(disk.Path, h.Label)
+	if err = storage.ImportSnapshot(r, h, volPath); err != nil {
+		return
+	}
+	if v, err = NewVol(disk, volType, volId, volSize, n.extentBlockSize, n.extentCacheSize, n.defaultIoMode(volType), storage.ReBootStoreMode); err != nil {
+		os.RemoveAll(volPath)
+		return
+	}
+	if err = v.verify(); err != nil {
+		v.delete()
+		return nil, err
+	}
+	v.setSyncMode(n.syncMode, n.commitInterval, n.commitBytes)
+	n.putVol(v)
+
+	return
+}
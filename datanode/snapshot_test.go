@@ -0,0 +1,107 @@
+package datanode
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/storage"
+)
+
+// The volume imported from the snapshot of another DataNode keeps the data,
+// the snapshot corrupt is refused and leaves nothing on the disk.
+func TestSnapshotImport(t *testing.T) {
+	src, dst := newTestDataNode(t), newTestDataNode(t)
+	defer src.stop()
+	defer dst.stop()
+	dst.disks = []*Disk{dst.disk}
+	v := src.createVol(t, proto.ExtentVol, 1, storage.BlockSize)
+	data := testData(storage.BlockSize + 100)
+	for extentId := uint64(1); extentId <= 2; extentId++ {
+		if err := v.getExtentStore().CreateWithId(extentId); err != nil {
+			t.Fatal(err)
+		}
+		writeTestExtent(t, v.getExtentStore(), extentId, 0, data[:int(extentId)*1000])
+	}
+	snapshot := new(bytes.Buffer)
+	if err := v.exportSnapshot(snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt := append([]byte(nil), snapshot.Bytes()...)
+	corrupt[len(corrupt)-10] ^= 0xff
+	if _, err := dst.importSnapshot(bytes.NewReader(corrupt)); err == nil {
+		t.Fatal("corrupt snapshot imported")
+	}
+	if finfos, _ := ioutil.ReadDir(dst.disk.Path); len(finfos) != 0 || dst.getVol(1) != nil {
+		t.Fatalf("corrupt snapshot left %v", finfos)
+	}
+
+	imported, err := dst.importSnapshot(bytes.NewReader(snapshot.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.volType != v.volType || imported.volSize != v.volSize || dst.getVol(1) != imported {
+		t.Fatalf("imported vol type[%v] size[%v]", imported.volType, imported.volSize)
+	}
+	for extentId := uint64(1); extentId <= 2; extentId++ {
+		if got := readTestExtent(t, imported.getExtentStore(), extentId); !bytes.Equal(got, data[:int(extentId)*1000]) {
+			t.Fatalf("extent[%v] data unmatch", extentId)
+		}
+	}
+	if _, err = dst.importSnapshot(bytes.NewReader(snapshot.Bytes())); err == nil {
+		t.Fatal("snapshot of an existing vol imported")
+	}
+}
+
+// stalledWriter blocks the writes of the snapshot stream until it is
+// released.
+type stalledWriter struct {
+	stalled chan struct{}
+	release chan struct{}
+}
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	select {
+	case w.stalled <- struct{}{}:
+	default:
+	}
+	<-w.release
+	return len(p), nil
+}
+
+// The volume takes the writes while its snapshot is streamed to a stalled
+// reader, only one snapshot is taken at a time.
+func TestSnapshotStalledReader(t *testing.T) {
+	n := newTestDataNode(t)
+	defer n.stop()
+	v := n.createVol(t, proto.ExtentVol, 1, storage.BlockSize)
+	store := v.getExtentStore()
+	if err := store.CreateWithId(1); err != nil {
+		t.Fatal(err)
+	}
+	data := testData(1000)
+	writeTestExtent(t, store, 1, 0, data)
+
+	w := &stalledWriter{stalled: make(chan struct{}, 1), release: make(chan struct{})}
+	exported := make(chan error, 1)
+	go func() {
+		exported <- v.exportSnapshot(w)
+	}()
+	<-w.stalled
+	if v.isFrozen() {
+		t.Fatal("vol frozen while the snapshot is streamed")
+	}
+	writeTestExtent(t, store, 1, int64(len(data)), data)
+	if err := v.exportSnapshot(new(bytes.Buffer)); err != storage.ErrorSnapshotBusy {
+		t.Fatalf("second snapshot err[%v]", err)
+	}
+	close(w.release)
+	if err := <-exported; err != nil {
+		t.Fatal(err)
+	}
+	if finfos, _ := ioutil.ReadDir(n.disk.Path); len(finfos) != 1 {
+		t.Fatalf("snapshot left %v", finfos)
+	}
+}
@@ -0,0 +1,194 @@
+package datanode
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/util"
+	"github.com/tiglabs/baudstorage/util/log"
+)
+
+// The reads and the writes of the clients are throttled by the limits master
+// sets, see proto.ThrottleLimits. A request takes the tokens of its vol, of
+// the namespace of the vol and of its client, and is replied OpAgain if any
+// of them is used up, the client backs off and sends it again. No token is
+// taken by the request refused. The writes are throttled at the head of the
+// chain only, the followers always apply the writes forwarded, and the
+// requests of the other DataNodes, such as the reads of the ec repair, are
+// not throttled.
+
+var (
+	ErrThrottled = errors.New("throttled")
+)
+
+type ioLimiter struct {
+	iops      *util.TokenBucket
+	bandwidth *util.TokenBucket
+}
+
+func newIoLimiter(limit *proto.ThrottleLimit) (l *ioLimiter) {
+	if limit == nil || (limit.Iops <= 0 && limit.Bandwidth <= 0) {
+		return nil
+	}
+	l = new(ioLimiter)
+	if limit.Iops > 0 {
+		l.iops = util.NewTokenBucket(limit.Iops)
+	}
+	if limit.Bandwidth > 0 {
+		l.bandwidth = util.NewTokenBucket(limit.Bandwidth)
+	}
+
+	return
+}
+
+func (l *ioLimiter) ready() bool {
+	if l == nil {
+		return true
+	}
+
+	return (l.iops == nil || l.iops.Ready()) && (l.bandwidth == nil || l.bandwidth.Ready())
+}
+
+func (l *ioLimiter) take(size int64) {
+	if l == nil {
+		return
+	}
+	if l.iops != nil {
+		l.iops.Take(1)
+	}
+	if l.bandwidth != nil {
+		l.bandwidth.Take(size)
+	}
+}
+
+type throttler struct {
+	limits        *proto.ThrottleLimits
+	vols          map[uint32]*ioLimiter
+	namespaces    map[string]*ioLimiter
+	clients       map[string]*ioLimiter
+	defaultClient *proto.ThrottleLimit
+	peers         map[string]bool
+	sync.RWMutex
+}
+
+// setLimits replaces the limits, the token buckets are kept if the limits
+// are not changed, as they are sent with every heartbeat.
+func (t *throttler) setLimits(limits *proto.ThrottleLimits) {
+	t.Lock()
+	defer t.Unlock()
+	if reflect.DeepEqual(t.limits, limits) {
+		return
+	}
+	t.limits = limits
+	t.vols = make(map[uint32]*ioLimiter)
+	t.namespaces = make(map[string]*ioLimiter)
+	t.clients = make(map[string]*ioLimiter)
+	t.defaultClient = limits.DefaultClient
+	t.peers = make(map[string]bool, len(limits.DataNodes))
+	for _, ip := range limits.DataNodes {
+		t.peers[ip] = true
+	}
+	for volId, limit := range limits.Vols {
+		if l := newIoLimiter(limit); l != nil {
+			t.vols[uint32(volId)] = l
+		}
+	}
+	for name, limit := range limits.Namespaces {
+		if l := newIoLimiter(limit); l != nil {
+			t.namespaces[name] = l
+		}
+	}
+	for client, limit := range limits.Clients {
+		if l := newIoLimiter(limit); l != nil {
+			t.clients[client] = l
+		}
+	}
+	log.LogInfo(fmt.Sprintf("action[setLimits] vols[%v] namespaces[%v] clients[%v] default client[%v]",
+		len(t.vols), len(t.namespaces), len(t.clients), t.defaultClient))
+}
+
+// clientLimiter returns the limiter of the client, the limiter of the default
+// limit is created on the first request of the client.
+func (t *throttler) clientLimiter(client string) (l *ioLimiter) {
+	t.RLock()
+	l, ok := t.clients[client]
+	defaultClient := t.defaultClient
+	t.RUnlock()
+	if ok || defaultClient == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	if l, ok = t.clients[client]; !ok && t.clients != nil {
+		l = newIoLimiter(t.defaultClient)
+		t.clients[client] = l
+	}
+
+	return
+}
+
+// allow takes the tokens of the request if every limiter of it is ready.
+func (t *throttler) allow(volId uint32, client string, size int64) bool {
+	t.RLock()
+	if t.limits == nil || t.peers[client] {
+		t.RUnlock()
+		return true
+	}
+	limiters := []*ioLimiter{t.vols[volId], t.namespaces[t.limits.NamespaceVols[uint64(volId)]]}
+	t.RUnlock()
+	limiters = append(limiters, t.clientLimiter(client))
+	for _, l := range limiters {
+		if !l.ready() {
+			return false
+		}
+	}
+	for _, l := range limiters {
+		l.take(size)
+	}
+
+	return true
+}
+
+// throttled reports whether the read or the write of the client is over the
+// limits, the packets forwarded by the chain are not throttled.
+func (n *DataNode) throttled(pkg *Packet, remote string) bool {
+	switch pkg.Opcode {
+	case proto.OpRead, proto.OpStreamRead:
+	case proto.OpWrite:
+		if _, err := pkg.UnmarshalAddrs(); err != nil || pkg.Nodes != pkg.goals {
+			return false
+		}
+	default:
+		return false
+	}
+	client, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		client = remote
+	}
+
+	return !n.throttle.allow(pkg.VolID, client, int64(pkg.Size))
+}
+
+// Handle OpSetThrottle
+func (n *DataNode) setThrottle(task *proto.AdminTask) (resp *proto.SetThrottleResponse) {
+	var err error
+	req := &proto.SetThrottleRequest{}
+	resp = &proto.SetThrottleResponse{}
+	defer func() {
+		resp.Status, resp.Result = setTaskStatus(task, err)
+	}()
+	if err = unmarshalTaskRequest(task, req); err != nil {
+		return
+	}
+	if req.Limits == nil {
+		err = fmt.Errorf("no limits")
+		return
+	}
+	n.throttle.setLimits(req.Limits)
+
+	return
+}
@@ -0,0 +1,62 @@
+package datanode
+
+import (
+	"testing"
+
+	"github.com/tiglabs/baudstorage/proto"
+)
+
+func newTestThrottler(limits *proto.ThrottleLimits) (t *throttler) {
+	t = new(throttler)
+	t.setLimits(limits)
+
+	return
+}
+
+// The request refused by any limiter takes no token of the others.
+func TestThrottleAllowAll(t *testing.T) {
+	th := newTestThrottler(&proto.ThrottleLimits{
+		Vols:    map[uint64]*proto.ThrottleLimit{1: {Bandwidth: 3000}},
+		Clients: map[string]*proto.ThrottleLimit{"a": {Bandwidth: 1000}},
+	})
+	if !th.allow(1, "a", 1500) {
+		t.Fatal("first request of a refused")
+	}
+	for i := 0; i < 3; i++ {
+		if th.allow(1, "a", 1500) {
+			t.Fatal("request of a over its limit allowed")
+		}
+	}
+	if !th.allow(1, "b", 1500) {
+		t.Fatal("request of b refused by the tokens of the requests of a refused")
+	}
+}
+
+// The requests of the DataNodes and the writes forwarded by the chain are not
+// throttled.
+func TestThrottlePeers(t *testing.T) {
+	n := newTestDataNode(t)
+	defer n.stop()
+	n.throttle.setLimits(&proto.ThrottleLimits{
+		Vols:      map[uint64]*proto.ThrottleLimit{1: {Bandwidth: 100}},
+		DataNodes: []string{"10.0.0.2"},
+	})
+	read := newExtentReadPacket(0, 200)
+	if n.throttled(read, "10.0.0.1:1000") {
+		t.Fatal("first read throttled")
+	}
+	if !n.throttled(read, "10.0.0.1:1000") {
+		t.Fatal("read over the vol limit not throttled")
+	}
+	if n.throttled(read, "10.0.0.2:1000") {
+		t.Fatal("read of a DataNode throttled")
+	}
+	forwarded := newChainWritePacket("10.0.0.3:6000", 0, testData(100))
+	forwarded.Nodes = 0
+	if n.throttled(forwarded, "10.0.0.1:1000") {
+		t.Fatal("write forwarded throttled")
+	}
+	if !n.throttled(newChainWritePacket("10.0.0.3:6000", 0, testData(100)), "10.0.0.1:1000") {
+		t.Fatal("write to the head over the vol limit not throttled")
+	}
+}
@@ -0,0 +1,511 @@
+package datanode
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/storage"
+	"github.com/tiglabs/baudstorage/util/log"
+)
+
+const (
+	VolNameSegs = 3 // {volType}_{volId}_{volSize}
+
+	// The io mode of a volume is kept in this file of the volume directory,
+	// the volume without it takes the io mode of the node for its type.
+	volIoModeFile = ".iomode"
+)
+
+// Vol is a replica of a volume group on this DataNode, it owns either a
+// TinyStore (chunk volume) or an ExtentStore (extent volume, or a shard of
+// an erasure coded volume).
+type Vol struct {
+	volId     uint32
+	volType   string
+	volSize   int
+	disk      *Disk
+	path      string
+	storeType uint8
+	store     interface{}
+	ioMode    storage.IoMode
+	leader    bool
+	followers []string
+	badFiles  map[string]*badFile
+	sealed    bool
+	volStatus int32 // the status cached for the write path, see refreshStatus
+	lock      sync.RWMutex
+	opLock    sync.RWMutex // held by the operations in flight, see enter
+	deleted   bool
+	repairing int32 // set while the repair notified runs, see handleNotifyRepair
+}
+
+func volDirName(volType string, volId uint32, volSize int) string {
+	return strings.Join([]string{volType, strconv.Itoa(int(volId)), strconv.Itoa(volSize)}, proto.VolNameSplit)
+}
+
+func parseVolDirName(name string) (volType string, volId uint32, volSize int, err error) {
+	segs := strings.Split(name, proto.VolNameSplit)
+	if len(segs) != VolNameSegs {
+		err = fmt.Errorf("error vol name[%v]", name)
+		return
+	}
+	volType = segs[0]
+	if volType != proto.ExtentVol && volType != proto.ChunkVol && volType != proto.EcVol {
+		err = fmt.Errorf("error vol type[%v]", name)
+		return
+	}
+	id, err := strconv.ParseUint(segs[1], 10, 32)
+	if err != nil {
+		return
+	}
+	volId = uint32(id)
+	volSize, err = strconv.Atoi(segs[2])
+
+	return
+}
+
+// NewVol opens the store of the volume, extentBlockSize is the block size of
+// the new extents and extentCacheSize is the number of open extents of an
+// extent volume. The io mode of the store is set before the store opens any
+// file for the volume, it is ioMode for the new volume and the one recorded
+// for the volume loaded, or ioMode if none is recorded.
+func NewVol(disk *Disk, volType string, volId uint32, volSize, extentBlockSize, extentCacheSize int, ioMode storage.IoMode, newMode bool) (v *Vol, err error) {
+	v = &Vol{volId: volId, volType: volType, volSize: volSize, disk: disk, badFiles: make(map[string]*badFile)}
+	v.path = path.Join(disk.Path, volDirName(volType, volId, volSize))
+	switch volType {
+	case proto.ExtentVol, proto.EcVol:
+		v.storeType = proto.ExtentStoreMode
+		v.store, err = storage.NewExtentStore(v.path, extentBlockSize, extentCacheSize, newMode)
+	case proto.ChunkVol:
+		v.storeType = proto.TinyStoreMode
+		v.store, err = storage.NewTinyStore(v.path, volSize, newMode)
+	default:
+		err = fmt.Errorf("error vol type[%v]", volType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if newMode {
+		err = ioutil.WriteFile(path.Join(v.path, volIoModeFile), []byte(ioMode.String()), 0666)
+	} else {
+		ioMode = loadVolIoMode(v.path, ioMode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if e := v.setIoMode(ioMode); e != nil {
+		log.LogError(fmt.Sprintf("action[NewVol] vol[%v] set io mode[%v] err[%v]", v.path, ioMode, e))
+	}
+	if v.storeType == proto.TinyStoreMode {
+		for _, report := range v.getTinyStore().GetRecoveryReports() {
+			log.LogWarn(fmt.Sprintf("action[NewVol] vol[%v] recovered %v", v.path, report))
+		}
+	}
+	v.updateStoreInfo()
+
+	return
+}
+
+// loadVolIoMode reads the io mode recorded in the volume directory, the
+// volume without a valid one takes defaultMode.
+func loadVolIoMode(volPath string, defaultMode storage.IoMode) storage.IoMode {
+	data, err := ioutil.ReadFile(path.Join(volPath, volIoModeFile))
+	if os.IsNotExist(err) {
+		return defaultMode
+	}
+	mode, e := storage.ParseIoMode(string(data))
+	if err == nil {
+		err = e
+	}
+	if err != nil {
+		log.LogError(fmt.Sprintf("action[loadVolIoMode] vol[%v] err[%v]", volPath, err))
+		return defaultMode
+	}
+
+	return mode
+}
+
+// defaultIoMode is the io mode of the node for the volume of volType.
+func (n *DataNode) defaultIoMode(volType string) storage.IoMode {
+	if volType == proto.ChunkVol {
+		return n.tinyIoMode
+	}
+
+	return n.extentIoMode
+}
+
+// loadVols opens every volume directory found under the configured disks.
+func (n *DataNode) loadVols() (err error) {
+	for _, disk := range n.disks {
+		var finfos []os.FileInfo
+		if finfos, err = ioutil.ReadDir(disk.Path); err != nil {
+			return fmt.Errorf("loadVols disk[%v] err[%v]", disk.Path, err)
+		}
+		for _, finfo := range finfos {
+			if !finfo.IsDir() {
+				continue
+			}
+			volType, volId, volSize, e := parseVolDirName(finfo.Name())
+			if e != nil {
+				continue
+			}
+			v, e := NewVol(disk, volType, volId, volSize, n.extentBlockSize, n.extentCacheSize, n.defaultIoMode(volType), storage.ReBootStoreMode)
+			if e != nil {
+				log.LogError(fmt.Sprintf("loadVols disk[%v] vol[%v] err[%v]", disk.Path, finfo.Name(), e))
+				continue
+			}
+			v.setSyncMode(n.syncMode, n.commitInterval, n.commitBytes)
+			n.putVol(v)
+			log.LogInfo(fmt.Sprintf("loadVols disk[%v] vol[%v] success", disk.Path, finfo.Name()))
+		}
+	}
+
+	return nil
+}
+
+// setLeader records the leadership of this replica in the view of master,
+// the leader heads the replication chain of the followers. It reports whether
+// the replica becomes the leader.
+func (v *Vol) setLeader(leader bool, followers []string) (elected bool) {
+	v.lock.Lock()
+	elected = leader && !v.leader
+	v.leader = leader
+	v.followers = followers
+	v.lock.Unlock()
+
+	return
+}
+
+func (v *Vol) isLeader() bool {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	return v.leader
+}
+
+func (v *Vol) getFollowers() (followers []string) {
+	v.lock.RLock()
+	followers = make([]string, len(v.followers))
+	copy(followers, v.followers)
+	v.lock.RUnlock()
+
+	return
+}
+
+// checkCommitted refuses the read past the commit length of the extent on the
+// leader in the view of master, the data after it may be missing on some
+// replica.
+func (v *Vol) checkCommitted(extentId uint64, offset, size int64) (err error) {
+	if !v.isLeader() {
+		return
+	}
+	committed, err := v.getExtentStore().GetCommitLength(extentId)
+	if err != nil {
+		return
+	}
+	if offset+size > committed {
+		return storage.ErrorPastCommit
+	}
+
+	return
+}
+
+func (v *Vol) setSyncMode(mode storage.SyncMode, interval time.Duration, maxBytes int64) {
+	switch v.storeType {
+	case proto.ExtentStoreMode:
+		v.getExtentStore().SetSyncMode(mode, interval, maxBytes)
+	case proto.TinyStoreMode:
+		v.getTinyStore().SetSyncMode(mode, interval, maxBytes)
+	}
+}
+
+// setIoMode sets the io mode of the store of the volume.
+func (v *Vol) setIoMode(mode storage.IoMode) (err error) {
+	v.ioMode = mode
+	switch v.storeType {
+	case proto.ExtentStoreMode:
+		v.getExtentStore().SetIoMode(mode)
+	case proto.TinyStoreMode:
+		err = v.getTinyStore().SetIoMode(mode)
+	}
+
+	return
+}
+
+func (v *Vol) getSyncStats() (stats *storage.SyncStats) {
+	switch v.storeType {
+	case proto.ExtentStoreMode:
+		stats = v.getExtentStore().GetSyncStats()
+	case proto.TinyStoreMode:
+		stats = v.getTinyStore().GetSyncStats()
+	}
+
+	return
+}
+
+// checkDiskErr converts the EIO and ENOSPC of the store, the disk of the
+// volume is isolated for them.
+func (v *Vol) checkDiskErr(err error) error {
+	switch err = storage.ConvertSyscallErr(err); err {
+	case storage.ErrSyscallIO:
+		v.disk.setStatus(proto.VolUnavailable)
+	case storage.ErrSyscallNoSpace:
+		v.disk.setStatus(proto.VolReadOnly)
+	}
+
+	return err
+}
+
+// seal makes the volume refuse the new extents while it is converted to an
+// erasure coded one, the extents converted are sealed already. It is not
+// persisted, master sees the volume sealed until the conversion is done.
+func (v *Vol) seal() {
+	v.lock.Lock()
+	v.sealed = true
+	v.lock.Unlock()
+	v.refreshStatus()
+}
+
+func (v *Vol) unseal() {
+	v.lock.Lock()
+	v.sealed = false
+	v.lock.Unlock()
+	v.refreshStatus()
+}
+
+func (v *Vol) isSealed() bool {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	return v.sealed || v.volType == proto.EcVol
+}
+
+// writeRefused reports whether the packet writes to a volume not writable,
+// the shards of an erasure coded volume are sealed but take the writes of
+// the conversion and the repair.
+func (v *Vol) writeRefused(pkg *Packet) bool {
+	if pkg.Opcode != proto.OpCreateFile && pkg.Opcode != proto.OpWrite {
+		return false
+	}
+	switch v.getStatus() {
+	case proto.VolReadOnly:
+		return true
+	case proto.VolSealed:
+		return v.volType != proto.EcVol
+	}
+
+	return false
+}
+
+// diskRefused reports whether the packet is refused by the disk of the volume
+// isolated for errors, a full disk still serves the reads and deletes.
+func (v *Vol) diskRefused(pkg *Packet) bool {
+	switch v.disk.getStatus() {
+	case proto.VolUnavailable:
+		return true
+	case proto.VolReadOnly:
+		return pkg.Opcode == proto.OpCreateFile || pkg.Opcode == proto.OpWrite
+	}
+
+	return false
+}
+
+func (v *Vol) diskErr() error {
+	if v.disk.getStatus() == proto.VolUnavailable {
+		return storage.ErrSyscallIO
+	}
+
+	return storage.ErrSyscallNoSpace
+}
+
+func (v *Vol) String() string {
+	return v.path
+}
+
+func (v *Vol) getTinyStore() (s *storage.TinyStore) {
+	s, _ = v.store.(*storage.TinyStore)
+	return
+}
+
+func (v *Vol) getExtentStore() (s *storage.ExtentStore) {
+	s, _ = v.store.(*storage.ExtentStore)
+	return
+}
+
+// updateStoreInfo refreshes the full chunks of a TinyStore and moves every
+// chunk which still has room back to the available chunk channel.
+func (v *Vol) updateStoreInfo() {
+	defer v.refreshStatus()
+	store := v.getTinyStore()
+	if store == nil {
+		return
+	}
+	store.UpdateStoreInfo()
+	unavailChunks := store.GetUnAvailChanLen()
+	for i := 0; i < unavailChunks; i++ {
+		chunkId, err := store.GetUnAvailChunk()
+		if err != nil {
+			return
+		}
+		if store.IsFullChunk(chunkId) {
+			store.PutUnAvailChunk(chunkId)
+		} else {
+			store.PutAvailChunk(chunkId)
+		}
+	}
+}
+
+func (v *Vol) syncAll() {
+	switch v.storeType {
+	case proto.ExtentStoreMode:
+		v.getExtentStore().SyncAll()
+	case proto.TinyStoreMode:
+		v.getTinyStore().SyncAll()
+	}
+}
+
+// snapshot returns the files of the volume for the master to check the
+// replicas of the volume group.
+func (v *Vol) snapshot() (files []*proto.File, err error) {
+	switch v.storeType {
+	case proto.ExtentStoreMode:
+		return v.extentSnapshot()
+	case proto.TinyStoreMode:
+		return v.chunkSnapshot()
+	}
+
+	return
+}
+
+func (v *Vol) extentSnapshot() (files []*proto.File, err error) {
+	var extents []*storage.ExtentInfo
+	store := v.getExtentStore()
+	if extents, err = store.GetAllWatermark(); err != nil {
+		return
+	}
+	files = make([]*proto.File, 0, len(extents))
+	for _, ei := range extents {
+		var index *storage.BlockCrcIndex
+		f := &proto.File{Name: strconv.FormatUint(ei.ExtentId, 10), Size: uint32(ei.Size)}
+		if index, err = store.GetBlockCrcIndex(ei.ExtentId); err != nil {
+			return nil, err
+		}
+		f.Crc = index.Checksum(ei.Size)
+		f.MarkDel = index.MarkDel
+		f.Sealed = index.Sealed
+		f.Corrupt = v.isBadFile(f.Name)
+		if finfo, e := os.Stat(path.Join(v.path, f.Name)); e == nil {
+			f.Modified = finfo.ModTime().Unix()
+		}
+		files = append(files, f)
+	}
+
+	return
+}
+
+func (v *Vol) chunkSnapshot() (files []*proto.File, err error) {
+	store := v.getTinyStore()
+	files = make([]*proto.File, 0, storage.ChunkCount)
+	for chunkId := 1; chunkId <= storage.ChunkCount; chunkId++ {
+		f := &proto.File{Name: strconv.Itoa(chunkId)}
+		if f.Crc, f.LastObjID, f.NeedleCnt, err = store.GetChunkCheckSum(chunkId); err != nil {
+			return nil, err
+		}
+		f.Corrupt = v.isBadFile(f.Name)
+		if finfo, e := os.Stat(path.Join(v.path, f.Name)); e == nil {
+			f.Size = uint32(finfo.Size())
+			f.Modified = finfo.ModTime().Unix()
+		}
+		files = append(files, f)
+	}
+
+	return
+}
+
+// usedSize returns the logical size of the volume files and the disk space
+// they take.
+func (v *Vol) usedSize() (logical, physical int64) {
+	switch v.storeType {
+	case proto.ExtentStoreMode:
+		logical, physical = v.getExtentStore().GetStoreUsedSize()
+	case proto.TinyStoreMode:
+		logical, physical = v.getTinyStore().GetStoreUsedSize()
+	}
+
+	return
+}
+
+// status returns the status of the volume in the view of master, a volume
+// is unavailable when its directory can not be accessed, sealed when it is
+// erasure coded or being converted to, and readonly when it is full or its
+// snapshot is being taken. The volume is never better than its disk.
+func (v *Vol) status() int {
+	diskStatus := v.disk.getStatus()
+	if _, err := os.Stat(v.path); err != nil || diskStatus == proto.VolUnavailable {
+		return proto.VolUnavailable
+	}
+	if v.isSealed() {
+		return proto.VolSealed
+	}
+	if diskStatus == proto.VolReadOnly || v.isFrozen() {
+		return proto.VolReadOnly
+	}
+	if used, _ := v.usedSize(); used >= int64(v.volSize) {
+		return proto.VolReadOnly
+	}
+	if store := v.getTinyStore(); store != nil && store.GetStoreStatus() == storage.ReadOnlyStore {
+		return proto.VolReadOnly
+	}
+
+	return proto.VolReadWrite
+}
+
+// refreshStatus caches the status of the volume, the write path checks the
+// cached one as status stats the files of the volume.
+func (v *Vol) refreshStatus() (status int) {
+	status = v.status()
+	atomic.StoreInt32(&v.volStatus, int32(status))
+
+	return
+}
+
+func (v *Vol) getStatus() int {
+	return int(atomic.LoadInt32(&v.volStatus))
+}
+
+// enter marks an operation in flight on the volume, it fails once the volume
+// is deleted. The operation exits the volume when done, and must not enter it
+// again before that.
+func (v *Vol) enter() bool {
+	v.opLock.RLock()
+	if v.deleted {
+		v.opLock.RUnlock()
+		return false
+	}
+
+	return true
+}
+
+func (v *Vol) exit() {
+	v.opLock.RUnlock()
+}
+
+// delete removes every file of the volume from disk, after the operations in
+// flight are done. The operations entered later fail.
+func (v *Vol) delete() {
+	v.opLock.Lock()
+	v.deleted = true
+	v.opLock.Unlock()
+	switch v.storeType {
+	case proto.ExtentStoreMode:
+		v.getExtentStore().DeleteStore()
+	case proto.TinyStoreMode:
+		v.getTinyStore().DeleteStore()
+	}
+}
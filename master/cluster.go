@@ -16,12 +16,14 @@ type Cluster struct {
 	createVolLock sync.Mutex
 	createNsLock  sync.Mutex
 	cfg           *ClusterConfig
+	throttle      *throttleConfig
 }
 
 func NewCluster(name string) (c *Cluster) {
 	c = new(Cluster)
 	c.Name = name
 	c.cfg = NewClusterConfig()
+	c.throttle = newThrottleConfig()
 	c.startCheckVolGroups()
 	c.startCheckBackendLoadVolGroups()
 	c.startCheckReleaseVolGroups()
@@ -35,6 +37,7 @@ func (c *Cluster) startCheckVolGroups() {
 		for {
 			for _, ns := range c.namespaces {
 				c.checkVolGroups(ns)
+				c.checkEcConvert(ns)
 			}
 			time.Sleep(time.Second * time.Duration(c.cfg.CheckVolIntervalSeconds))
 		}
@@ -68,9 +71,10 @@ func (c *Cluster) startCheckHearBeat() {
 	go func() {
 		for {
 			tasks := make([]*proto.AdminTask, 0)
+			limits := c.getThrottleLimits()
 			c.dataNodes.Range(func(addr, dataNode interface{}) bool {
 				node := dataNode.(*DataNode)
-				task := node.generateHeartbeatTask()
+				task := node.generateHeartbeatTask(limits, c.getVolViews(node.HttpAddr))
 				tasks = append(tasks, task)
 				return true
 			})
@@ -94,6 +98,23 @@ func (c *Cluster) startCheckHearBeat() {
 	}()
 }
 
+// getVolViews returns the vols on the DataNode of addr in the view of master, the first
+// persistence host of a vol group is its leader. The shards of an ec vol are led by none
+func (c *Cluster) getVolViews(addr string) (views []*proto.VolView) {
+	views = make([]*proto.VolView, 0)
+	for _, ns := range c.namespaces {
+		ns.volGroups.RLock()
+		for _, vg := range ns.volGroups.volGroupMap {
+			if view := vg.getVolView(addr); view != nil {
+				views = append(views, view)
+			}
+		}
+		ns.volGroups.RUnlock()
+	}
+
+	return
+}
+
 func (c *Cluster) startCheckMetaGroups() {
 	go func() {
 		for {
@@ -185,7 +206,7 @@ func (c *Cluster) getNamespace(nsName string) (ns *NameSpace, err error) {
 	return
 }
 
-func (c *Cluster) createVolGroup(nsName string) (vg *VolGroup, err error) {
+func (c *Cluster) createVolGroup(nsName, ioMode string) (vg *VolGroup, err error) {
 	var (
 		ns          *NameSpace
 		volID       uint64
@@ -203,6 +224,7 @@ func (c *Cluster) createVolGroup(nsName string) (vg *VolGroup, err error) {
 	}
 	//volID++
 	vg = newVolGroup(volID, ns.volReplicaNum)
+	vg.ioMode = ioMode
 	if targetHosts, err = c.ChooseTargetDataHosts(int(ns.volReplicaNum)); err != nil {
 		goto errDeal
 	}
@@ -304,6 +326,10 @@ func (c *Cluster) volOffline(offlineAddr string, vg *VolGroup, errMsg string) {
 	if ok := vg.isInPersistenceHosts(offlineAddr); !ok {
 		return
 	}
+	if vg.volType == proto.EcVol {
+		c.ecShardOffline(offlineAddr, vg, errMsg)
+		return
+	}
 
 	if err = vg.hasMissOne(); err != nil {
 		goto errDeal
@@ -328,7 +354,7 @@ func (c *Cluster) volOffline(offlineAddr string, vg *VolGroup, errMsg string) {
 	}
 	vg.volOffLineInMem(offlineAddr)
 	vg.checkAndRemoveMissVol(offlineAddr)
-	task = proto.NewAdminTask(OpCreateVol, offlineAddr, newCreateVolRequest(vg.volType, vg.VolID))
+	task = proto.NewAdminTask(OpCreateVol, offlineAddr, newCreateVolRequest(vg.volType, vg.VolID, vg.ioMode))
 	tasks = make([]*proto.AdminTask, 0)
 	tasks = append(tasks, task)
 	c.putDataNodeTasks(tasks)
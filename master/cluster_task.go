@@ -46,7 +46,7 @@ func (c *Cluster) checkVolGroups(ns *NameSpace) {
 		vg.checkStatus(true, c.cfg.VolTimeOutSec)
 		vg.checkVolGroupMiss(c.cfg.VolMissSec, c.cfg.VolWarnInterval)
 		vg.checkReplicaNum()
-		if vg.status == VolReadWrite {
+		if vg.status == proto.VolReadWrite {
 			newReadWriteVolGroups++
 		}
 		volDiskErrorAddrs := vg.checkVolDiskError()
@@ -57,6 +57,7 @@ func (c *Cluster) checkVolGroups(ns *NameSpace) {
 		}
 		volTasks := vg.checkVolReplicationTask()
 		c.putDataNodeTasks(volTasks)
+		c.putDataNodeTasks(vg.checkEcTasks())
 	}
 	ns.volGroups.readWriteVolGroups = newReadWriteVolGroups
 	ns.volGroups.RUnlock()
@@ -130,6 +131,11 @@ func (c *Cluster) processLoadVol(v *VolGroup, isRecover bool) {
 		return
 	}
 	v.getFileCount()
+	if v.isEcVol() {
+		// the shards differ from each other, they are repaired by the ec repair tasks
+		v.setVolToNormal()
+		return
+	}
 	checkFileTasks := v.checkFile(isRecover)
 	v.setVolToNormal()
 	c.putDataNodeTasks(checkFileTasks)
@@ -276,9 +282,21 @@ func (c *Cluster) dealDataNodeTaskResponse(nodeAddr string, task *proto.AdminTas
 	case OpDeleteFile:
 		response := task.Response.(*proto.DeleteFileResponse)
 		c.dealDeleteFileResponse(task.OperatorAddr, response)
+	case OpReplicateFile:
+		response := task.Response.(*proto.ReplicateFileResponse)
+		c.dealReplicateFileResponse(task.OperatorAddr, response)
 	case OpDataNodeHeartbeat:
 		response := task.Response.(*proto.DataNodeHeartBeatResponse)
 		c.dealDataNodeHeartbeat(task.OperatorAddr, response)
+	case OpConvertToEc:
+		response := task.Response.(*proto.ConvertToEcResponse)
+		c.dealConvertToEcResponse(task.OperatorAddr, response)
+	case OpEcRepair:
+		response := task.Response.(*proto.EcRepairResponse)
+		c.dealEcRepairResponse(task.OperatorAddr, response)
+	case OpSetThrottle:
+		response := task.Response.(*proto.SetThrottleResponse)
+		c.dealSetThrottleResponse(task.OperatorAddr, response)
 	default:
 		log.LogError(fmt.Sprintf("unknown operate code %v", task.OpCode))
 	}
@@ -311,8 +329,11 @@ func (c *Cluster) createVolSuccessTriggerOperator(nodeAddr string, resp *proto.C
 	if dataNode, err = c.getDataNode(nodeAddr); err != nil {
 		goto errDeal
 	}
+	if vg.ecHostCreated(nodeAddr) {
+		return
+	}
 	vol = NewVol(dataNode)
-	vol.status = VolReadWrite
+	vol.status = proto.VolReadWrite
 	vg.addMember(vol)
 
 	vg.Lock()
@@ -358,6 +379,11 @@ func (c *Cluster) dealLoadVolResponse(nodeAddr string, resp *proto.LoadVolRespon
 	if dataNode, err = c.getDataNode(nodeAddr); err != nil {
 		return
 	}
+	// the vol on an ec host of the conversion is not a member of the group yet
+	if tasks, isEcHost := vg.ecShardsReported(nodeAddr, resp.VolSnapshot); isEcHost {
+		c.putDataNodeTasks(tasks)
+		return
+	}
 	vg.LoadFile(dataNode, resp)
 
 	return
@@ -378,6 +404,18 @@ func (c *Cluster) dealDeleteFileResponse(nodeAddr string, resp *proto.DeleteFile
 	return
 }
 
+func (c *Cluster) dealReplicateFileResponse(nodeAddr string, resp *proto.ReplicateFileResponse) {
+	if resp.Status == proto.CmdSuccess {
+		log.LogInfo(fmt.Sprintf("action[dealReplicateFileResponse],vol:%v file:%v on :%v repaired",
+			resp.VolId, resp.Name, nodeAddr))
+		return
+	}
+	log.LogWarn(fmt.Sprintf("action[dealReplicateFileResponse],vol:%v file:%v on :%v repair failed:%v",
+		resp.VolId, resp.Name, nodeAddr, resp.Result))
+
+	return
+}
+
 func (c *Cluster) dealDataNodeHeartbeat(nodeAddr string, resp *proto.DataNodeHeartBeatResponse) {
 
 	var (
@@ -393,10 +431,12 @@ func (c *Cluster) dealDataNodeHeartbeat(nodeAddr string, resp *proto.DataNodeHea
 	logMsg = fmt.Sprintf("action[dealDataNodeHeartbeat],dataNode:%v ReportTime:%v  success", dataNode.HttpAddr, time.Now().Unix())
 	log.LogDebug(logMsg)
 	dataNode.setNodeAlive()
+	dataNode.UpdateNodeMetric(resp)
 	dataNode.VolInfo = resp.VolInfo
 	c.UpdateDataNode(dataNode)
 	dataNode.VolInfoCount = len(dataNode.VolInfo)
 	dataNode.VolInfo = nil
+	c.dealBadFileReports(dataNode, resp.BadFiles)
 
 	return
 errDeal:
@@ -417,6 +457,25 @@ func (c *Cluster) UpdateDataNode(dataNode *DataNode) {
 	}
 }
 
+/*if node report corrupt files,so load their vol groups,then the file crc check repair them.
+the files are reported by every heartbeat until repaired, the vol group loaded recently is not loaded again*/
+func (c *Cluster) dealBadFileReports(dataNode *DataNode, reports []*proto.BadFileReport) {
+	volIDs := make(map[uint64]bool)
+	for _, report := range reports {
+		if report == nil {
+			continue
+		}
+		log.LogWarn(fmt.Sprintf("action[dealBadFileReports],vol:%v file:%v on :%v corrupt blocks:%v",
+			report.VolID, report.Name, dataNode.HttpAddr, report.Blocks))
+		volIDs[report.VolID] = true
+	}
+	for volID := range volIDs {
+		if vg, err := c.getVolGroupByVolID(volID); err == nil && time.Now().Unix()-vg.LastLoadTime > LoadVolWaitTime {
+			c.loadVolAndCheckResponse(vg, false)
+		}
+	}
+}
+
 func (c *Cluster) UpdateMetaNode(metaNode *MetaNode) {
 	for _, mr := range metaNode.metaRangeInfo {
 		if mr == nil {
@@ -18,6 +18,9 @@ const (
 	DefaultLoadVolFrequencyTime          = 60 * 60
 	DefaultEveryLoadVolCount             = 10
 	DefaultMetaRangeTimeOutSec           = 5 * DefaultCheckHeartBeatIntervalSeconds
+	EcTaskTimeOutSec                     = 6 * 3600
+	DefaultEcColdSec                     = 7 * 24 * 3600
+	DefaultMaxEcConvertCount             = 4
 )
 
 type ClusterConfig struct {
@@ -28,10 +31,12 @@ type ClusterConfig struct {
 	VolMissSec                    int64
 	VolTimeOutSec                 int64
 	VolWarnInterval               int64
+	EcColdSec                     int64
 	LoadVolFrequencyTime          int64
 	CheckVolIntervalSeconds       int
 	everyReleaseVolCount          int
 	everyLoadVolCount             int
+	maxEcConvertCount             int
 	replicaNum                    uint8
 }
 
@@ -49,5 +54,7 @@ func NewClusterConfig() (cfg *ClusterConfig) {
 	cfg.VolWarnInterval = DefaultVolWarnInterval
 	cfg.everyLoadVolCount = DefaultEveryLoadVolCount
 	cfg.LoadVolFrequencyTime = DefaultLoadVolFrequencyTime
+	cfg.EcColdSec = DefaultEcColdSec
+	cfg.maxEcConvertCount = DefaultMaxEcConvertCount
 	return
 }
@@ -1,5 +1,7 @@
 package master
 
+import "github.com/tiglabs/baudstorage/proto"
+
 const (
 	ParaNodeAddr = "addr"
 	ParaName     = "name"
@@ -7,11 +9,11 @@ const (
 	ParaCount    = "count"
 	ParaReplicas = "replicas"
 	ParaVolGroup = "vg"
-)
-
-const (
-	ExtentVol = "extent"
-	ChunkVol  = "chunk"
+	ParaIoMode   = "ioMode" // the io mode of the vols created, the DataNode default if empty
+	// the io limits of admin/setThrottle, iops in requests and bandwidth in bytes per second
+	ParaClient    = "client"
+	ParaIops      = "iops"
+	ParaBandwidth = "bandwidth"
 )
 
 const (
@@ -24,6 +26,7 @@ const (
 	DeleteFileInCoreInfo        = "DeleteFileInCoreInfo "
 	GetVolLocationFileCountInfo = "GetVolLocationFileCountInfo "
 	DataNodeOfflineInfo         = "dataNodeOfflineInfo"
+	EcShardOfflineErr           = "EcShardOfflineErr "
 )
 
 const (
@@ -35,12 +38,6 @@ const (
 	NeedUpdateVolResponse   = true
 )
 
-const (
-	VolUnavailable = -1
-	VolReadOnly    = 1
-	VolReadWrite   = 2
-)
-
 const (
 	//high 4 bit represent range is available,low 4 bit represent range is writable
 	MetaRangeUnavailable uint8 = 0x00
@@ -58,15 +55,19 @@ const (
 	RuntimeStackBufSize       = 4096
 )
 
-//OpCode
+// OpCode, the commands are sent to nodes within the packet header, so they
+// share the opcode space of proto.
 const (
-	OpCreateVol         = 0x01
-	OpDeleteVol         = 0x02
-	OpReplicateFile     = 0x03
-	OpDeleteFile        = 0x04
-	OpLoadVol           = 0x05
-	OpCreateMetaGroup   = 0x06
-	OpDataNodeHeartbeat = 0x07
+	OpCreateVol         = proto.OpCreateVol
+	OpDeleteVol         = proto.OpDeleteVol
+	OpReplicateFile     = proto.OpReplicateFile
+	OpDeleteFile        = proto.OpDeleteFile
+	OpLoadVol           = proto.OpLoadVol
+	OpCreateMetaGroup   = proto.OpMetaCreateMetaRange
+	OpDataNodeHeartbeat = proto.OpDataNodeHeartbeat
+	OpConvertToEc       = proto.OpConvertToEc
+	OpEcRepair          = proto.OpEcRepair
+	OpSetThrottle       = proto.OpSetThrottle
 	OpMetaNodeHeartbeat = 0x08
 )
 
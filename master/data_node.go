@@ -36,8 +36,8 @@ func NewDataNode(addr string) (dataNode *DataNode) {
 	dataNode = new(DataNode)
 	dataNode.carry = rand.Float64()
 	dataNode.Total = 1
-	dataNode.sender = NewAdminTaskSender(dataNode.HttpAddr)
 	dataNode.HttpAddr = addr
+	dataNode.sender = NewAdminTaskSender(dataNode.HttpAddr)
 	return
 }
 
@@ -68,13 +68,16 @@ func (dataNode *DataNode) checkIsActive() bool {
 
 }
 
-func (dataNode *DataNode) UpdateNodeMetric(sourceNode *DataNode) {
+func (dataNode *DataNode) UpdateNodeMetric(resp *proto.DataNodeHeartBeatResponse) {
 	dataNode.Lock()
 	defer dataNode.Unlock()
-	dataNode.MaxDiskAvailWeight = sourceNode.MaxDiskAvailWeight
-	dataNode.Total = sourceNode.Total
-	dataNode.Used = sourceNode.Used
-	dataNode.RackName = sourceNode.RackName
+	dataNode.MaxDiskAvailWeight = (uint64)(resp.MaxDiskAvailWeight)
+	dataNode.Total = resp.Total
+	dataNode.Used = resp.Used
+	dataNode.RackName = resp.RackName
+	if dataNode.Total == 0 {
+		dataNode.Total = 1
+	}
 	dataNode.ratio = (float64)(dataNode.Used) / (float64)(dataNode.Total)
 }
 
@@ -116,9 +119,11 @@ func (dataNode *DataNode) clean() {
 	dataNode.sender.exitCh <- struct{}{}
 }
 
-func (dataNode *DataNode) generateHeartbeatTask() (task *proto.AdminTask) {
+func (dataNode *DataNode) generateHeartbeatTask(limits *proto.ThrottleLimits, vols []*proto.VolView) (task *proto.AdminTask) {
 	request := &proto.HeartBeatRequest{
 		CurrTime: time.Now().Unix(),
+		Throttle: limits,
+		Vols:     vols,
 	}
 	task = proto.NewAdminTask(OpDataNodeHeartbeat, dataNode.HttpAddr, request)
 	return
@@ -26,6 +26,7 @@ var (
 	CannotOffLineErr              = errors.New("cannot offline because avail vol replicate <0")
 	NoAnyDataNodeForCreateVol     = errors.New("no have enough data server for create vol")
 	NoAnyMetaNodeForCreateVol     = errors.New("no have enough meta server for create meta range")
+	EcShardsNotEnough             = errors.New("ec vol live shards less than data shards")
 )
 
 func paraNotFound(name string) (err error) {
@@ -17,10 +17,10 @@ func (vg *VolGroup) checkFile(isRecoverVolFlag bool) (tasks []*proto.AdminTask)
 	}
 
 	switch vg.volType {
-	case ExtentVol:
-		vg.checkExtentFile(liveVols, isRecoverVolFlag)
-	case ChunkVol:
-		vg.checkChunkFile(liveVols)
+	case proto.ExtentVol:
+		tasks = vg.checkExtentFile(liveVols, isRecoverVolFlag)
+	case proto.ChunkVol:
+		tasks = vg.checkChunkFile(liveVols)
 	}
 
 	return
@@ -28,7 +28,7 @@ func (vg *VolGroup) checkFile(isRecoverVolFlag bool) (tasks []*proto.AdminTask)
 
 func (vg *VolGroup) checkChunkFile(liveVols []*Vol) (tasks []*proto.AdminTask) {
 	for _, fc := range vg.FileInCoreMap {
-		tasks = append(tasks, fc.generateFileCrcTask(vg.VolID, liveVols, ChunkVol)...)
+		tasks = append(tasks, fc.generateFileCrcTask(vg.VolID, liveVols, proto.ChunkVol)...)
 	}
 	return
 }
@@ -45,7 +45,7 @@ func (vg *VolGroup) checkExtentFile(liveVols []*Vol, isRecoverVolFlag bool) (tas
 			if fc.isDelayCheck() {
 				tasks = append(tasks, fc.generatorLackFileTask(vg.VolID, liveVols)...)
 			}
-			tasks = append(tasks, fc.generateFileCrcTask(vg.VolID, liveVols, ExtentVol)...)
+			tasks = append(tasks, fc.generateFileCrcTask(vg.VolID, liveVols, proto.ExtentVol)...)
 		}
 	}
 	return
@@ -60,7 +60,7 @@ func (fc *FileInCore) generatorLackFileTask(volID uint64, liveVols []*Vol) (task
 			continue
 		}
 		msg := fc.generatorLackFileLog(volID, lackLoc, liveVols)
-		if lackLoc.status == VolUnavailable {
+		if lackLoc.status == proto.VolUnavailable {
 			msg = msg + fmt.Sprintf(" ,But volLocationStatus :%v  So Can't do Replicat Task",
 				lackLoc.status)
 			log.LogWarn(msg)
@@ -99,5 +99,15 @@ func (fc *FileInCore) generatorLackFileLog(volID uint64, lackLoc *Vol, liveLocs
 }
 
 func (fc *FileInCore) generatorReplicateFileTask(volID uint64, badLoc *Vol, liveLocs []*Vol) (t *proto.AdminTask) {
-	return proto.NewAdminTask(OpReplicateFile, badLoc.addr, nil)
+	hosts := make([]string, 0)
+	for _, volLoc := range liveLocs {
+		if _, ok := fc.getFileMetaByVolAddr(volLoc); ok && volLoc.addr != badLoc.addr {
+			hosts = append(hosts, volLoc.addr)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	return proto.NewAdminTask(OpReplicateFile, badLoc.addr, newReplicateFileRequest(volID, fc.Name, hosts))
 }
@@ -8,16 +8,18 @@ import (
 	"time"
 )
 
-/*use struct define File crc and this crc in all File count*/
+/*use struct define File crc and this crc in all File count,the replicas of an extent are grouped by size and crc*/
 type FileCrc struct {
 	crc   uint32
+	size  uint32
 	count int
-	meta  *FileMetaOnNode
+	metas []*FileMetaOnNode
 }
 
-func NewFileCrc(volCrc uint32) (fc *FileCrc) {
+func NewFileCrc(volCrc, size uint32) (fc *FileCrc) {
 	fc = new(FileCrc)
 	fc.crc = volCrc
+	fc.size = size
 	fc.count = 1
 
 	return
@@ -40,13 +42,10 @@ func (fileCrcArr FileCrcSorterByCount) Len() (length int) {
 
 func (fileCrcArr FileCrcSorterByCount) log() (msg string) {
 	for _, fileCrc := range fileCrcArr {
-		addr := fileCrc.meta.getLocationAddr()
-		count := fileCrc.count
-		lastObjId := fileCrc.meta.LastObjID
-		needleCnt := fileCrc.meta.NeedleCnt
-		crc := fileCrc.crc
-		msg = fmt.Sprintf(msg+" addr:%v  count:%v  crc:%v lastObjId:%v needleCnt:%v ", addr, count, crc, lastObjId, needleCnt)
-
+		for _, meta := range fileCrc.metas {
+			msg = fmt.Sprintf(msg+" addr:%v  count:%v  crc:%v size:%v corrupt:%v lastObjId:%v needleCnt:%v ",
+				meta.getLocationAddr(), fileCrc.count, fileCrc.crc, fileCrc.size, meta.Corrupt, meta.LastObjID, meta.NeedleCnt)
+		}
 	}
 
 	return
@@ -63,10 +62,12 @@ func (fc *FileInCore) generateFileCrcTask(volID uint64, liveVols []*Vol, volType
 		return
 	}
 
-	fileCrcArr := fc.calculateCrcCount(fms)
+	fileCrcArr := fc.calculateCrcCount(fms, volType)
 	sort.Sort((FileCrcSorterByCount)(fileCrcArr))
 	maxCountFileCrcIndex := len(fileCrcArr) - 1
-	if fileCrcArr[maxCountFileCrcIndex].count == 1 {
+	good := fileCrcArr[maxCountFileCrcIndex]
+	// the only good replica is trusted if the others are corrupt
+	if good.count == 0 || (good.count == 1 && maxCountFileCrcIndex > 0 && fileCrcArr[maxCountFileCrcIndex-1].count != 0) {
 		msg := fmt.Sprintf("checkFileCrcTaskErr volID:%v  File:%v  Crc diffrent between all Node  "+
 			" it can not repair it ", volID, fc.Name)
 		msg += (FileCrcSorterByCount)(fileCrcArr).log()
@@ -74,10 +75,22 @@ func (fc *FileInCore) generateFileCrcTask(volID uint64, liveVols []*Vol, volType
 		return
 	}
 
-	for index, crc := range fileCrcArr {
-		if index != maxCountFileCrcIndex {
-			badNode := crc.meta
-			tasks = append(tasks, generateOpDeleteFileTask(badNode.getLocationAddr(), volID, fc.Name))
+	for _, crc := range fileCrcArr[:maxCountFileCrcIndex] {
+		for _, badNode := range crc.metas {
+			// a replica larger than the good ones has the data they do not have,so it is never
+			// deleted,and a smaller one lags behind them unless it is corrupt
+			size := fileCrcSize(badNode, volType)
+			if size > good.size || (size < good.size && !badNode.Corrupt) {
+				continue
+			}
+			if volType == proto.ChunkVol {
+				// a chunk can not be deleted,so repair the bad objects of it by replicate
+				if t := fc.generatorChunkRepairTask(volID, badNode, liveVols); t != nil {
+					tasks = append(tasks, t)
+				}
+			} else {
+				tasks = append(tasks, generateOpDeleteFileTask(badNode.getLocationAddr(), volID, fc.Name))
+			}
 			msg := fmt.Sprintf("checkFileCrcTaskErr volID:%v  File:%v  badCrc On :%v  ",
 				volID, fc.Name, badNode.getLocationAddr())
 			msg += (FileCrcSorterByCount)(fileCrcArr).log()
@@ -88,6 +101,16 @@ func (fc *FileInCore) generateFileCrcTask(volID uint64, liveVols []*Vol, volType
 	return
 }
 
+func (fc *FileInCore) generatorChunkRepairTask(volID uint64, badNode *FileMetaOnNode, liveVols []*Vol) (t *proto.AdminTask) {
+	for _, volLoc := range liveVols {
+		if volLoc.addr == badNode.getLocationAddr() {
+			return fc.generatorReplicateFileTask(volID, volLoc, liveVols)
+		}
+	}
+
+	return
+}
+
 func generateOpDeleteFileTask(addr string, volId uint64, name string) (task *proto.AdminTask) {
 	return proto.NewAdminTask(OpDeleteFile, addr, newDeleteFileRequest(volId, name))
 }
@@ -101,7 +124,6 @@ func (fc *FileInCore) isDelayCheck() bool {
 }
 
 func (fc *FileInCore) needCrcRepair(liveVols []*Vol, volType string) (fms []*FileMetaOnNode, needRepair bool) {
-	var baseCrc uint32
 	fms = make([]*FileMetaOnNode, 0)
 
 	for i := 0; i < len(liveVols); i++ {
@@ -114,21 +136,38 @@ func (fc *FileInCore) needCrcRepair(liveVols []*Vol, volType string) (fms []*Fil
 		return
 	}
 
-	if volType == ChunkVol {
+	if volType == proto.ChunkVol {
 		if !isSameLastObjectID(fms) || !isSameNeedleCnt(fms) {
 			return
 		}
 	}
-	baseCrc = fms[0].Crc
 	for _, fm := range fms {
-		if fm.getFileCrc() != baseCrc {
+		if fm.Corrupt {
 			needRepair = true
 			return
 		}
 	}
+	// the crcs of the extents of different sizes are not comparable
+	for i, fm := range fms {
+		for _, other := range fms[i+1:] {
+			if fileCrcSize(fm, volType) == fileCrcSize(other, volType) && fm.getFileCrc() != other.getFileCrc() {
+				needRepair = true
+				return
+			}
+		}
+	}
 
 	return
 }
+
+/*the size the crc of the file is of,the crc of a chunk covers all the objects of it*/
+func fileCrcSize(fm *FileMetaOnNode, volType string) uint32 {
+	if volType == proto.ChunkVol {
+		return 0
+	}
+
+	return fm.Size
+}
 func isSameLastObjectID(fms []*FileMetaOnNode) (same bool) {
 	sentry := fms[0].LastObjID
 	for _, fm := range fms {
@@ -149,27 +188,36 @@ func isSameNeedleCnt(fms []*FileMetaOnNode) (same bool) {
 	return true
 }
 
-func (fc *FileInCore) calculateCrcCount(badVfNodes []*FileMetaOnNode) (fileCrcArr []*FileCrc) {
+/*group the replicas by size and crc,a corrupt replica is a group of count 0 by itself*/
+func (fc *FileInCore) calculateCrcCount(badVfNodes []*FileMetaOnNode, volType string) (fileCrcArr []*FileCrc) {
 	badLen := len(badVfNodes)
 	fileCrcArr = make([]*FileCrc, 0)
 	for i := 0; i < badLen; i++ {
 		crcKey := badVfNodes[i].getFileCrc()
+		sizeKey := fileCrcSize(badVfNodes[i], volType)
+		if badVfNodes[i].Corrupt {
+			crc := NewFileCrc(crcKey, sizeKey)
+			crc.count = 0
+			crc.metas = []*FileMetaOnNode{badVfNodes[i]}
+			fileCrcArr = append(fileCrcArr, crc)
+			continue
+		}
 		isFind := false
 		var crc *FileCrc
 		for _, crc = range fileCrcArr {
-			if crc.crc == crcKey {
+			if crc.count != 0 && crc.crc == crcKey && crc.size == sizeKey {
 				isFind = true
 				break
 			}
 		}
 
 		if isFind == false {
-			crc = NewFileCrc(crcKey)
-			crc.meta = badVfNodes[i]
+			crc = NewFileCrc(crcKey, sizeKey)
 			fileCrcArr = append(fileCrcArr, crc)
 		} else {
 			crc.count++
 		}
+		crc.metas = append(crc.metas, badVfNodes[i])
 	}
 
 	return
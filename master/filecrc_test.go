@@ -0,0 +1,99 @@
+package master
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/tiglabs/baudstorage/proto"
+)
+
+// testReplica is the file reported by the replica on addr.
+type testReplica struct {
+	addr    string
+	size    uint32
+	crc     uint32
+	corrupt bool
+}
+
+func newTestFileInCore(replicas []testReplica) (fc *FileInCore, liveVols []*Vol) {
+	fc = NewFileInCore("1")
+	for i, r := range replicas {
+		vol := NewVol(&DataNode{HttpAddr: r.addr})
+		liveVols = append(liveVols, vol)
+		fc.updateFileInCore(1, &proto.File{Name: "1", Size: r.size, Crc: r.crc, Corrupt: r.corrupt}, vol, i)
+	}
+
+	return
+}
+
+func crcTaskAddrs(tasks []*proto.AdminTask, opcode uint8) (addrs []string) {
+	for _, t := range tasks {
+		if t.OpCode == opcode {
+			addrs = append(addrs, t.OperatorAddr)
+		}
+	}
+	sort.Strings(addrs)
+
+	return
+}
+
+func TestExtentCrcTask(t *testing.T) {
+	cases := []struct {
+		name     string
+		replicas []testReplica
+		deleted  []string
+	}{
+		{"same", []testReplica{{"a", 200, 1, false}, {"b", 200, 1, false}, {"c", 200, 1, false}}, nil},
+		{"lagging", []testReplica{{"a", 100, 1, false}, {"b", 200, 2, false}, {"c", 200, 2, false}}, nil},
+		{"bad crc", []testReplica{{"a", 200, 1, false}, {"b", 200, 2, false}, {"c", 200, 2, false}}, []string{"a"}},
+		{"largest", []testReplica{{"a", 300, 1, false}, {"b", 200, 2, false}, {"c", 200, 2, false}}, nil},
+		{"largest bad crc", []testReplica{{"a", 300, 1, false}, {"b", 300, 2, false}, {"c", 200, 3, false}}, nil},
+		{"corrupt", []testReplica{{"a", 200, 2, true}, {"b", 200, 2, false}, {"c", 200, 2, false}}, []string{"a"}},
+		{"corrupt lagging", []testReplica{{"a", 100, 2, true}, {"b", 200, 2, false}}, []string{"a"}},
+		{"corrupt largest", []testReplica{{"a", 300, 2, true}, {"b", 200, 2, false}, {"c", 200, 2, false}}, nil},
+		{"all corrupt", []testReplica{{"a", 200, 2, true}, {"b", 200, 2, true}}, nil},
+		{"two bad", []testReplica{{"a", 200, 1, false}, {"b", 200, 1, false}, {"c", 200, 2, false},
+			{"d", 200, 2, false}, {"e", 200, 2, false}}, []string{"a", "b"}},
+	}
+	for _, c := range cases {
+		fc, liveVols := newTestFileInCore(c.replicas)
+		tasks := fc.generateFileCrcTask(1, liveVols, proto.ExtentVol)
+		if deleted := crcTaskAddrs(tasks, OpDeleteFile); !reflect.DeepEqual(deleted, c.deleted) {
+			t.Errorf("%v: deleted on %v, expected %v", c.name, deleted, c.deleted)
+		}
+	}
+}
+
+func TestChunkCrcTask(t *testing.T) {
+	fc, liveVols := newTestFileInCore([]testReplica{{"a", 100, 2, true}, {"b", 200, 2, false}, {"c", 300, 2, false}})
+	tasks := fc.generateFileCrcTask(1, liveVols, proto.ChunkVol)
+	if repaired := crcTaskAddrs(tasks, OpReplicateFile); !reflect.DeepEqual(repaired, []string{"a"}) {
+		t.Fatalf("repaired on %v, expected [a]", repaired)
+	}
+	if deleted := crcTaskAddrs(tasks, OpDeleteFile); len(deleted) != 0 {
+		t.Fatalf("chunk deleted on %v", deleted)
+	}
+}
+
+// The crc repair deletes the bad replica, the file check finds it lacking
+// once the replica reports the files without it.
+func TestLoadFileDropsDeletedReplica(t *testing.T) {
+	vg := newVolGroup(1, 2)
+	for _, addr := range []string{"a", "b"} {
+		vg.PersistenceHosts = append(vg.PersistenceHosts, addr)
+		vg.locations = append(vg.locations, NewVol(&DataNode{HttpAddr: addr}))
+	}
+	for _, addr := range []string{"a", "b"} {
+		vg.LoadFile(&DataNode{HttpAddr: addr}, &proto.LoadVolResponse{VolSnapshot: []*proto.File{{Name: "1", Size: 10}}})
+	}
+	vg.DeleteFileOnNode("a", "1")
+	if metas := len(vg.FileInCoreMap["1"].Metas); metas != 2 {
+		t.Fatalf("%v replicas after the delete response of a file not deleted", metas)
+	}
+	vg.LoadFile(&DataNode{HttpAddr: "a"}, &proto.LoadVolResponse{VolSnapshot: []*proto.File{}})
+	fc := vg.FileInCoreMap["1"]
+	if _, ok := fc.getFileMetaByVolAddr(vg.locations[0]); ok || len(fc.Metas) != 1 {
+		t.Fatalf("replicas %v after the file deleted on a", fc.Metas)
+	}
+}
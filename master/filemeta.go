@@ -14,6 +14,9 @@ type FileMetaOnNode struct {
 	LocIndex  uint8
 	LastObjID uint64
 	NeedleCnt int
+	Size      uint32
+	Corrupt   bool
+	Sealed    bool
 }
 
 type FileInCore struct {
@@ -61,19 +64,24 @@ func (fc *FileInCore) updateFileInCore(volID uint64, vf *proto.File, volLoc *Vol
 		fc.LastModify = vf.Modified
 	}
 
-	isFind := false
+	var fm *FileMetaOnNode
 	for i := 0; i < len(fc.Metas); i++ {
 		if fc.Metas[i].getLocationAddr() == volLoc.addr {
-			fc.Metas[i].Crc = vf.Crc
-			isFind = true
+			fm = fc.Metas[i]
+			fm.Crc = vf.Crc
+			fm.LastObjID = vf.LastObjID
+			fm.NeedleCnt = vf.NeedleCnt
 			break
 		}
 	}
 
-	if isFind == false {
-		fm := NewFileMetaOnNode(vf.Crc, volLoc.addr, volLocIndex, vf.LastObjID, vf.NeedleCnt)
+	if fm == nil {
+		fm = NewFileMetaOnNode(vf.Crc, volLoc.addr, volLocIndex, vf.LastObjID, vf.NeedleCnt)
 		fc.Metas = append(fc.Metas, fm)
 	}
+	fm.Size = vf.Size
+	fm.Corrupt = vf.Corrupt
+	fm.Sealed = vf.Sealed
 
 }
 
@@ -8,6 +8,7 @@ import (
 	"strconv"
 
 	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/storage"
 	"github.com/tiglabs/baudstorage/util/log"
 	"io/ioutil"
 )
@@ -16,12 +17,13 @@ func (m *Master) createVol(w http.ResponseWriter, r *http.Request) {
 	var (
 		rstMsg string
 		nsName string
+		ioMode string
 		ns     *NameSpace
 		count  int
 		err    error
 	)
 
-	if count, nsName, err = parseCreateVolPara(r); err != nil {
+	if count, nsName, ioMode, err = parseCreateVolPara(r); err != nil {
 		goto errDeal
 	}
 
@@ -32,7 +34,7 @@ func (m *Master) createVol(w http.ResponseWriter, r *http.Request) {
 		if count < len(ns.volGroups.volGroups) {
 			break
 		}
-		if _, err = m.cluster.createVolGroup(nsName); err != nil {
+		if _, err = m.cluster.createVolGroup(nsName, ioMode); err != nil {
 			goto errDeal
 		}
 	}
@@ -143,6 +145,60 @@ errDeal:
 	return
 }
 
+// setThrottle sets the io limit of a vol group, a namespace or a client, the
+// limit of 0 iops and 0 bandwidth removes it
+func (m *Master) setThrottle(w http.ResponseWriter, r *http.Request) {
+	var (
+		volID  uint64
+		name   string
+		client string
+		limit  *proto.ThrottleLimit
+		msg    string
+		err    error
+	)
+
+	if volID, name, client, limit, err = parseSetThrottlePara(r); err != nil {
+		goto errDeal
+	}
+	switch {
+	case volID != 0:
+		err = m.cluster.setVolThrottle(volID, limit)
+	case name != "":
+		err = m.cluster.setNamespaceThrottle(name, limit)
+	default:
+		err = m.cluster.setClientThrottle(client, limit)
+	}
+	if err != nil {
+		goto errDeal
+	}
+	msg = fmt.Sprintf(AdminSetThrottle+" vol:%v namespace:%v client:%v iops:%v bandwidth:%v success",
+		volID, name, client, limit.Iops, limit.Bandwidth)
+	io.WriteString(w, msg)
+	log.LogWarn(msg)
+	return
+errDeal:
+	logMsg := getReturnMessage(AdminSetThrottle, r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) getThrottle(w http.ResponseWriter, r *http.Request) {
+	var (
+		body []byte
+		err  error
+	)
+
+	if body, err = json.Marshal(m.cluster.getThrottleLimits()); err != nil {
+		goto errDeal
+	}
+	io.WriteString(w, string(body))
+	return
+errDeal:
+	logMsg := getReturnMessage(AdminGetThrottle, r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, http.StatusBadRequest, w)
+	return
+}
+
 func (m *Master) createNamespace(w http.ResponseWriter, r *http.Request) {
 	var (
 		name       string
@@ -419,7 +475,7 @@ func parseCreateNamespacePara(r *http.Request) (name string, replicaNum int, err
 	return
 }
 
-func parseCreateVolPara(r *http.Request) (count int, name string, err error) {
+func parseCreateVolPara(r *http.Request) (count int, name, ioMode string, err error) {
 	r.ParseForm()
 	if countStr := r.FormValue(ParaCount); countStr == "" {
 		err = paraNotFound(ParaCount)
@@ -431,6 +487,11 @@ func parseCreateVolPara(r *http.Request) (count int, name string, err error) {
 	if name, err = checkNamespace(r); err != nil {
 		return
 	}
+	if ioMode = r.FormValue(ParaIoMode); ioMode != "" {
+		if _, err = storage.ParseIoMode(ioMode); err != nil {
+			err = UnMatchPara
+		}
+	}
 	return
 }
 
@@ -469,6 +530,44 @@ func parseVolOfflinePara(r *http.Request) (nodeAddr string, volID uint64, name s
 	return
 }
 
+// parseSetThrottlePara parses the target, which is one of the vol group, the
+// namespace and the client, and the limit of it
+func parseSetThrottlePara(r *http.Request) (volID uint64, name, client string, limit *proto.ThrottleLimit, err error) {
+	r.ParseForm()
+	targets := 0
+	if value := r.FormValue(ParaVolGroup); value != "" {
+		if volID, err = strconv.ParseUint(value, 10, 64); err != nil || volID == 0 {
+			err = UnMatchPara
+			return
+		}
+		targets++
+	}
+	if name = r.FormValue(ParaName); name != "" {
+		targets++
+	}
+	if client = r.FormValue(ParaClient); client != "" {
+		targets++
+	}
+	if targets != 1 {
+		err = paraNotFound(fmt.Sprintf("one of %v,%v,%v", ParaVolGroup, ParaName, ParaClient))
+		return
+	}
+	limit = &proto.ThrottleLimit{}
+	if value := r.FormValue(ParaIops); value != "" {
+		if limit.Iops, err = strconv.ParseInt(value, 10, 64); err != nil || limit.Iops < 0 {
+			err = UnMatchPara
+			return
+		}
+	}
+	if value := r.FormValue(ParaBandwidth); value != "" {
+		if limit.Bandwidth, err = strconv.ParseInt(value, 10, 64); err != nil || limit.Bandwidth < 0 {
+			err = UnMatchPara
+			return
+		}
+	}
+	return
+}
+
 func checkNodeAddr(r *http.Request) (nodeAddr string, err error) {
 	if nodeAddr = r.FormValue(ParaNodeAddr); nodeAddr == "" {
 		err = paraNotFound(ParaNodeAddr)
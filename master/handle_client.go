@@ -7,9 +7,12 @@ import (
 
 type VolResponse struct {
 	VolID      uint64
-	Status     uint8
+	Status     int
 	ReplicaNum uint8
 	Hosts      []string
+	// The shards of an erasure coded volume, Hosts[i] keeps the i-th shard.
+	EcDataNum   uint8
+	EcParityNum uint8
 }
 
 type VolsView struct {
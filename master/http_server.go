@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/tiglabs/baudstorage/proto"
 	"github.com/tiglabs/baudstorage/util/log"
 )
 
@@ -14,6 +15,8 @@ const (
 	AdminCreateVol       = "admin/createVol"
 	AdminVolOffline      = "admin/volOffline"
 	AdminCreateNamespace = "admin/createNamespace"
+	AdminSetThrottle     = "admin/setThrottle"
+	AdminGetThrottle     = "admin/getThrottle"
 
 	// Client APIs
 	ClientVols      = "client/vols"
@@ -29,8 +32,8 @@ const (
 	GetMetaNode     = "admin/getMetaNode"
 
 	// Operation response
-	MetaNodeResponse = "metaNode/response" // Method: 'POST', ContentType: 'application/json'
-	DataNodeResponse = "dataNode/response" // Method: 'POST', ContentType: 'application/json'
+	MetaNodeResponse = proto.MetaNodeResponsePath // Method: 'POST', ContentType: 'application/json'
+	DataNodeResponse = proto.DataNodeResponsePath // Method: 'POST', ContentType: 'application/json'
 )
 
 func (m *Master) startHttpService() (err error) {
@@ -70,6 +73,10 @@ func (m *Master) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		m.volOffline(w, r)
 	case AdminCreateNamespace:
 		m.createNamespace(w, r)
+	case AdminSetThrottle:
+		m.setThrottle(w, r)
+	case AdminGetThrottle:
+		m.getThrottle(w, r)
 	case DataNodeOffline:
 		m.dataNodeOffline(w, r)
 	case MetaNodeOffline:
@@ -0,0 +1,22 @@
+package master
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/tiglabs/baudstorage/util/log"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "master-log")
+	if err != nil {
+		panic(err)
+	}
+	if _, err = log.NewLog(dir, "master", log.DebugLevel); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
@@ -8,11 +8,12 @@ import (
 	"github.com/tiglabs/baudstorage/util/log"
 )
 
-func newCreateVolRequest(volType string, volId uint64) (req *proto.CreateVolRequest) {
+func newCreateVolRequest(volType string, volId uint64, ioMode string) (req *proto.CreateVolRequest) {
 	req = &proto.CreateVolRequest{
 		VolType: volType,
 		VolId:   volId,
 		VolSize: util.DefaultVolSize,
+		IoMode:  ioMode,
 	}
 	return
 }
@@ -25,6 +26,46 @@ func newLoadVolMetricRequest(volType string, volId uint64) (req *proto.LoadVolRe
 	return
 }
 
+func newDeleteVolRequest(volType string, volId uint64) (req *proto.DeleteVolRequest) {
+	req = &proto.DeleteVolRequest{
+		VolType: volType,
+		VolId:   volId,
+		VolSize: util.DefaultVolSize,
+	}
+	return
+}
+
+func newConvertToEcRequest(volId uint64, dataNum, parityNum uint8, ecHosts, replicas []string) (req *proto.ConvertToEcRequest) {
+	req = &proto.ConvertToEcRequest{
+		VolId:     volId,
+		DataNum:   int(dataNum),
+		ParityNum: int(parityNum),
+		EcHosts:   ecHosts,
+		Replicas:  replicas,
+	}
+	return
+}
+
+func newEcRepairRequest(volId uint64, dataNum, parityNum uint8, shardIndex int, hosts []string) (req *proto.EcRepairRequest) {
+	req = &proto.EcRepairRequest{
+		VolId:      volId,
+		DataNum:    int(dataNum),
+		ParityNum:  int(parityNum),
+		ShardIndex: shardIndex,
+		Hosts:      hosts,
+	}
+	return
+}
+
+func newReplicateFileRequest(volId uint64, name string, hosts []string) (req *proto.ReplicateFileRequest) {
+	req = &proto.ReplicateFileRequest{
+		VolId: volId,
+		Name:  name,
+		Hosts: hosts,
+	}
+	return
+}
+
 func newDeleteFileRequest(volId uint64, name string) (req *proto.DeleteFileRequest) {
 	req = &proto.DeleteFileRequest{
 		VolId: volId,
@@ -50,6 +91,16 @@ func UnmarshalTaskResponse(task *proto.AdminTask) (err error) {
 		response = &proto.CreateMetaRangeResponse{}
 	case OpDeleteFile:
 		response = &proto.DeleteFileResponse{}
+	case OpReplicateFile:
+		response = &proto.ReplicateFileResponse{}
+	case OpDataNodeHeartbeat:
+		response = &proto.DataNodeHeartBeatResponse{}
+	case OpConvertToEc:
+		response = &proto.ConvertToEcResponse{}
+	case OpEcRepair:
+		response = &proto.EcRepairResponse{}
+	case OpSetThrottle:
+		response = &proto.SetThrottleResponse{}
 	default:
 		log.LogError(fmt.Sprintf("unknown operate code(%v)", task.OpCode))
 	}
@@ -2,6 +2,7 @@ package master
 
 import (
 	"fmt"
+	"path"
 	"sync"
 
 	"github.com/tiglabs/baudstorage/util/config"
@@ -11,19 +12,31 @@ import (
 const (
 	HttpPort    = "httpPort"
 	LogDir      = "logDir"
+	ClusterName = "clusterName"
+	StoreDir    = "storeDir" // the dir the io limits are persisted to, optional
 	RootUrlPath = "/"
 )
 
+const ThrottleFileName = "throttle"
+
 type Master struct {
-	config  *config.Config
-	cluster *Cluster
-	wg      sync.WaitGroup
+	config      *config.Config
+	cluster     *Cluster
+	clusterName string
+	storeDir    string
+	wg          sync.WaitGroup
 }
 
 func (m *Master) Start(cfg *config.Config) (err error) {
 	if err = m.parseConfig(cfg); err != nil {
 		return
 	}
+	m.cluster = NewCluster(m.clusterName)
+	if m.storeDir != "" {
+		if err = m.cluster.loadThrottle(path.Join(m.storeDir, ThrottleFileName)); err != nil {
+			return
+		}
+	}
 	m.startHttpService()
 	return nil
 }
@@ -33,6 +46,8 @@ func (m *Master) parseConfig(cfg *config.Config) (err error) {
 	if logDir == "" {
 		return fmt.Errorf("bad config file,logDir is null")
 	}
+	m.clusterName = cfg.GetString(ClusterName)
+	m.storeDir = cfg.GetString(StoreDir)
 	return
 }
 
@@ -0,0 +1,238 @@
+package master
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/util/log"
+)
+
+// DefaultThrottleClient is the client name of the limit of every client not
+// limited by its own
+const DefaultThrottleClient = "default"
+
+// throttleLimits is the io limits of the DataNodes set by AdminSetThrottle
+type throttleLimits struct {
+	Vols          map[uint64]*proto.ThrottleLimit
+	Namespaces    map[string]*proto.ThrottleLimit
+	Clients       map[string]*proto.ThrottleLimit
+	DefaultClient *proto.ThrottleLimit
+}
+
+// throttleConfig keeps the limits, they are persisted to the throttle file of the store
+// dir when set, pushed to every DataNode, and sent with every heartbeat so the DataNode
+// restarted gets them too
+type throttleConfig struct {
+	throttleLimits
+	path string // the file the limits are persisted to, not persisted if empty
+	sync.RWMutex
+}
+
+func newThrottleLimits() (limits throttleLimits) {
+	limits.Vols = make(map[uint64]*proto.ThrottleLimit, 0)
+	limits.Namespaces = make(map[string]*proto.ThrottleLimit, 0)
+	limits.Clients = make(map[string]*proto.ThrottleLimit, 0)
+	return
+}
+
+func newThrottleConfig() (tc *throttleConfig) {
+	tc = new(throttleConfig)
+	tc.throttleLimits = newThrottleLimits()
+	return
+}
+
+func (limits *throttleLimits) clone() (c throttleLimits) {
+	c = newThrottleLimits()
+	for volID, limit := range limits.Vols {
+		c.Vols[volID] = limit
+	}
+	for name, limit := range limits.Namespaces {
+		c.Namespaces[name] = limit
+	}
+	for client, limit := range limits.Clients {
+		c.Clients[client] = limit
+	}
+	c.DefaultClient = limits.DefaultClient
+	return
+}
+
+// loadThrottle loads the limits persisted to path, the limits set after are persisted
+// to it too
+func (c *Cluster) loadThrottle(path string) (err error) {
+	var data []byte
+	limits := newThrottleLimits()
+	if data, err = ioutil.ReadFile(path); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		if err = json.Unmarshal(data, &limits); err != nil {
+			return fmt.Errorf("action[loadThrottle],file:%v  Err:%v ", path, err)
+		}
+	}
+	c.throttle.Lock()
+	c.throttle.throttleLimits = limits
+	c.throttle.path = path
+	c.throttle.Unlock()
+	return nil
+}
+
+// persistThrottle writes the limits to a temporary file, then renames it to path
+func persistThrottle(path string, limits *throttleLimits) (err error) {
+	var (
+		data []byte
+		f    *os.File
+	)
+	if path == "" {
+		return
+	}
+	if data, err = json.Marshal(limits); err != nil {
+		return
+	}
+	tmpFile := path + ".tmp"
+	if f, err = os.OpenFile(tmpFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644); err != nil {
+		return
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return
+	}
+	return os.Rename(tmpFile, path)
+}
+
+// updateThrottle applies update to a copy of the limits, the copy takes the place of
+// the limits after it is persisted, then it is pushed to the DataNodes
+func (c *Cluster) updateThrottle(update func(limits *throttleLimits)) (err error) {
+	c.throttle.Lock()
+	limits := c.throttle.clone()
+	update(&limits)
+	if err = persistThrottle(c.throttle.path, &limits); err == nil {
+		c.throttle.throttleLimits = limits
+	}
+	c.throttle.Unlock()
+	if err != nil {
+		return fmt.Errorf("action[updateThrottle],file:%v  Err:%v ", c.throttle.path, err)
+	}
+	c.pushThrottle()
+	return
+}
+
+// the zero limit removes the limit set before
+func isNoLimit(limit *proto.ThrottleLimit) bool {
+	return limit.Iops <= 0 && limit.Bandwidth <= 0
+}
+
+func (c *Cluster) setVolThrottle(volID uint64, limit *proto.ThrottleLimit) (err error) {
+	if _, err = c.getVolGroupByVolID(volID); err != nil {
+		return
+	}
+	return c.updateThrottle(func(limits *throttleLimits) {
+		if isNoLimit(limit) {
+			delete(limits.Vols, volID)
+		} else {
+			limits.Vols[volID] = limit
+		}
+	})
+}
+
+func (c *Cluster) setNamespaceThrottle(name string, limit *proto.ThrottleLimit) (err error) {
+	if _, err = c.getNamespace(name); err != nil {
+		return
+	}
+	return c.updateThrottle(func(limits *throttleLimits) {
+		if isNoLimit(limit) {
+			delete(limits.Namespaces, name)
+		} else {
+			limits.Namespaces[name] = limit
+		}
+	})
+}
+
+func (c *Cluster) setClientThrottle(client string, limit *proto.ThrottleLimit) (err error) {
+	return c.updateThrottle(func(limits *throttleLimits) {
+		switch {
+		case client == DefaultThrottleClient && isNoLimit(limit):
+			limits.DefaultClient = nil
+		case client == DefaultThrottleClient:
+			limits.DefaultClient = limit
+		case isNoLimit(limit):
+			delete(limits.Clients, client)
+		default:
+			limits.Clients[client] = limit
+		}
+	})
+}
+
+// getThrottleLimits returns a copy of the limits, with the namespace of every vol
+// group of the namespaces limited and the ips of the DataNodes
+func (c *Cluster) getThrottleLimits() (limits *proto.ThrottleLimits) {
+	limits = &proto.ThrottleLimits{
+		Vols:          make(map[uint64]*proto.ThrottleLimit, 0),
+		Namespaces:    make(map[string]*proto.ThrottleLimit, 0),
+		NamespaceVols: make(map[uint64]string, 0),
+		Clients:       make(map[string]*proto.ThrottleLimit, 0),
+	}
+	c.throttle.RLock()
+	for volID, limit := range c.throttle.Vols {
+		limits.Vols[volID] = limit
+	}
+	for name, limit := range c.throttle.Namespaces {
+		limits.Namespaces[name] = limit
+	}
+	for client, limit := range c.throttle.Clients {
+		limits.Clients[client] = limit
+	}
+	limits.DefaultClient = c.throttle.DefaultClient
+	c.throttle.RUnlock()
+	c.dataNodes.Range(func(addr, dataNode interface{}) bool {
+		ip, _, err := net.SplitHostPort(dataNode.(*DataNode).HttpAddr)
+		if err != nil {
+			ip = dataNode.(*DataNode).HttpAddr
+		}
+		limits.DataNodes = append(limits.DataNodes, ip)
+		return true
+	})
+	// the DataNode keeps the token buckets while the limits are the same
+	sort.Strings(limits.DataNodes)
+	for name := range limits.Namespaces {
+		ns, ok := c.namespaces[name]
+		if !ok {
+			continue
+		}
+		ns.volGroups.RLock()
+		for volID := range ns.volGroups.volGroupMap {
+			limits.NamespaceVols[volID] = name
+		}
+		ns.volGroups.RUnlock()
+	}
+	return
+}
+
+// pushThrottle sends the limits to every DataNode at once
+func (c *Cluster) pushThrottle() {
+	tasks := make([]*proto.AdminTask, 0)
+	limits := c.getThrottleLimits()
+	c.dataNodes.Range(func(addr, dataNode interface{}) bool {
+		node := dataNode.(*DataNode)
+		tasks = append(tasks, proto.NewAdminTask(OpSetThrottle, node.HttpAddr, &proto.SetThrottleRequest{Limits: limits}))
+		return true
+	})
+	c.putDataNodeTasks(tasks)
+}
+
+func (c *Cluster) dealSetThrottleResponse(nodeAddr string, resp *proto.SetThrottleResponse) {
+	if resp.Status != proto.CmdSuccess {
+		log.LogWarn(fmt.Sprintf("action[dealSetThrottleResponse],on :%v set throttle failed:%v", nodeAddr, resp.Result))
+	}
+	return
+}
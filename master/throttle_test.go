@@ -0,0 +1,50 @@
+package master
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/tiglabs/baudstorage/proto"
+)
+
+func newThrottleTestCluster(t *testing.T, file string) (c *Cluster) {
+	c = &Cluster{namespaces: make(map[string]*NameSpace), throttle: newThrottleConfig()}
+	if err := c.loadThrottle(file); err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+// The limits set are loaded by the master restarted, the limit not persisted
+// is not set.
+func TestThrottlePersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "master-throttle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, ThrottleFileName)
+	c := newThrottleTestCluster(t, file)
+	if err = c.setClientThrottle("10.0.0.1", &proto.ThrottleLimit{Iops: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.setClientThrottle(DefaultThrottleClient, &proto.ThrottleLimit{Bandwidth: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	expected := c.getThrottleLimits()
+	if restarted := newThrottleTestCluster(t, file).getThrottleLimits(); !reflect.DeepEqual(restarted, expected) {
+		t.Fatalf("limits loaded %+v, expected %+v", restarted, expected)
+	}
+
+	os.RemoveAll(dir)
+	if err = c.setClientThrottle("10.0.0.2", &proto.ThrottleLimit{Iops: 100}); err == nil {
+		t.Fatal("limit set without the store dir")
+	}
+	if limits := c.getThrottleLimits(); !reflect.DeepEqual(limits, expected) {
+		t.Fatalf("limits %+v after the persist failed, expected %+v", limits, expected)
+	}
+}
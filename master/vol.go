@@ -1,6 +1,10 @@
 package master
 
-import "time"
+import (
+	"time"
+
+	"github.com/tiglabs/baudstorage/proto"
+)
 
 type Vol struct {
 	addr              string
@@ -8,10 +12,11 @@ type Vol struct {
 	ReportTime        int64
 	FileCount         uint32
 	loc               uint8
-	status            uint8
+	status            int
 	LoadVolIsResponse bool
 	Total             uint64 `json:"TotalSize"`
 	Used              uint64 `json:"UsedSize"`
+	PhysicalUsed      uint64 `json:"PhysicalUsedSize"`
 }
 
 func NewVol(dataNode *DataNode) (v *Vol) {
@@ -34,7 +39,7 @@ func (v *Vol) CheckVolMiss(volMissSec int64) (isMiss bool) {
 }
 
 func (v *Vol) IsLive(volTimeOutSec int64) (avail bool) {
-	if v.dataNode.isActive == true && v.status != VolUnavailable &&
+	if v.dataNode.isActive == true && v.status != proto.VolUnavailable &&
 		v.IsActive(volTimeOutSec) == true {
 		avail = true
 	}
@@ -13,11 +13,16 @@ type VolGroup struct {
 	VolID            uint64
 	LastLoadTime     int64
 	replicaNum       uint8
-	status           uint8
+	status           int
 	isRecover        bool
 	locations        []*Vol
 	volType          string
+	ioMode           string
 	PersistenceHosts []string
+	EcDataNum        uint8
+	EcParityNum      uint8
+	ecConvert        *ecConvert
+	ecRepairs        map[string]*ecRepair
 	sync.Mutex
 
 	FileInCoreMap map[string]*FileInCore
@@ -31,6 +36,7 @@ func newVolGroup(volID uint64, replicaNum uint8) (vg *VolGroup) {
 	vg.PersistenceHosts = make([]string, 0)
 	vg.locations = make([]*Vol, 0)
 	vg.FileInCoreMap = make(map[string]*FileInCore, 0)
+	vg.ecRepairs = make(map[string]*ecRepair, 0)
 	return
 }
 
@@ -52,7 +58,7 @@ func (vg *VolGroup) checkBadStatus() {
 func (vg *VolGroup) generateCreateVolGroupTasks() (tasks []*proto.AdminTask) {
 	tasks = make([]*proto.AdminTask, 0)
 	for _, addr := range vg.PersistenceHosts {
-		tasks = append(tasks, proto.NewAdminTask(OpCreateVol, addr, newCreateVolRequest(vg.volType, vg.VolID)))
+		tasks = append(tasks, proto.NewAdminTask(OpCreateVol, addr, newCreateVolRequest(vg.volType, vg.VolID, vg.ioMode)))
 	}
 	return
 }
@@ -160,6 +166,21 @@ func (vg *VolGroup) generateLoadVolTasks() (tasks []*proto.AdminTask) {
 	return
 }
 
+func (vg *VolGroup) getVolView(addr string) (view *proto.VolView) {
+	vg.Lock()
+	defer vg.Unlock()
+	if vg.volType == proto.EcVol || !contains(vg.PersistenceHosts, addr) {
+		return
+	}
+	view = &proto.VolView{VolID: vg.VolID, Leader: vg.PersistenceHosts[0] == addr}
+	if view.Leader {
+		view.Followers = make([]string, len(vg.PersistenceHosts)-1)
+		copy(view.Followers, vg.PersistenceHosts[1:])
+	}
+
+	return
+}
+
 func (vg *VolGroup) getVolLocation(addr string) (vol *Vol, err error) {
 	for index := 0; index < len(vg.locations); index++ {
 		vol = vg.locations[index]
@@ -179,6 +200,8 @@ func (vg *VolGroup) convertToVolResponse() (vr *VolResponse) {
 	vr.VolID = vg.VolID
 	vr.Status = vg.status
 	vr.ReplicaNum = vg.replicaNum
+	vr.EcDataNum = vg.EcDataNum
+	vr.EcParityNum = vg.EcParityNum
 	vr.Hosts = make([]string, len(vg.PersistenceHosts))
 	copy(vr.Hosts, vg.PersistenceHosts)
 	return
@@ -324,7 +347,7 @@ func (vg *VolGroup) checkVolReplicationTask() (tasks []*proto.AdminTask) {
 			DeleteExcessReplicationErr, vg.VolID, excessAddr, excessErr.Error(), vg.PersistenceHosts)
 		log.LogWarn(msg)
 	}
-	if vg.status == VolReadWrite {
+	if vg.status == proto.VolReadWrite {
 		return
 	}
 	if lackTask, lackAddr, lackErr := vg.addLackReplication(); lackErr != nil {
@@ -370,7 +393,7 @@ func (vg *VolGroup) addLackReplication() (t *proto.AdminTask, lackAddr string, e
 			err = VolReplicationLackError
 			lackAddr = addr
 
-			t = proto.NewAdminTask(OpCreateVol, addr, newCreateVolRequest(vg.volType, vg.VolID))
+			t = proto.NewAdminTask(OpCreateVol, addr, newCreateVolRequest(vg.volType, vg.VolID, vg.ioMode))
 			vg.isRecover = true
 			break
 		}
@@ -425,10 +448,12 @@ func (vg *VolGroup) LoadFile(dataNode *DataNode, resp *proto.LoadVolResponse) {
 	}
 	volLoc := vg.locations[index]
 	volLoc.LoadVolIsResponse = true
+	reported := make(map[string]bool, len(resp.VolSnapshot))
 	for _, vf := range resp.VolSnapshot {
 		if vf == nil {
 			continue
 		}
+		reported[vf.Name] = true
 		fc, ok := vg.FileInCoreMap[vf.Name]
 		if !ok {
 			fc = NewFileInCore(vf.Name)
@@ -436,6 +461,14 @@ func (vg *VolGroup) LoadFile(dataNode *DataNode, resp *proto.LoadVolResponse) {
 		}
 		fc.updateFileInCore(vg.VolID, vf, volLoc, index)
 	}
+	// The snapshot lists every file of the node, the file not in it has been
+	// deleted on the node, such as the bad replica deleted by the crc check,
+	// and is found lacking by the file check.
+	for name, fc := range vg.FileInCoreMap {
+		if !reported[name] {
+			fc.deleteFileInNode(vg.VolID, volLoc)
+		}
+	}
 }
 
 func (vg *VolGroup) getVolLocationIndex(addr string) (volLocIndex int, err error) {
@@ -545,9 +578,10 @@ func (vg *VolGroup) UpdateVol(vr *proto.VolReport, dataNode *DataNode) {
 		volLoc = NewVol(dataNode)
 		vg.addMember(volLoc)
 	}
-	volLoc.status = (uint8)(vr.VolStatus)
+	volLoc.status = vr.VolStatus
 	volLoc.Total = vr.Total
 	volLoc.Used = vr.Used
+	volLoc.PhysicalUsed = vr.PhysicalUsed
 	volLoc.SetVolAlive()
 	vg.Lock()
 	vg.checkAndRemoveMissVol(dataNode.HttpAddr)
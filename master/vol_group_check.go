@@ -2,6 +2,7 @@ package master
 
 import (
 	"fmt"
+	"github.com/tiglabs/baudstorage/proto"
 	"github.com/tiglabs/baudstorage/util/log"
 	"time"
 )
@@ -10,16 +11,23 @@ func (vg *VolGroup) checkStatus(needLog bool, volTimeOutSec int64) {
 	vg.Lock()
 	defer vg.Unlock()
 	liveVolLocs := vg.getLiveVolsByPersistenceHosts(volTimeOutSec)
+	if vg.volType == proto.EcVol {
+		vg.checkEcStatus(liveVolLocs)
+		return
+	}
 	switch len(liveVolLocs) {
 	case 0:
-		vg.status = VolUnavailable
+		vg.status = proto.VolUnavailable
 	case (int)(vg.replicaNum):
-		vg.status = VolReadOnly
+		vg.status = proto.VolReadOnly
 		if vg.checkVolLocStatusOnLiveNode(liveVolLocs) == true {
-			vg.status = VolReadWrite
+			vg.status = proto.VolReadWrite
 		}
 	default:
-		vg.status = VolReadOnly
+		vg.status = proto.VolReadOnly
+	}
+	if vg.status != proto.VolUnavailable && (vg.ecConvert != nil || vg.hasSealedVolLoc(liveVolLocs)) {
+		vg.status = proto.VolSealed
 	}
 	if needLog == true {
 		msg := fmt.Sprintf("action[checkStatus],volID:%v  goal:%v  liveLocation:%v   VolStatus:%v  RocksDBHost:%v ",
@@ -30,7 +38,7 @@ func (vg *VolGroup) checkStatus(needLog bool, volTimeOutSec int64) {
 
 func (vg *VolGroup) checkVolLocStatusOnLiveNode(liveLocs []*Vol) (volEqual bool) {
 	for _, volLoc := range liveLocs {
-		if volLoc.status != VolReadWrite {
+		if volLoc.status != proto.VolReadWrite {
 			return
 		}
 	}
@@ -38,6 +46,17 @@ func (vg *VolGroup) checkVolLocStatusOnLiveNode(liveLocs []*Vol) (volEqual bool)
 	return true
 }
 
+// a vol group is sealed once any of its replicas is sealed
+func (vg *VolGroup) hasSealedVolLoc(liveLocs []*Vol) bool {
+	for _, volLoc := range liveLocs {
+		if volLoc.status == proto.VolSealed {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (vg *VolGroup) checkLocationStatus(volTimeOutSec int64) {
 	vg.Lock()
 	defer vg.Unlock()
@@ -109,13 +128,13 @@ func (vg *VolGroup) checkVolDiskError() (volDiskErrorAddrs []string) {
 		if !ok {
 			continue
 		}
-		if volLoc.status == VolUnavailable {
+		if volLoc.status == proto.VolUnavailable {
 			volDiskErrorAddrs = append(volDiskErrorAddrs, addr)
 		}
 	}
 
 	if len(volDiskErrorAddrs) != (int)(vg.replicaNum) && len(volDiskErrorAddrs) > 0 {
-		vg.status = VolReadOnly
+		vg.status = proto.VolReadOnly
 	}
 	vg.Unlock()
 
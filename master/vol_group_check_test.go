@@ -0,0 +1,34 @@
+package master
+
+import (
+	"testing"
+
+	"github.com/tiglabs/baudstorage/proto"
+)
+
+// The vol group is writable only if every replica is, and sealed once any
+// replica is sealed.
+func TestVolGroupStatus(t *testing.T) {
+	cases := []struct {
+		statuses []int
+		expected int
+	}{
+		{[]int{proto.VolReadWrite, proto.VolReadWrite}, proto.VolReadWrite},
+		{[]int{proto.VolReadWrite, proto.VolReadOnly}, proto.VolReadOnly},
+		{[]int{proto.VolReadWrite, proto.VolSealed}, proto.VolSealed},
+		{[]int{proto.VolReadOnly, proto.VolSealed}, proto.VolSealed},
+	}
+	for _, c := range cases {
+		vg := newVolGroup(1, uint8(len(c.statuses)))
+		vg.volType = proto.ExtentVol
+		for i, status := range c.statuses {
+			dataNode := &DataNode{HttpAddr: string('a' + byte(i)), isActive: true}
+			vg.PersistenceHosts = append(vg.PersistenceHosts, dataNode.HttpAddr)
+			vg.UpdateVol(&proto.VolReport{VolID: 1, VolStatus: status}, dataNode)
+		}
+		vg.checkStatus(false, DefaultVolTimeOutSec)
+		if vg.status != c.expected {
+			t.Fatalf("replicas %v: vol group status[%v], expected[%v]", c.statuses, vg.status, c.expected)
+		}
+	}
+}
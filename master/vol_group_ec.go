@@ -0,0 +1,424 @@
+package master
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/util/ec"
+	"github.com/tiglabs/baudstorage/util/log"
+)
+
+// ecConvert is the conversion of a cold replicated extent vol group to an erasure coded
+// one, the vol is created on every ec host first, then the leader of the group encodes its
+// extents into the shards on the ec hosts, hosts[i] keeps the i-th shard. The replicas are
+// deleted after every ec host reports the shards of all the extents converted
+type ecConvert struct {
+	dataNum    uint8
+	parityNum  uint8
+	hosts      []string
+	created    map[string]bool
+	extents    map[string]uint32 // the shard size of every extent converted
+	acked      map[string]bool
+	createTime int64
+	sendTime   int64
+	loadTime   int64
+}
+
+// ecRepair is the rebuild of a lost shard of an ec vol group on a new host
+type ecRepair struct {
+	shardIndex int
+	createTime int64
+	sendTime   int64
+}
+
+func isEcTaskRunning(sendTime int64) bool {
+	return time.Now().Unix()-sendTime < EcTaskTimeOutSec
+}
+
+func isCreateVolRunning(createTime int64) bool {
+	return time.Now().Unix()-createTime < DefaultVolTimeOutSec
+}
+
+func isLoadVolRunning(loadTime int64) bool {
+	return time.Now().Unix()-loadTime < DefaultVolTimeOutSec
+}
+
+func (vg *VolGroup) isEcVol() bool {
+	vg.Lock()
+	defer vg.Unlock()
+	return vg.volType == proto.EcVol
+}
+
+// an ec vol group is sealed, it is readable while any EcDataNum shards are live
+func (vg *VolGroup) checkEcStatus(liveVolLocs []*Vol) {
+	live := 0
+	for _, volLoc := range liveVolLocs {
+		if volLoc.status != proto.VolUnavailable {
+			live++
+		}
+	}
+	vg.status = proto.VolUnavailable
+	if live >= int(vg.EcDataNum) {
+		vg.status = proto.VolSealed
+	}
+}
+
+// the vol created on an ec host of the conversion is not a member of the group until
+// the conversion is done
+func (vg *VolGroup) ecHostCreated(addr string) (ok bool) {
+	vg.Lock()
+	defer vg.Unlock()
+	if vg.ecConvert == nil || !contains(vg.ecConvert.hosts, addr) {
+		return
+	}
+	vg.ecConvert.created[addr] = true
+
+	return true
+}
+
+// isColdVol reports whether the extent vol group is to be converted to an ec one: every
+// replica is live, no file is modified for coldSec, and every file not deleted is sealed
+// and the same on all the replicas
+func (vg *VolGroup) isColdVol(coldSec, volTimeOutSec int64) bool {
+	vg.Lock()
+	defer vg.Unlock()
+	if vg.volType != proto.ExtentVol || vg.ecConvert != nil || vg.status == proto.VolUnavailable {
+		return false
+	}
+	if len(vg.getLiveVolsByPersistenceHosts(volTimeOutSec)) != int(vg.replicaNum) {
+		return false
+	}
+	live := 0
+	now := time.Now().Unix()
+	for _, fc := range vg.FileInCoreMap {
+		if fc.MarkDel {
+			continue
+		}
+		if now-fc.LastModify < coldSec || len(fc.Metas) != int(vg.replicaNum) {
+			return false
+		}
+		for _, fm := range fc.Metas {
+			if !fm.Sealed || fm.Corrupt || fm.Size != fc.Metas[0].Size || fm.Crc != fc.Metas[0].Crc {
+				return false
+			}
+		}
+		live++
+	}
+
+	return live > 0
+}
+
+func (vg *VolGroup) isConvertingToEc() bool {
+	vg.Lock()
+	defer vg.Unlock()
+	return vg.ecConvert != nil
+}
+
+// checkEcTasks sends the conversion task after the vol is created on every ec host, the
+// load tasks to the ec hosts not reported the shards after the conversion, and the repair
+// task after the vol is created on the new host of a lost shard. The tasks timed out are
+// sent again
+func (vg *VolGroup) checkEcTasks() (tasks []*proto.AdminTask) {
+	tasks = make([]*proto.AdminTask, 0)
+	vg.Lock()
+	defer vg.Unlock()
+	if conv := vg.ecConvert; conv != nil {
+		switch {
+		case len(conv.created) < len(conv.hosts):
+			if !isCreateVolRunning(conv.createTime) {
+				tasks = append(tasks, conv.createVolTasks(vg.VolID, vg.ioMode)...)
+			}
+		case conv.extents == nil:
+			if !isEcTaskRunning(conv.sendTime) && len(vg.PersistenceHosts) > 0 {
+				conv.sendTime = time.Now().Unix()
+				replicas := make([]string, len(vg.PersistenceHosts)-1)
+				copy(replicas, vg.PersistenceHosts[1:])
+				tasks = append(tasks, proto.NewAdminTask(OpConvertToEc, vg.PersistenceHosts[0],
+					newConvertToEcRequest(vg.VolID, conv.dataNum, conv.parityNum, conv.hosts, replicas)))
+			}
+		case !isLoadVolRunning(conv.loadTime):
+			tasks = append(tasks, conv.loadVolTasks(vg.VolID)...)
+		}
+	}
+	for addr, repair := range vg.ecRepairs {
+		if _, ok := vg.IsInVolLocs(addr); !ok {
+			if !isCreateVolRunning(repair.createTime) {
+				repair.createTime = time.Now().Unix()
+				tasks = append(tasks, proto.NewAdminTask(OpCreateVol, addr, newCreateVolRequest(proto.EcVol, vg.VolID, vg.ioMode)))
+			}
+			continue
+		}
+		if isEcTaskRunning(repair.sendTime) {
+			continue
+		}
+		repair.sendTime = time.Now().Unix()
+		hosts := make([]string, len(vg.PersistenceHosts))
+		copy(hosts, vg.PersistenceHosts)
+		tasks = append(tasks, proto.NewAdminTask(OpEcRepair, addr,
+			newEcRepairRequest(vg.VolID, vg.EcDataNum, vg.EcParityNum, repair.shardIndex, hosts)))
+	}
+
+	return
+}
+
+func (conv *ecConvert) createVolTasks(volID uint64, ioMode string) (tasks []*proto.AdminTask) {
+	conv.createTime = time.Now().Unix()
+	for _, addr := range conv.hosts {
+		if !conv.created[addr] {
+			tasks = append(tasks, proto.NewAdminTask(OpCreateVol, addr, newCreateVolRequest(proto.EcVol, volID, ioMode)))
+		}
+	}
+
+	return
+}
+
+// loadVolTasks asks the ec hosts not reported yet for the snapshot of the shards
+func (conv *ecConvert) loadVolTasks(volID uint64) (tasks []*proto.AdminTask) {
+	conv.loadTime = time.Now().Unix()
+	for _, addr := range conv.hosts {
+		if !conv.acked[addr] {
+			tasks = append(tasks, proto.NewAdminTask(OpLoadVol, addr, newLoadVolMetricRequest(proto.EcVol, volID)))
+		}
+	}
+
+	return
+}
+
+// ecConverted records the shards the leader has written and checked, the ec hosts are
+// asked for the snapshot of them
+func (vg *VolGroup) ecConverted(extents map[string]uint32) (tasks []*proto.AdminTask) {
+	vg.Lock()
+	defer vg.Unlock()
+	conv := vg.ecConvert
+	if conv == nil {
+		return
+	}
+	conv.extents = extents
+	if conv.extents == nil {
+		conv.extents = make(map[string]uint32, 0)
+	}
+	conv.acked = make(map[string]bool, 0)
+
+	return conv.loadVolTasks(vg.VolID)
+}
+
+// ecShardsReported checks the snapshot reported by an ec host of the conversion, the host
+// acks once it has every shard converted sealed and of the size expected. The conversion
+// fails if a shard is lost, and is done after every ec host acks. isEcHost is false if
+// addr is not an ec host of the conversion
+func (vg *VolGroup) ecShardsReported(addr string, files []*proto.File) (tasks []*proto.AdminTask, isEcHost bool) {
+	vg.Lock()
+	defer vg.Unlock()
+	conv := vg.ecConvert
+	if conv == nil || !contains(conv.hosts, addr) {
+		return
+	}
+	isEcHost = true
+	if conv.extents == nil {
+		return
+	}
+	reported := make(map[string]*proto.File, len(files))
+	for _, f := range files {
+		if f != nil {
+			reported[f.Name] = f
+		}
+	}
+	for name, size := range conv.extents {
+		if f, ok := reported[name]; !ok || f.MarkDel || !f.Sealed || f.Size != size {
+			log.LogWarn(fmt.Sprintf("action[ecShardsReported],vol:%v  shard of extent:%v on :%v lost",
+				vg.VolID, name, addr))
+			return vg.ecConvertFailed(), true
+		}
+	}
+	conv.acked[addr] = true
+	if len(conv.acked) == len(conv.hosts) {
+		tasks = vg.ecConvertSuccess()
+	}
+
+	return
+}
+
+// ecConvertFailed gives up the conversion and deletes the vol on the ec hosts, the group
+// is converted again once it is found cold. It is called with the lock of vg held
+func (vg *VolGroup) ecConvertFailed() (tasks []*proto.AdminTask) {
+	tasks = make([]*proto.AdminTask, 0)
+	conv := vg.ecConvert
+	if conv == nil {
+		return
+	}
+	vg.ecConvert = nil
+	for _, addr := range conv.hosts {
+		tasks = append(tasks, proto.NewAdminTask(OpDeleteVol, addr, newDeleteVolRequest(proto.EcVol, vg.VolID)))
+	}
+	log.LogWarn(fmt.Sprintf("action[ecConvertFailed],vol:%v  replicas:%v  ec hosts:%v",
+		vg.VolID, vg.PersistenceHosts, conv.hosts))
+
+	return
+}
+
+// ecConvertSuccess makes the ec hosts the members of the group, and deletes the vol on
+// the replicas. It is called with the lock of vg held
+func (vg *VolGroup) ecConvertSuccess() (tasks []*proto.AdminTask) {
+	tasks = make([]*proto.AdminTask, 0)
+	conv := vg.ecConvert
+	if conv == nil {
+		return
+	}
+	oldHosts := vg.PersistenceHosts
+	oldVolType := vg.volType
+	vg.PersistenceHosts = conv.hosts
+	vg.replicaNum = uint8(len(conv.hosts))
+	vg.volType = proto.EcVol
+	vg.EcDataNum = conv.dataNum
+	vg.EcParityNum = conv.parityNum
+	vg.ecConvert = nil
+	vg.UpdateVolHosts()
+	for _, addr := range oldHosts {
+		vg.volOffLineInMem(addr)
+		vg.checkAndRemoveMissVol(addr)
+		tasks = append(tasks, proto.NewAdminTask(OpDeleteVol, addr, newDeleteVolRequest(oldVolType, vg.VolID)))
+	}
+	msg := fmt.Sprintf("action[ecConvertSuccess],vol:%v  replicas:%v  ec hosts:%v  data:%v  parity:%v",
+		vg.VolID, oldHosts, vg.PersistenceHosts, vg.EcDataNum, vg.EcParityNum)
+	log.LogWarn(msg)
+
+	return
+}
+
+// checkEcConvert starts the conversion of the cold extent vol groups of the namespace in
+// the background, at most maxEcConvertCount groups are converted at the same time
+func (c *Cluster) checkEcConvert(ns *NameSpace) {
+	ns.volGroups.RLock()
+	defer ns.volGroups.RUnlock()
+	converting := 0
+	cold := make([]*VolGroup, 0)
+	for _, vg := range ns.volGroups.volGroupMap {
+		if vg.isConvertingToEc() {
+			converting++
+		} else if vg.isColdVol(c.cfg.EcColdSec, c.cfg.VolTimeOutSec) {
+			cold = append(cold, vg)
+		}
+	}
+	for _, vg := range cold {
+		if converting >= c.cfg.maxEcConvertCount {
+			break
+		}
+		if c.convertVolToEc(vg) == nil {
+			converting++
+		}
+	}
+}
+
+// convertVolToEc starts the conversion of a cold extent vol group, the group is sealed
+// since, and the shards are placed on the hosts other than the replicas
+func (c *Cluster) convertVolToEc(vg *VolGroup) (err error) {
+	var hosts []string
+	vg.Lock()
+	defer vg.Unlock()
+	if hosts, err = c.getAvailDataNodeHosts("", vg.PersistenceHosts, ec.DefaultDataNum+ec.DefaultParityNum); err != nil {
+		goto errDeal
+	}
+	vg.ecConvert = &ecConvert{
+		dataNum:   ec.DefaultDataNum,
+		parityNum: ec.DefaultParityNum,
+		hosts:     hosts,
+		created:   make(map[string]bool, 0),
+	}
+	vg.status = proto.VolSealed
+	c.putDataNodeTasks(vg.ecConvert.createVolTasks(vg.VolID, vg.ioMode))
+	log.LogWarn(fmt.Sprintf("action[convertVolToEc],vol:%v  replicas:%v  ec hosts:%v",
+		vg.VolID, vg.PersistenceHosts, hosts))
+	return
+errDeal:
+	err = fmt.Errorf("action[convertVolToEc],vol:%v  Err:%v ", vg.VolID, err.Error())
+	log.LogError(err.Error())
+	return
+}
+
+// ecShardOffline moves the shard on offlineAddr to a new host at the same index, the
+// shard is rebuilt from the other shards there. It is called with the lock of vg held
+func (c *Cluster) ecShardOffline(offlineAddr string, vg *VolGroup, errMsg string) {
+	var (
+		newHosts []string
+		newAddr  string
+		index    int
+		live     int
+		msg      string
+		err      error
+	)
+	for _, volLoc := range vg.getLiveVolsByPersistenceHosts(c.cfg.VolTimeOutSec) {
+		if volLoc.addr != offlineAddr && volLoc.status != proto.VolUnavailable {
+			live++
+		}
+	}
+	if live < int(vg.EcDataNum) {
+		err = EcShardsNotEnough
+		goto errDeal
+	}
+	if newHosts, err = c.getAvailDataNodeHosts("", vg.PersistenceHosts, 1); err != nil {
+		goto errDeal
+	}
+	newAddr = newHosts[0]
+	for index = 0; index < len(vg.PersistenceHosts); index++ {
+		if vg.PersistenceHosts[index] == offlineAddr {
+			break
+		}
+	}
+	vg.PersistenceHosts[index] = newAddr
+	vg.UpdateVolHosts()
+	vg.volOffLineInMem(offlineAddr)
+	vg.checkAndRemoveMissVol(offlineAddr)
+	delete(vg.ecRepairs, offlineAddr)
+	vg.ecRepairs[newAddr] = &ecRepair{shardIndex: index, createTime: time.Now().Unix()}
+	c.putDataNodeTasks([]*proto.AdminTask{proto.NewAdminTask(OpCreateVol, newAddr, newCreateVolRequest(proto.EcVol, vg.VolID, vg.ioMode))})
+	goto errDeal
+errDeal:
+	msg = fmt.Sprintf(EcShardOfflineErr+errMsg+" vol:%v  shard:%v  on Node:%v  "+
+		"Rebuild It on newHost:%v   Err:%v , PersistenceHosts:%v  ",
+		vg.VolID, index, offlineAddr, newAddr, err, vg.PersistenceHosts)
+	log.LogWarn(msg)
+}
+
+func (c *Cluster) dealConvertToEcResponse(nodeAddr string, resp *proto.ConvertToEcResponse) {
+	vg, err := c.getVolGroupByVolID(resp.VolId)
+	if err != nil {
+		return
+	}
+	if resp.Status != proto.CmdSuccess {
+		log.LogWarn(fmt.Sprintf("action[dealConvertToEcResponse],vol:%v on :%v convert failed:%v",
+			resp.VolId, nodeAddr, resp.Result))
+		vg.Lock()
+		tasks := vg.ecConvertFailed()
+		vg.Unlock()
+		c.putDataNodeTasks(tasks)
+		return
+	}
+	c.putDataNodeTasks(vg.ecConverted(resp.Extents))
+
+	return
+}
+
+func (c *Cluster) dealEcRepairResponse(nodeAddr string, resp *proto.EcRepairResponse) {
+	vg, err := c.getVolGroupByVolID(resp.VolId)
+	if err != nil {
+		return
+	}
+	vg.Lock()
+	defer vg.Unlock()
+	repair, ok := vg.ecRepairs[nodeAddr]
+	if !ok || repair.shardIndex != resp.ShardIndex {
+		return
+	}
+	if resp.Status == proto.CmdSuccess {
+		delete(vg.ecRepairs, nodeAddr)
+		log.LogInfo(fmt.Sprintf("action[dealEcRepairResponse],vol:%v shard:%v on :%v repaired",
+			resp.VolId, resp.ShardIndex, nodeAddr))
+		return
+	}
+	repair.sendTime = 0
+	log.LogWarn(fmt.Sprintf("action[dealEcRepairResponse],vol:%v shard:%v on :%v repair failed:%v",
+		resp.VolId, resp.ShardIndex, nodeAddr, resp.Result))
+
+	return
+}
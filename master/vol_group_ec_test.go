@@ -0,0 +1,77 @@
+package master
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tiglabs/baudstorage/proto"
+)
+
+func newTestEcConvert() (vg *VolGroup) {
+	vg = newVolGroup(1, 2)
+	vg.volType = proto.ExtentVol
+	vg.PersistenceHosts = []string{"r1", "r2"}
+	vg.ecConvert = &ecConvert{
+		dataNum:   2,
+		parityNum: 1,
+		hosts:     []string{"e1", "e2", "e3"},
+		created:   map[string]bool{"e1": true, "e2": true, "e3": true},
+	}
+
+	return
+}
+
+// The replicas are deleted only after every ec host reports the shards of all
+// the extents converted.
+func TestEcShardsReported(t *testing.T) {
+	vg := newTestEcConvert()
+	tasks := vg.ecConverted(map[string]uint32{"1": 100, "2": 10})
+	if addrs := crcTaskAddrs(tasks, OpLoadVol); !reflect.DeepEqual(addrs, []string{"e1", "e2", "e3"}) {
+		t.Fatalf("load vol tasks to %v", addrs)
+	}
+	shards := []*proto.File{{Name: "1", Size: 100, Sealed: true}, {Name: "2", Size: 10, Sealed: true}}
+	if _, isEcHost := vg.ecShardsReported("r1", shards); isEcHost {
+		t.Fatal("replica taken as an ec host")
+	}
+	for _, addr := range []string{"e1", "e2"} {
+		if tasks, _ = vg.ecShardsReported(addr, shards); len(tasks) != 0 || !vg.isConvertingToEc() {
+			t.Fatalf("ec host[%v] acked: tasks %v", addr, crcTaskAddrs(tasks, OpDeleteVol))
+		}
+	}
+	if tasks = vg.checkEcTasks(); len(tasks) != 0 {
+		t.Fatalf("%v tasks while the load tasks are running", len(tasks))
+	}
+
+	tasks, _ = vg.ecShardsReported("e3", shards)
+	if addrs := crcTaskAddrs(tasks, OpDeleteVol); !reflect.DeepEqual(addrs, []string{"r1", "r2"}) {
+		t.Fatalf("delete vol tasks to %v", addrs)
+	}
+	if vg.volType != proto.EcVol || !reflect.DeepEqual(vg.PersistenceHosts, []string{"e1", "e2", "e3"}) {
+		t.Fatalf("vol type[%v] hosts %v after the conversion", vg.volType, vg.PersistenceHosts)
+	}
+}
+
+// A shard lost on any ec host fails the conversion, the shards are deleted and
+// the replicas are kept.
+func TestEcShardLost(t *testing.T) {
+	cases := []struct {
+		name  string
+		shard *proto.File
+	}{
+		{"missing", nil},
+		{"not sealed", &proto.File{Name: "1", Size: 100}},
+		{"short", &proto.File{Name: "1", Size: 50, Sealed: true}},
+		{"deleted", &proto.File{Name: "1", Size: 100, Sealed: true, MarkDel: true}},
+	}
+	for _, c := range cases {
+		vg := newTestEcConvert()
+		vg.ecConverted(map[string]uint32{"1": 100})
+		tasks, _ := vg.ecShardsReported("e1", []*proto.File{c.shard})
+		if addrs := crcTaskAddrs(tasks, OpDeleteVol); !reflect.DeepEqual(addrs, []string{"e1", "e2", "e3"}) {
+			t.Fatalf("%v: delete vol tasks to %v", c.name, addrs)
+		}
+		if vg.isConvertingToEc() || vg.volType != proto.ExtentVol || !reflect.DeepEqual(vg.PersistenceHosts, []string{"r1", "r2"}) {
+			t.Fatalf("%v: vol type[%v] hosts %v after the conversion failed", c.name, vg.volType, vg.PersistenceHosts)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package master
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/tiglabs/baudstorage/proto"
 	"github.com/tiglabs/baudstorage/util/log"
 	"runtime"
 	"sync"
@@ -79,7 +80,7 @@ func (vm *VolGroupMap) GetVolsView(minVolID uint64) (vrs []*VolResponse) {
 		if vol.VolID <= minVolID {
 			continue
 		}
-		if vol.status == VolUnavailable {
+		if vol.status == proto.VolUnavailable {
 			continue
 		}
 		vr := vol.convertToVolResponse()
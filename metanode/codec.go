@@ -0,0 +1,157 @@
+package metanode
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// The inodes, the dentries and the raft commands are encoded in binary, the
+// encodings start with the version of the codec and are refused by the codec
+// of another version. The integers are big endian.
+//
+//	Inode key:    | Inode(8) |
+//	Inode value:  | Type(4) | Size(8) | AccessTime(8) | ModifyTime(8) | HasStream(1) |
+//	                with stream: | Stream.Inode(8) | Count(4) | Count * ExtentKey |
+//	ExtentKey:    | VolId(4) | ExtentId(8) | Size(4) | Crc(4) |
+//	Dentry key:   | ParentId(8) | Name |
+//	Dentry value: | Inode(8) | Type(4) |
+//	Item:         | Version(1) | KeyLen(4) | Key | Value |
+//	Command:      | Version(1) | Op(4) | KeyLen(4) | Key | Value |
+//
+// The snapshots and the checkpoints keep the inodes and dentries as the
+// commands of opCreateInode and opCreateDentry, and as the items respectively.
+const codecVersion uint8 = 1
+
+const (
+	inodeValueLen  = 29
+	streamHeadLen  = 12
+	extentKeyLen   = 20
+	dentryValueLen = 12
+)
+
+// Errors
+var (
+	ErrCodecVersion = errors.New("unknown codec version")
+	ErrCodecCorrupt = errors.New("corrupt encoding")
+)
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return append(b, byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32),
+		byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// decoder reads the integers and bytes in order, the first read beyond the
+// data sets err and the reads after it return zeros and nil.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) next(n int) (b []byte) {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.data) {
+		d.err = ErrCodecCorrupt
+		return nil
+	}
+	b, d.data = d.data[:n], d.data[n:]
+	return
+}
+
+func (d *decoder) uint8() uint8 {
+	if b := d.next(1); len(b) == 1 {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.next(4); len(b) == 4 {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if b := d.next(8); len(b) == 8 {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+// rest returns the data not read.
+func (d *decoder) rest() (b []byte) {
+	b, d.data = d.data, nil
+	return
+}
+
+// version reads the version and checks it.
+func (d *decoder) version() {
+	if v := d.uint8(); d.err == nil && v != codecVersion {
+		d.err = ErrCodecVersion
+	}
+}
+
+// finish returns the error of the reads, the data left is corrupt too.
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) != 0 {
+		d.err = ErrCodecCorrupt
+	}
+	return d.err
+}
+
+func marshalItem(key, value []byte) (data []byte) {
+	data = make([]byte, 0, 5+len(key)+len(value))
+	data = append(data, codecVersion)
+	data = appendUint32(data, uint32(len(key)))
+	data = append(data, key...)
+	return append(data, value...)
+}
+
+func unmarshalItem(data []byte) (key, value []byte, err error) {
+	d := &decoder{data: data}
+	d.version()
+	key = d.next(int(d.uint32()))
+	value = d.rest()
+	err = d.finish()
+	return
+}
+
+// MarshalBinary returns the item encoding of the inode.
+func (i *Inode) MarshalBinary() ([]byte, error) {
+	return marshalItem(i.GetKeyBytes(), i.GetValueBytes()), nil
+}
+
+// UnmarshalBinary restores the inode from the item encoding.
+func (i *Inode) UnmarshalBinary(data []byte) (err error) {
+	key, value, err := unmarshalItem(data)
+	if err != nil {
+		return
+	}
+	if err = i.ParseKeyBytes(key); err != nil {
+		return
+	}
+	return i.ParseValueBytes(value)
+}
+
+// MarshalBinary returns the item encoding of the dentry.
+func (d *Dentry) MarshalBinary() ([]byte, error) {
+	return marshalItem(d.GetKeyBytes(), d.GetValueBytes()), nil
+}
+
+// UnmarshalBinary restores the dentry from the item encoding.
+func (d *Dentry) UnmarshalBinary(data []byte) (err error) {
+	key, value, err := unmarshalItem(data)
+	if err != nil {
+		return
+	}
+	if err = d.ParseKeyBytes(key); err != nil {
+		return
+	}
+	return d.ParseValueBytes(value)
+}
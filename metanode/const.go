@@ -34,9 +34,32 @@ type (
 	OpenReq = proto.OpenRequest
 	// MetaNode -> Client open file response struct
 	OpenResp = proto.OpenResponse
+	// Client -> MetaNode lookup dentry request struct
+	LookupReq = proto.LookupRequest
+	// MetaNode -> Client lookup dentry response struct
+	LookupResp = proto.LookupResponse
+	// Client -> MetaNode get inode request struct
+	InodeGetReq = proto.InodeGetRequest
+	// MetaNode -> Client get inode response struct
+	InodeGetResp = proto.InodeGetResponse
+	// Client -> MetaNode append extent keys request struct
+	AppendExtentKeyReq = proto.AppendExtentKeyRequest
+	// MetaNode -> Client append extent keys response struct
+	AppendExtentKeyResp = proto.AppendExtentKeyResponse
+	// Client -> MetaNode delete extent keys request struct
+	DelExtentKeyReq = proto.DelExtentKeyRequest
+	// MetaNode -> Client delete extent keys response struct
+	DelExtentKeyResp = proto.DelExtentKeyResponse
+	// Client -> MetaNode list extent keys request struct
+	GetExtentsReq = proto.GetExtentsRequest
+	// MetaNode -> Client list extent keys response struct
+	GetExtentsResp = proto.GetExtentsResponse
 )
 
-// For use when raft store and application apply
+// For use when raft store and application apply.
+// The reads opReadDir, opOpen and opExtentsList are served by the leader
+// without the raft log, they are kept for the values of the ops.
+// opSnapshotApplyID is the first item of the snapshots only.
 const (
 	opCreateInode = iota
 	opDeleteInode
@@ -45,4 +68,8 @@ const (
 	opReadDir
 	opOpen
 	opCreateMetaRange
+	opExtentsAdd
+	opExtentsDel
+	opExtentsList
+	opSnapshotApplyID
 )
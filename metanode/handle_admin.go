@@ -3,6 +3,8 @@ package metanode
 import (
 	"encoding/json"
 	"net"
+	"os"
+	"path"
 
 	"github.com/tiglabs/baudstorage/proto"
 )
@@ -37,7 +39,7 @@ func (m *MetaNode) opCreateMetaRange(conn net.Conn, p *Packet) (err error) {
 	}
 	// Unmarshal request to entity
 	req := &proto.CreateMetaRangeRequest{}
-	if err := json.Unmarshal(requestJson, req); err != nil {
+	if err = json.Unmarshal(requestJson, req); err != nil {
 		return
 	}
 	// Create new  MetaRange.
@@ -48,6 +50,7 @@ func (m *MetaNode) opCreateMetaRange(conn net.Conn, p *Packet) (err error) {
 		Cursor:      req.Start,
 		RaftGroupID: req.GroupId,
 		Peers:       req.Members,
+		RootDir:     path.Join(m.metaDir, metaManagePrefix+req.MetaId),
 	}
 	mr := NewMetaRange(mConf)
 	if err = m.metaRangeManager.SetMetaRange(mr); err != nil {
@@ -58,9 +61,15 @@ func (m *MetaNode) opCreateMetaRange(conn net.Conn, p *Packet) (err error) {
 			m.metaRangeManager.DeleteMetaRange(mr.ID)
 		}
 	}()
-	//TODO: Write to File
-
-	//TODO: create Raft
-
+	if err = os.MkdirAll(mr.RootDir, 0755); err != nil {
+		return
+	}
+	if err = mr.StoreMeta(); err != nil {
+		return
+	}
+	if err = m.createPartition(mr); err != nil {
+		return
+	}
+	go mr.StartStoreSchedule()
 	return
 }
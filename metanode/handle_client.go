@@ -118,3 +118,98 @@ func (m *MetaNode) opOpen(conn net.Conn, p *Packet) (err error) {
 	err = m.replyToClient(conn, p, resp)
 	return
 }
+
+// Handle OpMetaLookup
+func (m *MetaNode) opLookup(conn net.Conn, p *Packet) (err error) {
+	req := &LookupReq{}
+	if err = json.Unmarshal(p.Data, req); err != nil {
+		return
+	}
+	mr, err := m.metaRangeManager.LoadMetaRange(req.Namespace)
+	if err != nil {
+		return
+	}
+	resp, err := mr.Lookup(req)
+	if err != nil {
+		return
+	}
+	// Reply operation result to client though TCP connection.
+	err = m.replyToClient(conn, p, resp)
+	return
+}
+
+// Handle OpMetaInodeGet
+func (m *MetaNode) opInodeGet(conn net.Conn, p *Packet) (err error) {
+	req := &InodeGetReq{}
+	if err = json.Unmarshal(p.Data, req); err != nil {
+		return
+	}
+	mr, err := m.metaRangeManager.LoadMetaRange(req.Namespace)
+	if err != nil {
+		return
+	}
+	resp, err := mr.InodeGet(req)
+	if err != nil {
+		return
+	}
+	// Reply operation result to client though TCP connection.
+	err = m.replyToClient(conn, p, resp)
+	return
+}
+
+// Handle OpMetaExtentsAdd
+func (m *MetaNode) opAppendExtents(conn net.Conn, p *Packet) (err error) {
+	req := &AppendExtentKeyReq{}
+	if err = json.Unmarshal(p.Data, req); err != nil {
+		return
+	}
+	mr, err := m.metaRangeManager.LoadMetaRange(req.Namespace)
+	if err != nil {
+		return
+	}
+	resp, err := mr.AppendExtents(req)
+	if err != nil {
+		return
+	}
+	// Reply operation result to client though TCP connection.
+	err = m.replyToClient(conn, p, resp)
+	return
+}
+
+// Handle OpMetaExtentsDel
+func (m *MetaNode) opDeleteExtents(conn net.Conn, p *Packet) (err error) {
+	req := &DelExtentKeyReq{}
+	if err = json.Unmarshal(p.Data, req); err != nil {
+		return
+	}
+	mr, err := m.metaRangeManager.LoadMetaRange(req.Namespace)
+	if err != nil {
+		return
+	}
+	resp, err := mr.DeleteExtents(req)
+	if err != nil {
+		return
+	}
+	// Reply operation result to client though TCP connection.
+	err = m.replyToClient(conn, p, resp)
+	return
+}
+
+// Handle OpMetaExtentsList
+func (m *MetaNode) opListExtents(conn net.Conn, p *Packet) (err error) {
+	req := &GetExtentsReq{}
+	if err = json.Unmarshal(p.Data, req); err != nil {
+		return
+	}
+	mr, err := m.metaRangeManager.LoadMetaRange(req.Namespace)
+	if err != nil {
+		return
+	}
+	resp, err := mr.ListExtents(req)
+	if err != nil {
+		return
+	}
+	// Reply operation result to client though TCP connection.
+	err = m.replyToClient(conn, p, resp)
+	return
+}
@@ -0,0 +1,158 @@
+package metanode
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/sdk/stream"
+)
+
+// applyPartition leads a single replica, the commands submitted are applied
+// at once and counted, so are the read indexes.
+type applyPartition struct {
+	leaderPartition
+	mr         *MetaRange
+	submitted  uint64
+	readIndexs uint64
+}
+
+func (p *applyPartition) ReadIndex() error {
+	p.readIndexs++
+	return p.leaderPartition.ReadIndex()
+}
+
+func (p *applyPartition) Submit(cmd []byte) (interface{}, error) {
+	p.submitted++
+	return p.mr.store.Apply(cmd, p.submitted)
+}
+
+func (p *applyPartition) Truncate(index uint64) {
+}
+
+func newApplyMetaNode(t *testing.T) (m *MetaNode, mr *MetaRange, partition *applyPartition) {
+	mr = createTestMetaRange(t)
+	partition = &applyPartition{leaderPartition: leaderPartition{leader: true}, mr: mr}
+	mr.RaftPartition = partition
+	m = &MetaNode{metaRangeManager: NewMetaRangeManager()}
+	if err := m.metaRangeManager.SetMetaRange(mr); err != nil {
+		os.RemoveAll(mr.RootDir)
+		t.Fatal(err)
+	}
+	return
+}
+
+// routeTestRequest routes the request and unmarshals the reply into resp.
+func routeTestRequest(t *testing.T, m *MetaNode, opcode uint8, req, resp interface{}) {
+	reply, err := routeTestPacket(t, m, opcode, req)
+	if reply.Opcode != opcode || err != nil {
+		t.Fatalf("op[%v] reply opcode[%v] data[%s] err[%v]", opcode, reply.Opcode, reply.Data, err)
+	}
+	if err = json.Unmarshal(reply.Data, resp); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The extent keys appended to the stream of an inode are listed in order,
+// until they are deleted.
+func TestExtentKeys(t *testing.T) {
+	m, mr, partition := newApplyMetaNode(t)
+	defer os.RemoveAll(mr.RootDir)
+	const inode = 2
+	partition.submitted++
+	apply(t, mr, opCreateInode, NewInode(inode, 1), partition.submitted)
+	keys := []string{
+		(&stream.ExtentKey{VolId: 1, ExtentId: 1, Size: 4096, Crc: 1}).Marshal(),
+		(&stream.ExtentKey{VolId: 2, ExtentId: 7, Size: 100, Crc: 2}).Marshal(),
+	}
+	list := func() (resp *GetExtentsResp) {
+		resp = &GetExtentsResp{}
+		routeTestRequest(t, m, proto.OpMetaExtentsList, &GetExtentsReq{Namespace: mr.ID, Inode: inode}, resp)
+		return
+	}
+
+	appended := &AppendExtentKeyResp{}
+	routeTestRequest(t, m, proto.OpMetaExtentsAdd, &AppendExtentKeyReq{Namespace: mr.ID, Inode: inode, Extents: keys}, appended)
+	if appended.Status != proto.OpOk || appended.Size != 4196 {
+		t.Fatalf("append extents status[%v] size[%v]", appended.Status, appended.Size)
+	}
+	if resp := list(); !reflect.DeepEqual(resp.Extents, keys) || resp.Size != 4196 {
+		t.Fatalf("extents %v size[%v]", resp.Extents, resp.Size)
+	}
+
+	deleted := &DelExtentKeyResp{}
+	routeTestRequest(t, m, proto.OpMetaExtentsDel, &DelExtentKeyReq{Namespace: mr.ID, Inode: inode, Extents: keys[:1]}, deleted)
+	if deleted.Status != proto.OpOk {
+		t.Fatalf("delete extents status[%v]", deleted.Status)
+	}
+	if resp := list(); !reflect.DeepEqual(resp.Extents, keys[1:]) || resp.Size != 100 {
+		t.Fatalf("extents %v size[%v] after the delete", resp.Extents, resp.Size)
+	}
+
+	bad := &AppendExtentKeyResp{}
+	routeTestRequest(t, m, proto.OpMetaExtentsAdd, &AppendExtentKeyReq{Namespace: mr.ID, Inode: inode, Extents: []string{"bad"}}, bad)
+	if bad.Status != proto.OpArgMismatchErr {
+		t.Fatalf("append bad extent status[%v]", bad.Status)
+	}
+}
+
+// The reads are served by the local store once the read index is confirmed,
+// without submitting any command.
+func TestReadAfterReadIndex(t *testing.T) {
+	m, mr, partition := newApplyMetaNode(t)
+	defer os.RemoveAll(mr.RootDir)
+	index := applyTestLogs(t, mr, 1)
+	partition.submitted = index
+	const inode = 2
+	name := fmt.Sprintf("file%v", inode)
+
+	check := func(op string, status uint8) {
+		if status != proto.OpOk {
+			t.Fatalf("%v status[%v]", op, status)
+		}
+		if partition.readIndexs != 1 || partition.submitted != index {
+			t.Fatalf("%v read indexes[%v] submitted[%v]", op, partition.readIndexs, partition.submitted-index)
+		}
+		partition.readIndexs = 0
+	}
+
+	got := &InodeGetResp{}
+	routeTestRequest(t, m, proto.OpMetaInodeGet, &InodeGetReq{Namespace: mr.ID, Inode: inode}, got)
+	check("inode get", got.Status)
+	if got.Info == nil || got.Info.Inode != inode || len(got.Info.Extents) != 1 {
+		t.Fatalf("inode info %+v", got.Info)
+	}
+
+	found := &LookupResp{}
+	routeTestRequest(t, m, proto.OpMetaLookup, &LookupReq{Namespace: mr.ID, ParentID: 1, Name: name}, found)
+	check("lookup", found.Status)
+	if found.Inode != inode {
+		t.Fatalf("lookup inode[%v]", found.Inode)
+	}
+
+	dir := &ReadDirResp{}
+	routeTestRequest(t, m, proto.OpMetaReadDir, &ReadDirReq{Namespace: mr.ID, ParentID: 1}, dir)
+	check("read dir", dir.Status)
+	if len(dir.Children) != 9 {
+		t.Fatalf("children %v", dir.Children)
+	}
+	for _, child := range dir.Children {
+		if child.Name == "file3" {
+			t.Fatalf("deleted dentry read %v", child)
+		}
+	}
+
+	opened := &OpenResp{}
+	routeTestRequest(t, m, proto.OpMetaOpen, &OpenReq{Namespace: mr.ID, Inode: inode}, opened)
+	check("open", opened.Status)
+
+	extents := &GetExtentsResp{}
+	routeTestRequest(t, m, proto.OpMetaExtentsList, &GetExtentsReq{Namespace: mr.ID, Inode: inode}, extents)
+	check("list extents", extents.Status)
+	if len(extents.Extents) != 1 || extents.Size != 4096 {
+		t.Fatalf("extents %v size[%v]", extents.Extents, extents.Size)
+	}
+}
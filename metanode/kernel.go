@@ -1,11 +1,8 @@
 package metanode
 
 import (
-	"fmt"
 	"time"
 
-	"strconv"
-
 	"github.com/google/btree"
 	"github.com/tiglabs/baudstorage/sdk/stream"
 )
@@ -21,52 +18,49 @@ type Dentry struct {
 
 // Less tests whether the current dentry item is less than the given one.
 // This method is necessary fot B-Tree item implementation.
+// The dentries are ordered by ParentId and then Name, so the children of an
+// inode are adjacent in the B-Tree.
 func (d *Dentry) Less(than btree.Item) (less bool) {
 	dentry, ok := than.(*Dentry)
-	less = ok && d.GetKey() < dentry.GetKey()
-	return
-}
-
-// GetKeyString returns string value of key used as an index in the B-Tree consists
-// of ParentId and Name properties and connected by '*'.
-// Since the type of `InodeId` is uint64 and the maximum value is 1.844674407371e+19,
-// so the `ParentId` in key uses 20-bit character alignment to support fuzzy retrieval.
-// Example:
-//  +----------------------------------------------------+
-//  | ParentId    | Name  | ExtentKey                    |
-//  +----------------------------------------------------+
-//  |           1 | demo1 | "                   1*demo1" |
-//  | 84467440737 | demo2 | "         84467440737*demo2" |
-//  +----------------------------------------------------+
-func (d *Dentry) GetKey() (m string) {
-	return fmt.Sprintf("%10d*%s", d.ParentId, d.Name)
+	if !ok {
+		return false
+	}
+	if d.ParentId != dentry.ParentId {
+		return d.ParentId < dentry.ParentId
+	}
+	return d.Name < dentry.Name
 }
 
-// GetKeyBytes is the bytes version of GetKey method which returns byte slice result.
+// GetKeyBytes returns the binary key of the dentry which consists of ParentId
+// and Name properties, see codec.go.
 func (d *Dentry) GetKeyBytes() (m []byte) {
-	return []byte(d.GetKey())
+	m = make([]byte, 0, 8+len(d.Name))
+	m = appendUint64(m, d.ParentId)
+	return append(m, d.Name...)
 }
 
+// ParseKeyBytes restores ParentId and Name from the binary key.
 func (d *Dentry) ParseKeyBytes(k []byte) (err error) {
-	key := string(k)
-	_, err = fmt.Sscanf(key, "%d*%s", &d.ParentId, d.Name)
-	return
+	dec := &decoder{data: k}
+	d.ParentId = dec.uint64()
+	d.Name = string(dec.rest())
+	return dec.finish()
 }
 
-// GetValueString returns string value of this dentry which consists of Inode and Type properties.
-func (d *Dentry) GetValue() (m string) {
-	return fmt.Sprintf("%d*%d", d.Inode, d.Type)
-}
-
-// GetValueBytes is the bytes version of GetValue method which returns byte slice result.
+// GetValueBytes returns the binary value of the dentry which consists of Inode
+// and Type properties.
 func (d *Dentry) GetValueBytes() (m []byte) {
-	return []byte(d.GetValue())
+	m = make([]byte, 0, dentryValueLen)
+	m = appendUint64(m, d.Inode)
+	return appendUint32(m, d.Type)
 }
 
+// ParseValueBytes restores Inode and Type from the binary value.
 func (d *Dentry) ParseValueBytes(val []byte) (err error) {
-	value := string(val)
-	_, err = fmt.Sscanf(value, "%d*%d", &d.Inode, &d.Type)
-	return
+	dec := &decoder{data: val}
+	d.Inode = dec.uint64()
+	d.Type = dec.uint32()
+	return dec.finish()
 }
 
 // Inode wraps necessary properties of `inode` information in file system.
@@ -92,6 +86,18 @@ func NewInode(ino uint64, t uint32) *Inode {
 	}
 }
 
+// Copy returns a copy of the inode with its own extent keys. The inodes in the
+// inode tree are not changed in place but replaced by the copies changed, so
+// the clones of the tree taken by checkpoints stay unchanged.
+func (i *Inode) Copy() *Inode {
+	ino := *i
+	if i.Stream != nil {
+		ino.Stream = stream.NewStreamKey(i.Stream.Inode)
+		ino.Stream.Extents = append([]stream.ExtentKey(nil), i.Stream.Extents...)
+	}
+	return &ino
+}
+
 // Less tests whether the current inode item is less than the given one.
 // This method is necessary fot B-Tree item implementation.
 func (i *Inode) Less(than btree.Item) bool {
@@ -99,50 +105,72 @@ func (i *Inode) Less(than btree.Item) bool {
 	return ok && i.Inode < ino.Inode
 }
 
-// GetKey returns string value of key used as an index in the B-Tree consists of Inode property.
-func (i *Inode) GetKey() (m string) {
-	return fmt.Sprintf("%d", i.Inode)
-}
-
-// GetKeyBytes is the bytes version of GetKey method which returns byte slice result.
+// GetKeyBytes returns the binary key of the inode which consists of Inode property.
 func (i *Inode) GetKeyBytes() (m []byte) {
-
-	return []byte(i.GetKey())
+	return appendUint64(make([]byte, 0, 8), i.Inode)
 }
 
+// ParseKeyBytes restores Inode from the binary key.
 func (i *Inode) ParseKeyBytes(k []byte) (err error) {
-	key := string(k)
-	inodeID, err := strconv.ParseUint(key, 10, 64)
-	if err != nil {
-		return
-	}
-	i.Inode = inodeID
-	return
+	dec := &decoder{data: k}
+	i.Inode = dec.uint64()
+	return dec.finish()
 }
 
-// GetValue returns string value of this Inode which consists of Name, Size, AccessTime and
-// ModifyTime properties and connected by '*'.
-func (i *Inode) GetValue() (m string) {
-	s := fmt.Sprintf("%d*%d*%d*%d", i.Type, i.Size, i.AccessTime, i.ModifyTime)
-	i.Stream.Range(func(index int, extentKey stream.ExtentKey) bool {
-		if uint64(index) == i.Stream.Size() {
-			s += extentKey.Marshal()
-		} else {
-			s += "*"
-			s += extentKey.Marshal()
-		}
-		return true
-	})
-	return s
-}
-
-// GetValueBytes is the bytes version of GetValue method which returns byte slice result.
+// GetValueBytes returns the binary value of the inode which consists of Type,
+// Size, AccessTime, ModifyTime and the extent keys of Stream, see codec.go.
 func (i *Inode) GetValueBytes() (m []byte) {
-	return []byte(i.GetValue())
+	if i.Stream == nil {
+		m = make([]byte, 0, inodeValueLen)
+	} else {
+		m = make([]byte, 0, inodeValueLen+streamHeadLen+extentKeyLen*len(i.Stream.Extents))
+	}
+	m = appendUint32(m, i.Type)
+	m = appendUint64(m, i.Size)
+	m = appendUint64(m, uint64(i.AccessTime))
+	m = appendUint64(m, uint64(i.ModifyTime))
+	if i.Stream == nil {
+		return append(m, 0)
+	}
+	m = append(m, 1)
+	m = appendUint64(m, i.Stream.Inode)
+	m = appendUint32(m, uint32(len(i.Stream.Extents)))
+	for _, k := range i.Stream.Extents {
+		m = appendUint32(m, k.VolId)
+		m = appendUint64(m, k.ExtentId)
+		m = appendUint32(m, k.Size)
+		m = appendUint32(m, k.Crc)
+	}
+	return
 }
 
+// ParseValueBytes restores the properties but Inode from the binary value,
+// Stream is nil if the inode encoded has no stream.
 func (i *Inode) ParseValueBytes(val []byte) (err error) {
-	value := string(val)
-	_, err = fmt.Sscanf(value, "%d*%d*%d*%d", &i.Type, &i.Size, &i.AccessTime, &i.ModifyTime)
-	return
+	dec := &decoder{data: val}
+	i.Type = dec.uint32()
+	i.Size = dec.uint64()
+	i.AccessTime = int64(dec.uint64())
+	i.ModifyTime = int64(dec.uint64())
+	i.Stream = nil
+	switch dec.uint8() {
+	case 0:
+	case 1:
+		i.Stream = stream.NewStreamKey(dec.uint64())
+		count := int(dec.uint32())
+		if count > len(dec.data)/extentKeyLen {
+			return ErrCodecCorrupt
+		}
+		for n := 0; n < count; n++ {
+			i.Stream.Extents = append(i.Stream.Extents, stream.ExtentKey{
+				VolId:    dec.uint32(),
+				ExtentId: dec.uint64(),
+				Size:     dec.uint32(),
+				Crc:      dec.uint32(),
+			})
+		}
+	default:
+		return ErrCodecCorrupt
+	}
+	return dec.finish()
 }
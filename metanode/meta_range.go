@@ -1,9 +1,10 @@
 package metanode
 
 import (
-	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -13,6 +14,7 @@ import (
 	"github.com/tiglabs/baudstorage/proto"
 	"github.com/tiglabs/baudstorage/raftstore"
 	"github.com/tiglabs/baudstorage/sdk/stream"
+	"github.com/tiglabs/baudstorage/util/log"
 )
 
 // Errors
@@ -63,17 +65,7 @@ func (mr *MetaRange) Load() (err error) {
 	if err = mr.LoadMeta(); err != nil {
 		return
 	}
-	if err = mr.store.LoadInode(); err != nil {
-		return
-	}
-	if err = mr.store.LoadDentry(); err != nil {
-		return
-	}
-	// Restore ApplyID
-	if err = mr.store.LoadApplyID(); err != nil {
-		return
-	}
-	return
+	return mr.LoadCheckpoint()
 }
 
 // Load range meta from meta snapshot file.
@@ -93,68 +85,59 @@ func (mr *MetaRange) LoadMeta() (err error) {
 	if err = json.Unmarshal(data, &mConf); err != nil {
 		return
 	}
+	mConf.RootDir = mr.RootDir
+	mConf.Cursor = mConf.Start
 	mr.MetaRangeConfig = mConf
 	return
 }
 
+// StoreMeta writes the range meta to the meta file of the root dir.
+func (mr *MetaRange) StoreMeta() (err error) {
+	data, err := json.Marshal(mr.MetaRangeConfig)
+	if err != nil {
+		return
+	}
+	tmpFile := path.Join(mr.RootDir, ".meta")
+	err = storeFile(tmpFile, func(w io.Writer) (err error) {
+		_, err = w.Write(data)
+		return
+	})
+	if err != nil {
+		return
+	}
+	if err = os.Rename(tmpFile, path.Join(mr.RootDir, "meta")); err != nil {
+		return
+	}
+	return syncDir(mr.RootDir)
+}
+
+// StartStoreSchedule writes the checkpoint every hour if any raft log is applied,
+// or at once if more than 20000 raft logs are applied since the last one.
 func (mr *MetaRange) StartStoreSchedule() {
 	t := time.NewTicker(5 * time.Minute)
+	defer t.Stop()
 	next := time.Now().Add(time.Hour)
-	curApplyID := mr.store.applyID
-	for {
-		select {
-		case <-t.C:
-			now := time.Now()
-			if now.After(next) {
-				next = now.Add(time.Hour)
-				if (mr.store.applyID - curApplyID) > 0 {
-					curApplyID = mr.store.applyID
-					goto store
-				}
-				goto end
-			} else if (mr.store.applyID - curApplyID) > 20000 {
-				next = now.Add(time.Hour)
-				curApplyID = mr.store.applyID
-				goto store
+	curApplyID := mr.store.getApplyID()
+	for range t.C {
+		now := time.Now()
+		applyID := mr.store.getApplyID()
+		if now.After(next) {
+			next = now.Add(time.Hour)
+			if applyID == curApplyID {
+				continue
 			}
-			goto end
-		}
-	store:
-		// 1st: load applyID
-		if err := mr.store.StoreApplyID(); err != nil {
-			//TODO: Log
-			goto end
-		}
-		// 2st: load ino tree
-		if err := mr.store.StoreInodeTree(); err != nil {
-			//TODO: Log
-			goto end
-		}
-		// 3st: load dentry tree
-		if err := mr.store.StoreDentryTree(); err != nil {
-			//TODO: Log
-			goto end
-
-		}
-		// rename
-		if err := os.Rename(path.Join(mr.RootDir, "_inode"), path.Join(mr.RootDir, "inode")); err != nil {
-			//TODO: Log
-			goto end
-		}
-		if err := os.Rename(path.Join(mr.RootDir, "_dentry"), path.Join(mr.RootDir, "dentry")); err != nil {
-			//TODO: Log
-			goto end
+		} else if applyID-curApplyID <= 20000 {
+			continue
+		} else {
+			next = now.Add(time.Hour)
 		}
-		if err := os.Rename(path.Join(mr.RootDir, "_applyid"), path.Join(mr.RootDir, "applyid")); err != nil {
-			//TODO: Log
-			goto end
+		stored, err := mr.StoreCheckpoint()
+		if err != nil {
+			log.LogError(fmt.Sprintf("meta range[%v] store checkpoint: %v", mr.ID, err))
+			continue
 		}
-	end:
-		os.Remove(path.Join(mr.RootDir, "_applyid"))
-		os.Remove(path.Join(mr.RootDir, "_inode"))
-		os.Remove(path.Join(mr.RootDir, "_dentry"))
+		curApplyID = stored
 	}
-	return
 }
 
 // UpdatePeers
@@ -162,6 +145,34 @@ func (mr *MetaRange) UpdatePeers(peers []proto.Peer) {
 	mr.Peers = peers
 }
 
+// IsLeader returns true if this node is the raft leader of the meta range,
+// or the address of the leader in peers otherwise, which is empty if the
+// leader is unknown.
+func (mr *MetaRange) IsLeader() (leaderAddr string, ok bool) {
+	if mr.RaftPartition.IsLeader() {
+		return "", true
+	}
+	leaderID, _ := mr.RaftPartition.LeaderTerm()
+	for _, peer := range mr.Peers {
+		if leaderID != 0 && peer.ID == leaderID {
+			leaderAddr = peer.Addr
+			return
+		}
+	}
+	return
+}
+
+// updateCursor raises the cursor to the inode ID created, so the IDs are not
+// assigned again after the inodes are loaded or replayed.
+func (mr *MetaRange) updateCursor(inodeId uint64) {
+	for {
+		cur := atomic.LoadUint64(&mr.Cursor)
+		if cur >= inodeId || atomic.CompareAndSwapUint64(&mr.Cursor, cur, inodeId) {
+			return
+		}
+	}
+}
+
 // NextInodeId returns a new ID value of inode and update offset.
 // If inode ID is out of this MetaRange limit then return ErrInodeOutOfRange error.
 func (mr *MetaRange) nextInodeID() (inodeId uint64, err error) {
@@ -179,18 +190,14 @@ func (mr *MetaRange) nextInodeID() (inodeId uint64, err error) {
 }
 
 func (mr *MetaRange) CreateDentry(req *CreateDentryReq) (data []byte, err error) {
-	var resp *CreateDentryResp
+	resp := &CreateDentryResp{}
 	dentry := &Dentry{
 		ParentId: req.ParentID,
 		Name:     req.Name,
 		Inode:    req.Inode,
 		Type:     req.Mode,
 	}
-	val, err := json.Marshal(dentry)
-	if err != nil {
-		return
-	}
-	r, err := mr.put(opCreateDentry, val)
+	r, err := mr.put(opCreateDentry, dentry)
 	if err != nil {
 		return
 	}
@@ -200,16 +207,12 @@ func (mr *MetaRange) CreateDentry(req *CreateDentryReq) (data []byte, err error)
 }
 
 func (mr *MetaRange) DeleteDentry(req *DeleteDentryReq) (data []byte, err error) {
-	var resp *DeleteDentryResp
+	resp := &DeleteDentryResp{}
 	dentry := &Dentry{
 		ParentId: req.ParentID,
 		Name:     req.Name,
 	}
-	val, err := json.Marshal(dentry)
-	if err != nil {
-		return
-	}
-	r, err := mr.put(opDeleteDentry, val)
+	r, err := mr.put(opDeleteDentry, dentry)
 	if err != nil {
 		return
 	}
@@ -236,11 +239,7 @@ func (mr *MetaRange) CreateInode(req *CreateInoReq) (data []byte, err error) {
 		ModifyTime: ts,
 		Stream:     stream.NewStreamKey(resp.Info.Inode),
 	}
-	val, err := json.Marshal(ino)
-	if err != nil {
-		return
-	}
-	r, err := mr.put(opCreateInode, val)
+	r, err := mr.put(opCreateInode, ino)
 	if err != nil {
 		return
 	}
@@ -254,11 +253,7 @@ func (mr *MetaRange) DeleteInode(req *DeleteInoReq) (data []byte, err error) {
 	ino := &Inode{
 		Inode: req.Inode,
 	}
-	val, err := json.Marshal(ino)
-	if err != nil {
-		return
-	}
-	r, err := mr.put(opDeleteInode, val)
+	r, err := mr.put(opDeleteInode, ino)
 	if err != nil {
 		return
 	}
@@ -267,41 +262,128 @@ func (mr *MetaRange) DeleteInode(req *DeleteInoReq) (data []byte, err error) {
 	return
 }
 
-func (mr *MetaRange) PutStreamKey() {
+// AppendExtents appends the extent keys to the stream of the inode.
+func (mr *MetaRange) AppendExtents(req *AppendExtentKeyReq) (data []byte, err error) {
+	var resp *AppendExtentKeyResp
+	ino, err := newExtentsInode(req.Inode, req.Extents)
+	if err != nil {
+		resp = &AppendExtentKeyResp{}
+		resp.Status = proto.OpArgMismatchErr
+		data, err = json.Marshal(resp)
+		return
+	}
+	r, err := mr.put(opExtentsAdd, ino)
+	if err != nil {
+		return
+	}
+	resp = r.(*AppendExtentKeyResp)
+	data, err = json.Marshal(resp)
 	return
 }
 
-func (mr *MetaRange) ReadDir(req *ReadDirReq) (data []byte, err error) {
-	// TODO: Implement read dir operation.
-	val, err := json.Marshal(req)
+// DeleteExtents removes the extent keys from the stream of the inode.
+func (mr *MetaRange) DeleteExtents(req *DelExtentKeyReq) (data []byte, err error) {
+	var resp *DelExtentKeyResp
+	ino, err := newExtentsInode(req.Inode, req.Extents)
 	if err != nil {
+		resp = &DelExtentKeyResp{}
+		resp.Status = proto.OpArgMismatchErr
+		data, err = json.Marshal(resp)
 		return
 	}
-	resp, err := mr.put(opReadDir, val)
+	r, err := mr.put(opExtentsDel, ino)
 	if err != nil {
 		return
 	}
+	resp = r.(*DelExtentKeyResp)
+	data, err = json.Marshal(resp)
+	return
+}
+
+// ListExtents returns the extent keys of the stream of the inode.
+func (mr *MetaRange) ListExtents(req *GetExtentsReq) (data []byte, err error) {
+	if err = mr.readIndex(); err != nil {
+		return
+	}
+	resp := mr.store.ListExtents(&Inode{
+		Inode: req.Inode,
+	})
+	data, err = json.Marshal(resp)
+	return
+}
+
+// newExtentsInode returns the inode carrying the extent keys marshaled of an
+// extents operation, the modify time is set here so that every replica
+// applies the same.
+func newExtentsInode(inode uint64, extents []string) (ino *Inode, err error) {
+	ino = &Inode{
+		Inode:      inode,
+		ModifyTime: time.Now().Unix(),
+		Stream:     stream.NewStreamKey(inode),
+	}
+	for _, m := range extents {
+		k := stream.ExtentKey{}
+		if err = k.UnMarshal(m); err != nil {
+			return
+		}
+		ino.Stream.Extents = append(ino.Stream.Extents, k)
+	}
+	return
+}
+
+func (mr *MetaRange) ReadDir(req *ReadDirReq) (data []byte, err error) {
+	if err = mr.readIndex(); err != nil {
+		return
+	}
+	resp := mr.store.ReadDir(req)
 	data, err = json.Marshal(resp)
 	return
 }
 
 func (mr *MetaRange) Open(req *OpenReq) (data []byte, err error) {
-	// TODO: Implement open operation.
-	val, err := json.Marshal(req)
-	if err != nil {
+	if err = mr.readIndex(); err != nil {
 		return
 	}
-	resp, err := mr.put(opOpen, val)
-	if err != nil {
+	resp := mr.store.OpenFile(req)
+	data, err = json.Marshal(resp)
+	return
+}
+
+func (mr *MetaRange) Lookup(req *LookupReq) (data []byte, err error) {
+	if err = mr.readIndex(); err != nil {
 		return
 	}
+	resp := mr.store.Lookup(req)
 	data, err = json.Marshal(resp)
 	return
 }
 
-func (mr *MetaRange) put(op uint32, body []byte) (r interface{}, err error) {
-	key := make([]byte, 4)
-	binary.BigEndian.PutUint32(key, op)
-	r, err = mr.store.Put(key, body)
+func (mr *MetaRange) InodeGet(req *InodeGetReq) (data []byte, err error) {
+	if err = mr.readIndex(); err != nil {
+		return
+	}
+	resp := mr.store.InodeGet(req)
+	data, err = json.Marshal(resp)
+	return
+}
+
+// readIndex confirms the leadership before a read, see Partition.ReadIndex.
+// Any failure of it is returned as raftstore.ErrNotLeader, the read changes
+// nothing and is sent to the leader again.
+func (mr *MetaRange) readIndex() (err error) {
+	if err = mr.RaftPartition.ReadIndex(); err != nil {
+		err = raftstore.ErrNotLeader
+	}
+	return
+}
+
+// metaItem is the inode or dentry of a raft command.
+type metaItem interface {
+	GetKeyBytes() []byte
+	GetValueBytes() []byte
+}
+
+func (mr *MetaRange) put(op uint32, item metaItem) (r interface{}, err error) {
+	r, err = mr.store.Put(op, item.GetKeyBytes(), item.GetValueBytes())
 	return
 }
@@ -1,13 +1,12 @@
 package metanode
 
 import (
-	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"sync"
 
 	"github.com/google/btree"
-	"github.com/kubernetes/kubernetes/staging/src/k8s.io/apimachinery/pkg/util/json"
 	"github.com/tiglabs/raft"
 	raftproto "github.com/tiglabs/raft/proto"
 )
@@ -18,6 +17,7 @@ const defaultBTreeDegree = 32
 // and manage dentry and inode by B-Tree in memory.
 type MetaRangeFsm struct {
 	metaRange  *MetaRange
+	applyMu    sync.Mutex   // Mutex held while applying, the trees and applyID are taken together under it.
 	applyID    uint64       // for restore inode/dentry max applyID
 	dentryMu   sync.RWMutex // Mutex for dentry operation.
 	dentryTree *btree.BTree // B-Tree for dentry.
@@ -26,57 +26,60 @@ type MetaRangeFsm struct {
 }
 
 func (mf *MetaRangeFsm) Apply(command []byte, index uint64) (resp interface{}, err error) {
-	msg := &MetaRangeSnapshot{}
-	err = msg.Decode(command)
-	if err != nil {
-		goto end
+	mf.applyMu.Lock()
+	defer mf.applyMu.Unlock()
+	var (
+		msg = &MetaRangeSnapshot{}
+		ino *Inode
+		den *Dentry
+	)
+	// The command not decoded is not applied, applyID stays at the last
+	// command applied.
+	if err = msg.Decode(command); err != nil {
+		return
 	}
 	//TODO
 	switch msg.Op {
 	case opCreateInode:
-		ino := &Inode{}
-		if err = json.Unmarshal(msg.V, ino); err != nil {
-			goto end
+		if ino, err = decodeInode(msg.K, msg.V); err != nil {
+			return
 		}
 		resp = mf.CreateInode(ino)
+		mf.metaRange.updateCursor(ino.Inode)
 	case opDeleteInode:
-		ino := &Inode{}
-		if err = json.Unmarshal(msg.V, ino); err != nil {
-			goto end
+		if ino, err = decodeInode(msg.K, msg.V); err != nil {
+			return
 		}
 		resp = mf.DeleteInode(ino)
 	case opCreateDentry:
-		den := &Dentry{}
-		if err = json.Unmarshal(msg.V, den); err != nil {
-			goto end
+		if den, err = decodeDentry(msg.K, msg.V); err != nil {
+			return
 		}
 		resp = mf.CreateDentry(den)
 	case opDeleteDentry:
-		den := &Dentry{}
-		if err = json.Unmarshal(msg.V, den); err != nil {
-			goto end
+		if den, err = decodeDentry(msg.K, msg.V); err != nil {
+			return
 		}
 		resp = mf.DeleteDentry(den)
-	case opOpen:
-		req := &OpenReq{}
-		if err = json.Unmarshal(msg.V, req); err != nil {
-			goto end
+	case opCreateMetaRange:
+	case opExtentsAdd:
+		if ino, err = decodeInode(msg.K, msg.V); err != nil {
+			return
 		}
-		resp = mf.OpenFile(req)
-	case opReadDir:
-		req := &ReadDirReq{}
-		if err = json.Unmarshal(msg.V, req); err != nil {
-			goto end
+		resp = mf.AppendExtents(ino)
+	case opExtentsDel:
+		if ino, err = decodeInode(msg.K, msg.V); err != nil {
+			return
 		}
-		resp = mf.ReadDir(req)
-	case opCreateMetaRange:
+		resp = mf.DeleteExtents(ino)
 	}
-end:
 	mf.applyID = index
 	return
 }
 
-func (mf *MetaRangeFsm) ApplyMemeberChange(confChange *raftproto.ConfChange, index uint64) (interface{}, error) {
+func (mf *MetaRangeFsm) ApplyMemberChange(confChange *raftproto.ConfChange, index uint64) (interface{}, error) {
+	mf.applyMu.Lock()
+	defer mf.applyMu.Unlock()
 	// Write Disk
 	// Rename
 	// Change memory state
@@ -95,18 +98,58 @@ func (mf *MetaRangeFsm) ApplyMemeberChange(confChange *raftproto.ConfChange, ind
 }
 
 func (mf *MetaRangeFsm) Snapshot() (raftproto.Snapshot, error) {
-	appid := mf.applyID
-	ino := mf.GetInodeTree()
-	dentry := mf.GetDentryTree()
+	appid, ino, dentry := mf.cloneTrees()
 	snapIter := NewSnapshotIterator(appid, ino, dentry)
 	return snapIter, nil
 }
 
+func (mf *MetaRangeFsm) getApplyID() uint64 {
+	mf.applyMu.Lock()
+	defer mf.applyMu.Unlock()
+	return mf.applyID
+}
+
+// cloneTrees returns the clones of the trees and the applyID of the last log
+// applied to them. The items in the trees are not changed in place, so the
+// clones are not changed by the logs applied after.
+func (mf *MetaRangeFsm) cloneTrees() (applyID uint64, inodeTree, dentryTree *btree.BTree) {
+	mf.applyMu.Lock()
+	defer mf.applyMu.Unlock()
+	mf.inodeMu.Lock()
+	inodeTree = mf.inodeTree.Clone()
+	mf.inodeMu.Unlock()
+	mf.dentryMu.Lock()
+	dentryTree = mf.dentryTree.Clone()
+	mf.dentryMu.Unlock()
+	applyID = mf.applyID
+	return
+}
+
+// setTrees replaces the trees and applyID with the ones restored.
+func (mf *MetaRangeFsm) setTrees(applyID uint64, inodeTree, dentryTree *btree.BTree) {
+	mf.applyMu.Lock()
+	defer mf.applyMu.Unlock()
+	mf.inodeMu.Lock()
+	mf.inodeTree = inodeTree
+	mf.inodeMu.Unlock()
+	mf.dentryMu.Lock()
+	mf.dentryTree = dentryTree
+	mf.dentryMu.Unlock()
+	mf.applyID = applyID
+}
+
 func (mf *MetaRangeFsm) ApplySnapshot(peers []raftproto.Peer,
 	iter raftproto.SnapIterator) error {
-	newMF := NewMetaRangeFsm(mf.metaRange)
+	var (
+		newMF      = NewMetaRangeFsm(mf.metaRange)
+		applyID    uint64
+		hasApplyID bool
+	)
 	for {
 		data, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
 			return err
 		}
@@ -115,25 +158,60 @@ func (mf *MetaRangeFsm) ApplySnapshot(peers []raftproto.Peer,
 			return err
 		}
 		switch snap.Op {
+		case opSnapshotApplyID:
+			dec := &decoder{data: snap.V}
+			applyID = dec.uint64()
+			if err = dec.finish(); err != nil {
+				return err
+			}
+			hasApplyID = true
 		case opCreateInode:
-			var ino = &Inode{}
-			ino.ParseKeyBytes(snap.K)
-			ino.ParseValueBytes(snap.V)
+			ino, err := decodeInode(snap.K, snap.V)
+			if err != nil {
+				return err
+			}
 			newMF.CreateInode(ino)
+			mf.metaRange.updateCursor(ino.Inode)
 		case opCreateDentry:
-			dentry := &Dentry{}
-			dentry.ParseKeyBytes(snap.K)
-			dentry.ParseValueBytes(snap.V)
+			dentry, err := decodeDentry(snap.K, snap.V)
+			if err != nil {
+				return err
+			}
 			newMF.CreateDentry(dentry)
 		default:
 			return errors.New(fmt.Sprintf("unknown op=%d", snap.Op))
 		}
 	}
-	newMF.applyID = newMF.metaRange.RaftPartition.AppliedIndex()
-	*mf = *newMF
+	// The trees are the state after the log of the snapshot index, the index
+	// applied of the raft partition is still the one before the snapshot.
+	if snap, ok := iter.(raftproto.Snapshot); ok {
+		applyID, hasApplyID = snap.ApplyIndex(), true
+	}
+	if !hasApplyID {
+		return errors.New("snapshot without applyID")
+	}
+	mf.setTrees(applyID, newMF.inodeTree, newMF.dentryTree)
 	return nil
 }
 
+func decodeInode(key, val []byte) (ino *Inode, err error) {
+	ino = &Inode{}
+	if err = ino.ParseKeyBytes(key); err != nil {
+		return
+	}
+	err = ino.ParseValueBytes(val)
+	return
+}
+
+func decodeDentry(key, val []byte) (den *Dentry, err error) {
+	den = &Dentry{}
+	if err = den.ParseKeyBytes(key); err != nil {
+		return
+	}
+	err = den.ParseValueBytes(val)
+	return
+}
+
 func (mf *MetaRangeFsm) HandleFatalEvent(err *raft.FatalError) {
 	panic(err)
 }
@@ -141,11 +219,10 @@ func (mf *MetaRangeFsm) HandleFatalEvent(err *raft.FatalError) {
 func (mf *MetaRangeFsm) HandleLeaderChange(leader uint64) {
 }
 
-func (mf *MetaRangeFsm) Put(key, val []byte) (resp interface{}, err error) {
-	snap := NewMetaRangeSnapshot(0, nil, nil)
-	snap.Op = binary.BigEndian.Uint32(key)
-	snap.V = val
-	cmd, err := json.Marshal(snap)
+// Put submits the command of op with the binary key and value of the inode or
+// dentry, and returns the result of Apply.
+func (mf *MetaRangeFsm) Put(op uint32, key, val []byte) (resp interface{}, err error) {
+	cmd, err := NewMetaRangeSnapshot(op, key, val).Encode()
 	if err != nil {
 		return
 	}
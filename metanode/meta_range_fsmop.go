@@ -112,26 +112,86 @@ func (mf *MetaRangeFsm) DeleteInode(ino *Inode) (status uint8) {
 	return
 }
 
+// OpenFile checks the inode exists. It is a read served by the leader, the
+// access time is not changed as it is not replicated.
 func (mf *MetaRangeFsm) OpenFile(req *OpenReq) (resp *OpenResp) {
+	resp = &OpenResp{}
+	mf.inodeMu.RLock()
 	item := mf.inodeTree.Get(&Inode{
 		Inode: req.Inode,
 	})
+	mf.inodeMu.RUnlock()
 	if item == nil {
 		resp.Status = proto.OpNotExistErr
 		return
 	}
-	item.(*Inode).AccessTime = time.Now().Unix()
 	resp.Status = proto.OpOk
 	return
 }
 
+// Lookup returns the inode and the type of the dentry in the parent.
+func (mf *MetaRangeFsm) Lookup(req *LookupReq) (resp *LookupResp) {
+	resp = &LookupResp{}
+	mf.dentryMu.RLock()
+	item := mf.dentryTree.Get(&Dentry{
+		ParentId: req.ParentID,
+		Name:     req.Name,
+	})
+	mf.dentryMu.RUnlock()
+	if item == nil {
+		resp.Status = proto.OpNotExistErr
+		return
+	}
+	dentry := item.(*Dentry)
+	resp.Status = proto.OpOk
+	resp.Inode = dentry.Inode
+	resp.Mode = dentry.Type
+	return
+}
+
+// InodeGet returns the information of the inode with its extent keys.
+func (mf *MetaRangeFsm) InodeGet(req *InodeGetReq) (resp *InodeGetResp) {
+	resp = &InodeGetResp{}
+	mf.inodeMu.RLock()
+	defer mf.inodeMu.RUnlock()
+	item := mf.inodeTree.Get(&Inode{
+		Inode: req.Inode,
+	})
+	if item == nil {
+		resp.Status = proto.OpNotExistErr
+		return
+	}
+	ino := item.(*Inode)
+	resp.Status = proto.OpOk
+	resp.Info = &proto.InodeInfo{
+		Inode:      ino.Inode,
+		Type:       ino.Type,
+		Size:       ino.Size,
+		ModifyTime: time.Unix(ino.ModifyTime, 0),
+		AccessTime: time.Unix(ino.AccessTime, 0),
+	}
+	if ino.Stream == nil {
+		return
+	}
+	resp.Info.Extents = make([]string, 0, ino.Stream.GetExtentLen())
+	ino.Stream.Range(func(_ int, k stream.ExtentKey) bool {
+		resp.Info.Extents = append(resp.Info.Extents, k.Marshal())
+		return true
+	})
+	return
+}
+
 func (mf *MetaRangeFsm) ReadDir(req *ReadDirReq) (resp *ReadDirResp) {
+	resp = &ReadDirResp{}
+	resp.Status = proto.OpOk
 	begDentry := &Dentry{
 		ParentId: req.ParentID,
 	}
 	endDentry := &Dentry{
 		ParentId: req.ParentID + 1,
 	}
+	mf.dentryMu.RLock()
+	defer mf.dentryMu.RUnlock()
 	mf.dentryTree.AscendRange(begDentry, endDentry, func(i btree.Item) bool {
 		d := i.(*Dentry)
 		resp.Children = append(resp.Children, proto.Dentry{
@@ -144,14 +204,82 @@ func (mf *MetaRangeFsm) ReadDir(req *ReadDirReq) (resp *ReadDirResp) {
 	return
 }
 
-func (mf *MetaRangeFsm) PutStreamKey(ino *Inode, k stream.ExtentKey) (status uint8) {
-	status = proto.OpOk
+// AppendExtents puts the extent keys in the stream of ino into the stream of
+// the inode in the inode tree, the key of an extent already there updates
+// its size. The size of the inode is the size of its extents.
+func (mf *MetaRangeFsm) AppendExtents(ino *Inode) (resp *AppendExtentKeyResp) {
+	resp = &AppendExtentKeyResp{}
+	resp.Status = proto.OpOk
+	mf.inodeMu.Lock()
+	defer mf.inodeMu.Unlock()
 	item := mf.inodeTree.Get(ino)
 	if item == nil {
-		status = proto.OpNotExistErr
+		resp.Status = proto.OpNotExistErr
 		return
 	}
-	ino = item.(*Inode)
-	ino.Stream.Put(k)
+	i := item.(*Inode).Copy()
+	if i.Stream == nil {
+		i.Stream = stream.NewStreamKey(i.Inode)
+	}
+	if ino.Stream != nil {
+		ino.Stream.Range(func(_ int, k stream.ExtentKey) bool {
+			i.Stream.Put(k)
+			return true
+		})
+	}
+	i.Size = i.Stream.Size()
+	i.ModifyTime = ino.ModifyTime
+	mf.inodeTree.ReplaceOrInsert(i)
+	resp.Size = i.Size
+	return
+}
+
+// DeleteExtents removes the extent keys in the stream of ino from the stream
+// of the inode in the inode tree, the keys not found are skipped.
+func (mf *MetaRangeFsm) DeleteExtents(ino *Inode) (resp *DelExtentKeyResp) {
+	resp = &DelExtentKeyResp{}
+	resp.Status = proto.OpOk
+	mf.inodeMu.Lock()
+	defer mf.inodeMu.Unlock()
+	item := mf.inodeTree.Get(ino)
+	if item == nil {
+		resp.Status = proto.OpNotExistErr
+		return
+	}
+	i := item.(*Inode).Copy()
+	if i.Stream != nil && ino.Stream != nil {
+		ino.Stream.Range(func(_ int, k stream.ExtentKey) bool {
+			i.Stream.Delete(k)
+			return true
+		})
+		i.Size = i.Stream.Size()
+	}
+	i.ModifyTime = ino.ModifyTime
+	mf.inodeTree.ReplaceOrInsert(i)
+	resp.Size = i.Size
+	return
+}
+
+// ListExtents returns the extent keys of the inode in order.
+func (mf *MetaRangeFsm) ListExtents(ino *Inode) (resp *GetExtentsResp) {
+	resp = &GetExtentsResp{}
+	resp.Status = proto.OpOk
+	mf.inodeMu.RLock()
+	defer mf.inodeMu.RUnlock()
+	item := mf.inodeTree.Get(ino)
+	if item == nil {
+		resp.Status = proto.OpNotExistErr
+		return
+	}
+	i := item.(*Inode)
+	resp.Size = i.Size
+	if i.Stream == nil {
+		return
+	}
+	resp.Extents = make([]string, 0, i.Stream.GetExtentLen())
+	i.Stream.Range(func(_ int, k stream.ExtentKey) bool {
+		resp.Extents = append(resp.Extents, k.Marshal())
+		return true
+	})
 	return
 }
@@ -77,6 +77,7 @@ func (m *MetaRangeManager) LoadMetaManagers(metaDir string) (err error) {
 			wg.Add(1)
 			metaRangeId := fileInfo.Name()[12:]
 			go func(metaID string, fileInfo os.FileInfo) {
+				defer wg.Done()
 				/* Create MetaRange and add metaRangeManager */
 				mr := NewMetaRange(MetaRangeConfig{
 					ID:      metaID,
@@ -87,7 +88,6 @@ func (m *MetaRangeManager) LoadMetaManagers(metaDir string) (err error) {
 					return
 				}
 				m.SetMetaRange(mr)
-				wg.Done()
 			}(metaRangeId, fileInfo)
 		}
 	}
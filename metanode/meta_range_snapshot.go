@@ -1,24 +1,38 @@
 package metanode
 
 import (
-	"encoding/json"
 	"io"
 
 	"github.com/google/btree"
 )
 
+// MetaRangeSnapshot is the raft command of op, and the item of the snapshot.
+// K and V are the binary key and value of the inode or dentry, see codec.go.
 type MetaRangeSnapshot struct {
-	Op uint32 `json:"op"`
-	K  []byte `json:"k"`
-	V  []byte `json:"v"`
+	Op uint32
+	K  []byte
+	V  []byte
 }
 
+// Encode returns the command encoding of the snapshot.
 func (s *MetaRangeSnapshot) Encode() ([]byte, error) {
-	return json.Marshal(s)
+	data := make([]byte, 0, 9+len(s.K)+len(s.V))
+	data = append(data, codecVersion)
+	data = appendUint32(data, s.Op)
+	data = appendUint32(data, uint32(len(s.K)))
+	data = append(data, s.K...)
+	return append(data, s.V...), nil
 }
 
+// Decode restores the snapshot from the command encoding, K and V share the
+// memory of data.
 func (s *MetaRangeSnapshot) Decode(data []byte) error {
-	return json.Unmarshal(data, s)
+	d := &decoder{data: data}
+	d.version()
+	s.Op = d.uint32()
+	s.K = d.next(int(d.uint32()))
+	s.V = d.rest()
+	return d.finish()
 }
 
 func NewMetaRangeSnapshot(op uint32, key, value []byte) *MetaRangeSnapshot {
@@ -45,7 +59,6 @@ func NewSnapshotIterator(applyID uint64, ino, den *btree.BTree) *SnapshotIterato
 	si.applyID = applyID
 	si.inodeTree = ino
 	si.dentryTree = den
-	si.cur = 1
 	si.inoLen = ino.Len()
 	si.dentryLen = den.Len()
 	si.total = si.inoLen + si.dentryLen
@@ -60,7 +73,15 @@ func (si *SnapshotIterator) Close() {
 	return
 }
 
+// Next returns the applyID of the snapshot first, as the iterator the
+// followers receive from the leader has no ApplyIndex, then the inodes and
+// the dentries.
 func (si *SnapshotIterator) Next() (data []byte, err error) {
+	if si.cur == 0 {
+		si.cur++
+		return NewMetaRangeSnapshot(opSnapshotApplyID, nil,
+			appendUint64(nil, si.applyID)).Encode()
+	}
 	if si.cur > si.total {
 		err = io.EOF
 		return
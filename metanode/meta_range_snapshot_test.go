@@ -0,0 +1,59 @@
+package metanode
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	raftproto "github.com/tiglabs/raft/proto"
+)
+
+// snapIterator hides the ApplyIndex of the snapshot, as the iterator the
+// followers receive from the leader.
+type snapIterator struct {
+	raftproto.SnapIterator
+}
+
+func TestApplySnapshot(t *testing.T) {
+	mr := createTestMetaRange(t)
+	defer os.RemoveAll(mr.RootDir)
+	applyTestLogs(t, mr, 0)
+
+	dir, err := ioutil.TempDir("", "metarange")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, local := range []bool{true, false} {
+		follower := newTestMetaRange(t, dir)
+		follower.Start, follower.End, follower.Cursor = mr.Start, mr.End, mr.Start
+		applyTestLogs(t, follower, 1000)
+		snap, err := mr.store.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var iter raftproto.SnapIterator = snap
+		if !local {
+			iter = &snapIterator{snap}
+		}
+		if err = follower.store.ApplySnapshot(nil, iter); err != nil {
+			t.Fatal(err)
+		}
+		// The cursor is not lowered by the snapshot, the inode IDs above
+		// it are not assigned again anyway.
+		follower.Cursor = mr.Cursor
+		checkRestarted(t, mr, follower)
+	}
+}
+
+func TestApplyCorruptCommand(t *testing.T) {
+	mr := createTestMetaRange(t)
+	defer os.RemoveAll(mr.RootDir)
+	index := applyTestLogs(t, mr, 0)
+	if _, err := mr.store.Apply([]byte{codecVersion, 0}, index+1); err == nil {
+		t.Fatal("corrupt command applied")
+	}
+	if applyID := mr.store.getApplyID(); applyID != index {
+		t.Fatalf("applyID %v after the corrupt command, expected %v", applyID, index)
+	}
+}
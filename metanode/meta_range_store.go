@@ -2,9 +2,10 @@ package metanode
 
 import (
 	"bufio"
+	"encoding"
 	"encoding/binary"
-	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -14,74 +15,75 @@ import (
 	"github.com/tiglabs/baudstorage/proto"
 )
 
+// The checkpoint of a meta range is the directory 'snapshot' in its root dir
+// which keeps the files 'applyid', 'inode' and 'dentry', the trees are the
+// state after the raft log of the applyid is applied. A new checkpoint is
+// written into '.snapshot' and synced, then the old one is renamed to
+// '.snapshot_backup' and the new one to 'snapshot'. Load takes the backup if
+// the node crashed between the renames, the new one not renamed is dropped.
+// The inode and dentry files are the item encodings of codec.go in order,
+// each one follows its length of 4 bytes.
+const (
+	checkpointDir       = "snapshot"
+	checkpointTmpDir    = ".snapshot"
+	checkpointBackupDir = ".snapshot_backup"
+	inodeFile           = "inode"
+	dentryFile          = "dentry"
+	applyIDFile         = "applyid"
+)
+
 // Load inode info from inode snapshot file
-func (mf *MetaRangeFsm) LoadInode() (err error) {
+func (mf *MetaRangeFsm) LoadInode(dir string) (err error) {
 	// Restore btree from ino file
-	inoFile := path.Join(mf.metaRange.RootDir, "inode")
-	fp, err := os.OpenFile(inoFile, os.O_RDONLY, 0644)
+	fp, err := os.OpenFile(path.Join(dir, inodeFile), os.O_RDONLY, 0644)
 	if err != nil {
-		if err == os.ErrNotExist {
-			err = nil
-		}
 		return
 	}
 	defer fp.Close()
 	reader := bufio.NewReader(fp)
 	for {
 		var (
-			line []byte
+			data []byte
 			ino  = &Inode{}
 		)
-		line, _, err = reader.ReadLine()
-		if err != nil {
+		if data, err = readItem(reader); err != nil {
 			if err == io.EOF {
 				err = nil
-				return
 			}
 			return
 		}
-
-		if err = json.Unmarshal(line, ino); err != nil {
+		if err = ino.UnmarshalBinary(data); err != nil {
 			return
 		}
 		if mf.CreateInode(ino) != proto.OpOk {
 			err = errors.New("load inode info error!")
 			return
 		}
-		if mf.metaRange.Cursor < ino.Inode {
-			mf.metaRange.Cursor = ino.Inode
-		}
+		mf.metaRange.updateCursor(ino.Inode)
 	}
-	return
 }
 
 // Load dentry from dentry snapshot file
-func (mf *MetaRangeFsm) LoadDentry() (err error) {
+func (mf *MetaRangeFsm) LoadDentry(dir string) (err error) {
 	// Restore dentry from dentry file
-	dentryFile := path.Join(mf.metaRange.RootDir, "dentry")
-	fp, err := os.OpenFile(dentryFile, os.O_RDONLY, 0644)
+	fp, err := os.OpenFile(path.Join(dir, dentryFile), os.O_RDONLY, 0644)
 	if err != nil {
-		if err == os.ErrNotExist {
-			err = nil
-		}
 		return
 	}
 	defer fp.Close()
 	reader := bufio.NewReader(fp)
 	for {
 		var (
-			line   []byte
+			data   []byte
 			dentry = &Dentry{}
 		)
-		line, _, err = reader.ReadLine()
-		if err != nil {
+		if data, err = readItem(reader); err != nil {
 			if err == io.EOF {
 				err = nil
-				return
 			}
 			return
 		}
-		if err = json.Unmarshal(line, dentry); err != nil {
+		if err = dentry.UnmarshalBinary(data); err != nil {
 			return
 		}
 		if mf.CreateDentry(dentry) != proto.OpOk {
@@ -89,58 +91,62 @@ func (mf *MetaRangeFsm) LoadDentry() (err error) {
 			return
 		}
 	}
-	return
 }
 
-func (mf *MetaRangeFsm) LoadApplyID() (err error) {
-	applyIDFile := path.Join(mf.metaRange.RootDir, "applyid")
-	data, err := ioutil.ReadFile(applyIDFile)
+func (mf *MetaRangeFsm) LoadApplyID(dir string) (err error) {
+	data, err := ioutil.ReadFile(path.Join(dir, applyIDFile))
 	if err != nil {
 		return
 	}
-	if len(data) == 0 {
-		err = errors.New("read applyid empty error")
+	if len(data) != 8 {
+		err = errors.New("read applyid length error")
 		return
 	}
 	mf.applyID = binary.BigEndian.Uint64(data)
 	return
 }
 
-func (mf *MetaRangeFsm) StoreApplyID() (err error) {
-	filename := path.Join(mf.metaRange.RootDir, "_applyid")
-	fp, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_TRUNC, 0644)
-	if err != nil {
+func (mf *MetaRangeFsm) StoreApplyID(dir string, applyID uint64) (err error) {
+	return storeFile(path.Join(dir, applyIDFile), func(w io.Writer) error {
+		return binary.Write(w, binary.BigEndian, applyID)
+	})
+}
+
+func (mf *MetaRangeFsm) StoreInodeTree(dir string, inoTree *btree.BTree) (err error) {
+	return storeFile(path.Join(dir, inodeFile), func(w io.Writer) error {
+		return storeTree(w, inoTree)
+	})
+}
+
+func (mf *MetaRangeFsm) StoreDentryTree(dir string, denTree *btree.BTree) (err error) {
+	return storeFile(path.Join(dir, dentryFile), func(w io.Writer) error {
+		return storeTree(w, denTree)
+	})
+}
+
+// readItem reads the length and the item encoding after it, it returns io.EOF
+// at the end of the file only.
+func readItem(r io.Reader) (data []byte, err error) {
+	head := make([]byte, 4)
+	if _, err = io.ReadFull(r, head); err != nil {
 		return
 	}
-	defer func() {
-		fp.Sync()
-		fp.Close()
-	}()
-	err = binary.Write(fp, binary.BigEndian, mf.applyID)
+	data = make([]byte, binary.BigEndian.Uint32(head))
+	if _, err = io.ReadFull(r, data); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
 	return
 }
 
-func (mf *MetaRangeFsm) StoreInodeTree() (err error) {
-	filename := path.Join(mf.metaRange.RootDir, "_inode")
-	fp, err := os.OpenFile(filename, os.O_RDWR|os.O_TRUNC|os.O_APPEND, 0644)
-	if err != nil {
-		return
-	}
-	defer func() {
-		fp.Sync()
-		fp.Close()
-	}()
-	inoTree := mf.GetInodeTree()
-	inoTree.Ascend(func(i btree.Item) bool {
+// storeTree writes the item encodings of the tree in order.
+func storeTree(w io.Writer, tree *btree.BTree) (err error) {
+	tree.Ascend(func(i btree.Item) bool {
 		var data []byte
-		if data, err = json.Marshal(i); err != nil {
+		if data, err = i.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
 			return false
 		}
-		if _, err = fp.Write(data); err != nil {
-			return false
-		}
-		data[0] = byte('\n')
-		if _, err = fp.Write(data[:1]); err != nil {
+		data = append(appendUint32(make([]byte, 0, 4+len(data)), uint32(len(data))), data...)
+		if _, err = w.Write(data); err != nil {
 			return false
 		}
 		return true
@@ -148,31 +154,102 @@ func (mf *MetaRangeFsm) StoreInodeTree() (err error) {
 	return
 }
 
-func (mf *MetaRangeFsm) StoreDentryTree() (err error) {
-	filename := path.Join(mf.metaRange.RootDir, "_dentry")
-	fp, err := os.OpenFile(filename, os.O_RDWR|os.O_TRUNC|os.O_APPEND, 0644)
+// storeFile creates the file, writes it by write and syncs it.
+func storeFile(filename string, write func(w io.Writer) error) (err error) {
+	fp, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return
 	}
-	defer func() {
-		fp.Sync()
-		fp.Close()
-	}()
-	denTree := mf.GetDentryTree()
-	denTree.Ascend(func(i btree.Item) bool {
-		var data []byte
-		data, err = json.Marshal(i)
-		if err != nil {
-			return false
+	defer fp.Close()
+	bw := bufio.NewWriter(fp)
+	if err = write(bw); err != nil {
+		return
+	}
+	if err = bw.Flush(); err != nil {
+		return
+	}
+	return fp.Sync()
+}
+
+func syncDir(dir string) (err error) {
+	fp, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer fp.Close()
+	return fp.Sync()
+}
+
+// StoreCheckpoint writes the checkpoint of the trees, and truncates the raft
+// log up to the applyid of it. It returns the applyid of the checkpoint.
+func (mr *MetaRange) StoreCheckpoint() (applyID uint64, err error) {
+	applyID, inoTree, denTree := mr.store.cloneTrees()
+	tmpDir := path.Join(mr.RootDir, checkpointTmpDir)
+	curDir := path.Join(mr.RootDir, checkpointDir)
+	backupDir := path.Join(mr.RootDir, checkpointBackupDir)
+	if err = os.RemoveAll(tmpDir); err != nil {
+		return
+	}
+	if err = os.Mkdir(tmpDir, 0755); err != nil {
+		return
+	}
+	if err = mr.store.StoreApplyID(tmpDir, applyID); err != nil {
+		return
+	}
+	if err = mr.store.StoreInodeTree(tmpDir, inoTree); err != nil {
+		return
+	}
+	if err = mr.store.StoreDentryTree(tmpDir, denTree); err != nil {
+		return
+	}
+	if err = syncDir(tmpDir); err != nil {
+		return
+	}
+	if _, err = os.Stat(curDir); err == nil {
+		if err = os.RemoveAll(backupDir); err != nil {
+			return
 		}
-		if _, err = fp.Write(data); err != nil {
-			return false
+		if err = os.Rename(curDir, backupDir); err != nil {
+			return
 		}
-		data[0] = byte('\n')
-		if _, err = fp.Write(data[:1]); err != nil {
-			return false
+	}
+	if err = os.Rename(tmpDir, curDir); err != nil {
+		return
+	}
+	if err = syncDir(mr.RootDir); err != nil {
+		return
+	}
+	os.RemoveAll(backupDir)
+	if mr.RaftPartition != nil {
+		mr.RaftPartition.Truncate(applyID)
+	}
+	return
+}
+
+// LoadCheckpoint restores the trees and the applyid from the checkpoint, the
+// trees are empty if there is no checkpoint. The raft log after the applyid is
+// applied by the raft partition created after.
+func (mr *MetaRange) LoadCheckpoint() (err error) {
+	curDir := path.Join(mr.RootDir, checkpointDir)
+	backupDir := path.Join(mr.RootDir, checkpointBackupDir)
+	os.RemoveAll(path.Join(mr.RootDir, checkpointTmpDir))
+	if _, err = os.Stat(curDir); os.IsNotExist(err) {
+		if _, err = os.Stat(backupDir); os.IsNotExist(err) {
+			return nil
 		}
-		return true
-	})
+		if err = os.Rename(backupDir, curDir); err != nil {
+			return
+		}
+	}
+	os.RemoveAll(backupDir)
+	if err = mr.store.LoadApplyID(curDir); err != nil {
+		return fmt.Errorf("load checkpoint applyid: %v", err)
+	}
+	if err = mr.store.LoadInode(curDir); err != nil {
+		return fmt.Errorf("load checkpoint inode: %v", err)
+	}
+	if err = mr.store.LoadDentry(curDir); err != nil {
+		return fmt.Errorf("load checkpoint dentry: %v", err)
+	}
 	return
 }
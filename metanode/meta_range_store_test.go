@@ -0,0 +1,176 @@
+package metanode
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/google/btree"
+	"github.com/tiglabs/baudstorage/raftstore"
+	"github.com/tiglabs/baudstorage/sdk/stream"
+)
+
+// The tests restart a meta range on the root dir of another one, the raft
+// partition is faked and only records the index the log is truncated to.
+
+type truncatePartition struct {
+	raftstore.Partition
+	truncated uint64
+}
+
+func (p *truncatePartition) Truncate(index uint64) {
+	p.truncated = index
+}
+
+func newTestMetaRange(t *testing.T, dir string) (mr *MetaRange) {
+	mr = NewMetaRange(MetaRangeConfig{ID: "1", RootDir: dir})
+	mr.RaftPartition = &truncatePartition{}
+	return
+}
+
+func createTestMetaRange(t *testing.T) (mr *MetaRange) {
+	dir, err := ioutil.TempDir("", "metarange")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr = newTestMetaRange(t, dir)
+	mr.Start, mr.End, mr.Cursor = 1, 1000, 1
+	if err = mr.StoreMeta(); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// apply applies the command the way MetaRangeFsm.Put submits it.
+func apply(t *testing.T, mr *MetaRange, op uint32, item metaItem, index uint64) {
+	cmd, err := NewMetaRangeSnapshot(op, item.GetKeyBytes(), item.GetValueBytes()).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mr.store.Apply(cmd, index); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func applyTestLogs(t *testing.T, mr *MetaRange, from uint64) (index uint64) {
+	index = from
+	for i := uint64(0); i < 10; i++ {
+		ino := NewInode(from+i+1, 1)
+		index++
+		apply(t, mr, opCreateInode, ino, index)
+		index++
+		apply(t, mr, opCreateDentry, &Dentry{ParentId: 1, Name: fmt.Sprintf("file%v", ino.Inode), Inode: ino.Inode, Type: 1}, index)
+	}
+	ino := &Inode{Inode: from + 1, Stream: stream.NewStreamKey(from + 1)}
+	ino.Stream.Put(stream.ExtentKey{VolId: 1, ExtentId: 2, Size: 4096, Crc: 3})
+	index++
+	apply(t, mr, opExtentsAdd, ino, index)
+	index++
+	apply(t, mr, opDeleteDentry, &Dentry{ParentId: 1, Name: fmt.Sprintf("file%v", from+2)}, index)
+	return
+}
+
+func treeItems(tree *btree.BTree) (items []btree.Item) {
+	tree.Ascend(func(i btree.Item) bool {
+		items = append(items, i)
+		return true
+	})
+	return
+}
+
+func checkRestarted(t *testing.T, mr, restarted *MetaRange) {
+	applyID, inodeTree, dentryTree := mr.store.cloneTrees()
+	if id := restarted.store.getApplyID(); id != applyID {
+		t.Fatalf("applyID %v, expected %v", id, applyID)
+	}
+	_, restartedInodes, restartedDentries := restarted.store.cloneTrees()
+	if !reflect.DeepEqual(treeItems(restartedInodes), treeItems(inodeTree)) {
+		t.Fatalf("inodes %v, expected %v", treeItems(restartedInodes), treeItems(inodeTree))
+	}
+	if !reflect.DeepEqual(treeItems(restartedDentries), treeItems(dentryTree)) {
+		t.Fatalf("dentries %v, expected %v", treeItems(restartedDentries), treeItems(dentryTree))
+	}
+	if restarted.Cursor != mr.Cursor {
+		t.Fatalf("cursor %v, expected %v", restarted.Cursor, mr.Cursor)
+	}
+}
+
+func TestCheckpointRestart(t *testing.T) {
+	mr := createTestMetaRange(t)
+	defer os.RemoveAll(mr.RootDir)
+	index := applyTestLogs(t, mr, 0)
+	applyID, err := mr.StoreCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applyID != index {
+		t.Fatalf("checkpoint applyID %v, expected %v", applyID, index)
+	}
+	if truncated := mr.RaftPartition.(*truncatePartition).truncated; truncated != index {
+		t.Fatalf("raft log truncated to %v, expected %v", truncated, index)
+	}
+
+	restarted := newTestMetaRange(t, mr.RootDir)
+	if err = restarted.Load(); err != nil {
+		t.Fatal(err)
+	}
+	checkRestarted(t, mr, restarted)
+
+	// The logs after the checkpoint are replayed by raft on the restarted one.
+	index = applyTestLogs(t, mr, index)
+	applyTestLogs(t, restarted, applyID)
+	checkRestarted(t, mr, restarted)
+}
+
+func TestCheckpointRestartEmpty(t *testing.T) {
+	mr := createTestMetaRange(t)
+	defer os.RemoveAll(mr.RootDir)
+	restarted := newTestMetaRange(t, mr.RootDir)
+	if err := restarted.Load(); err != nil {
+		t.Fatal(err)
+	}
+	checkRestarted(t, mr, restarted)
+}
+
+// The node crashed after the checkpoint is renamed to the backup, before the
+// new one written is renamed.
+func TestCheckpointRestartCrashed(t *testing.T) {
+	mr := createTestMetaRange(t)
+	defer os.RemoveAll(mr.RootDir)
+	index := applyTestLogs(t, mr, 0)
+	if _, err := mr.StoreCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+	stored := newTestMetaRange(t, mr.RootDir)
+	if err := stored.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	index = applyTestLogs(t, mr, index)
+	tmpDir := path.Join(mr.RootDir, checkpointTmpDir)
+	if err := os.Mkdir(tmpDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := mr.store.StoreApplyID(tmpDir, index); err != nil {
+		t.Fatal(err)
+	}
+	curDir := path.Join(mr.RootDir, checkpointDir)
+	if err := os.Rename(curDir, path.Join(mr.RootDir, checkpointBackupDir)); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newTestMetaRange(t, mr.RootDir)
+	if err := restarted.Load(); err != nil {
+		t.Fatal(err)
+	}
+	checkRestarted(t, stored, restarted)
+	if _, err := os.Stat(tmpDir); !os.IsNotExist(err) {
+		t.Fatalf("partial checkpoint not removed: %v", err)
+	}
+	if _, err := os.Stat(curDir); err != nil {
+		t.Fatalf("backup not restored: %v", err)
+	}
+}
@@ -1,9 +1,15 @@
 package metanode
 
+import (
+	"path"
+	"strconv"
+
+	"github.com/tiglabs/baudstorage/raftstore"
+	raftproto "github.com/tiglabs/raft/proto"
+)
+
 // StartRaftServer init address resolver and raft server instance.
 func (m *MetaNode) startRaftServer() (err error) {
-	//TODO: collect peers information from metaRanges
-
 	if err = m.createRaftServer(); err != nil {
 		return
 	}
@@ -16,9 +22,30 @@ func (m *MetaNode) startRaftServer() (err error) {
 }
 
 func (m *MetaNode) createRaftServer() (err error) {
+	nodeId, err := strconv.ParseUint(m.nodeId, 10, 64)
+	if err != nil {
+		return
+	}
+	m.raftStore, err = raftstore.NewRaftStore(&raftstore.Config{
+		NodeID:  nodeId,
+		WalPath: path.Join(m.metaDir, "wal"),
+	})
 	return
 }
 
-func (m MetaNode) createPartition(mr *MetaRange) (err error) {
+// createPartition creates the raft partition of the meta range, the raft log
+// after the applyid of the checkpoint loaded is applied to it again.
+func (m *MetaNode) createPartition(mr *MetaRange) (err error) {
+	peers := make([]raftproto.Peer, 0, len(mr.Peers))
+	for _, peer := range mr.Peers {
+		m.raftStore.AddNode(peer.ID, peer.Addr)
+		peers = append(peers, raftproto.Peer{ID: peer.ID})
+	}
+	mr.RaftPartition, err = m.raftStore.CreatePartition(&raftstore.PartitionConfig{
+		ID:      mr.RaftGroupID,
+		Applied: mr.store.getApplyID(),
+		Peers:   peers,
+		SM:      mr.store,
+	})
 	return
 }
@@ -10,8 +10,8 @@ import (
 
 	"errors"
 
-	"github.com/tiglabs/baudstorage/master"
 	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/raftstore"
 	"github.com/tiglabs/baudstorage/util"
 	"github.com/tiglabs/baudstorage/util/log"
 )
@@ -81,7 +81,32 @@ func (m *MetaNode) servConn(conn net.Conn, stopC chan uint8) {
 }
 
 // RoutePacket check the OpCode in specified packet and route it to handler.
+// The request to the meta range this node does not lead, or stops leading
+// before the request is proposed or read, is replied with the address of the
+// leader. The client request failed otherwise is replied OpErr, such as the
+// proposal failed after it is submitted, which may still be committed by the
+// new leader and must not be sent again.
 func (m *MetaNode) routePacket(conn net.Conn, p *Packet) (err error) {
+	var mr *MetaRange
+	if p.Opcode != proto.OpMetaCreateMetaRange {
+		if mr, err = m.loadRequestRange(p); err != nil {
+			return
+		}
+		if leaderAddr, ok := mr.IsLeader(); !ok {
+			return m.replyNotLeader(conn, p, leaderAddr)
+		}
+	}
+	defer func() {
+		if mr == nil || err == nil {
+			return
+		}
+		if err == raftstore.ErrNotLeader {
+			leaderAddr, _ := mr.IsLeader()
+			err = m.replyNotLeader(conn, p, leaderAddr)
+			return
+		}
+		m.replyError(conn, p, err)
+	}()
 	switch p.Opcode {
 	case proto.OpMetaCreateInode:
 		// Client → MetaNode
@@ -101,6 +126,21 @@ func (m *MetaNode) routePacket(conn net.Conn, p *Packet) (err error) {
 	case proto.OpMetaOpen:
 		// Client → MetaNode
 		err = m.opOpen(conn, p)
+	case proto.OpMetaLookup:
+		// Client → MetaNode
+		err = m.opLookup(conn, p)
+	case proto.OpMetaInodeGet:
+		// Client → MetaNode
+		err = m.opInodeGet(conn, p)
+	case proto.OpMetaExtentsAdd:
+		// Client → MetaNode
+		err = m.opAppendExtents(conn, p)
+	case proto.OpMetaExtentsDel:
+		// Client → MetaNode
+		err = m.opDeleteExtents(conn, p)
+	case proto.OpMetaExtentsList:
+		// Client → MetaNode
+		err = m.opListExtents(conn, p)
 	case proto.OpMetaCreateMetaRange:
 		// Mater → MetaNode
 		err = m.opCreateMetaRange(conn, p)
@@ -111,6 +151,18 @@ func (m *MetaNode) routePacket(conn net.Conn, p *Packet) (err error) {
 	return
 }
 
+// loadRequestRange returns the meta range of the namespace the client request
+// is for.
+func (m *MetaNode) loadRequestRange(p *Packet) (mr *MetaRange, err error) {
+	req := &struct {
+		Namespace string `json:"namespace"`
+	}{}
+	if err = json.Unmarshal(p.Data, req); err != nil {
+		return
+	}
+	return m.metaRangeManager.LoadMetaRange(req.Namespace)
+}
+
 // ReplyToClient send reply data though tcp connection to client.
 func (m *MetaNode) replyToClient(conn net.Conn, p *Packet, data []byte) (err error) {
 	// Handle panic
@@ -126,10 +178,29 @@ func (m *MetaNode) replyToClient(conn net.Conn, p *Packet, data []byte) (err err
 	}()
 	// Process data and send reply though specified tcp connection.
 	p.Data = data
+	p.Size = uint32(len(data))
 	err = p.WriteToConn(conn)
 	return
 }
 
+// ReplyNotLeader replies OpNotLeaderErr with the address of the leader of the
+// meta range to the client, which sends the request to the leader again.
+func (m *MetaNode) replyNotLeader(conn net.Conn, p *Packet, leaderAddr string) (err error) {
+	p.Opcode = proto.OpNotLeaderErr
+	p.Data = []byte(leaderAddr)
+	p.Size = uint32(len(p.Data))
+	err = p.WriteToConn(conn)
+	return
+}
+
+// ReplyError replies OpErr with the message of err to the client.
+func (m *MetaNode) replyError(conn net.Conn, p *Packet, err error) error {
+	p.Opcode = proto.OpErr
+	p.Data = []byte(err.Error())
+	p.Size = uint32(len(p.Data))
+	return p.WriteToConn(conn)
+}
+
 // ReplyToMaster reply operation result to master by sending http request.
 func (m *MetaNode) replyToMaster(ip string, data interface{}) (err error) {
 	// Handle panic
@@ -148,7 +219,7 @@ func (m *MetaNode) replyToMaster(ip string, data interface{}) (err error) {
 	if err != nil {
 		return
 	}
-	url := fmt.Sprintf("http://%s%s", ip, master.MetaNodeResponse)
+	url := fmt.Sprintf("http://%s%s", ip, proto.MetaNodeResponsePath)
 	util.PostToNode(jsonBytes, url)
 	return
 }
@@ -0,0 +1,126 @@
+package metanode
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/tiglabs/baudstorage/proto"
+	"github.com/tiglabs/baudstorage/raftstore"
+)
+
+// errRaftNotLeader is the error of the raft future, not the one of the
+// leadership check of the partition.
+var errRaftNotLeader = errors.New("raft: not leader")
+
+// leaderPartition fakes the leadership of the raft partition. Once the
+// leadership is lost after the request is routed, the read index fails with
+// the error of raft and the proposal fails the leadership check. The proposal
+// lost fails after it is submitted.
+type leaderPartition struct {
+	raftstore.Partition
+	leader       bool
+	leaderId     uint64
+	lost         bool
+	proposalLost bool
+}
+
+func (p *leaderPartition) IsLeader() bool {
+	return p.leader
+}
+
+func (p *leaderPartition) LeaderTerm() (uint64, uint64) {
+	return p.leaderId, 1
+}
+
+func (p *leaderPartition) ReadIndex() error {
+	if p.lost {
+		p.leader = false
+		return errRaftNotLeader
+	}
+	return nil
+}
+
+func (p *leaderPartition) Submit(cmd []byte) (interface{}, error) {
+	if p.lost {
+		p.leader = false
+		return nil, raftstore.ErrNotLeader
+	}
+	if p.proposalLost {
+		p.leader = false
+		return nil, errRaftNotLeader
+	}
+	return proto.OpOk, nil
+}
+
+// routeTestPacket routes the request to the meta node and returns the reply
+// and the error of routePacket.
+func routeTestPacket(t *testing.T, m *MetaNode, opcode uint8, req interface{}) (reply *proto.Packet, routeErr error) {
+	p := &Packet{Packet: *proto.NewPacket()}
+	p.Opcode = opcode
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Data = data
+	p.Size = uint32(len(data))
+	server, client := net.Pipe()
+	defer client.Close()
+	routed := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		routed <- m.routePacket(server, p)
+	}()
+	reply = proto.NewPacket()
+	if err = reply.ReadFromConn(client, proto.ReadDeadlineTime); err != nil {
+		t.Fatal(err)
+	}
+	routeErr = <-routed
+	return
+}
+
+// The request to the follower, or the leader losing the leadership before it
+// is proposed or read, is replied with the address of the leader. The
+// proposal failed after it is submitted is replied OpErr.
+func TestRouteNotLeader(t *testing.T) {
+	m := &MetaNode{metaRangeManager: NewMetaRangeManager()}
+	mr := NewMetaRange(MetaRangeConfig{ID: "ns"})
+	partition := &leaderPartition{leaderId: 2}
+	mr.RaftPartition = partition
+	mr.Peers = []proto.Peer{{ID: 1, Addr: "127.0.0.1:9021"}, {ID: 2, Addr: "127.0.0.1:9022"}}
+	if err := m.metaRangeManager.SetMetaRange(mr); err != nil {
+		t.Fatal(err)
+	}
+	req := &InodeGetReq{Namespace: "ns", Inode: 1}
+	createReq := &CreateDentryReq{Namespace: "ns", ParentID: 1, Inode: 2, Name: "f"}
+
+	checkReply := func(opcode uint8, req interface{}, replyOpcode uint8) (reply *proto.Packet) {
+		reply, err := routeTestPacket(t, m, opcode, req)
+		if reply.Opcode != replyOpcode {
+			t.Fatalf("request opcode[%v] reply opcode[%v] data[%s]", opcode, reply.Opcode, reply.Data)
+		}
+		// The failed request is returned to be logged after it is replied.
+		if (err != nil) != (replyOpcode == proto.OpErr) {
+			t.Fatalf("request opcode[%v] route err[%v]", opcode, err)
+		}
+		if replyOpcode == proto.OpNotLeaderErr && string(reply.Data) != "127.0.0.1:9022" {
+			t.Fatalf("redirected to [%s]", reply.Data)
+		}
+		return
+	}
+	checkReply(proto.OpMetaInodeGet, req, proto.OpNotLeaderErr)
+	partition.leader, partition.lost = true, true
+	checkReply(proto.OpMetaInodeGet, req, proto.OpNotLeaderErr)
+	partition.leader = true
+	checkReply(proto.OpMetaCreateDentry, createReq, proto.OpNotLeaderErr)
+
+	partition.leader, partition.lost, partition.proposalLost = true, false, true
+	if reply := checkReply(proto.OpMetaCreateDentry, createReq, proto.OpErr); string(reply.Data) != errRaftNotLeader.Error() {
+		t.Fatalf("reply data[%s]", reply.Data)
+	}
+
+	partition.leader, partition.proposalLost = true, false
+	checkReply(proto.OpMetaInodeGet, req, proto.OpMetaInodeGet)
+	checkReply(proto.OpMetaCreateDentry, createReq, proto.OpMetaCreateDentry)
+}
@@ -36,7 +36,7 @@ func NewMockServer(datadir string) (m *MockServer, err error) {
 
 	}
 	m.datadir = datadir
-	m.storage, err = storage.NewExtentStore(datadir, storage.ReBootStoreMode)
+	m.storage, err = storage.NewExtentStore(datadir, storage.BlockSize, storage.DefaultExtentCacheCapacity, storage.ReBootStoreMode)
 	if err != nil {
 		return nil, errors.Annotatef(err, "NewMock server error")
 	}
@@ -52,7 +52,7 @@ func (m *MockServer) volGroupView() (views []*sdk.VolGroup) {
 			hosts[j] = "127.0.0.1:9000"
 		}
 		v := &sdk.VolGroup{VolId: uint32(i), Goal: 3,
-			Status: uint8((rand.Int()%2 + 1)), Hosts: hosts}
+			Status: rand.Int()%2 + 1, Hosts: hosts}
 		views = append(views, v)
 	}
 
@@ -168,7 +168,7 @@ func (s *MockServer) serveConn(conn net.Conn) {
 }
 
 func (s *MockServer) clientview(w http.ResponseWriter, r *http.Request) {
-	views := s.volGroupView()
+	views := &sdk.VolsView{Vols: s.volGroupView()}
 	body, _ := json.Marshal(views)
 	w.Write(body)
 }
@@ -181,7 +181,7 @@ func (s *MockServer) listenAndServe() (err error) {
 		return
 	}
 	go func() {
-		http.HandleFunc("/client/view", s.clientview)
+		http.HandleFunc(sdk.VolViewUrl, s.clientview)
 		http.ListenAndServe(":7778", nil)
 	}()
 
@@ -10,10 +10,34 @@ const (
 	CmdSuccess = 1
 )
 
+// The paths of master the DataNodes and MetaNodes reply the admin tasks to.
+const (
+	MetaNodeResponsePath = "/metaNode/response"
+	DataNodeResponsePath = "/dataNode/response"
+)
+
+// The types of the vols.
+const (
+	ExtentVol = "extent"
+	ChunkVol  = "chunk"
+	EcVol     = "ec"
+)
+
+// The status of the vols and the disks, only the ReadWrite vols take the new
+// writes. A readonly vol may be writable again, such as a full vol freed by
+// the deletes, a sealed vol never is, such as an erasure coded vol.
+const (
+	VolUnavailable = -1
+	VolReadOnly    = 1
+	VolReadWrite   = 2
+	VolSealed      = 3
+)
+
 type CreateVolRequest struct {
 	VolType string
 	VolId   uint64
 	VolSize int
+	IoMode  string // such as "direct,dsync", the DataNode default if empty
 }
 
 type CreateVolResponse struct {
@@ -40,12 +64,13 @@ type LoadVolRequest struct {
 }
 
 type LoadVolResponse struct {
-	VolType     string
-	VolId       uint64
-	Used        uint64
-	VolSnapshot []*File
-	Status      uint8
-	Result      string
+	VolType      string
+	VolId        uint64
+	Used         uint64
+	PhysicalUsed uint64
+	VolSnapshot  []*File
+	Status       uint8
+	Result       string
 }
 
 type File struct {
@@ -57,6 +82,8 @@ type File struct {
 	MarkDel   bool
 	LastObjID uint64
 	NeedleCnt int
+	Corrupt   bool // found corrupt by the DataNode, the file is repaired from the other replicas
+	Sealed    bool // the extent refuses the writes, it is converted to ec once cold
 }
 
 type LoadMetaRangeMetricRequest struct {
@@ -74,13 +101,32 @@ type LoadMetaRangeMetricResponse struct {
 
 type HeartBeatRequest struct {
 	CurrTime int64
+	Throttle *ThrottleLimits // the io limits of the DataNode, nil to the MetaNode
+	Vols     []*VolView      // the vols of the DataNode, nil to the MetaNode
 }
 
-type VolReport struct {
+// VolView is a vol of the DataNode in the view of master, the leader of the
+// vol group heads the replication chain of the Followers.
+type VolView struct {
 	VolID     uint64
-	VolStatus int
-	Total     uint64
-	Used      uint64
+	Leader    bool
+	Followers []string
+}
+
+type VolReport struct {
+	VolID        uint64
+	VolStatus    int
+	Total        uint64
+	Used         uint64
+	PhysicalUsed uint64
+}
+
+// BadFileReport is a file found corrupt by the scrubber of the DataNode, the
+// Blocks are the corrupt blocks of an extent or objects of a chunk.
+type BadFileReport struct {
+	VolID  uint64
+	Name   string
+	Blocks []uint64
 }
 
 type DataNodeHeartBeatResponse struct {
@@ -89,6 +135,7 @@ type DataNodeHeartBeatResponse struct {
 	Used               uint64
 	RackName           string
 	VolInfo            []*VolReport
+	BadFiles           []*BadFileReport
 	Status             uint8
 	Result             string
 }
@@ -108,6 +155,19 @@ type MetaNodeHeartbeatResponse struct {
 	Result        string
 }
 
+type ReplicateFileRequest struct {
+	VolId uint64
+	Name  string
+	Hosts []string
+}
+
+type ReplicateFileResponse struct {
+	Status uint8
+	Result string
+	VolId  uint64
+	Name   string
+}
+
 type DeleteFileRequest struct {
 	VolId uint64
 	Name  string
@@ -119,3 +179,70 @@ type DeleteFileResponse struct {
 	VolId  uint64
 	Name   string
 }
+
+// ConvertToEcRequest asks the leader of a replicated extent volume to encode
+// its extents into DataNum+ParityNum shards, the i-th of EcHosts keeps the
+// i-th shard.
+type ConvertToEcRequest struct {
+	VolId     uint64
+	DataNum   int
+	ParityNum int
+	EcHosts   []string
+	Replicas  []string // the other replicas, every extent must be the same on them
+}
+
+// ConvertToEcResponse has the shard size of every extent converted, master
+// deletes the replicas once every ec host reports the shards of them.
+type ConvertToEcResponse struct {
+	Status  uint8
+	Result  string
+	VolId   uint64
+	Extents map[string]uint32
+}
+
+// EcRepairRequest asks a DataNode to rebuild the ShardIndex-th shard of an
+// erasure coded volume from the other shards on Hosts.
+type EcRepairRequest struct {
+	VolId      uint64
+	DataNum    int
+	ParityNum  int
+	ShardIndex int
+	Hosts      []string
+}
+
+type EcRepairResponse struct {
+	Status     uint8
+	Result     string
+	VolId      uint64
+	ShardIndex int
+}
+
+// ThrottleLimit is the token bucket limit of the reads and writes, the zero
+// field is unlimited.
+type ThrottleLimit struct {
+	Iops      int64 // requests per second
+	Bandwidth int64 // bytes per second
+}
+
+// ThrottleLimits are the io limits of every DataNode. The limit of a vol is
+// of its replica on a DataNode, the limit of a namespace is shared by the
+// vols of the namespace on a DataNode, and the limit of a client is by the
+// client ip, DefaultClient is of every client not listed. The requests of
+// the DataNodes are not limited.
+type ThrottleLimits struct {
+	Vols          map[uint64]*ThrottleLimit
+	Namespaces    map[string]*ThrottleLimit
+	NamespaceVols map[uint64]string // the namespace of the vols, for the namespaces limited only
+	Clients       map[string]*ThrottleLimit
+	DefaultClient *ThrottleLimit
+	DataNodes     []string // the ips of the DataNodes
+}
+
+type SetThrottleRequest struct {
+	Limits *ThrottleLimits
+}
+
+type SetThrottleResponse struct {
+	Status uint8
+	Result string
+}
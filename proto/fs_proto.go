@@ -17,7 +17,7 @@ type InodeInfo struct {
 	Type       uint32    `json:"type"`
 	Size       uint64    `json:"size"`
 	ModifyTime time.Time `json:"modify_time"`
-	CreateTime time.Time `json:"create_time"`
+	CreateTime time.Time `json:"create_time"` // zero, the inode keeps no create time
 	AccessTime time.Time `json:"access_time"`
 	Extents    []string
 }
@@ -122,3 +122,42 @@ type ReadDirResponse struct {
 	OpResult
 	Children []Dentry `json:"children"`
 }
+
+// The extent keys of the requests and the responses below are marshaled by
+// stream.ExtentKey.Marshal, the same as InodeInfo.Extents.
+
+type AppendExtentKeyRequest struct {
+	Namespace string `json:"namespace"`
+	GroupID   string
+	Inode     uint64   `json:"inode"`
+	Extents   []string `json:"extents"`
+}
+
+type AppendExtentKeyResponse struct {
+	OpResult
+	Size uint64 `json:"size"`
+}
+
+type DelExtentKeyRequest struct {
+	Namespace string `json:"namespace"`
+	GroupID   string
+	Inode     uint64   `json:"inode"`
+	Extents   []string `json:"extents"`
+}
+
+type DelExtentKeyResponse struct {
+	OpResult
+	Size uint64 `json:"size"`
+}
+
+type GetExtentsRequest struct {
+	Namespace string `json:"namespace"`
+	GroupID   string
+	Inode     uint64 `json:"inode"`
+}
+
+type GetExtentsResponse struct {
+	OpResult
+	Size    uint64   `json:"size"`
+	Extents []string `json:"extents"`
+}
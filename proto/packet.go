@@ -61,7 +61,26 @@ const (
 	// Operations: Master -> MetaNode
 	OpMetaCreateMetaRange uint8 = 0x1A
 
+	// Operations: Master -> DataNode
+	OpCreateVol         uint8 = 0x1B
+	OpDeleteVol         uint8 = 0x1C
+	OpLoadVol           uint8 = 0x1D
+	OpDataNodeHeartbeat uint8 = 0x1E
+	OpReplicateFile     uint8 = 0x1F
+	OpDeleteFile        uint8 = 0x20
+	OpConvertToEc       uint8 = 0x23
+	OpEcRepair          uint8 = 0x24
+	OpSetThrottle       uint8 = 0x25
+
+	// Operations: DataNode -> DataNode
+	OpGetBlockCrc uint8 = 0x26
+
+	// Operations: Client -> DataNode
+	OpSealFile   uint8 = 0x21
+	OpUnsealFile uint8 = 0x22
+
 	// Commons
+	OpCorruptErr       uint8 = 0xF2
 	OpIntraGroupNetErr uint8 = 0xF3
 	OpArgMismatchErr   uint8 = 0xF4
 	OpNotExistErr      uint8 = 0xF5
@@ -71,6 +90,8 @@ const (
 	OpAgain            uint8 = 0xF9
 	OpExistErr         uint8 = 0xFA
 	OpInodeFullErr     uint8 = 0xFB
+	OpVolReadOnlyErr   uint8 = 0xFC
+	OpNotLeaderErr     uint8 = 0xFD
 	OpOk               uint8 = 0x00
 )
 
@@ -137,6 +158,32 @@ func GetOpMesg(opcode uint8) (m string) {
 		m = "ExtentRepairRead"
 	case OpFlowInfo:
 		m = "FlowInfo"
+	case OpCreateVol:
+		m = "CreateVol"
+	case OpDeleteVol:
+		m = "DeleteVol"
+	case OpLoadVol:
+		m = "LoadVol"
+	case OpDataNodeHeartbeat:
+		m = "DataNodeHeartbeat"
+	case OpReplicateFile:
+		m = "ReplicateFile"
+	case OpDeleteFile:
+		m = "DeleteFile"
+	case OpConvertToEc:
+		m = "ConvertToEc"
+	case OpEcRepair:
+		m = "EcRepair"
+	case OpSetThrottle:
+		m = "SetThrottle"
+	case OpGetBlockCrc:
+		m = "GetBlockCrc"
+	case OpSealFile:
+		m = "SealFile"
+	case OpUnsealFile:
+		m = "UnsealFile"
+	case OpCorruptErr:
+		m = "CorruptErr"
 	case OpIntraGroupNetErr:
 		m = "IntraGroupNetErr"
 	case OpArgMismatchErr:
@@ -159,6 +206,10 @@ func GetOpMesg(opcode uint8) (m string) {
 		m = "ExistErr"
 	case OpInodeFullErr:
 		m = "InodeFullErr"
+	case OpVolReadOnlyErr:
+		m = "VolReadOnlyErr"
+	case OpNotLeaderErr:
+		m = "NotLeaderErr"
 	default:
 		return ""
 
@@ -272,7 +323,7 @@ func (p *Packet) ReadFromConn(c net.Conn, deadlineTime time.Duration) (err error
 		return
 	}
 	size := p.Size
-	if p.Opcode == OpRead || p.Opcode == OpStreamRead {
+	if p.Opcode == OpRead || p.Opcode == OpStreamRead || p.Opcode == OpERepairRead || p.Opcode == OpCRepairRead {
 		size = 0
 	}
 	return ReadFull(c, &p.Data, int(size))
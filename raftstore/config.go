@@ -1,6 +1,7 @@
 package raftstore
 
 import (
+	"github.com/tiglabs/raft"
 	"github.com/tiglabs/raft/proto"
 )
 
@@ -21,5 +22,5 @@ type PartitionConfig struct {
 	ID      uint64
 	Applied uint64
 	Peers   []proto.Peer
-	SM      PartitionFsm
+	SM      raft.StateMachine
 }
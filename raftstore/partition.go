@@ -48,6 +48,14 @@ type Partition interface {
 	// AppliedIndex returns current index value of applied raft log in this raft store partition.
 	AppliedIndex() uint64
 
+	// ReadIndex confirms this node is the leader, by the lease of the leader since the raft store
+	// enables the lease check, and waits until the raft log committed is applied. The reads of the
+	// state machine after it returns are linearizable.
+	ReadIndex() error
+
+	// Truncate removes the raft log up to index, which is applied and persisted by the state machine.
+	Truncate(index uint64)
+
 	// NodeManager define necessary methods for node address management.
 	NodeManager
 }
@@ -95,7 +103,7 @@ func (p *partition) LeaderTerm() (leaderId, term uint64) {
 }
 
 func (p *partition) IsLeader() (isLeader bool) {
-	isLeader = p.raft != nil && p.IsLeader()
+	isLeader = p.raft != nil && p.raft.IsLeader(p.id)
 	return
 }
 
@@ -104,6 +112,20 @@ func (p *partition) AppliedIndex() (applied uint64) {
 	return
 }
 
+func (p *partition) ReadIndex() (err error) {
+	if !p.IsLeader() {
+		err = ErrNotLeader
+		return
+	}
+	future := p.raft.ReadIndex(p.id)
+	_, err = future.Response()
+	return
+}
+
+func (p *partition) Truncate(index uint64) {
+	p.raft.Truncate(p.id, index)
+}
+
 func (p *partition) Submit(cmd []byte) (resp interface{}, err error) {
 	if !p.IsLeader() {
 		err = ErrNotLeader
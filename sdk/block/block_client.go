@@ -76,12 +76,12 @@ func (clt *BlockClient) Write(data []byte) (key string, err error) {
 
 func (clt *BlockClient) Read(key string) (data []byte, err error) {
 	var (
-		volId, size, crc uint32
-		offset           int64
-		fileId           uint64
-		vol              *sdk.VolGroup
+		volId, size uint32
+		offset      int64
+		fileId      uint64
+		vol         *sdk.VolGroup
 	)
-	volId, fileId, offset, size, crc, err = unmarshalKey(key)
+	volId, fileId, offset, size, _, err = unmarshalKey(key)
 	if err != nil {
 		return
 	}
@@ -89,9 +89,9 @@ func (clt *BlockClient) Read(key string) (data []byte, err error) {
 	if err != nil {
 		return
 	}
-	pkt := newReadPacket(volId, size, crc, fileId, offset)
-
+	var pkt *proto.Packet
 	for _, host := range vol.Hosts {
+		pkt = newReadPacket(volId, size, fileId, offset, otherAddrs(vol, host))
 		conn, err := clt.conns.Get(host)
 		if err != nil {
 			err = errors.New("connect to destination storage node failed, err: " + err.Error())
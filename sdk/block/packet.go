@@ -24,19 +24,21 @@ func newWritePacket(data []byte, vol *sdk.VolGroup) (pkg *proto.Packet) {
 	pkg = proto.NewPacket()
 	pkg.Opcode = proto.OpWrite
 	pkg.StoreType = proto.TinyStoreMode
-	pkg.Nodes = 1
+	pkg.Nodes = uint8(len(vol.Hosts) - 1)
 	pkg.Size = uint32(len(data))
 	pkg.Data = data
 	pkg.Crc = crc32.ChecksumIEEE(data)
-	argstr := vol.Hosts[1] + proto.AddrSplit + vol.Hosts[2]
-	pkg.Arg = []byte(argstr)
+	pkg.Arg = []byte(vol.GetFollowAddrs())
 	pkg.Arglen = uint32(len(pkg.Arg))
 	pkg.VolID = vol.VolId
 	pkg.ReqID = allocReqId()
 	return
 }
 
-func newReadPacket(vid, size uint32, fid uint64, ofs int64) (pkg *proto.Packet) {
+// newReadPacket returns the packet reading the object from a replica, the
+// Arg carries the addresses of the other replicas, the replica reads the
+// object from them when its own copy is corrupt.
+func newReadPacket(vid, size uint32, fid uint64, ofs int64, addrs string) (pkg *proto.Packet) {
 	pkg = proto.NewPacket()
 	pkg.Opcode = proto.OpRead
 	pkg.StoreType = proto.TinyStoreMode
@@ -44,20 +46,30 @@ func newReadPacket(vid, size uint32, fid uint64, ofs int64) (pkg *proto.Packet)
 	pkg.Size = size
 	pkg.FileID = fid
 	pkg.Offset = ofs
-	pkg.Arglen = 0
+	pkg.Arg = []byte(addrs)
+	pkg.Arglen = uint32(len(pkg.Arg))
 	pkg.VolID = vid
 	pkg.ReqID = allocReqId()
 	return
 }
 
+// otherAddrs returns the addresses of the replicas of the vol but the host.
+func otherAddrs(vol *sdk.VolGroup, host string) (m string) {
+	for _, h := range vol.Hosts {
+		if h != host {
+			m = m + h + proto.AddrSplit
+		}
+	}
+	return
+}
+
 func newDelPacket(fid uint64, size uint32, ofs int64, vol *sdk.VolGroup) (pkg *proto.Packet) {
 	pkg = proto.NewPacket()
 	pkg.Opcode = proto.OpMarkDelete
 	pkg.StoreType = proto.TinyStoreMode
-	pkg.Nodes = 1
+	pkg.Nodes = uint8(len(vol.Hosts) - 1)
 	pkg.Size = size
-	argstr := vol.Hosts[1] + proto.AddrSplit + vol.Hosts[2]
-	pkg.Arg = []byte(argstr)
+	pkg.Arg = []byte(vol.GetFollowAddrs())
 	pkg.Arglen = uint32(len(pkg.Arg))
 	pkg.VolID = vol.VolId
 	pkg.Offset = ofs
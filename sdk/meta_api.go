@@ -147,3 +147,39 @@ func (mw *MetaWrapper) ReadDir_ll(parentID uint64) (children []proto.Dentry, err
 	children, err = mw.readdir(mc, parentID)
 	return
 }
+
+// The extent keys are marshaled by stream.ExtentKey.Marshal, since sdk/stream
+// imports this package.
+
+func (mw *MetaWrapper) AppendExtentKeys(inode uint64, extents []string) (status int, size uint64, err error) {
+	mc, err := mw.connect(inode)
+	if err != nil {
+		return
+	}
+	defer mw.putConn(mc, err)
+
+	status, size, err = mw.appendExtentKeys(mc, inode, extents)
+	return
+}
+
+func (mw *MetaWrapper) DelExtentKeys(inode uint64, extents []string) (status int, size uint64, err error) {
+	mc, err := mw.connect(inode)
+	if err != nil {
+		return
+	}
+	defer mw.putConn(mc, err)
+
+	status, size, err = mw.delExtentKeys(mc, inode, extents)
+	return
+}
+
+func (mw *MetaWrapper) GetExtents(inode uint64) (status int, size uint64, extents []string, err error) {
+	mc, err := mw.connect(inode)
+	if err != nil {
+		return
+	}
+	defer mw.putConn(mc, err)
+
+	status, size, extents, err = mw.getExtents(mc, inode)
+	return
+}
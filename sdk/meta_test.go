@@ -26,10 +26,10 @@ type testcase struct {
 var globalNV *NamespaceView
 
 var globalMP = []MetaPartition{
-	{"mp001", 1, 100, nil},
-	{"mp002", 101, 200, nil},
-	{"mp003", 210, 300, nil},
-	{"mp004", 301, 400, nil},
+	{GroupID: "mp001", Start: 1, End: 100},
+	{GroupID: "mp002", Start: 101, End: 200},
+	{GroupID: "mp003", Start: 210, End: 300},
+	{GroupID: "mp004", Start: 301, End: 400},
 }
 
 var globalTests = []testcase{
@@ -49,8 +49,8 @@ var globalTests = []testcase{
 }
 
 var extraMP = []MetaPartition{
-	{"mp004", 320, 390, nil},
-	{"mp006", 600, 700, nil},
+	{GroupID: "mp004", Start: 320, End: 390},
+	{GroupID: "mp006", Start: 600, End: 700},
 }
 
 var extraTests = []testcase{
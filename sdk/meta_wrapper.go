@@ -24,6 +24,10 @@ const (
 	CreateInodeTimeout            = time.Second * 5
 
 	MetaAllocBufSize = 1000
+
+	// The request replied OpNotLeaderErr is sent to the leader again.
+	MaxNotLeaderRetry      = 3
+	NotLeaderRetryInterval = time.Millisecond * 100
 )
 
 type MetaPartition struct {
@@ -31,11 +35,16 @@ type MetaPartition struct {
 	Start   uint64
 	End     uint64
 	Members []string
+
+	// LeaderAddr is the member replied as the leader, the requests are sent to
+	// it rather than the first member.
+	LeaderAddr string `json:"-"`
 }
 
 type MetaConn struct {
 	conn net.Conn
 	gid  string
+	addr string
 }
 
 type NamespaceView struct {
@@ -153,6 +162,9 @@ func (mw *MetaWrapper) replaceOrInsertPartition(mp *MetaPartition) {
 	found, ok := mw.partitions[mp.GroupID]
 	if ok {
 		mw.deletePartition(found)
+		if mp.LeaderAddr == "" && mp.isMember(found.LeaderAddr) {
+			mp.LeaderAddr = found.LeaderAddr
+		}
 	}
 
 	mw.addPartition(mp)
@@ -203,18 +215,55 @@ func (mw *MetaWrapper) getNextPartition(ino uint64) *MetaPartition {
 	return mp
 }
 
+func (mp *MetaPartition) isMember(addr string) bool {
+	for _, member := range mp.Members {
+		if member == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// getLeader returns the leader replied, or the first member if it is unknown.
+func (mw *MetaWrapper) getLeader(mp *MetaPartition) string {
+	mw.RLock()
+	defer mw.RUnlock()
+	if mp.LeaderAddr != "" {
+		return mp.LeaderAddr
+	}
+	return mp.Members[0]
+}
+
+// updateLeader sets the leader of the partition to the address replied by a
+// member which is not the leader. If the leader is unknown to the member, the
+// member after addr is tried next.
+func (mw *MetaWrapper) updateLeader(mp *MetaPartition, addr, leaderAddr string) {
+	mw.Lock()
+	defer mw.Unlock()
+	if leaderAddr != "" && mp.isMember(leaderAddr) {
+		mp.LeaderAddr = leaderAddr
+		return
+	}
+	for i, member := range mp.Members {
+		if member == addr {
+			mp.LeaderAddr = mp.Members[(i+1)%len(mp.Members)]
+			return
+		}
+	}
+	mp.LeaderAddr = ""
+}
+
 // Connection managements
 //
 
 func (mw *MetaWrapper) getConn(mp *MetaPartition) (*MetaConn, error) {
-	addr := mp.Members[0]
-	//TODO: deal with member 0 is not leader
+	addr := mw.getLeader(mp)
 	conn, err := mw.conns.Get(addr)
 	if err != nil {
 		return nil, err
 	}
 
-	mc := &MetaConn{conn: conn, gid: mp.GroupID}
+	mc := &MetaConn{conn: conn, gid: mp.GroupID, addr: addr}
 	return mc, nil
 }
 
@@ -239,6 +288,7 @@ func (mw *MetaWrapper) connect(inode uint64) (*MetaConn, error) {
 }
 
 func (mc *MetaConn) send(req *proto.Packet) (*proto.Packet, error) {
+	req.Size = uint32(len(req.Data))
 	err := req.WriteToConn(mc.conn)
 	if err != nil {
 		return nil, err
@@ -251,6 +301,43 @@ func (mc *MetaConn) send(req *proto.Packet) (*proto.Packet, error) {
 	return resp, nil
 }
 
+// send sends the request to the leader of the partition of mc. If the member
+// connected replies OpNotLeaderErr, the leader replied is remembered and the
+// request is sent to it again, mc is connected to the leader then. The request
+// replied OpErr is not sent again, it may have been done.
+func (mw *MetaWrapper) send(mc *MetaConn, req *proto.Packet) (resp *proto.Packet, err error) {
+	for i := 0; ; i++ {
+		if resp, err = mc.send(req); err != nil {
+			return
+		}
+		if resp.Opcode == proto.OpErr {
+			return nil, errors.Errorf("meta partition[%v] %v", mc.gid, string(resp.Data[:resp.Size]))
+		}
+		if resp.Opcode != proto.OpNotLeaderErr {
+			return
+		}
+		if i >= MaxNotLeaderRetry {
+			return nil, errors.Errorf("meta partition[%v] no leader after %v retries", mc.gid, i)
+		}
+		mp := mw.getPartitionByID(mc.gid)
+		if mp == nil {
+			return nil, errors.Errorf("meta partition[%v] not found", mc.gid)
+		}
+		leaderAddr := string(resp.Data[:resp.Size])
+		if leaderAddr == "" {
+			time.Sleep(NotLeaderRetryInterval)
+		}
+		mw.updateLeader(mp, mc.addr, leaderAddr)
+		addr := mw.getLeader(mp)
+		conn, e := mw.conns.Get(addr)
+		if e != nil {
+			return nil, e
+		}
+		mw.conns.Put(mc.conn)
+		mc.conn, mc.addr = conn, addr
+	}
+}
+
 // API implementations
 //
 
@@ -266,7 +353,7 @@ func (mw *MetaWrapper) icreate(mc *MetaConn, mode uint32) (status int, info *pro
 		return
 	}
 
-	packet, err = mc.send(packet)
+	packet, err = mw.send(mc, packet)
 	if err != nil {
 		return
 	}
@@ -291,7 +378,7 @@ func (mw *MetaWrapper) idelete(mc *MetaConn, inode uint64) (status int, err erro
 		return
 	}
 
-	packet, err = mc.send(packet)
+	packet, err = mw.send(mc, packet)
 	if err != nil {
 		return
 	}
@@ -319,7 +406,7 @@ func (mw *MetaWrapper) dcreate(mc *MetaConn, parentID uint64, name string, inode
 		return
 	}
 
-	packet, err = mc.send(packet)
+	packet, err = mw.send(mc, packet)
 	if err != nil {
 		return
 	}
@@ -345,7 +432,7 @@ func (mw *MetaWrapper) ddelete(mc *MetaConn, parentID uint64, name string) (stat
 		return
 	}
 
-	packet, err = mc.send(packet)
+	packet, err = mw.send(mc, packet)
 	if err != nil {
 		return
 	}
@@ -371,7 +458,7 @@ func (mw *MetaWrapper) lookup(mc *MetaConn, parentID uint64, name string) (statu
 		return
 	}
 
-	packet, err = mc.send(packet)
+	packet, err = mw.send(mc, packet)
 	if err != nil {
 		return
 	}
@@ -396,7 +483,7 @@ func (mw *MetaWrapper) iget(mc *MetaConn, inode uint64) (status int, info *proto
 		return
 	}
 
-	packet, err = mc.send(packet)
+	packet, err = mw.send(mc, packet)
 	if err != nil {
 		return
 	}
@@ -421,7 +508,7 @@ func (mw *MetaWrapper) readdir(mc *MetaConn, parentID uint64) (children []proto.
 		return
 	}
 
-	packet, err = mc.send(packet)
+	packet, err = mw.send(mc, packet)
 	if err != nil {
 		return
 	}
@@ -433,3 +520,80 @@ func (mw *MetaWrapper) readdir(mc *MetaConn, parentID uint64) (children []proto.
 	}
 	return resp.Children, nil
 }
+
+func (mw *MetaWrapper) appendExtentKeys(mc *MetaConn, inode uint64, extents []string) (status int, size uint64, err error) {
+	req := &proto.AppendExtentKeyRequest{
+		Namespace: mw.namespace,
+		Inode:     inode,
+		Extents:   extents,
+	}
+	packet := proto.NewPacket()
+	packet.Opcode = proto.OpMetaExtentsAdd
+	packet.Data, err = json.Marshal(req)
+	if err != nil {
+		return
+	}
+
+	packet, err = mw.send(mc, packet)
+	if err != nil {
+		return
+	}
+
+	resp := new(proto.AppendExtentKeyResponse)
+	err = json.Unmarshal(packet.Data, &resp)
+	if err != nil {
+		return
+	}
+	return int(resp.Status), resp.Size, nil
+}
+
+func (mw *MetaWrapper) delExtentKeys(mc *MetaConn, inode uint64, extents []string) (status int, size uint64, err error) {
+	req := &proto.DelExtentKeyRequest{
+		Namespace: mw.namespace,
+		Inode:     inode,
+		Extents:   extents,
+	}
+	packet := proto.NewPacket()
+	packet.Opcode = proto.OpMetaExtentsDel
+	packet.Data, err = json.Marshal(req)
+	if err != nil {
+		return
+	}
+
+	packet, err = mw.send(mc, packet)
+	if err != nil {
+		return
+	}
+
+	resp := new(proto.DelExtentKeyResponse)
+	err = json.Unmarshal(packet.Data, &resp)
+	if err != nil {
+		return
+	}
+	return int(resp.Status), resp.Size, nil
+}
+
+func (mw *MetaWrapper) getExtents(mc *MetaConn, inode uint64) (status int, size uint64, extents []string, err error) {
+	req := &proto.GetExtentsRequest{
+		Namespace: mw.namespace,
+		Inode:     inode,
+	}
+	packet := proto.NewPacket()
+	packet.Opcode = proto.OpMetaExtentsList
+	packet.Data, err = json.Marshal(req)
+	if err != nil {
+		return
+	}
+
+	packet, err = mw.send(mc, packet)
+	if err != nil {
+		return
+	}
+
+	resp := new(proto.GetExtentsResponse)
+	err = json.Unmarshal(packet.Data, &resp)
+	if err != nil {
+		return
+	}
+	return int(resp.Status), resp.Size, resp.Extents, nil
+}
@@ -23,10 +23,10 @@ const (
 )
 
 var globalMP = []MetaPartition{
-	{"mp001", 1, 100, nil},
-	{"mp002", 101, 200, nil},
-	{"mp003", 210, 300, nil},
-	{"mp004", 301, 400, nil},
+	{GroupID: "mp001", Start: 1, End: 100},
+	{GroupID: "mp002", Start: 101, End: 200},
+	{GroupID: "mp003", Start: 210, End: 300},
+	{GroupID: "mp004", Start: 301, End: 400},
 }
 
 type MasterServer struct {
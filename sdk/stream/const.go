@@ -1,5 +1,27 @@
 package stream
 
+import "time"
+
 const (
 	ActionExtentRecover = "ActionExtentRecover"
 )
+
+// The DataNode replies OpAgain to the requests over its io limits, the
+// request is sent again after a backoff doubled on every retry.
+const (
+	MinAgainBackoff = 10 * time.Millisecond
+	MaxAgainBackoff = time.Second
+	MaxAgainRetry   = 5
+)
+
+func againBackoff(retry int) (backoff time.Duration) {
+	backoff = MinAgainBackoff
+	for i := 0; i < retry && backoff < MaxAgainBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > MaxAgainBackoff {
+		backoff = MaxAgainBackoff
+	}
+
+	return
+}
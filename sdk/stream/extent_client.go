@@ -38,6 +38,39 @@ func NewExtentClient(logdir string, master string, saveExtentKeyFn func(inode ui
 	return
 }
 
+// MetaExtentKeyFns returns the callbacks of NewExtentClient which keep the
+// extent keys of the inodes on the metanodes through mw.
+func MetaExtentKeyFns(mw *sdk.MetaWrapper) (saveExtentKeyFn func(inode uint64, key ExtentKey) (err error),
+	updateExtentKeyFn func(inode uint64) (streamKey *StreamKey, err error)) {
+	saveExtentKeyFn = func(inode uint64, key ExtentKey) (err error) {
+		status, _, err := mw.AppendExtentKeys(inode, []string{key.Marshal()})
+		if err == nil && status != int(proto.OpOk) {
+			err = fmt.Errorf("append extent key[%v] of inode[%v] status[%v]", key.Marshal(), inode, status)
+		}
+		return
+	}
+	updateExtentKeyFn = func(inode uint64) (streamKey *StreamKey, err error) {
+		status, _, extents, err := mw.GetExtents(inode)
+		if err != nil {
+			return
+		}
+		if status != int(proto.OpOk) {
+			return nil, fmt.Errorf("get extents of inode[%v] status[%v]", inode, status)
+		}
+		streamKey = NewStreamKey(inode)
+		for _, m := range extents {
+			k := ExtentKey{}
+			if err = k.UnMarshal(m); err != nil {
+				return nil, err
+			}
+			streamKey.Extents = append(streamKey.Extents, k)
+		}
+		return
+	}
+
+	return
+}
+
 func (client *ExtentClient) InitWriteStream(inode uint64) (stream *StreamWriter) {
 	stream = NewStreamWriter(client.wrapper, inode, client.saveExtentKeyFn)
 	client.writerLock.Lock()
@@ -101,6 +134,10 @@ func (client *ExtentClient) Close(inode uint64) (err error) {
 	var streamReader *StreamReader
 	streamWriter := client.getStreamWriter(inode)
 	err = streamWriter.flushCurrExtentWriter()
+	if writer := streamWriter.getWriter(); err == nil && writer != nil {
+		streamWriter.setWriterToNull()
+		streamWriter.sealExtent(writer)
+	}
 	client.writerLock.Lock()
 	delete(client.writers, inode)
 	client.writerLock.Unlock()
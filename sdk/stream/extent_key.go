@@ -54,6 +54,19 @@ func (sk *StreamKey) Put(k ExtentKey) {
 	return
 }
 
+// Delete removes the key of the same extent as k, it returns false if there
+// is no such key.
+func (sk *StreamKey) Delete(k ExtentKey) (found bool) {
+	for index := 0; index < len(sk.Extents); index++ {
+		if sk.Extents[index].isEquare(k) {
+			sk.Extents = append(sk.Extents[:index], sk.Extents[index+1:]...)
+			return true
+		}
+	}
+
+	return
+}
+
 func (sk *StreamKey) Size() (bytes uint64) {
 	for _, okey := range sk.Extents {
 		bytes += uint64(okey.Size)
@@ -90,6 +103,9 @@ func (k *ExtentKey) UnMarshal(m string) (err error) {
 	)
 	err = InvalidKey
 	keyArr := strings.Split(m, "_")
+	if len(keyArr) != 4 {
+		return
+	}
 	size, err = strconv.ParseUint(keyArr[2], 10, 64)
 	if err != nil {
 		return
@@ -5,6 +5,7 @@ import (
 	"github.com/juju/errors"
 	"github.com/tiglabs/baudstorage/proto"
 	"github.com/tiglabs/baudstorage/sdk"
+	"github.com/tiglabs/baudstorage/util/ec"
 	"github.com/tiglabs/baudstorage/util/log"
 	"github.com/tiglabs/raft/util"
 	"math/rand"
@@ -74,6 +75,9 @@ func (reader *ExtentReader) read(data []byte, offset, size int) (err error) {
 }
 
 func (reader *ExtentReader) readDataFromVol(p *Packet, data []byte) (err error) {
+	if reader.vol.IsEcVol() {
+		return reader.readDataFromEcVol(p, data)
+	}
 	rand.Seed(time.Now().UnixNano())
 	index := rand.Intn(int(reader.vol.Goal))
 	host := reader.vol.Hosts[index]
@@ -96,8 +100,62 @@ FORLOOP:
 	return
 }
 
+// readDataFromEcVol reads every piece of the range from the shard keeping it,
+// the piece is reconstructed from the other shards if the shard fails.
+func (reader *ExtentReader) readDataFromEcVol(p *Packet, data []byte) (err error) {
+	dataNum := int(reader.vol.EcDataNum)
+	for _, piece := range ec.Locate(dataNum, p.Offset, int64(p.Size)) {
+		buf := data[piece.Offset-p.Offset : piece.Offset-p.Offset+int64(piece.Size)]
+		host := reader.vol.Hosts[piece.Shard]
+		pp := NewReadPacket(reader.key, int(piece.ShardOffset), piece.Size)
+		if _, err = reader.readDataFromHost(pp, host, buf); err == nil {
+			continue
+		}
+		if err = reader.reconstructEcPiece(piece, buf); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// reconstructEcPiece reads the same range of EcDataNum other shards, and
+// decodes the piece of the failed shard from them.
+func (reader *ExtentReader) reconstructEcPiece(piece ec.Piece, buf []byte) (err error) {
+	var encoder *ec.Encoder
+	dataNum := int(reader.vol.EcDataNum)
+	if encoder, err = ec.NewEncoder(dataNum, len(reader.vol.Hosts)-dataNum); err != nil {
+		return
+	}
+	shards := make([][]byte, len(reader.vol.Hosts))
+	readable := 0
+	for i, host := range reader.vol.Hosts {
+		if i == piece.Shard || readable == dataNum {
+			continue
+		}
+		shard := make([]byte, piece.Size)
+		pp := NewReadPacket(reader.key, int(piece.ShardOffset), piece.Size)
+		if _, e := reader.readDataFromHost(pp, host, shard); e != nil {
+			continue
+		}
+		shards[i] = shard
+		readable++
+	}
+	if err = encoder.Reconstruct(shards); err != nil {
+		return errors.Annotatef(err, reader.toString()+"reconstructEcPiece shard[%v] offset[%v] size[%v] readable[%v]",
+			piece.Shard, piece.ShardOffset, piece.Size, readable)
+	}
+	copy(buf, shards[piece.Shard])
+	log.LogWarn(fmt.Sprintf(reader.toString()+"reconstructEcPiece shard[%v] host[%v] offset[%v] size[%v] degraded read",
+		piece.Shard, reader.vol.Hosts[piece.Shard], piece.ShardOffset, piece.Size))
+
+	return
+}
+
 func (reader *ExtentReader) readDataFromHost(p *Packet, host string, data []byte) (acatualReadSize int, err error) {
 	expectReadSize := int(p.Size)
+	request := *p
+	retry := 0
 	conn, err := reader.wraper.GetConnect(host)
 	if err != nil {
 		return 0, errors.Annotatef(err, reader.toString()+"readDataFromHost vol[%v] cannot get"+
@@ -125,6 +183,18 @@ func (reader *ExtentReader) readDataFromHost(p *Packet, host string, data []byte
 			return acatualReadSize, err
 
 		}
+		// the request throttled is sent again, the reply overwrote it
+		if p.Opcode == proto.OpAgain && acatualReadSize == 0 && retry < MaxAgainRetry {
+			time.Sleep(againBackoff(retry))
+			retry++
+			*p = request
+			if err = p.WriteToConn(conn); err != nil {
+				err = errors.Annotatef(err, reader.toString()+"readDataFromHost host[%v] error request[%v]",
+					host, p.GetUniqLogId())
+				return 0, err
+			}
+			continue
+		}
 		if p.Opcode != proto.OpOk {
 			err = errors.Annotatef(fmt.Errorf(string(p.Data[:p.Size])), reader.toString()+"readDataFromHost host [%v]"+
 				"  request[%v] reply[%v]", host, p.GetUniqLogId(), p.GetUniqLogId())
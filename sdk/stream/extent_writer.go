@@ -48,6 +48,8 @@ type ExtentWriter struct {
 	connect          net.Conn
 	handleCh         chan bool //a Chan for signal recive goroutine recive packet from connect
 	recoverCnt       int       //if failed,then recover contine,this is recover count
+	throttled        int32     //the DataNode replied OpAgain, the recover backs off and resends
+	againCnt         int32     //the resends after OpAgain since the last ack
 
 	cond *sync.Cond //flushCond use for backEndlush func
 	sync.Mutex
@@ -157,10 +159,21 @@ func (writer *ExtentWriter) sendCurrPacket() (err error) {
 	return err
 }
 
-//if send failed,recover it
+//if send failed,recover it. The requests over the io limits of the DataNode are
+//resent to the same extent after a backoff, up to MaxAgainRetry times
 func (writer *ExtentWriter) recover() (sucess bool) {
-	if writer.recoverCnt > ExtentWriterRecoverCnt {
+	if atomic.CompareAndSwapInt32(&writer.throttled, 1, 0) {
+		retry := atomic.AddInt32(&writer.againCnt, 1)
+		if retry > MaxAgainRetry {
+			//the stream backs off before it moves to a new extent
+			atomic.StoreInt32(&writer.throttled, 1)
+			return
+		}
+		time.Sleep(againBackoff(int(retry - 1)))
+	} else if writer.recoverCnt > ExtentWriterRecoverCnt {
 		return
+	} else {
+		writer.recoverCnt++
 	}
 	var (
 		connect net.Conn
@@ -168,7 +181,6 @@ func (writer *ExtentWriter) recover() (sucess bool) {
 	)
 	writer.getConnect().Close()
 	writer.cleanHandleCh()
-	writer.recoverCnt++
 	defer func() {
 		if err == nil {
 			writer.recoverCnt = 0
@@ -214,6 +226,10 @@ func (writer *ExtentWriter) isFullExtent() bool {
 	return writer.offset+CFSBLOCKSIZE >= CFSEXTENTSIZE
 }
 
+func (writer *ExtentWriter) isThrottled() bool {
+	return atomic.LoadInt32(&writer.throttled) == 1
+}
+
 //check allPacket has Ack
 func (writer *ExtentWriter) isAllFlushed() bool {
 	writer.Lock()
@@ -295,6 +311,12 @@ func (writer *ExtentWriter) processReply(e *list.Element, request, reply *Packet
 		return errors.Annotatef(fmt.Errorf("processReply recive [%v] but actual recive [%v]",
 			request.GetUniqLogId(), reply.GetUniqLogId()), "writer[%v]", writer.toString())
 	}
+	if reply.Opcode == proto.OpVolReadOnlyErr {
+		writer.wraper.MarkVolReadOnly(writer.volGroup.VolId)
+	}
+	if reply.Opcode == proto.OpAgain {
+		atomic.StoreInt32(&writer.throttled, 1)
+	}
 	if reply.Opcode != proto.OpOk {
 		writer.connect.Close()
 		return errors.Annotatef(fmt.Errorf("processReply recive [%v] error [%v]", request.GetUniqLogId(),
@@ -302,6 +324,7 @@ func (writer *ExtentWriter) processReply(e *list.Element, request, reply *Packet
 	}
 	writer.removeRquest(e)
 	writer.addByteAck(uint64(request.Size))
+	atomic.StoreInt32(&writer.againCnt, 0)
 	log.LogDebug(fmt.Sprintf("ActionProcessReply[%v] is recived", request.GetUniqLogId()))
 
 	return nil
@@ -22,8 +22,9 @@ func NewWritePacket(vol *sdk.VolGroup, extentId, seqNo uint64, offset int) (p *P
 	p.StoreType = proto.ExtentStoreMode
 	p.FileID = extentId
 	p.Offset = int64(offset)
-	p.Arg = ([]byte)(vol.GetAllAddrs())
+	p.Arg = ([]byte)(vol.GetFollowAddrs())
 	p.Arglen = uint32(len(p.Arg))
+	p.Nodes = uint8(len(vol.Hosts) - 1)
 	p.ReqID = int64(seqNo)
 	p.Opcode = proto.OpWrite
 
@@ -51,8 +52,9 @@ func NewCreateExtentPacket(vol *sdk.VolGroup) (p *Packet) {
 	p.VolID = vol.VolId
 	p.StoreType = proto.ExtentStoreMode
 	p.ReqID = proto.GetReqID()
-	p.Arg = ([]byte)(vol.GetAllAddrs())
+	p.Arg = ([]byte)(vol.GetFollowAddrs())
 	p.Arglen = uint32(len(p.Arg))
+	p.Nodes = uint8(len(vol.Hosts) - 1)
 	return p
 }
 
@@ -63,8 +65,23 @@ func NewDeleteExtentPacket(vol *sdk.VolGroup, extentId uint64) (p *Packet) {
 	p.StoreType = proto.ExtentStoreMode
 	p.VolID = vol.VolId
 	p.FileID = extentId
-	p.Arg = ([]byte)(vol.GetAllAddrs())
+	p.Arg = ([]byte)(vol.GetFollowAddrs())
 	p.Arglen = uint32(len(p.Arg))
+	p.Nodes = uint8(len(vol.Hosts) - 1)
+	return p
+}
+
+func NewSealExtentPacket(vol *sdk.VolGroup, extentId uint64) (p *Packet) {
+	p = new(Packet)
+	p.Magic = proto.ProtoMagic
+	p.Opcode = proto.OpSealFile
+	p.StoreType = proto.ExtentStoreMode
+	p.VolID = vol.VolId
+	p.FileID = extentId
+	p.ReqID = proto.GetReqID()
+	p.Arg = ([]byte)(vol.GetFollowAddrs())
+	p.Arglen = uint32(len(p.Arg))
+	p.Nodes = uint8(len(vol.Hosts) - 1)
 	return p
 }
 
@@ -146,11 +146,41 @@ func (stream *StreamWriter) flushCurrExtentWriter() (err error) {
 	}
 	if writer.isFullExtent() {
 		stream.setWriterToNull()
+		stream.sealExtent(writer)
 	}
 
 	return
 }
 
+// sealExtent seals the extent the writer leaves at its commit length, it is
+// written no more and is converted to ec once cold. The seal is best effort,
+// the extent not sealed is kept replicated.
+func (stream *StreamWriter) sealExtent(writer *ExtentWriter) {
+	var err error
+	defer func() {
+		if err != nil {
+			log.LogWarn(fmt.Sprintf("StreamWriter[%v] seal extent[%v] err[%v]", stream.toString(), writer.toString(), err))
+		}
+	}()
+	connect, err := stream.wraper.GetConnect(writer.volGroup.Hosts[0])
+	if err != nil {
+		return
+	}
+	p := NewSealExtentPacket(writer.volGroup, writer.extentId)
+	if err = p.WriteToConn(connect); err != nil {
+		connect.Close()
+		return
+	}
+	if err = p.ReadFromConn(connect, proto.ReadDeadlineTime); err != nil {
+		connect.Close()
+		return
+	}
+	stream.wraper.PutConnect(connect)
+	if p.Opcode != proto.OpOk {
+		err = fmt.Errorf("seal on vol[%v] err[%v]", writer.volGroup.VolId, string(p.Data[:p.Size]))
+	}
+}
+
 func (stream *StreamWriter) recoverExtent() (err error) {
 	defer func() {
 		if err == nil {
@@ -160,10 +190,15 @@ func (stream *StreamWriter) recoverExtent() (err error) {
 		}
 	}()
 
+	if stream.getWriter().isThrottled() {
+		time.Sleep(againBackoff(stream.errCount))
+	}
 	sendList := stream.getWriter().getNeedRetrySendPackets()
+	failed := stream.getWriter()
 	if err = stream.allocateNewExtentWriter(); err != nil {
 		return
 	}
+	stream.sealExtent(failed)
 	if err = stream.updateExtentKeyFn(stream.currentInode, stream.getWriter().toKey()); err != nil {
 		return
 	}
@@ -230,6 +265,14 @@ func (stream *StreamWriter) createExtent(vol *sdk.VolGroup) (extentId uint64, er
 	if err = p.ReadFromConn(connect, proto.ReadDeadlineTime); err != nil {
 		return
 	}
+	if p.Opcode == proto.OpVolReadOnlyErr {
+		stream.wraper.MarkVolReadOnly(vol.VolId)
+		stream.excludeVols = append(stream.excludeVols, vol.VolId)
+	}
+	if p.Opcode != proto.OpOk {
+		err = fmt.Errorf("createExtent on vol[%v] err[%v]", vol.VolId, string(p.Data[:p.Size]))
+		return
+	}
 	extentId = p.FileID
 
 	return
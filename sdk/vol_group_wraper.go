@@ -12,16 +12,22 @@ import (
 	"time"
 
 	"github.com/tiglabs/baudstorage/proto"
-	"github.com/tiglabs/baudstorage/storage"
 	"github.com/tiglabs/baudstorage/util/log"
 	"github.com/tiglabs/baudstorage/util/pool"
 )
 
 type VolGroup struct {
 	VolId  uint32
-	Goal   uint8
+	Goal   uint8 `json:"ReplicaNum"`
 	Hosts  []string
-	Status uint8
+	Status int
+	// The shards of an erasure coded vol, Hosts[i] keeps the i-th shard.
+	EcDataNum   uint8
+	EcParityNum uint8
+}
+
+func (vg *VolGroup) IsEcVol() bool {
+	return vg.EcDataNum > 0
 }
 
 func (vg *VolGroup) GetAllAddrs() (m string) {
@@ -35,8 +41,21 @@ func (vg *VolGroup) GetAllAddrs() (m string) {
 	return
 }
 
+// GetFollowAddrs returns the replication chain after the head host, every
+// address is followed by an AddrSplit.
+func (vg *VolGroup) GetFollowAddrs() (m string) {
+	for _, host := range vg.Hosts[1:] {
+		m = m + host + proto.AddrSplit
+	}
+	return
+}
+
+type VolsView struct {
+	Vols []*VolGroup
+}
+
 const (
-	VolViewUrl            = "/client/view"
+	VolViewUrl            = "/client/vols"
 	ActionGetVolGroupView = "ActionGetVolGroupView"
 )
 
@@ -89,34 +108,37 @@ func (wraper *VolGroupWraper) getVolsFromMaster() (err error) {
 		if err != nil {
 			continue
 		}
-		views := make([]VolGroup, 0)
-		if err = json.Unmarshal(body, &views); err != nil {
+		view := new(VolsView)
+		if err = json.Unmarshal(body, view); err != nil {
 			log.LogError(fmt.Sprintf(ActionGetVolGroupView+"get VolView from master[%v] err[%v]", m, err.Error()))
 			continue
 		}
-		wraper.updateVolGroup(views)
+		wraper.updateVolGroup(view.Vols)
 		break
 	}
 
 	return
 }
 
-func (wraper *VolGroupWraper) insertVol(vg VolGroup) {
+func (wraper *VolGroupWraper) insertVol(vg *VolGroup) {
 	wraper.RLock()
 	volGroup := wraper.volGroups[vg.VolId]
 	wraper.RUnlock()
 	wraper.Lock()
 	if volGroup == nil {
-		wraper.volGroups[vg.VolId] = &VolGroup{VolId: vg.VolId, Status: vg.Status, Hosts: vg.Hosts, Goal: vg.Goal}
+		wraper.volGroups[vg.VolId] = &VolGroup{VolId: vg.VolId, Status: vg.Status, Hosts: vg.Hosts, Goal: vg.Goal,
+			EcDataNum: vg.EcDataNum, EcParityNum: vg.EcParityNum}
 	} else {
 		volGroup.Status = vg.Status
 		volGroup.Hosts = vg.Hosts
 		volGroup.Goal = vg.Goal
+		volGroup.EcDataNum = vg.EcDataNum
+		volGroup.EcParityNum = vg.EcParityNum
 	}
 	wraper.Unlock()
 }
 
-func (wraper *VolGroupWraper) updateVolGroup(views []VolGroup) {
+func (wraper *VolGroupWraper) updateVolGroup(views []*VolGroup) {
 	wraper.RLock()
 	if len(views) < len(wraper.volGroups) {
 		wraper.RUnlock()
@@ -129,7 +151,7 @@ func (wraper *VolGroupWraper) updateVolGroup(views []VolGroup) {
 	wraper.Lock()
 	readWriteVols := make([]*VolGroup, 0)
 	for _, vg := range wraper.volGroups {
-		if vg.Status == storage.ReadWriteStore {
+		if vg.Status == proto.VolReadWrite {
 			readWriteVols = append(readWriteVols, vg)
 		}
 	}
@@ -151,19 +173,20 @@ func isExcluse(volId uint32, excludes *[]uint32) (exclude bool) {
 	return
 }
 
+// GetWriteVol picks a random ReadWrite vol group not excluded, the vol
+// groups marked readonly since the last view of master are skipped.
 func (wraper *VolGroupWraper) GetWriteVol(exclude []uint32) (v *VolGroup, err error) {
-	wraper.RLock()
-	rand.Seed(time.Now().UnixNano())
-	randomIndex := rand.Intn(len(wraper.readWriteVols))
-	v = wraper.readWriteVols[randomIndex]
-	wraper.RUnlock()
-	if !isExcluse(v.VolId, &exclude) {
-		return
-	}
 	wraper.RLock()
 	defer wraper.RUnlock()
+	if len(wraper.readWriteVols) > 0 {
+		rand.Seed(time.Now().UnixNano())
+		v = wraper.readWriteVols[rand.Intn(len(wraper.readWriteVols))]
+		if v.Status == proto.VolReadWrite && !isExcluse(v.VolId, &exclude) {
+			return
+		}
+	}
 	for _, v = range wraper.readWriteVols {
-		if !isExcluse(v.VolId, &exclude) {
+		if v.Status == proto.VolReadWrite && !isExcluse(v.VolId, &exclude) {
 			return
 		}
 	}
@@ -171,6 +194,17 @@ func (wraper *VolGroupWraper) GetWriteVol(exclude []uint32) (v *VolGroup, err er
 	return nil, fmt.Errorf("no volGroup for write")
 }
 
+// MarkVolReadOnly stops the writes to the vol group refused by the datanode
+// as readonly, until master reports it ReadWrite again.
+func (wraper *VolGroupWraper) MarkVolReadOnly(volId uint32) {
+	wraper.Lock()
+	defer wraper.Unlock()
+	if vg := wraper.volGroups[volId]; vg != nil && vg.Status == proto.VolReadWrite {
+		vg.Status = proto.VolReadOnly
+		log.LogWarn(fmt.Sprintf("volGroup[%v] is marked readonly", volId))
+	}
+}
+
 func (wraper *VolGroupWraper) GetVol(volId uint32) (v *VolGroup, err error) {
 	wraper.RLock()
 	defer wraper.RUnlock()
@@ -13,11 +13,27 @@ import (
 
 type Chunk struct {
 	file        *os.File
+	directFile  *os.File // the file opened with O_DIRECT in IoModeDirect
+	ioMode      IoMode
 	tree        *ObjectTree
 	lastOid     uint64
 	syncLastOid uint64
 	commitLock  sync.RWMutex
 	compactLock util.TryMutex
+	cpFile      *os.File
+	cpLock      sync.Mutex
+	checkpoint  chunkCheckpoint
+	report      *RecoveryReport
+	compactGen  uint64 // bumped by each compaction committed
+	delLock     sync.Mutex
+	pendingDels []pendingDelete
+}
+
+// pendingDelete is an object deleted while the compactLock is held by others,
+// its space is freed by the next holder of the compactLock.
+type pendingDelete struct {
+	Object
+	gen uint64
 }
 
 type ChunkInfo struct {
@@ -28,11 +44,13 @@ type ChunkInfo struct {
 func NewChunk(dataDir string, chunkId int) (c *Chunk, err error) {
 	c = new(Chunk)
 	name := dataDir + "/" + strconv.Itoa(chunkId)
-	maxOid, err := c.loadTree(name)
+	maxOid, report, err := c.loadTree(name)
 	if err != nil {
 		return nil, err
 	}
 
+	report.ChunkId = chunkId
+	c.report = report
 	c.storeLastOid(maxOid)
 	return c, nil
 }
@@ -46,14 +64,76 @@ func (c *Chunk) applyDelObjects(objects []uint64) (err error) {
 	return
 }
 
-func (c *Chunk) loadTree(name string) (maxOid uint64, err error) {
-	if c.file, err = os.OpenFile(name, ChunkOpenOpt, 0666); err != nil {
+// deletePending deletes the object without the compactLock, the space of it
+// is freed later by freePendingDeletes.
+func (c *Chunk) deletePending(oid uint64) error {
+	c.commitLock.RLock()
+	defer c.commitLock.RUnlock()
+	o, ok := c.tree.get(oid)
+	if err := c.tree.delete(oid); err != nil {
+		return err
+	}
+	if ok && o.Size != TombstoneFileSize {
+		c.delLock.Lock()
+		c.pendingDels = append(c.pendingDels, pendingDelete{Object: *o, gen: c.compactGen})
+		c.delLock.Unlock()
+	}
+
+	return nil
+}
+
+// freePendingDeletes punches the space of the objects deleted by
+// deletePending, the caller holds the compactLock. An object deleted before
+// the compaction committed may have been copied into the new chunk, it is
+// deleted again there. The tombstones are synced before the space is freed,
+// the space is left to the compaction if the sync fails.
+func (c *Chunk) freePendingDeletes() {
+	c.delLock.Lock()
+	pending := c.pendingDels
+	c.pendingDels = nil
+	c.delLock.Unlock()
+	punched := make([]*Object, 0, len(pending))
+	for i := range pending {
+		o := &pending[i].Object
+		if pending[i].gen != c.compactGen {
+			var ok bool
+			if o, ok = c.tree.get(pending[i].Oid); !ok {
+				continue
+			}
+			c.tree.delete(o.Oid)
+		}
+		if o.Size != TombstoneFileSize && o.Size >= PunchHoleMinSize {
+			punched = append(punched, o)
+		}
+	}
+	if len(punched) == 0 || fdatasync(c.tree.idxFile) != nil {
+		return
+	}
+	for _, o := range punched {
+		punchHole(c.file, int64(o.Offset), int64(o.Size))
+	}
+}
+
+func (c *Chunk) loadTree(name string) (maxOid uint64, report *RecoveryReport, err error) {
+	if c.file, err = os.OpenFile(name, ChunkOpenOpt|c.ioMode.openFlag(), 0666); err != nil {
+		return
+	}
+
+	if c.cpFile, err = os.OpenFile(checkpointName(name), os.O_CREATE|os.O_RDWR, 0666); err != nil {
+		c.file.Close()
 		return
 	}
 
-	var idxFile *os.File
 	idxName := name + ".idx"
+	if report, err = c.recover(idxName); err != nil {
+		c.cpFile.Close()
+		c.file.Close()
+		return
+	}
+
+	var idxFile *os.File
 	if idxFile, err = os.OpenFile(idxName, ChunkOpenOpt, 0666); err != nil {
+		c.cpFile.Close()
 		c.file.Close()
 		return
 	}
@@ -61,7 +141,9 @@ func (c *Chunk) loadTree(name string) (maxOid uint64, err error) {
 	tree := NewObjectTree(idxFile)
 	if maxOid, err = tree.Load(); err == nil {
 		c.tree = tree
+		c.directFile = c.ioMode.openDirect(name)
 	} else {
+		c.cpFile.Close()
 		idxFile.Close()
 		c.file.Close()
 	}
@@ -124,7 +206,52 @@ func (c *Chunk) storeSyncLastOid(val uint64) {
 	return
 }
 
-func (c *Chunk) doCompact() (err error) {
+// commitSync syncs the chunk for the group commit.
+func (c *Chunk) commitSync() (err error) {
+	return c.sync(fdatasync)
+}
+
+// setIoMode opens the chunk file again in the mode. The objects of a chunk
+// are not aligned, so only the reads bypass the page cache in IoModeDirect.
+func (c *Chunk) setIoMode(mode IoMode) (err error) {
+	c.commitLock.Lock()
+	defer c.commitLock.Unlock()
+	name := c.file.Name()
+	fp, err := os.OpenFile(name, ChunkOpenOpt|mode.openFlag(), 0666)
+	if err != nil {
+		return
+	}
+	c.file.Close()
+	c.file = fp
+	if c.directFile != nil {
+		c.directFile.Close()
+	}
+	c.directFile = mode.openDirect(name)
+	c.ioMode = mode
+
+	return
+}
+
+// readAt reads the data of the chunk file, the reads bypass the page cache
+// in IoModeDirect.
+func (c *Chunk) readAt(buf []byte, offset int64) (n int, err error) {
+	if c.directFile != nil {
+		return directReadAt(c.directFile, buf, offset)
+	}
+
+	return c.file.ReadAt(buf, offset)
+}
+
+func (c *Chunk) close() {
+	if c.directFile != nil {
+		c.directFile.Close()
+	}
+	c.file.Close()
+	c.tree.idxFile.Close()
+	c.cpFile.Close()
+}
+
+func (c *Chunk) doCompact(pace func(size int64)) (err error) {
 	var (
 		newIdxFile, newDatFile *os.File
 		tree                   *ObjectTree
@@ -146,14 +273,18 @@ func (c *Chunk) doCompact() (err error) {
 
 	tree = NewObjectTree(newIdxFile)
 
-	if err = c.copyValidData(tree, newDatFile); err != nil {
+	if err = c.copyValidData(tree, newDatFile, pace); err != nil {
+		return err
+	}
+	// The compacted chunk replaces the synced one, it must be synced first.
+	if err = newDatFile.Sync(); err != nil {
 		return err
 	}
 
-	return nil
+	return newIdxFile.Sync()
 }
 
-func (c *Chunk) copyValidData(dstNm *ObjectTree, dstDatFile *os.File) (err error) {
+func (c *Chunk) copyValidData(dstNm *ObjectTree, dstDatFile *os.File, pace func(size int64)) (err error) {
 	srcNm := c.tree
 	srcDatFile := c.file
 	srcIdxFile := srcNm.idxFile
@@ -203,6 +334,9 @@ func (c *Chunk) copyValidData(dstNm *ObjectTree, dstDatFile *os.File) (err error
 		if e = dstNm.appendToIdxFile(o); e != nil {
 			return e
 		}
+		if pace != nil {
+			pace(int64(realsize))
+		}
 
 		return nil
 	})
@@ -212,8 +346,7 @@ func (c *Chunk) copyValidData(dstNm *ObjectTree, dstDatFile *os.File) (err error
 
 func (c *Chunk) doCommit() (err error) {
 	name := c.file.Name()
-	c.tree.idxFile.Close()
-	c.file.Close()
+	c.close()
 
 	err = os.Rename(name+".cpd", name)
 	if err != nil {
@@ -223,8 +356,13 @@ func (c *Chunk) doCommit() (err error) {
 	if err != nil {
 		return
 	}
+	c.checkpoint = chunkCheckpoint{}
+	c.compactGen++
+	if err = resetCheckpoint(name); err != nil {
+		return
+	}
 
-	maxOid, err := c.loadTree(name)
+	maxOid, _, err := c.loadTree(name)
 	if err == nil && maxOid > c.loadLastOid() {
 		c.storeLastOid(maxOid)
 	}
@@ -0,0 +1,325 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+)
+
+// An object is written in two phases, the data is appended to the chunk file
+// first and then its entry to the index file, so a crash leaves at most an
+// entry whose data is torn, a torn entry at the tail of the index, or data
+// with no entry at the tail of the chunk.
+//
+// The checkpoint file of a chunk keeps the sizes of the index and the chunk
+// file at the last sync, the entries before it are durable. The recovery
+// checks the entries past the checkpoint with their crc and drops the torn
+// ones, then cuts the torn tails of the files.
+
+const (
+	CheckpointSize = 20 //idxSize:8, dataSize:8, crc:4
+)
+
+type chunkCheckpoint struct {
+	idxSize  int64
+	dataSize int64
+}
+
+func (cp *chunkCheckpoint) marshal() (out []byte) {
+	out = make([]byte, CheckpointSize)
+	binary.BigEndian.PutUint64(out[0:8], uint64(cp.idxSize))
+	binary.BigEndian.PutUint64(out[8:16], uint64(cp.dataSize))
+	binary.BigEndian.PutUint32(out[16:CheckpointSize], crc32.ChecksumIEEE(out[0:16]))
+	return
+}
+
+// unmarshal returns false if the checkpoint is missing or torn.
+func (cp *chunkCheckpoint) unmarshal(in []byte) bool {
+	if len(in) < CheckpointSize ||
+		crc32.ChecksumIEEE(in[0:16]) != binary.BigEndian.Uint32(in[16:CheckpointSize]) {
+		return false
+	}
+	cp.idxSize = int64(binary.BigEndian.Uint64(in[0:8]))
+	cp.dataSize = int64(binary.BigEndian.Uint64(in[8:16]))
+	return true
+}
+
+// RecoveryReport lists what the recovery of a chunk discarded.
+type RecoveryReport struct {
+	ChunkId       int
+	Discarded     []*Object // the entries whose data is torn
+	IdxTruncated  int64     // the bytes of the torn entry at the tail of the index
+	DataTruncated int64     // the bytes of the data with no entry at the tail of the chunk
+}
+
+func (r *RecoveryReport) IsEmpty() bool {
+	return len(r.Discarded) == 0 && r.IdxTruncated == 0 && r.DataTruncated == 0
+}
+
+func (r *RecoveryReport) String() string {
+	oids := make([]uint64, 0, len(r.Discarded))
+	for _, o := range r.Discarded {
+		oids = append(oids, o.Oid)
+	}
+
+	return fmt.Sprintf("chunk[%v] discarded objects%v idx truncated[%v] data truncated[%v]",
+		r.ChunkId, oids, r.IdxTruncated, r.DataTruncated)
+}
+
+func checkpointName(name string) string {
+	return name + ".cp"
+}
+
+// fileSizes returns the sizes of the index and the chunk file, the index is
+// taken first so that the data of every entry in it is within the chunk size.
+func (c *Chunk) fileSizes() (cp chunkCheckpoint, err error) {
+	var finfo os.FileInfo
+	if finfo, err = c.tree.idxFile.Stat(); err != nil {
+		return
+	}
+	cp.idxSize = finfo.Size()
+	if finfo, err = c.file.Stat(); err != nil {
+		return
+	}
+	cp.dataSize = finfo.Size()
+
+	return
+}
+
+// sync syncs the index and the chunk file, then moves the checkpoint to the
+// sizes synced.
+func (c *Chunk) sync(syncFile func(*os.File) error) (err error) {
+	c.commitLock.RLock()
+	defer c.commitLock.RUnlock()
+	cp, err := c.fileSizes()
+	if err != nil {
+		return
+	}
+	if err = syncFile(c.tree.idxFile); err != nil {
+		return
+	}
+	if err = syncFile(c.file); err != nil {
+		return
+	}
+
+	return c.writeCheckpoint(cp)
+}
+
+// writeCheckpoint is not synced, a checkpoint lost only makes the recovery
+// check more entries. The checkpoint never goes back, the syncs may finish
+// out of order.
+func (c *Chunk) writeCheckpoint(cp chunkCheckpoint) (err error) {
+	c.cpLock.Lock()
+	defer c.cpLock.Unlock()
+	if cp.idxSize <= c.checkpoint.idxSize && cp.dataSize <= c.checkpoint.dataSize {
+		return
+	}
+	if _, err = c.cpFile.WriteAt(cp.marshal(), 0); err != nil {
+		return
+	}
+	c.checkpoint = cp
+
+	return
+}
+
+// resetCheckpoint sets the checkpoint of the chunk files synced as a whole,
+// such as the compacted ones.
+func resetCheckpoint(name string) (err error) {
+	var (
+		fp    *os.File
+		finfo os.FileInfo
+		cp    chunkCheckpoint
+	)
+	if finfo, err = os.Stat(name + ".idx"); err != nil {
+		return
+	}
+	cp.idxSize = finfo.Size()
+	if finfo, err = os.Stat(name); err != nil {
+		return
+	}
+	cp.dataSize = finfo.Size()
+	if fp, err = os.OpenFile(checkpointName(name), os.O_CREATE|os.O_RDWR, 0666); err != nil {
+		return
+	}
+	defer fp.Close()
+	if _, err = fp.WriteAt(cp.marshal(), 0); err != nil {
+		return
+	}
+
+	return fp.Sync()
+}
+
+// recover drops the torn entries past the checkpoint and cuts the torn tails
+// of the index and the chunk file, it is called before the tree is loaded. A
+// checkpoint missing or past the files, which happens to the chunks of old
+// versions or after a crash in the compaction commit, checks every entry.
+func (c *Chunk) recover(idxName string) (report *RecoveryReport, err error) {
+	var (
+		idxFile           *os.File
+		idxSize, dataSize int64
+		dataEnd           int64
+		finfo             os.FileInfo
+		tail              []*Object
+	)
+	report = new(RecoveryReport)
+	if idxFile, err = os.OpenFile(idxName, ChunkOpenOpt, 0666); err != nil {
+		return
+	}
+	defer func() {
+		idxFile.Close()
+	}()
+	buf := make([]byte, CheckpointSize)
+	if _, err = c.cpFile.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return
+	}
+	if !c.checkpoint.unmarshal(buf) {
+		c.checkpoint = chunkCheckpoint{}
+	}
+	if finfo, err = idxFile.Stat(); err != nil {
+		return
+	}
+	idxSize = finfo.Size()
+	if finfo, err = c.file.Stat(); err != nil {
+		return
+	}
+	dataSize = finfo.Size()
+	cp := &c.checkpoint
+	if cp.idxSize > idxSize || cp.dataSize > dataSize || cp.idxSize%ObjectHeaderSize != 0 {
+		*cp = chunkCheckpoint{}
+	}
+	if cp.idxSize == idxSize && cp.dataSize == dataSize {
+		return
+	}
+
+	if torn := idxSize % ObjectHeaderSize; torn != 0 {
+		report.IdxTruncated = torn
+		idxSize -= torn
+		if err = idxFile.Truncate(idxSize); err != nil {
+			return
+		}
+	}
+	deleted := make(map[uint64]bool)
+	_, err = WalkIndexFile(idxFile, func(oid uint64, offset, size, crc uint32) error {
+		if size == TombstoneFileSize {
+			deleted[oid] = true
+		} else if end := int64(offset) + int64(size); end > dataEnd && end <= dataSize {
+			dataEnd = end
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	// The tail is walked again, the entry of an object deleted after is not
+	// checked since its data may be punched.
+	tailFile := io.NewSectionReader(idxFile, cp.idxSize, idxSize-cp.idxSize)
+	entry := make([]byte, ObjectHeaderSize)
+	for {
+		if _, err = io.ReadFull(tailFile, entry); err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return
+		}
+		o := new(Object)
+		o.Uomarshal(entry)
+		if o.Oid == 0 || (o.Size != TombstoneFileSize && !deleted[o.Oid] && !c.checkObject(o, dataSize)) {
+			report.Discarded = append(report.Discarded, o)
+			continue
+		}
+		tail = append(tail, o)
+	}
+
+	// The index without the discarded entries replaces the old one as a whole,
+	// a crash in the middle leaves the old one to recover again.
+	if len(report.Discarded) > 0 {
+		idxFile.Close()
+		if idxFile, err = rewriteIndex(idxName, cp.idxSize, tail); err != nil {
+			return
+		}
+	}
+	if dataEnd < cp.dataSize {
+		dataEnd = cp.dataSize
+	}
+	if dataEnd < dataSize {
+		report.DataTruncated = dataSize - dataEnd
+		if err = c.file.Truncate(dataEnd); err != nil {
+			return
+		}
+	}
+	if err = idxFile.Sync(); err != nil {
+		return
+	}
+	if err = c.file.Sync(); err != nil {
+		return
+	}
+	if finfo, err = idxFile.Stat(); err != nil {
+		return
+	}
+	*cp = chunkCheckpoint{idxSize: finfo.Size(), dataSize: dataEnd}
+	if _, err = c.cpFile.WriteAt(cp.marshal(), 0); err != nil {
+		return
+	}
+	err = c.cpFile.Sync()
+
+	return
+}
+
+// rewriteIndex writes the first size bytes of the index and the tail entries
+// to a temporary file, which is synced and renamed to the index. The new
+// index is returned open.
+func rewriteIndex(idxName string, size int64, tail []*Object) (idxFile *os.File, err error) {
+	var src, dst *os.File
+	tmpName := idxName + ".rcv"
+	if src, err = os.Open(idxName); err != nil {
+		return
+	}
+	defer src.Close()
+	if dst, err = os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			dst.Close()
+			os.Remove(tmpName)
+		}
+	}()
+	if _, err = io.Copy(dst, io.NewSectionReader(src, 0, size)); err != nil {
+		return
+	}
+	entry := make([]byte, ObjectHeaderSize)
+	for _, o := range tail {
+		o.Marshal(entry)
+		if _, err = dst.Write(entry); err != nil {
+			return
+		}
+	}
+	if err = dst.Sync(); err != nil {
+		return
+	}
+	if err = os.Rename(tmpName, idxName); err != nil {
+		return
+	}
+	if err = syncDir(path.Dir(idxName)); err != nil {
+		return
+	}
+
+	return dst, nil
+}
+
+// checkObject checks that the data of the object is within the chunk file
+// and matches its crc.
+func (c *Chunk) checkObject(o *Object, dataSize int64) bool {
+	if int64(o.Offset)+int64(o.Size) > dataSize {
+		return false
+	}
+	data := make([]byte, o.Size)
+	if _, err := c.file.ReadAt(data, int64(o.Offset)); err != nil {
+		return false
+	}
+
+	return crc32.ChecksumIEEE(data) == o.Crc
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// The crash is faked on the files of a store still open, the store opened
+// again on them recovers the chunk from the checkpoint of the last sync.
+func TestChunkRecoverTornTail(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	const chunkId = 1
+	c := s.chunks[chunkId]
+	synced := writeTestObject(t, s, chunkId, 4096)
+	if err := s.Sync(chunkId); err != nil {
+		t.Fatal(err)
+	}
+	torn := writeTestObject(t, s, chunkId, 4096)
+	o, _ := c.tree.get(torn)
+
+	name := s.dataDir + "/" + strconv.Itoa(chunkId)
+	dataFile, err := os.OpenFile(name, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dataFile.Close()
+	// The data of the entry not synced is torn, and the data of the object
+	// being written has no entry.
+	finfo, err := dataFile.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dataFile.WriteAt(make([]byte, 100), int64(o.Offset)); err == nil {
+		_, err = dataFile.WriteAt(make([]byte, 300), finfo.Size())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	idxFile, err := os.OpenFile(name+".idx", os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idxFile.Close()
+	if _, err = idxFile.Write(make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	// The index half rewritten by a recovery crashed before.
+	if err = ioutil.WriteFile(name+".idx.rcv", make([]byte, 7), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewTinyStore(s.dataDir, ChunkCount*1024*1024, ReBootStoreMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports := reopened.GetRecoveryReports()
+	if len(reports) != 1 {
+		t.Fatalf("reports %v", reports)
+	}
+	r := reports[0]
+	if r.ChunkId != chunkId || len(r.Discarded) != 1 || r.Discarded[0].Oid != torn ||
+		r.IdxTruncated != 5 || r.DataTruncated != 300 {
+		t.Fatalf("report %v", r)
+	}
+	buf := make([]byte, 4096)
+	if _, err = reopened.Read(chunkId, int64(synced), 4096, buf); err != nil {
+		t.Fatalf("read synced object: %v", err)
+	}
+	if _, err = reopened.Read(chunkId, int64(torn), 4096, buf); err == nil {
+		t.Fatalf("read torn object: %v", err)
+	}
+	if _, err = os.Stat(name + ".idx.rcv"); !os.IsNotExist(err) {
+		t.Fatalf("rewritten index left: %v", err)
+	}
+
+	// The recovered chunk is checkpointed, it is not recovered again.
+	again, err := NewTinyStore(s.dataDir, ChunkCount*1024*1024, ReBootStoreMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reports = again.GetRecoveryReports(); len(reports) != 0 {
+		t.Fatalf("reports of the recovered store %v", reports)
+	}
+}
+
+// The checkpoint torn is dropped, every entry of the chunk is checked then,
+// the ones before the sizes it kept too.
+func TestChunkRecoverCorruptCheckpoint(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	const chunkId = 1
+	c := s.chunks[chunkId]
+	torn := writeTestObject(t, s, chunkId, 4096)
+	if err := s.Sync(chunkId); err != nil {
+		t.Fatal(err)
+	}
+	kept := writeTestObject(t, s, chunkId, 4096)
+	o, _ := c.tree.get(torn)
+
+	name := s.dataDir + "/" + strconv.Itoa(chunkId)
+	dataFile, err := os.OpenFile(name, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dataFile.Close()
+	if _, err = dataFile.WriteAt(make([]byte, 100), int64(o.Offset)); err != nil {
+		t.Fatal(err)
+	}
+	cpFile, err := os.OpenFile(checkpointName(name), os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cpFile.Close()
+	if _, err = cpFile.WriteAt([]byte{0xff, 0xff}, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewTinyStore(s.dataDir, ChunkCount*1024*1024, ReBootStoreMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports := reopened.GetRecoveryReports()
+	if len(reports) != 1 || len(reports[0].Discarded) != 1 || reports[0].Discarded[0].Oid != torn {
+		t.Fatalf("reports %v", reports)
+	}
+	buf := make([]byte, 4096)
+	if _, err = reopened.Read(chunkId, int64(kept), 4096, buf); err != nil {
+		t.Fatalf("read object after the checkpoint: %v", err)
+	}
+	if _, err = reopened.Read(chunkId, int64(torn), 4096, buf); err == nil {
+		t.Fatal("torn object before the checkpoint read")
+	}
+	again, err := NewTinyStore(s.dataDir, ChunkCount*1024*1024, ReBootStoreMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reports = again.GetRecoveryReports(); len(reports) != 0 {
+		t.Fatalf("reports of the recovered store %v", reports)
+	}
+}
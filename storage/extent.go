@@ -1,29 +1,605 @@
 package storage
 
 import (
+	"bytes"
 	"container/list"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"os"
 	"sync"
+	"time"
 )
 
+// The v1 extent keeps a fixed crc header of BlockCount blocks at the front of
+// the extent file, so it can not grow beyond BlockCount*BlockSize. The time it
+// is marked deleted is kept in the sidecar file {extentId}.del. The crc of a
+// partial v1 block is the crc of the block padded with zeros to BlockSize, but
+// the v1 store kept the crc of the bytes if the block was written from its
+// start, either is accepted.
+//
+// The v2 extent starts with an ExtentHeaderSize header:
+//
+//	[0:4]   magic "BSEX"
+//	[4]     version
+//	[5]     mark delete flag
+//	[6]     seal flag
+//	[8:12]  block size
+//	[16:24] commit length
+//	[24:32] mark delete time
+//
+// and keeps the block crcs in the sidecar file {extentId}.crc, which grows
+// with the extent up to MaxExtentBlocks blocks.
+const (
+	ExtentVersionV1     = 1
+	ExtentVersionV2     = 2
+	ExtentHeaderSize    = 4096
+	ExtentCrcFileSuffix = ".crc"
+	ExtentDelFileSuffix = ".del"
+	MinBlockSize        = 4 * 1024
+	MaxBlockSize        = 16 * 1024 * 1024
+	MaxExtentBlocks     = 64 * 1024
+	ExtentSealed        = 'S'
+	ExtentActive        = 'A'
+)
+
+const (
+	extentMagicIndex      = 0
+	extentVersionIndex    = 4
+	extentMarkDeleteIndex = 5
+	extentSealIndex       = 6
+	extentBlockSizeIndex  = 8
+	extentCommitIndex     = 16
+	extentDeleteTimeIndex = 24
+)
+
+var extentMagic = []byte("BSEX")
+
 type Extent struct {
-	file      *os.File
-	filePath  string
-	extentId  uint64
-	lock      sync.RWMutex
-	blocksCrc []byte
-	element   *list.Element
+	file       *os.File
+	directFile *os.File // the file opened with O_DIRECT in IoModeDirect
+	crcFile    *os.File
+	filePath   string
+	extentId   uint64
+	lock       sync.RWMutex
+	version    uint8
+	blockSize  int64
+	header     []byte
+	crcLock    sync.Mutex // guards blocksCrc and commitLength
+	blocksCrc  []byte
+	element    *list.Element
+	refs       int   // pins of the operations, guarded by the store lock
+	closed     bool  // guarded by lock
+	closeErr   error // the error syncing the extent on close, guarded by lock
+
+	commitLength int64
+	pending      map[int64]int64 // the acked ranges past the commit length, offset to end, guarded by crcLock
+}
+
+type ExtentInfo struct {
+	ExtentId uint64
+	Size     int64
+}
+
+// BlockCrcIndex is a copy of the block crcs of an extent, Size is the size of
+// the extent the crcs are of.
+type BlockCrcIndex struct {
+	Version   uint8
+	BlockSize int64
+	MarkDel   bool
+	Sealed    bool
+	Size      int64
+	Crcs      []byte
+}
+
+// BlockCrc returns the crc of the block, or 0 if the index has no crc of it.
+func (index *BlockCrcIndex) BlockCrc(blockNo int64) (crc uint32) {
+	if blockNo >= 0 && (blockNo+1)*PerBlockCrcSize <= int64(len(index.Crcs)) {
+		crc = binary.BigEndian.Uint32(index.Crcs[blockNo*PerBlockCrcSize : (blockNo+1)*PerBlockCrcSize])
+	}
+
+	return
+}
+
+// Checksum returns the crc of the crcs of the whole blocks under size, it is
+// the same for the replicas of the extent with the same block size.
+func (index *BlockCrcIndex) Checksum(size int64) uint32 {
+	blocks := size / index.BlockSize
+	if blocks*PerBlockCrcSize > int64(len(index.Crcs)) {
+		blocks = int64(len(index.Crcs) / PerBlockCrcSize)
+	}
+
+	return crc32.ChecksumIEEE(index.Crcs[:blocks*PerBlockCrcSize])
+}
+
+// MatchBlock reports whether crc, the crc of the size bytes of the block,
+// matches the crc of the block in the index.
+func (index *BlockCrcIndex) MatchBlock(blockNo int64, crc uint32, size int64) bool {
+	return matchBlockCrc(index.Version, index.BlockCrc(blockNo), crc, size, index.BlockSize)
+}
+
+// SameData reports whether the extents of the indexes have the same data,
+// they are of the same size and the crcs of their blocks match.
+func (index *BlockCrcIndex) SameData(other *BlockCrcIndex) bool {
+	if index.Size != other.Size || index.BlockSize != other.BlockSize {
+		return false
+	}
+	for blockNo := int64(0); blockNo*index.BlockSize < index.Size; blockNo++ {
+		crc, otherCrc := index.BlockCrc(blockNo), other.BlockCrc(blockNo)
+		if crc == otherCrc {
+			continue
+		}
+		// The last block is partial, one of the crcs may be padded.
+		size := index.Size - blockNo*index.BlockSize
+		if !matchBlockCrc(index.Version, crc, otherCrc, size, index.BlockSize) &&
+			!matchBlockCrc(other.Version, otherCrc, crc, size, index.BlockSize) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// padBlockCrc returns the crc of the block padded with zeros to blockSize,
+// where crc is the crc of the size bytes of the block.
+func padBlockCrc(crc uint32, size, blockSize int64) uint32 {
+	if size >= blockSize {
+		return crc
+	}
+
+	return crc32.Update(crc, crc32.IEEETable, make([]byte, blockSize-size))
+}
+
+// matchBlockCrc reports whether crc, the crc of the size bytes of a block,
+// matches kept, the crc kept of the block by the extent of the version.
+func matchBlockCrc(version uint8, kept, crc uint32, size, blockSize int64) bool {
+	if kept == crc {
+		return true
+	}
+
+	return version == ExtentVersionV1 && size < blockSize && kept == padBlockCrc(crc, size, blockSize)
 }
 
 func NewExtentInCore(name string, extentId uint64) (e *Extent) {
 	e = new(Extent)
 	e.extentId = extentId
 	e.filePath = name
-	e.blocksCrc = make([]byte, BlockCrcHeaderSize)
 
 	return
 }
 
+func validBlockSize(blockSize int) bool {
+	return blockSize >= MinBlockSize && blockSize <= MaxBlockSize && blockSize%MinBlockSize == 0
+}
+
+func (e *Extent) crcFilePath() string {
+	return e.filePath + ExtentCrcFileSuffix
+}
+
+func (e *Extent) delFilePath() string {
+	return e.filePath + ExtentDelFileSuffix
+}
+
+// initHeader sets up the header of a new v2 extent.
+func (e *Extent) initHeader(blockSize int64) {
+	e.version = ExtentVersionV2
+	e.blockSize = blockSize
+	e.header = make([]byte, ExtentHeaderSize)
+	copy(e.header[extentMagicIndex:], extentMagic)
+	e.header[extentVersionIndex] = ExtentVersionV2
+	e.header[extentMarkDeleteIndex] = UnMarkDelete
+	e.header[extentSealIndex] = ExtentActive
+	binary.BigEndian.PutUint32(e.header[extentBlockSizeIndex:extentBlockSizeIndex+4], uint32(blockSize))
+	e.blocksCrc = make([]byte, 0)
+}
+
+// loadHeader reads the header of an opened extent file, the extent without
+// the v2 magic is taken as a v1 extent. The file shorter than its header is
+// left by a crash before the header of a new extent was written, it holds no
+// data and is set up again as a new extent of blockSize.
+func (e *Extent) loadHeader(blockSize int64) (err error) {
+	var finfo os.FileInfo
+	if finfo, err = e.file.Stat(); err != nil {
+		return
+	}
+	header := make([]byte, ExtentHeaderSize)
+	n, err := e.file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return
+	}
+	err = nil
+	isV2 := n >= len(extentMagic) && bytes.Equal(header[extentMagicIndex:extentMagicIndex+len(extentMagic)], extentMagic)
+	if (isV2 && finfo.Size() < ExtentHeaderSize) || (!isV2 && finfo.Size() < BlockCrcHeaderSize) {
+		return e.resetHeader(blockSize)
+	}
+	if !isV2 {
+		e.version = ExtentVersionV1
+		e.blockSize = BlockSize
+		e.header = make([]byte, BlockCrcHeaderSize)
+		if _, err = e.file.ReadAt(e.header, 0); err != nil {
+			return
+		}
+		e.blocksCrc = e.header[:MarkDeleteIndex]
+		// The v1 extents are written before the commit length is tracked.
+		e.commitLength = finfo.Size() - BlockCrcHeaderSize
+		return
+	}
+
+	e.version = header[extentVersionIndex]
+	if e.version != ExtentVersionV2 {
+		return fmt.Errorf("extent[%v] unknown version[%v]", e.extentId, e.version)
+	}
+	e.blockSize = int64(binary.BigEndian.Uint32(header[extentBlockSizeIndex : extentBlockSizeIndex+4]))
+	if !validBlockSize(int(e.blockSize)) {
+		return fmt.Errorf("extent[%v] error block size[%v]", e.extentId, e.blockSize)
+	}
+	e.header = header
+	e.commitLength = int64(binary.BigEndian.Uint64(header[extentCommitIndex : extentCommitIndex+8]))
+
+	return e.loadBlocksCrc()
+}
+
+// resetHeader writes the header of a new v2 extent to the opened file.
+func (e *Extent) resetHeader(blockSize int64) (err error) {
+	e.initHeader(blockSize)
+	if _, err = e.file.WriteAt(e.header, 0); err != nil {
+		return
+	}
+	e.crcFile, err = os.OpenFile(e.crcFilePath(), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+
+	return
+}
+
+// loadBlocksCrc reads the crc sidecar of a v2 extent. The crcs missing at the
+// tail, which are lost if the DataNode crashed after the data was written, and
+// the crc of the last block are computed from the data again.
+func (e *Extent) loadBlocksCrc() (err error) {
+	var finfo os.FileInfo
+	if e.crcFile, err = os.OpenFile(e.crcFilePath(), os.O_CREATE|os.O_RDWR, 0666); err != nil {
+		return
+	}
+	if finfo, err = e.crcFile.Stat(); err != nil {
+		return
+	}
+	e.blocksCrc = make([]byte, finfo.Size()-finfo.Size()%PerBlockCrcSize)
+	if _, err = e.crcFile.ReadAt(e.blocksCrc, 0); err != nil {
+		return
+	}
+
+	if finfo, err = e.file.Stat(); err != nil {
+		return
+	}
+	size := finfo.Size() - e.dataOffset()
+	if size <= 0 {
+		return
+	}
+	lastBlock := (size - 1) / e.blockSize
+	from := int64(len(e.blocksCrc) / PerBlockCrcSize)
+	if from > lastBlock {
+		from = lastBlock
+	}
+	e.blocksCrc = e.blocksCrc[:from*PerBlockCrcSize]
+
+	return e.updateBlocksCrc(from*e.blockSize, size-from*e.blockSize, nil, 0)
+}
+
+func (e *Extent) dataOffset() int64 {
+	if e.version == ExtentVersionV1 {
+		return BlockCrcHeaderSize
+	}
+
+	return ExtentHeaderSize
+}
+
+func (e *Extent) markDeleteIndex() int {
+	if e.version == ExtentVersionV1 {
+		return MarkDeleteIndex
+	}
+
+	return extentMarkDeleteIndex
+}
+
+func (e *Extent) isMarkDelete() bool {
+	return e.header[e.markDeleteIndex()] == MarkDelete
+}
+
+// markDelete flags the extent deleted and records the time of it for the
+// grace period before the extent is unlinked.
+func (e *Extent) markDelete() (err error) {
+	index := e.markDeleteIndex()
+	e.header[index] = MarkDelete
+	if _, err = e.file.WriteAt(e.header[index:index+1], int64(index)); err != nil {
+		return
+	}
+
+	return e.setMarkDeleteTime(time.Now().Unix())
+}
+
+// setMarkDeleteTime records the time the extent is marked deleted, in the
+// header of the v2 extent and in the del file of the v1 extent.
+func (e *Extent) setMarkDeleteTime(deleteTime int64) (err error) {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(deleteTime))
+	if e.version == ExtentVersionV1 {
+		return ioutil.WriteFile(e.delFilePath(), buf, 0666)
+	}
+	copy(e.header[extentDeleteTimeIndex:extentDeleteTimeIndex+8], buf)
+	_, err = e.file.WriteAt(buf, extentDeleteTimeIndex)
+
+	return
+}
+
+// markDeleteTime returns the unix time the extent was marked deleted, or 0 if
+// it is not deleted or the time is not recorded, such as the extent marked
+// deleted by the old version or a crash before the time is written.
+func (e *Extent) markDeleteTime() (deleteTime int64, err error) {
+	if !e.isMarkDelete() {
+		return
+	}
+	if e.version != ExtentVersionV1 {
+		deleteTime = int64(binary.BigEndian.Uint64(e.header[extentDeleteTimeIndex : extentDeleteTimeIndex+8]))
+		return
+	}
+	buf, err := ioutil.ReadFile(e.delFilePath())
+	if os.IsNotExist(err) || (err == nil && len(buf) < 8) {
+		return 0, nil
+	}
+	if err != nil {
+		return
+	}
+	deleteTime = int64(binary.BigEndian.Uint64(buf))
+
+	return
+}
+
+func (e *Extent) isSealed() bool {
+	return e.version != ExtentVersionV1 && e.header[extentSealIndex] == ExtentSealed
+}
+
+func (e *Extent) setSeal(flag byte) (err error) {
+	if e.version == ExtentVersionV1 {
+		return ErrorExtentVersion
+	}
+	e.header[extentSealIndex] = flag
+	_, err = e.file.WriteAt(e.header[extentSealIndex:extentSealIndex+1], extentSealIndex)
+
+	return
+}
+
+func (e *Extent) getCommitLength() (length int64) {
+	e.crcLock.Lock()
+	length = e.commitLength
+	e.crcLock.Unlock()
+
+	return
+}
+
+// commit records the acked range [offset, end) of the extent. The commit
+// length only moves forward over the contiguous acked ranges, the range past
+// a gap is kept until the gap is acked. The commit length of the v1 extent is
+// kept in memory only.
+func (e *Extent) commit(offset, end int64) (err error) {
+	e.crcLock.Lock()
+	defer e.crcLock.Unlock()
+	if end <= e.commitLength {
+		return
+	}
+	if offset > e.commitLength {
+		if e.pending == nil {
+			e.pending = make(map[int64]int64)
+		}
+		if end > e.pending[offset] {
+			e.pending[offset] = end
+		}
+		return
+	}
+
+	length := end
+	for merged := true; merged; {
+		merged = false
+		for off, pend := range e.pending {
+			if off > length {
+				continue
+			}
+			if pend > length {
+				length = pend
+			}
+			delete(e.pending, off)
+			merged = true
+		}
+	}
+
+	return e.setCommitLength(length)
+}
+
+// setCommitLength must be called with crcLock held.
+func (e *Extent) setCommitLength(length int64) (err error) {
+	e.commitLength = length
+	if e.version == ExtentVersionV1 {
+		return
+	}
+	binary.BigEndian.PutUint64(e.header[extentCommitIndex:extentCommitIndex+8], uint64(length))
+	_, err = e.file.WriteAt(e.header[extentCommitIndex:extentCommitIndex+8], extentCommitIndex)
+
+	return
+}
+
+// truncate cuts the extent to size, the crc of the last block left is
+// computed again.
+func (e *Extent) truncate(size int64) (err error) {
+	if err = e.file.Truncate(e.dataOffset() + size); err != nil {
+		return
+	}
+	blocks := (size + e.blockSize - 1) / e.blockSize
+	e.crcLock.Lock()
+	if int64(len(e.blocksCrc)) > blocks*PerBlockCrcSize {
+		e.blocksCrc = e.blocksCrc[:blocks*PerBlockCrcSize]
+	}
+	e.crcLock.Unlock()
+	if err = e.crcFile.Truncate(blocks * PerBlockCrcSize); err != nil {
+		return
+	}
+	if size%e.blockSize == 0 {
+		return
+	}
+	lastBlockStart := (blocks - 1) * e.blockSize
+
+	return e.updateBlocksCrc(lastBlockStart, size-lastBlockStart, nil, 0)
+}
+
+// crcWriter is where the block crcs are persisted, the v1 extent keeps them
+// at the front of the extent file.
+func (e *Extent) crcWriter() io.WriterAt {
+	if e.version == ExtentVersionV1 {
+		return e.file
+	}
+
+	return e.crcFile
+}
+
+func (e *Extent) checkOffsetAndSize(offset, size int64) error {
+	if offset < 0 || size <= 0 {
+		return ErrorUnmatchPara
+	}
+	if e.version == ExtentVersionV1 && offset+size > BlockSize*BlockCount {
+		return ErrorUnmatchPara
+	}
+	// The crcs of the blocks up to the end are kept in memory, the end is
+	// checked before the offset is added so a huge offset can not overflow.
+	if maxSize := MaxExtentBlocks * e.blockSize; offset > maxSize || size > maxSize-offset {
+		return ErrorUnmatchPara
+	}
+
+	return nil
+}
+
+func (e *Extent) blockCrc(blockNo int64) (crc uint32) {
+	e.crcLock.Lock()
+	if (blockNo+1)*PerBlockCrcSize <= int64(len(e.blocksCrc)) {
+		crc = binary.BigEndian.Uint32(e.blocksCrc[blockNo*PerBlockCrcSize : (blockNo+1)*PerBlockCrcSize])
+	}
+	e.crcLock.Unlock()
+
+	return
+}
+
+// updateBlocksCrc updates the crcs of the blocks covered by [offset,
+// offset+size), the crc of a block is the crc of its bytes in the extent, or
+// of the block padded with zeros for a partial v1 block. The crc of the data
+// is used directly if it is one whole block, the blocks partly covered are
+// read back from the extent.
+func (e *Extent) updateBlocksCrc(offset, size int64, data []byte, crc uint32) (err error) {
+	e.crcLock.Lock()
+	defer e.crcLock.Unlock()
+
+	firstBlock := offset / e.blockSize
+	lastBlock := (offset + size - 1) / e.blockSize
+	persistFrom := firstBlock
+	if blocks := int64(len(e.blocksCrc) / PerBlockCrcSize); lastBlock >= blocks {
+		// The blocks skipped by the write are holes of zero.
+		emptyCrc := crc32.ChecksumIEEE(make([]byte, e.blockSize))
+		blocksCrc := make([]byte, (lastBlock+1)*PerBlockCrcSize)
+		copy(blocksCrc, e.blocksCrc)
+		for blockNo := blocks; blockNo < firstBlock; blockNo++ {
+			binary.BigEndian.PutUint32(blocksCrc[blockNo*PerBlockCrcSize:(blockNo+1)*PerBlockCrcSize], emptyCrc)
+		}
+		e.blocksCrc = blocksCrc
+		if blocks < persistFrom {
+			persistFrom = blocks
+		}
+	}
+
+	var blockBuffer []byte
+	for blockNo := firstBlock; blockNo <= lastBlock; blockNo++ {
+		blockStart := blockNo * e.blockSize
+		blockEnd := blockStart + e.blockSize
+		var blockCrc uint32
+		switch {
+		case data != nil && offset == blockStart && size == e.blockSize:
+			blockCrc = crc
+		case data != nil && offset <= blockStart && offset+size >= blockEnd:
+			blockCrc = crc32.ChecksumIEEE(data[blockStart-offset : blockEnd-offset])
+		default:
+			if blockBuffer == nil {
+				blockBuffer = make([]byte, e.blockSize)
+			}
+			n, readErr := e.file.ReadAt(blockBuffer, blockStart+e.dataOffset())
+			if readErr != nil && readErr != io.EOF {
+				return readErr
+			}
+			blockCrc = crc32.ChecksumIEEE(blockBuffer[:n])
+			if e.version == ExtentVersionV1 {
+				blockCrc = padBlockCrc(blockCrc, int64(n), e.blockSize)
+			}
+		}
+		binary.BigEndian.PutUint32(e.blocksCrc[blockNo*PerBlockCrcSize:(blockNo+1)*PerBlockCrcSize], blockCrc)
+	}
+	_, err = e.crcWriter().WriteAt(e.blocksCrc[persistFrom*PerBlockCrcSize:(lastBlock+1)*PerBlockCrcSize],
+		persistFrom*PerBlockCrcSize)
+
+	return
+}
+
+func (e *Extent) crcIndex() (index *BlockCrcIndex) {
+	e.crcLock.Lock()
+	index = &BlockCrcIndex{
+		Version:   e.version,
+		BlockSize: e.blockSize,
+		MarkDel:   e.isMarkDelete(),
+		Sealed:    e.isSealed(),
+		Crcs:      make([]byte, len(e.blocksCrc)),
+	}
+	copy(index.Crcs, e.blocksCrc)
+	e.crcLock.Unlock()
+
+	return
+}
+
+func (e *Extent) sync() (err error) {
+	if err = fdatasync(e.file); err != nil {
+		return
+	}
+	if e.crcFile != nil {
+		err = fdatasync(e.crcFile)
+	}
+
+	return
+}
+
+// commitSync syncs the extent for the group commit, the extent closed since
+// has been synced by closeExtent and the error of that sync is returned.
+func (e *Extent) commitSync() error {
+	e.readlock()
+	defer e.readUnlock()
+	if e.closed {
+		return e.closeErr
+	}
+
+	return e.sync()
+}
+
+// readAt reads the data of the extent file, the reads bypass the page cache
+// in IoModeDirect.
+func (e *Extent) readAt(buf []byte, offset int64) (n int, err error) {
+	if e.directFile != nil {
+		return directReadAt(e.directFile, buf, offset)
+	}
+
+	return e.file.ReadAt(buf, offset)
+}
+
+// writeAt writes the data of the extent file, the aligned writes bypass the
+// page cache in IoModeDirect.
+func (e *Extent) writeAt(data []byte, offset int64) (n int, err error) {
+	if e.directFile != nil && isAligned(offset, len(data)) {
+		return directWriteAt(e.directFile, data, offset)
+	}
+
+	return e.file.WriteAt(data, offset)
+}
+
 func (e *Extent) readlock() {
 	e.lock.RLock()
 }
@@ -40,10 +616,30 @@ func (e *Extent) writeUnlock() {
 	e.lock.Unlock()
 }
 
+// closeExtent syncs the extent before it is closed, a write waiting for the
+// group commit is durable even if its extent is evicted from the cache. The
+// error of the sync is kept for the writes waiting for the group commit. The
+// header is not written again, every change of it is written when it is made,
+// so closing an evicted extent can not undo the changes made by the instance
+// opened again since.
 func (e *Extent) closeExtent() (err error) {
 	e.writelock()
-	_, err = e.file.WriteAt(e.blocksCrc, 0)
-	err = e.file.Close()
+	if e.closed {
+		e.writeUnlock()
+		return e.closeErr
+	}
+	err = e.sync()
+	e.closed = true
+	e.closeErr = err
+	if e1 := e.file.Close(); err == nil {
+		err = e1
+	}
+	if e.directFile != nil {
+		e.directFile.Close()
+	}
+	if e.crcFile != nil {
+		e.crcFile.Close()
+	}
 	e.writeUnlock()
 
 	return
@@ -52,6 +648,11 @@ func (e *Extent) closeExtent() (err error) {
 func (e *Extent) deleteExtent() (err error) {
 	e.writelock()
 	err = os.Remove(e.filePath)
+	if e.version != ExtentVersionV1 {
+		os.Remove(e.crcFilePath())
+	} else {
+		os.Remove(e.delFilePath())
+	}
 	e.writeUnlock()
 
 	return
@@ -1,25 +1,98 @@
 package storage
 
-import "container/list"
+import (
+	"container/list"
+	"sync/atomic"
+)
 
-func (s *ExtentStore) addExtentToCache(ec *Extent) {
+const (
+	DefaultExtentCacheCapacity = 4096
+)
+
+// ExtentCacheStats counts the lookups of the open extents of an ExtentStore.
+type ExtentCacheStats struct {
+	Capacity  int
+	Open      int
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+// addExtentToCache puts the opened extent at the back of the lru list, the
+// least recently used extents are closed when the cache is over capacity. If
+// the extent is cached by another loader already, that one is returned and e
+// is closed. The extent returned is pinned as getExtentFromCache does, e is
+// closed and ErrorHasDelete is returned if the extent is being deleted.
+func (s *ExtentStore) addExtentToCache(e *Extent) (cached *Extent, err error) {
+	var evicted []*Extent
 	s.lock.Lock()
-	s.extents[ec.extentId] = ec
-	ec.element = s.fdlist.PushBack(ec)
+	if s.deleting[e.extentId] {
+		s.lock.Unlock()
+		e.closeExtent()
+		return nil, ErrorHasDelete
+	}
+	if old, ok := s.extents[e.extentId]; ok {
+		old.refs++
+		s.fdlist.MoveToBack(old.element)
+		s.lock.Unlock()
+		e.closeExtent()
+		return old, nil
+	}
+	e.refs++
+	s.extents[e.extentId] = e
+	e.element = s.fdlist.PushBack(e)
+	// The extents pinned by the operations in progress are skipped, they
+	// are evicted by the later adds.
+	for elem := s.fdlist.Front(); elem != nil && s.cacheCapacity > 0 && s.fdlist.Len() > s.cacheCapacity; {
+		front := elem.Value.(*Extent)
+		elem = elem.Next()
+		if front.refs > 0 {
+			continue
+		}
+		delete(s.extents, front.extentId)
+		s.fdlist.Remove(front.element)
+		evicted = append(evicted, front)
+	}
 	s.lock.Unlock()
+
+	// The evicted extents are closed out of the store lock, closing waits for
+	// the operations still holding the extent lock.
+	for _, front := range evicted {
+		front.closeExtent()
+		atomic.AddUint64(&s.evictions, 1)
+	}
+
+	return e, nil
 }
 
-func (s *ExtentStore) delExtentFromCache(ec *Extent) {
+// delExtentFromCache takes the extent pinned by the caller out of the cache
+// and closes it once the other operations holding it have put it back. The
+// extent is loaded no more until the caller removes it from s.deleting, the
+// other deleters of the extent get ErrorHasDelete.
+func (s *ExtentStore) delExtentFromCache(ec *Extent) (err error) {
 	s.lock.Lock()
+	if cached, ok := s.extents[ec.extentId]; !ok || cached != ec || s.deleting[ec.extentId] {
+		s.lock.Unlock()
+		return ErrorHasDelete
+	}
 	delete(s.extents, ec.extentId)
 	s.fdlist.Remove(ec.element)
-	ec.closeExtent()
+	s.deleting[ec.extentId] = true
+	for ec.refs > 1 {
+		s.refsDrained.Wait()
+	}
 	s.lock.Unlock()
+	ec.closeExtent()
+
+	return
 }
 
+// getExtentFromCache pins the cached extent, it is not evicted until it is
+// put back by putExtent.
 func (s *ExtentStore) getExtentFromCache(extentId uint64) (ec *Extent, ok bool) {
 	s.lock.Lock()
 	if ec, ok = s.extents[extentId]; ok {
+		ec.refs++
 		s.fdlist.MoveToBack(ec.element)
 	}
 	s.lock.Unlock()
@@ -27,6 +100,13 @@ func (s *ExtentStore) getExtentFromCache(extentId uint64) (ec *Extent, ok bool)
 	return
 }
 
+func (s *ExtentStore) putExtent(ec *Extent) {
+	s.lock.Lock()
+	ec.refs--
+	s.lock.Unlock()
+	s.refsDrained.Broadcast()
+}
+
 func (s *ExtentStore) ClearAllCache() {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -54,12 +134,28 @@ func (s *ExtentStore) CloseStoreActiveFiles() {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	needClose := s.fdlist.Len() / 2
-	for i := 0; i < needClose; i++ {
-		if e := s.fdlist.Front(); e != nil {
-			front := e.Value.(*Extent)
-			delete(s.extents, front.extentId)
-			s.fdlist.Remove(front.element)
-			front.closeExtent()
+	for e := s.fdlist.Front(); e != nil && needClose > 0; {
+		front := e.Value.(*Extent)
+		e = e.Next()
+		if front.refs > 0 {
+			continue
 		}
+		delete(s.extents, front.extentId)
+		s.fdlist.Remove(front.element)
+		front.closeExtent()
+		atomic.AddUint64(&s.evictions, 1)
+		needClose--
+	}
+}
+
+func (s *ExtentStore) GetCacheStats() (stats *ExtentCacheStats) {
+	stats = &ExtentCacheStats{
+		Capacity:  s.cacheCapacity,
+		Open:      s.GetStoreActiveFiles(),
+		Hits:      atomic.LoadUint64(&s.hits),
+		Misses:    atomic.LoadUint64(&s.misses),
+		Evictions: atomic.LoadUint64(&s.evictions),
 	}
+
+	return
 }
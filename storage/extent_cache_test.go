@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func getTestExtent(t *testing.T, s *ExtentStore, extentId uint64) (e *Extent) {
+	e, err := s.getExtent(extentId)
+	if err != nil {
+		t.Fatalf("get extent[%v]: %v", extentId, err)
+	}
+
+	return
+}
+
+// The least recently used extents not pinned are evicted and counted, the
+// evicted extent is opened again from the disk.
+func TestExtentCacheEviction(t *testing.T) {
+	s, dir := newTestExtentStore(t, BlockSize)
+	defer os.RemoveAll(dir)
+	s.cacheCapacity = 2
+	data, crc := testData(1000)
+	for extentId := uint64(1); extentId <= 3; extentId++ {
+		if err := s.CreateWithId(extentId); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Write(extentId, 0, int64(len(data)), data, crc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := s.GetCacheStats(); stats.Capacity != 2 || stats.Open != 2 || stats.Evictions != 1 {
+		t.Fatalf("cache stats %+v", stats)
+	}
+	if _, ok := s.extents[1]; ok {
+		t.Fatal("least recently used extent not evicted")
+	}
+
+	before := s.GetCacheStats()
+	pinned := getTestExtent(t, s, 3)
+	// The pinned extent is the least recently used one.
+	s.putExtent(getTestExtent(t, s, 2))
+	reopened := getTestExtent(t, s, 1)
+	stats := s.GetCacheStats()
+	if stats.Hits-before.Hits != 2 || stats.Misses-before.Misses != 1 || stats.Evictions-before.Evictions != 1 || stats.Open != 2 {
+		t.Fatalf("cache stats %+v before %+v", stats, before)
+	}
+	if _, ok := s.extents[3]; !ok {
+		t.Fatal("pinned extent evicted")
+	}
+	if _, ok := s.extents[2]; ok {
+		t.Fatal("extent not pinned kept over the capacity")
+	}
+	s.putExtent(reopened)
+	s.putExtent(pinned)
+	checkRead(t, s, 1, 0, data)
+	checkRead(t, s, 2, 0, data)
+	if stats = s.GetCacheStats(); stats.Open != 2 {
+		t.Fatalf("cache stats %+v", stats)
+	}
+}
+
+// Closing an evicted extent after it was opened again does not undo the
+// changes of the header made through the new instance.
+func TestExtentCacheCloseEvicted(t *testing.T) {
+	s, dir := newTestExtentStore(t, BlockSize)
+	defer os.RemoveAll(dir)
+	data, crc := testData(1000)
+	if err := s.CreateWithId(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(1, 0, int64(len(data)), data, crc); err != nil {
+		t.Fatal(err)
+	}
+	// The extent is evicted but not closed yet.
+	evicted := getTestExtent(t, s, 1)
+	s.lock.Lock()
+	delete(s.extents, evicted.extentId)
+	s.fdlist.Remove(evicted.element)
+	evicted.refs--
+	s.lock.Unlock()
+
+	if err := s.Seal(1, int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if err := evicted.closeExtent(); err != nil {
+		t.Fatal(err)
+	}
+	s.ClearAllCache()
+	if sealed, err := s.IsSealed(1); err != nil || !sealed {
+		t.Fatalf("sealed[%v] err[%v]", sealed, err)
+	}
+}
+
+// The extent deleted is closed only after the operations holding it are
+// done.
+func TestExtentCacheDeletePinned(t *testing.T) {
+	s, dir := newTestExtentStore(t, BlockSize)
+	defer os.RemoveAll(dir)
+	data, crc := testData(1000)
+	if err := s.CreateWithId(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(1, 0, int64(len(data)), data, crc); err != nil {
+		t.Fatal(err)
+	}
+	pinned := getTestExtent(t, s, 1)
+	deleted := make(chan error, 1)
+	go func() {
+		deleted <- s.Delete(1)
+	}()
+	select {
+	case err := <-deleted:
+		t.Fatalf("extent deleted while pinned: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	buf := make([]byte, len(data))
+	if _, err := pinned.readAt(buf, pinned.dataOffset()); err != nil {
+		t.Fatalf("read the pinned extent: %v", err)
+	}
+	s.putExtent(pinned)
+	if err := <-deleted; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(pinned.filePath); !os.IsNotExist(err) {
+		t.Fatalf("extent file not removed: %v", err)
+	}
+}
+
+// Of the deletes of an extent pinned by an operation, only the first one
+// waits for the operation, the others get ErrorHasDelete at once. Both return
+// after the extent is put back.
+func TestExtentCacheDeleteConcurrent(t *testing.T) {
+	s, dir := newTestExtentStore(t, BlockSize)
+	defer os.RemoveAll(dir)
+	if err := s.CreateWithId(1); err != nil {
+		t.Fatal(err)
+	}
+	pinned := getTestExtent(t, s, 1)
+	deleted := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			deleted <- s.Delete(1)
+		}()
+	}
+	select {
+	case err := <-deleted:
+		if err != ErrorHasDelete {
+			t.Fatalf("second delete err[%v]", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("second delete not returned")
+	}
+	if _, err := s.getExtent(1); err != ErrorHasDelete {
+		t.Fatalf("get the extent being deleted err[%v]", err)
+	}
+	s.putExtent(pinned)
+	select {
+	case err := <-deleted:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("first delete not returned")
+	}
+	if _, err := os.Stat(pinned.filePath); !os.IsNotExist(err) {
+		t.Fatalf("extent file not removed: %v", err)
+	}
+	if err := s.Delete(1); err != nil {
+		t.Fatalf("delete of the extent removed err[%v]", err)
+	}
+}
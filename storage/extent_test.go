@@ -0,0 +1,402 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestExtentStore(t *testing.T, blockSize int) (s *ExtentStore, dir string) {
+	dir, err := ioutil.TempDir("", "extent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err = NewExtentStore(dir+"/extent", blockSize, 0, NewStoreMode); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return
+}
+
+func testData(size int) (data []byte, crc uint32) {
+	data = make([]byte, size)
+	rand.Read(data)
+
+	return data, crc32.ChecksumIEEE(data)
+}
+
+func checkRead(t *testing.T, s *ExtentStore, extentId uint64, offset int64, expected []byte) {
+	buf := make([]byte, len(expected))
+	crc, err := s.Read(extentId, offset, int64(len(buf)), buf)
+	if err != nil {
+		t.Fatalf("read extent[%v] offset[%v]: %v", extentId, offset, err)
+	}
+	if !bytes.Equal(buf, expected) {
+		t.Fatalf("extent[%v] offset[%v] data unmatch", extentId, offset)
+	}
+	if crc != crc32.ChecksumIEEE(expected) {
+		t.Fatalf("extent[%v] offset[%v] crc[%v] expected[%v]", extentId, offset, crc, crc32.ChecksumIEEE(expected))
+	}
+}
+
+// writeV1Extent writes the extent file the way the v1 store did, the crcs of
+// the blocks are in the header before the data.
+func writeV1Extent(t *testing.T, s *ExtentStore, extentId uint64, data []byte) {
+	header := make([]byte, BlockCrcHeaderSize)
+	for blockNo := 0; blockNo*BlockSize < len(data); blockNo++ {
+		end := (blockNo + 1) * BlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		binary.BigEndian.PutUint32(header[blockNo*PerBlockCrcSize:], crc32.ChecksumIEEE(data[blockNo*BlockSize:end]))
+	}
+	header[MarkDeleteIndex] = UnMarkDelete
+	name := s.dataDir + "/" + strconv.FormatUint(extentId, 10)
+	if err := ioutil.WriteFile(name, append(header, data...), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtentV1Load(t *testing.T) {
+	s, dir := newTestExtentStore(t, BlockSize)
+	defer os.RemoveAll(dir)
+	data, _ := testData(2*BlockSize + 100)
+	writeV1Extent(t, s, 1, data)
+
+	checkRead(t, s, 1, 0, data)
+	checkRead(t, s, 1, BlockSize, data[BlockSize:2*BlockSize])
+	checkRead(t, s, 1, 100, data[100:300])
+	if size, err := s.GetWatermark(1); err != nil || size != int64(len(data)) {
+		t.Fatalf("watermark[%v] err[%v], expected[%v]", size, err, len(data))
+	}
+	index, err := s.GetBlockCrcIndex(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.Version != ExtentVersionV1 || index.BlockSize != BlockSize {
+		t.Fatalf("version[%v] block size[%v]", index.Version, index.BlockSize)
+	}
+	if crc := binary.BigEndian.Uint32(index.Crcs[PerBlockCrcSize:]); crc != crc32.ChecksumIEEE(data[BlockSize:2*BlockSize]) {
+		t.Fatalf("crc of block 1 [%v]", crc)
+	}
+
+	// The v1 extent is still written in its limit, and can not be sealed.
+	more, crc := testData(BlockSize)
+	if err = s.Write(1, int64(len(data)), int64(len(more)), more, crc); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Write(1, BlockSize*BlockCount, int64(len(more)), more, crc); err != ErrorUnmatchPara {
+		t.Fatalf("write beyond the v1 limit: %v", err)
+	}
+	if err = s.Seal(1, int64(len(data))); err != ErrorExtentVersion {
+		t.Fatalf("seal v1 extent: %v", err)
+	}
+
+	// The extent loaded again keeps the data and the crcs written.
+	s.ClearAllCache()
+	checkRead(t, s, 1, 0, append(data, more...))
+	if _, err = s.VerifyBlock(1, 2); err != nil {
+		t.Fatalf("verify block 2: %v", err)
+	}
+}
+
+// The v1 store kept the crc of the last block appended to padded with zeros
+// to BlockSize, the block is verified and appended to again with that crc.
+func TestExtentV1PaddedCrc(t *testing.T) {
+	s, dir := newTestExtentStore(t, BlockSize)
+	defer os.RemoveAll(dir)
+	data, _ := testData(BlockSize + 100)
+	writeV1Extent(t, s, 1, data)
+	padded := make([]byte, BlockSize)
+	copy(padded, data[BlockSize:])
+	name := s.dataDir + "/1"
+	fp, err := os.OpenFile(name, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crc := make([]byte, PerBlockCrcSize)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(padded))
+	_, err = fp.WriteAt(crc, PerBlockCrcSize)
+	fp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkRead(t, s, 1, BlockSize, data[BlockSize:])
+	if _, err = s.VerifyBlock(1, 1); err != nil {
+		t.Fatalf("verify the padded block: %v", err)
+	}
+	index, err := s.GetBlockCrcIndex(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !index.MatchBlock(1, crc32.ChecksumIEEE(data[BlockSize:]), 100) {
+		t.Fatal("index does not match the data of the padded block")
+	}
+
+	// The block appended to keeps the padded crc as the v1 store did.
+	more, moreCrc := testData(100)
+	if err = s.Write(1, int64(len(data)), int64(len(more)), more, moreCrc); err != nil {
+		t.Fatal(err)
+	}
+	copy(padded[100:], more)
+	s.ClearAllCache()
+	header := make([]byte, BlockCrcHeaderSize)
+	if fp, err = os.Open(name); err != nil {
+		t.Fatal(err)
+	}
+	_, err = fp.ReadAt(header, 0)
+	fp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crc := binary.BigEndian.Uint32(header[PerBlockCrcSize:]); crc != crc32.ChecksumIEEE(padded) {
+		t.Fatalf("crc of the appended block[%v] expected[%v]", crc, crc32.ChecksumIEEE(padded))
+	}
+	if _, err = s.VerifyBlock(1, 1); err != nil {
+		t.Fatalf("verify the appended block: %v", err)
+	}
+}
+
+// The block size is kept in the header, the extent is loaded with it by the
+// store of another block size.
+func TestExtentBlockSizePersisted(t *testing.T) {
+	s, dir := newTestExtentStore(t, BlockSize)
+	defer os.RemoveAll(dir)
+	const blockSize = 4 * MinBlockSize
+	if err := s.CreateWithBlockSize(1, blockSize); err != nil {
+		t.Fatal(err)
+	}
+	data, crc := testData(3*blockSize + 10)
+	if err := s.Write(1, 0, int64(len(data)), data, crc); err != nil {
+		t.Fatal(err)
+	}
+	s.ClearAllCache()
+
+	reopened, err := NewExtentStore(s.dataDir, BlockSize, 0, ReBootStoreMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, err := reopened.GetBlockSize(1); err != nil || size != blockSize {
+		t.Fatalf("block size[%v] err[%v], expected[%v]", size, err, blockSize)
+	}
+	index, err := reopened.GetBlockCrcIndex(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Crcs) != 4*PerBlockCrcSize {
+		t.Fatalf("%v crcs, expected 4", len(index.Crcs)/PerBlockCrcSize)
+	}
+	if crc := binary.BigEndian.Uint32(index.Crcs[3*PerBlockCrcSize:]); crc != crc32.ChecksumIEEE(data[3*blockSize:]) {
+		t.Fatalf("crc of the last block [%v]", crc)
+	}
+	checkRead(t, reopened, 1, blockSize, data[blockSize:2*blockSize])
+	if err = reopened.CreateWithBlockSize(2, blockSize+1); err != ErrorUnmatchPara {
+		t.Fatalf("create with error block size: %v", err)
+	}
+}
+
+// The write past the maximum size of a v2 extent is refused before the crcs of
+// its blocks are allocated.
+func TestExtentWriteHugeOffset(t *testing.T) {
+	s, dir := newTestExtentStore(t, BlockSize)
+	defer os.RemoveAll(dir)
+	if err := s.CreateWithId(1); err != nil {
+		t.Fatal(err)
+	}
+	data, crc := testData(100)
+	maxSize := int64(MaxExtentBlocks * BlockSize)
+	for _, offset := range []int64{1 << 50, maxSize - 99, 1<<63 - 10} {
+		if err := s.Write(1, offset, int64(len(data)), data, crc); err != ErrorUnmatchPara {
+			t.Fatalf("write offset[%v]: %v", offset, err)
+		}
+	}
+	if err := s.Write(1, maxSize-100, int64(len(data)), data, crc); err != nil {
+		t.Fatal(err)
+	}
+	checkRead(t, s, 1, maxSize-100, data)
+}
+
+// The write racing with the delete of the extent is done before the extent
+// is marked deleted, or refused after.
+func TestExtentWriteMarkDelete(t *testing.T) {
+	s, dir := newTestExtentStore(t, BlockSize)
+	defer os.RemoveAll(dir)
+	if err := s.CreateWithId(1); err != nil {
+		t.Fatal(err)
+	}
+	data, crc := testData(BlockSize)
+	done := make(chan error)
+	go func() {
+		var err error
+		for offset := int64(0); err == nil; offset = (offset + BlockSize) % (64 * BlockSize) {
+			err = s.Write(1, offset, BlockSize, data, crc)
+		}
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := s.MarkDelete(1, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != ErrorHasDelete {
+		t.Fatalf("write after delete: %v", err)
+	}
+	if err := s.Write(1, 0, BlockSize, data, crc); err != ErrorHasDelete {
+		t.Fatalf("write after delete: %v", err)
+	}
+}
+
+// The extent file left empty, or with a part of the header, by a crash after
+// it was created is loaded as a new extent.
+func TestExtentTruncatedHeader(t *testing.T) {
+	s, dir := newTestExtentStore(t, BlockSize)
+	defer os.RemoveAll(dir)
+	for extentId, content := range map[uint64][]byte{1: nil, 2: extentMagic, 3: make([]byte, 100)} {
+		name := s.dataDir + "/" + strconv.FormatUint(extentId, 10)
+		if err := ioutil.WriteFile(name, content, 0666); err != nil {
+			t.Fatal(err)
+		}
+		if size, err := s.GetWatermark(extentId); err != nil || size != 0 {
+			t.Fatalf("extent[%v] watermark[%v] err[%v]", extentId, size, err)
+		}
+		data, crc := testData(BlockSize + 1)
+		if err := s.Write(extentId, 0, int64(len(data)), data, crc); err != nil {
+			t.Fatalf("write extent[%v]: %v", extentId, err)
+		}
+		s.ClearAllCache()
+		checkRead(t, s, extentId, 0, data)
+		if index, err := s.GetBlockCrcIndex(extentId); err != nil || index.Version != ExtentVersionV2 {
+			t.Fatalf("extent[%v] index[%v] err[%v]", extentId, index, err)
+		}
+	}
+}
+
+// The commit length only moves over the contiguous committed ranges, the
+// range acked before the one ahead of it waits for the gap.
+func TestExtentCommitContiguous(t *testing.T) {
+	s, dir := newTestExtentStore(t, BlockSize)
+	defer os.RemoveAll(dir)
+	if err := s.CreateWithId(1); err != nil {
+		t.Fatal(err)
+	}
+	data, crc := testData(4 * 1024)
+	if err := s.Write(1, 0, int64(len(data)), data, crc); err != nil {
+		t.Fatal(err)
+	}
+	checkCommit := func(expected int64) {
+		if length, err := s.GetCommitLength(1); err != nil || length != expected {
+			t.Fatalf("commit length[%v] err[%v], expected[%v]", length, err, expected)
+		}
+	}
+
+	commits := []struct{ offset, end, expected int64 }{
+		{2048, 3072, 0},
+		{3072, 4096, 0},
+		{0, 1024, 1024},
+		{0, 1024, 1024},
+		{1024, 2048, 4096},
+	}
+	for _, c := range commits {
+		if err := s.Commit(1, c.offset, c.end); err != nil {
+			t.Fatal(err)
+		}
+		checkCommit(c.expected)
+	}
+
+	s.ClearAllCache()
+	reopened, err := NewExtentStore(s.dataDir, BlockSize, 0, ReBootStoreMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if length, err := reopened.GetCommitLength(1); err != nil || length != 4096 {
+		t.Fatalf("reopened commit length[%v] err[%v]", length, err)
+	}
+}
+
+// The v1 extent keeps the delete time in the del file, the one marked deleted
+// without it gets its grace period from the first scan instead of the mtime.
+func TestExtentV1DeleteTime(t *testing.T) {
+	s, dir := newTestExtentStore(t, BlockSize)
+	defer os.RemoveAll(dir)
+	data, _ := testData(BlockSize)
+	writeV1Extent(t, s, 1, data)
+	if err := s.MarkDelete(1, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	delName := s.dataDir + "/1" + ExtentDelFileSuffix
+	if _, err := os.Stat(delName); err != nil {
+		t.Fatalf("del file: %v", err)
+	}
+	if extents, err := s.DeleteExpired(3600); err != nil || len(extents) != 0 {
+		t.Fatalf("deleted in grace period: %v %v", extents, err)
+	}
+	if extents, err := s.DeleteExpired(0); err != nil || len(extents) != 1 {
+		t.Fatalf("deleted after grace period: %v %v", extents, err)
+	}
+	if _, err := os.Stat(delName); !os.IsNotExist(err) {
+		t.Fatalf("del file left: %v", err)
+	}
+
+	// The extent marked deleted long ago by the old version.
+	writeV1Extent(t, s, 2, data)
+	name := s.dataDir + "/2"
+	fp, err := os.OpenFile(name, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fp.WriteAt([]byte{MarkDelete}, MarkDeleteIndex)
+	fp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	if err = os.Chtimes(name, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if extents, err := s.DeleteExpired(3600); err != nil || len(extents) != 0 {
+		t.Fatalf("legacy extent deleted by mtime: %v %v", extents, err)
+	}
+	if _, err = os.Stat(name + ExtentDelFileSuffix); err != nil {
+		t.Fatalf("del file of legacy extent: %v", err)
+	}
+}
+
+// The crc and del files are not counted as the extents.
+func TestExtentStoreUsedSize(t *testing.T) {
+	s, dir := newTestExtentStore(t, BlockSize)
+	defer os.RemoveAll(dir)
+	if err := s.CreateWithId(1); err != nil {
+		t.Fatal(err)
+	}
+	data, crc := testData(4 * 1024)
+	if err := s.Write(1, 0, int64(len(data)), data, crc); err != nil {
+		t.Fatal(err)
+	}
+	writeV1Extent(t, s, 2, data)
+	if err := s.MarkDelete(2, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	s.SyncAll()
+
+	var expected int64
+	for _, name := range []string{"1", "2"} {
+		finfo, err := os.Stat(s.dataDir + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected += finfo.Size()
+	}
+	if logical, _ := s.GetStoreUsedSize(); logical != expected {
+		t.Fatalf("used size[%v] expected[%v]", logical, expected)
+	}
+	if files, err := s.GetStoreFileCount(); err != nil || files != 2 {
+		t.Fatalf("file count[%v] err[%v]", files, err)
+	}
+}
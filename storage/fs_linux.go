@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	fallocKeepSize  = 0x1
+	fallocPunchHole = 0x2
+	oDirect         = syscall.O_DIRECT
+	oDsync          = syscall.O_DSYNC
+)
+
+// punchHole frees the disk space of [offset, offset+size) in the file, the
+// size of the file is kept and the range reads as zero after.
+func punchHole(file *os.File, offset, size int64) error {
+	return syscall.Fallocate(int(file.Fd()), fallocPunchHole|fallocKeepSize, offset, size)
+}
+
+func fdatasync(file *os.File) error {
+	return syscall.Fdatasync(int(file.Fd()))
+}
+
+// physicalSize returns the disk space allocated to the file.
+func physicalSize(finfo os.FileInfo) int64 {
+	if stat, ok := finfo.Sys().(*syscall.Stat_t); ok {
+		return stat.Blocks * 512
+	}
+
+	return finfo.Size()
+}
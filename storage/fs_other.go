@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package storage
+
+import "os"
+
+// The direct io is not supported, the files are synced with O_SYNC instead
+// of O_DSYNC.
+const (
+	oDirect = 0
+	oDsync  = os.O_SYNC
+)
+
+// punchHole is not supported, the space is reclaimed by the compaction.
+func punchHole(file *os.File, offset, size int64) error {
+	return nil
+}
+
+func fdatasync(file *os.File) error {
+	return file.Sync()
+}
+
+func physicalSize(finfo os.FileInfo) int64 {
+	return finfo.Size()
+}
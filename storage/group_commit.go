@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+type SyncMode uint8
+
+// In SyncModeAsync a write is acknowledged once it is in the page cache. In
+// SyncModeGroupCommit the concurrent writes of a store are synced together,
+// by one fdatasync per file every interval or every maxBytes written, and a
+// write is acknowledged after its batch is synced.
+const (
+	SyncModeAsync SyncMode = iota
+	SyncModeGroupCommit
+)
+
+const (
+	DefaultGroupCommitInterval = 2 * time.Millisecond
+	DefaultGroupCommitBytes    = 4 * 1024 * 1024
+)
+
+func (m SyncMode) String() string {
+	if m == SyncModeGroupCommit {
+		return "groupCommit"
+	}
+
+	return "async"
+}
+
+// syncer is a file of the store, the extent or the chunk.
+type syncer interface {
+	commitSync() error
+}
+
+type commitWaiter struct {
+	file  syncer
+	start time.Time
+	done  chan error
+}
+
+// groupCommitter batches the syncs of the files written in a store.
+type groupCommitter struct {
+	interval time.Duration
+	maxBytes int64
+	lock     sync.Mutex
+	waiters  []*commitWaiter
+	bytes    int64
+	kickC    chan struct{}
+	stopC    chan struct{}
+	stopped  bool
+	latency  *LatencyHistogram
+}
+
+func newGroupCommitter(interval time.Duration, maxBytes int64) (g *groupCommitter) {
+	g = &groupCommitter{
+		interval: interval,
+		maxBytes: maxBytes,
+		kickC:    make(chan struct{}, 1),
+		stopC:    make(chan struct{}),
+		latency:  NewLatencyHistogram(),
+	}
+	go g.run()
+
+	return
+}
+
+// commit waits until the size bytes written to the file are synced.
+func (g *groupCommitter) commit(file syncer, size int64) error {
+	w := &commitWaiter{file: file, start: time.Now(), done: make(chan error, 1)}
+	g.lock.Lock()
+	if g.stopped {
+		g.lock.Unlock()
+		return file.commitSync()
+	}
+	g.waiters = append(g.waiters, w)
+	g.bytes += size
+	full := g.bytes >= g.maxBytes
+	g.lock.Unlock()
+	if full {
+		select {
+		case g.kickC <- struct{}{}:
+		default:
+		}
+	}
+
+	return <-w.done
+}
+
+func (g *groupCommitter) run() {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.stopC:
+			g.flush()
+			return
+		case <-ticker.C:
+		case <-g.kickC:
+		}
+		g.flush()
+	}
+}
+
+// flush syncs every file of the batch once, and wakes the writes of the batch
+// with the error of their own file.
+func (g *groupCommitter) flush() {
+	g.lock.Lock()
+	waiters := g.waiters
+	g.waiters = nil
+	g.bytes = 0
+	g.lock.Unlock()
+	if len(waiters) == 0 {
+		return
+	}
+
+	errs := make(map[syncer]error)
+	for _, w := range waiters {
+		if _, ok := errs[w.file]; !ok {
+			errs[w.file] = w.file.commitSync()
+		}
+	}
+	now := time.Now()
+	for _, w := range waiters {
+		g.latency.Add(now.Sub(w.start))
+		w.done <- errs[w.file]
+	}
+}
+
+func (g *groupCommitter) stop() {
+	g.lock.Lock()
+	g.stopped = true
+	g.lock.Unlock()
+	close(g.stopC)
+}
+
+// LatencyHistogram counts the latencies in power of two millisecond buckets,
+// the bucket i counts the latencies below 2^i ms, the last bucket counts the
+// rest.
+type LatencyHistogram struct {
+	Buckets []uint64
+	Count   uint64
+	Sum     time.Duration
+	Max     time.Duration
+	lock    sync.Mutex
+}
+
+const latencyBuckets = 12
+
+func NewLatencyHistogram() *LatencyHistogram {
+	return &LatencyHistogram{Buckets: make([]uint64, latencyBuckets)}
+}
+
+func (h *LatencyHistogram) Add(latency time.Duration) {
+	bucket := 0
+	for bound := time.Millisecond; bucket < latencyBuckets-1 && latency >= bound; bound *= 2 {
+		bucket++
+	}
+	h.lock.Lock()
+	h.Buckets[bucket]++
+	h.Count++
+	h.Sum += latency
+	if latency > h.Max {
+		h.Max = latency
+	}
+	h.lock.Unlock()
+}
+
+// Snapshot returns a copy of the histogram.
+func (h *LatencyHistogram) Snapshot() (snap *LatencyHistogram) {
+	h.lock.Lock()
+	snap = &LatencyHistogram{Buckets: make([]uint64, len(h.Buckets)), Count: h.Count, Sum: h.Sum, Max: h.Max}
+	copy(snap.Buckets, h.Buckets)
+	h.lock.Unlock()
+
+	return
+}
+
+// SyncStats is the sync mode of a store and the latency of the writes waiting
+// for the group commit.
+type SyncStats struct {
+	Mode    string
+	Latency *LatencyHistogram
+}
+
+func syncStats(g *groupCommitter) (stats *SyncStats) {
+	stats = &SyncStats{Mode: SyncModeAsync.String()}
+	if g != nil {
+		stats.Mode = SyncModeGroupCommit.String()
+		stats.Latency = g.latency.Snapshot()
+	}
+
+	return
+}
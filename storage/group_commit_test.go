@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testSyncer struct {
+	syncs int32
+	err   error
+}
+
+func (f *testSyncer) commitSync() error {
+	atomic.AddInt32(&f.syncs, 1)
+	return f.err
+}
+
+// The concurrent writes of a batch are synced by one sync per file, every
+// write gets the error of its own file.
+func TestGroupCommitBatch(t *testing.T) {
+	g := newGroupCommitter(time.Hour, 8)
+	defer g.stop()
+	good, bad := &testSyncer{}, &testSyncer{err: errors.New("sync failed")}
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		file := good
+		if i%2 == 1 {
+			file = bad
+		}
+		wg.Add(1)
+		go func(i int, file *testSyncer) {
+			defer wg.Done()
+			errs[i] = g.commit(file, 1)
+		}(i, file)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if (i%2 == 1) != (err == bad.err) {
+			t.Fatalf("write[%v] err[%v]", i, err)
+		}
+	}
+	if syncs := atomic.LoadInt32(&good.syncs) + atomic.LoadInt32(&bad.syncs); syncs > 4 {
+		t.Fatalf("%v syncs of 8 writes", syncs)
+	}
+	if count := g.latency.Snapshot().Count; count != 8 {
+		t.Fatalf("latency of %v writes", count)
+	}
+}
+
+// The write waiting for the group commit of an extent closed since gets the
+// error of the sync on close.
+func TestGroupCommitClosedExtent(t *testing.T) {
+	s, dir := newTestExtentStore(t, BlockSize)
+	defer os.RemoveAll(dir)
+	if err := s.CreateWithId(1); err != nil {
+		t.Fatal(err)
+	}
+	e, err := s.getExtent(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.putExtent(e)
+	if err = e.commitSync(); err != nil {
+		t.Fatal(err)
+	}
+	e.file.Close()
+	if err = e.closeExtent(); err == nil {
+		t.Fatal("extent of a closed file closed")
+	}
+	if e1 := e.commitSync(); e1 != err {
+		t.Fatalf("commit sync err[%v], expected[%v]", e1, err)
+	}
+}
+
+// The tiny write waiting for the group commit does not hold the compact lock
+// of the chunk, the compaction and the other writes go on.
+func TestGroupCommitTinyWrite(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	s.SetSyncMode(SyncModeGroupCommit, time.Hour, DefaultGroupCommitBytes)
+	const chunkId = 1
+	c := s.chunks[chunkId]
+	oid, err := s.AllocObjectId(chunkId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, crc := testData(100)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Write(chunkId, int64(oid), int64(len(data)), data, crc)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if _, err = s.GetObject(chunkId, oid); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("object not written: %v", err)
+		}
+	}
+	select {
+	case err = <-done:
+		t.Fatalf("write done before the group commit: %v", err)
+	default:
+	}
+	if !c.compactLock.TryLock() {
+		t.Fatal("compact lock held by the write waiting for the group commit")
+	}
+	c.compactLock.Unlock()
+	s.committer.flush()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
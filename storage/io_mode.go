@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+type IoMode uint8
+
+// In IoModeDirect the data of the store is read and written with O_DIRECT,
+// through buffers aligned to DirectAlignSize, so it does not fill the page
+// cache shared with the other services of the host. Only the writes aligned
+// to DirectAlignSize bypass the page cache, the others, such as the tail of
+// an extent and the objects of a chunk, are written through it. In
+// IoModeDsync the data files are opened with O_DSYNC, a write returns after
+// its data is on the disk. The two can be combined, IoModeBuffered is none.
+const (
+	IoModeDirect IoMode = 1 << iota
+	IoModeDsync
+	IoModeBuffered IoMode = 0
+)
+
+const (
+	DirectAlignSize = 4096
+	// The aligned buffers of up to maxAlignedPoolSize are pooled by the
+	// power of two size class, the larger ones are allocated on demand.
+	maxAlignedPoolClass = 13
+	maxAlignedPoolSize  = DirectAlignSize << maxAlignedPoolClass
+)
+
+var alignedPools [maxAlignedPoolClass + 1]sync.Pool
+
+// ParseIoMode parses the io mode of the config, such as "direct", "dsync"
+// and "direct,dsync". The empty string and "buffered" are IoModeBuffered.
+func ParseIoMode(s string) (mode IoMode, err error) {
+	for _, name := range strings.Split(s, ",") {
+		switch strings.TrimSpace(name) {
+		case "", "buffered":
+		case "direct":
+			mode |= IoModeDirect
+		case "dsync":
+			mode |= IoModeDsync
+		default:
+			return IoModeBuffered, fmt.Errorf("unknown io mode[%v]", name)
+		}
+	}
+
+	return
+}
+
+func (m IoMode) String() string {
+	names := make([]string, 0)
+	if m&IoModeDirect != 0 {
+		names = append(names, "direct")
+	}
+	if m&IoModeDsync != 0 {
+		names = append(names, "dsync")
+	}
+	if len(names) == 0 {
+		return "buffered"
+	}
+
+	return strings.Join(names, ",")
+}
+
+// openFlag is the flag of the data files opened in the mode.
+func (m IoMode) openFlag() int {
+	if m&IoModeDsync != 0 {
+		return oDsync
+	}
+
+	return 0
+}
+
+// openDirect opens the file for the direct io. It returns nil if the mode is
+// not direct, or the platform or the file system does not support it.
+func (m IoMode) openDirect(name string) (fp *os.File) {
+	if m&IoModeDirect == 0 || oDirect == 0 {
+		return nil
+	}
+	fp, err := os.OpenFile(name, os.O_RDWR|oDirect|m.openFlag(), 0666)
+	if err != nil {
+		return nil
+	}
+
+	return
+}
+
+func isAligned(offset int64, size int) bool {
+	return offset%DirectAlignSize == 0 && size%DirectAlignSize == 0
+}
+
+func alignedPoolClass(size int) (class int) {
+	for DirectAlignSize<<uint(class) < size {
+		class++
+	}
+
+	return
+}
+
+// getAlignedBuffer returns a buffer of size whose address is aligned to
+// DirectAlignSize.
+func getAlignedBuffer(size int) []byte {
+	if size > maxAlignedPoolSize {
+		return allocAligned(size)
+	}
+	class := alignedPoolClass(size)
+	if b, ok := alignedPools[class].Get().([]byte); ok {
+		return b[:size]
+	}
+
+	return allocAligned(DirectAlignSize << uint(class))[:size]
+}
+
+func putAlignedBuffer(b []byte) {
+	if cap(b) > maxAlignedPoolSize {
+		return
+	}
+	class := alignedPoolClass(cap(b))
+	if DirectAlignSize<<uint(class) != cap(b) {
+		return
+	}
+	alignedPools[class].Put(b[:cap(b)])
+}
+
+func allocAligned(size int) []byte {
+	b := make([]byte, size+DirectAlignSize)
+	shift := 0
+	if rem := int(uintptr(unsafe.Pointer(&b[0])) & (DirectAlignSize - 1)); rem != 0 {
+		shift = DirectAlignSize - rem
+	}
+
+	return b[shift : shift+size : shift+size]
+}
+
+// directReadAt reads the aligned range covering [offset, offset+len(buf))
+// of the file opened with O_DIRECT, and copies the part asked into buf. It
+// returns io.EOF like ReadAt if the file ends before buf is filled.
+func directReadAt(fp *os.File, buf []byte, offset int64) (n int, err error) {
+	start := offset - offset%DirectAlignSize
+	end := offset + int64(len(buf))
+	if rem := end % DirectAlignSize; rem != 0 {
+		end += DirectAlignSize - rem
+	}
+	aligned := getAlignedBuffer(int(end - start))
+	defer putAlignedBuffer(aligned)
+	read, err := fp.ReadAt(aligned, start)
+	if skip := int(offset - start); read > skip {
+		n = copy(buf, aligned[skip:read])
+	}
+	if n == len(buf) {
+		return n, nil
+	}
+	if err == nil {
+		err = io.EOF
+	}
+
+	return
+}
+
+// directWriteAt writes data at offset of the file opened with O_DIRECT, both
+// of them must be aligned.
+func directWriteAt(fp *os.File, data []byte, offset int64) (n int, err error) {
+	aligned := getAlignedBuffer(len(data))
+	defer putAlignedBuffer(aligned)
+	copy(aligned, data)
+
+	return fp.WriteAt(aligned, offset)
+}
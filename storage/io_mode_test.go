@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// The benchmarks compare the io modes with the buffered path. The data dir
+// is taken from BENCH_DATA_DIR, the direct io falls back to the page cache
+// on the file systems without O_DIRECT, such as tmpfs.
+
+const (
+	benchExtentWriteSize = 64 * 1024
+	benchExtentSize      = 64 * 1024 * 1024
+	benchObjectSize      = 4 * 1024
+)
+
+var benchIoModes = []IoMode{IoModeBuffered, IoModeDirect, IoModeDsync, IoModeDirect | IoModeDsync}
+
+func benchDataDir(b *testing.B) (dir string) {
+	dir, err := ioutil.TempDir(os.Getenv("BENCH_DATA_DIR"), "iomode")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return
+}
+
+func benchData(size int) (data []byte, crc uint32) {
+	data = make([]byte, size)
+	rand.Read(data)
+
+	return data, crc32.ChecksumIEEE(data)
+}
+
+// The data written in every io mode is read back the same, through the
+// aligned and the unaligned ranges, and after the extents are opened again.
+func TestExtentIoModes(t *testing.T) {
+	for _, mode := range benchIoModes {
+		t.Run(mode.String(), func(t *testing.T) {
+			s, dir := newTestExtentStore(t, BlockSize)
+			defer os.RemoveAll(dir)
+			s.SetIoMode(mode)
+			if err := s.CreateWithId(1); err != nil {
+				t.Fatal(err)
+			}
+			data, _ := testData(3*DirectAlignSize + 100)
+			// The aligned writes, the tail and the write after the tail.
+			for _, w := range [][2]int{{0, 2 * DirectAlignSize}, {2 * DirectAlignSize, 2*DirectAlignSize + 100}, {2*DirectAlignSize + 100, len(data)}} {
+				part := data[w[0]:w[1]]
+				if err := s.Write(1, int64(w[0]), int64(len(part)), part, crc32.ChecksumIEEE(part)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < 2; i++ {
+				checkRead(t, s, 1, 0, data)
+				checkRead(t, s, 1, DirectAlignSize, data[DirectAlignSize:2*DirectAlignSize])
+				checkRead(t, s, 1, 100, data[100:DirectAlignSize+300])
+				checkRead(t, s, 1, 2*DirectAlignSize+50, data[2*DirectAlignSize+50:])
+				s.ClearAllCache()
+			}
+		})
+	}
+}
+
+// The objects written in every io mode are read back the same, after the
+// store is opened again.
+func TestTinyIoModes(t *testing.T) {
+	for _, mode := range benchIoModes {
+		t.Run(mode.String(), func(t *testing.T) {
+			s, dir := newTestTinyStore(t)
+			defer os.RemoveAll(dir)
+			if err := s.SetIoMode(mode); err != nil {
+				t.Fatal(err)
+			}
+			const chunkId = 1
+			objects := make(map[uint64][]byte)
+			for _, size := range []int{100, DirectAlignSize, 3*DirectAlignSize + 1} {
+				data, crc := testData(size)
+				oid, _ := s.AllocObjectId(chunkId)
+				if err := s.Write(chunkId, int64(oid), int64(size), data, crc); err != nil {
+					t.Fatal(err)
+				}
+				objects[oid] = data
+			}
+			if err := s.Sync(chunkId); err != nil {
+				t.Fatal(err)
+			}
+			reopened, err := NewTinyStore(s.dataDir, ChunkCount*1024*1024, ReBootStoreMode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = reopened.SetIoMode(mode); err != nil {
+				t.Fatal(err)
+			}
+			for _, store := range []*TinyStore{s, reopened} {
+				for oid, data := range objects {
+					buf := make([]byte, len(data))
+					if _, err = store.Read(chunkId, int64(oid), int64(len(data)), buf); err != nil {
+						t.Fatalf("read object[%v]: %v", oid, err)
+					}
+					if !bytes.Equal(buf, data) {
+						t.Fatalf("object[%v] data unmatch", oid)
+					}
+				}
+			}
+		})
+	}
+}
+
+func newBenchExtentStore(b *testing.B, mode IoMode) (s *ExtentStore, dir string) {
+	dir = benchDataDir(b)
+	s, err := NewExtentStore(dir+"/extent", BlockSize, 0, NewStoreMode)
+	if err != nil {
+		os.RemoveAll(dir)
+		b.Fatal(err)
+	}
+	s.SetIoMode(mode)
+
+	return
+}
+
+// writeBenchExtents writes n blocks of benchExtentWriteSize in sequence, a
+// new extent is created every benchExtentSize.
+func writeBenchExtents(b *testing.B, s *ExtentStore, n int, data []byte, crc uint32) (extents []uint64) {
+	var (
+		extentId uint64
+		offset   int64
+		err      error
+	)
+	for i := 0; i < n; i++ {
+		if i == 0 || offset == benchExtentSize {
+			if extentId, err = s.Create(); err != nil {
+				b.Fatal(err)
+			}
+			extents = append(extents, extentId)
+			offset = 0
+		}
+		if err = s.Write(extentId, offset, int64(len(data)), data, crc); err != nil {
+			b.Fatal(err)
+		}
+		offset += int64(len(data))
+	}
+
+	return
+}
+
+func BenchmarkExtentWrite(b *testing.B) {
+	data, crc := benchData(benchExtentWriteSize)
+	for _, mode := range benchIoModes {
+		b.Run(mode.String(), func(b *testing.B) {
+			s, dir := newBenchExtentStore(b, mode)
+			defer os.RemoveAll(dir)
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			writeBenchExtents(b, s, b.N, data, crc)
+			b.StopTimer()
+			s.ClearAllCache()
+		})
+	}
+}
+
+func BenchmarkExtentRead(b *testing.B) {
+	data, crc := benchData(benchExtentWriteSize)
+	blocks := benchExtentSize / benchExtentWriteSize
+	for _, mode := range benchIoModes {
+		b.Run(mode.String(), func(b *testing.B) {
+			s, dir := newBenchExtentStore(b, mode)
+			defer os.RemoveAll(dir)
+			extents := writeBenchExtents(b, s, blocks, data, crc)
+			buf := make([]byte, len(data))
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				offset := int64(i%blocks) * int64(len(data))
+				if _, err := s.Read(extents[0], offset, int64(len(buf)), buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			s.ClearAllCache()
+		})
+	}
+}
+
+func BenchmarkTinyWrite(b *testing.B) {
+	data, crc := benchData(benchObjectSize)
+	for _, mode := range benchIoModes {
+		b.Run(mode.String(), func(b *testing.B) {
+			dir := benchDataDir(b)
+			defer os.RemoveAll(dir)
+			s, err := NewTinyStore(dir+"/tiny", ChunkCount*1024*1024*1024, NewStoreMode)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err = s.SetIoMode(mode); err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				chunkId := uint32(i%ChunkCount + 1)
+				oid, _ := s.AllocObjectId(chunkId)
+				if err = s.Write(chunkId, int64(oid), int64(len(data)), data, crc); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			s.DeleteStore()
+		})
+	}
+}
+
+func BenchmarkTinyRead(b *testing.B) {
+	const objects = 1024
+	data, crc := benchData(benchObjectSize)
+	for _, mode := range benchIoModes {
+		b.Run(mode.String(), func(b *testing.B) {
+			dir := benchDataDir(b)
+			defer os.RemoveAll(dir)
+			s, err := NewTinyStore(dir+"/tiny", ChunkCount*1024*1024*1024, NewStoreMode)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err = s.SetIoMode(mode); err != nil {
+				b.Fatal(err)
+			}
+			for oid := 1; oid <= objects; oid++ {
+				if err = s.Write(1, int64(oid), int64(len(data)), data, crc); err != nil {
+					b.Fatal(err)
+				}
+			}
+			buf := make([]byte, len(data))
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err = s.Read(1, int64(i%objects+1), int64(len(buf)), buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			s.DeleteStore()
+		})
+	}
+}
@@ -158,12 +158,9 @@ func (tree *ObjectTree) set(oid uint64, offset, size, crc uint32) (oldOff, oldSi
 }
 
 func (tree *ObjectTree) get(oid uint64) (n *Object, exist bool) {
-	defer func() {
-		if r := recover(); r != nil {
-			exist = false
-		}
-	}()
+	tree.idxLock.Lock()
 	found := tree.tree.Get(Object{Oid: oid})
+	tree.idxLock.Unlock()
 	if found != nil {
 		o := found.(Object)
 		return &o, true
@@ -172,6 +169,19 @@ func (tree *ObjectTree) get(oid uint64) (n *Object, exist bool) {
 	return nil, false
 }
 
+// oids returns the ids of the objects in the tree in order.
+func (tree *ObjectTree) oids() (oids []uint64) {
+	tree.idxLock.Lock()
+	oids = make([]uint64, 0, tree.tree.Len())
+	tree.tree.Ascend(func(i btree.Item) bool {
+		oids = append(oids, i.(Object).Oid)
+		return true
+	})
+	tree.idxLock.Unlock()
+
+	return
+}
+
 func (tree *ObjectTree) delete(oid uint64) error {
 	tree.idxLock.Lock()
 	found := tree.tree.Delete(Object{Oid: oid})
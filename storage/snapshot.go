@@ -0,0 +1,420 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The snapshot of a store is a stream of its files copied while the store is
+// frozen:
+//
+//	header: magic "BSSN", version:1, store type:1, label len:2, label
+//	file:   name len:2, name, size:8, data, crc:4
+//	end:    name len:2 of 0
+//
+// The extent store keeps the extent files and their crc sidecars, the tiny
+// store keeps the chunk files and their index files. The checkpoint of a
+// chunk is not in the stream, every file imported is synced. The crc of a
+// file only guards the stream, ImportSnapshot checks nothing else. The data is
+// verified by the caller with Verify, after the import is renamed into place
+// and opened as a store, and the store is deleted if it is bad.
+//
+// The files are copied into the staging directory {dataDir}.export while the
+// store is frozen, and the store is thawed before the copy is streamed, so a
+// slow reader of the stream does not hold the writes of the store. The
+// staging directory needs as much space as the store on the same disk.
+
+const (
+	SnapshotVersion     = 1
+	SnapshotExtentStore = 'E'
+	SnapshotTinyStore   = 'T'
+	snapshotImportDir   = ".import"
+	snapshotExportDir   = ".export"
+	maxSnapshotName     = 255
+)
+
+var (
+	snapshotMagic = []byte("BSSN")
+
+	ErrorStoreFrozen     = errors.New("store frozen")
+	ErrorSnapshotBusy    = errors.New("snapshot in progress")
+	ErrorSnapshotFormat  = errors.New("snapshot format error")
+	ErrorSnapshotCorrupt = errors.New("snapshot corrupt")
+)
+
+// SnapshotHeader leads the snapshot stream, the label is set by the caller,
+// such as the name of the volume.
+type SnapshotHeader struct {
+	Version   uint8
+	StoreType uint8
+	Label     string
+}
+
+// freezer stops the writes of a store for the snapshot. Every write enters it
+// and exits when done, freeze refuses the writes after and waits for the ones
+// entered.
+type freezer struct {
+	lock      sync.RWMutex
+	frozen    int32
+	exporting int32 // a snapshot is copied or streamed
+}
+
+func (f *freezer) enter() error {
+	f.lock.RLock()
+	if atomic.LoadInt32(&f.frozen) != 0 {
+		f.lock.RUnlock()
+		return ErrorStoreFrozen
+	}
+
+	return nil
+}
+
+func (f *freezer) exit() {
+	f.lock.RUnlock()
+}
+
+func (f *freezer) freeze() (err error) {
+	if !atomic.CompareAndSwapInt32(&f.frozen, 0, 1) {
+		return ErrorStoreFrozen
+	}
+	f.lock.Lock()
+	f.lock.Unlock()
+
+	return
+}
+
+func (f *freezer) thaw() {
+	atomic.StoreInt32(&f.frozen, 0)
+}
+
+func (f *freezer) IsFrozen() bool {
+	return atomic.LoadInt32(&f.frozen) != 0
+}
+
+// Snapshot writes the snapshot of the extent store to w, the store refuses
+// the writes with ErrorStoreFrozen while its files are copied.
+func (s *ExtentStore) Snapshot(w io.Writer, label string) (err error) {
+	h := &SnapshotHeader{Version: SnapshotVersion, StoreType: SnapshotExtentStore, Label: label}
+
+	return s.snapshot(w, s.dataDir, h, s.SyncAll, s.snapshotFiles)
+}
+
+// snapshotFiles returns the extent files and their sidecars.
+func (s *ExtentStore) snapshotFiles() (names []string, err error) {
+	var finfos []os.FileInfo
+	if finfos, err = ioutil.ReadDir(s.dataDir); err != nil {
+		return
+	}
+	names = make([]string, 0, len(finfos))
+	exist := make(map[string]bool, len(finfos))
+	for _, finfo := range finfos {
+		exist[finfo.Name()] = true
+	}
+	for _, finfo := range finfos {
+		if _, e := strconv.ParseUint(finfo.Name(), 10, 64); e != nil || !finfo.Mode().IsRegular() {
+			continue
+		}
+		names = append(names, finfo.Name())
+		for _, suffix := range []string{ExtentCrcFileSuffix, ExtentDelFileSuffix} {
+			if name := finfo.Name() + suffix; exist[name] {
+				names = append(names, name)
+			}
+		}
+	}
+
+	return
+}
+
+// Snapshot writes the snapshot of the tiny store to w, the store refuses the
+// writes and the compactions with ErrorStoreFrozen while its files are
+// copied.
+func (s *TinyStore) Snapshot(w io.Writer, label string) (err error) {
+	h := &SnapshotHeader{Version: SnapshotVersion, StoreType: SnapshotTinyStore, Label: label}
+
+	return s.snapshot(w, s.dataDir, h, s.SyncAll, func() ([]string, error) {
+		names := make([]string, 0, 2*ChunkCount)
+		for chunkId := 1; chunkId <= ChunkCount; chunkId++ {
+			names = append(names, strconv.Itoa(chunkId), strconv.Itoa(chunkId)+".idx")
+		}
+		return names, nil
+	})
+}
+
+// snapshot copies the files listed into the staging directory while the
+// store is frozen, then writes the snapshot of the copy to w. Only one
+// snapshot of the store is taken at a time.
+func (f *freezer) snapshot(w io.Writer, dataDir string, h *SnapshotHeader, syncAll func(), listFiles func() ([]string, error)) (err error) {
+	var names []string
+	if !atomic.CompareAndSwapInt32(&f.exporting, 0, 1) {
+		return ErrorSnapshotBusy
+	}
+	defer atomic.StoreInt32(&f.exporting, 0)
+	stageDir := dataDir + snapshotExportDir
+	// The staging directory is left by a crash during the last snapshot.
+	if err = os.RemoveAll(stageDir); err != nil {
+		return
+	}
+	if err = os.Mkdir(stageDir, 0755); err != nil {
+		return
+	}
+	defer os.RemoveAll(stageDir)
+
+	if err = f.freeze(); err != nil {
+		return
+	}
+	syncAll()
+	if names, err = listFiles(); err == nil {
+		err = copySnapshotFiles(dataDir, stageDir, names)
+	}
+	f.thaw()
+	if err != nil {
+		return
+	}
+
+	return writeSnapshot(w, stageDir, h, names)
+}
+
+func copySnapshotFiles(dataDir, stageDir string, names []string) (err error) {
+	for _, name := range names {
+		if err = copyFile(path.Join(dataDir, name), path.Join(stageDir, name)); err != nil {
+			return fmt.Errorf("snapshot copy file[%v] err[%v]", name, err)
+		}
+	}
+
+	return
+}
+
+func copyFile(src, dst string) (err error) {
+	var in, out *os.File
+	if in, err = os.Open(src); err != nil {
+		return
+	}
+	defer in.Close()
+	if out, err = os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666); err != nil {
+		return
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+
+	return
+}
+
+func writeSnapshot(w io.Writer, dataDir string, h *SnapshotHeader, names []string) (err error) {
+	bw := bufio.NewWriter(w)
+	buf := new(bytes.Buffer)
+	buf.Write(snapshotMagic)
+	buf.WriteByte(h.Version)
+	buf.WriteByte(h.StoreType)
+	binary.Write(buf, binary.BigEndian, uint16(len(h.Label)))
+	buf.WriteString(h.Label)
+	if _, err = bw.Write(buf.Bytes()); err != nil {
+		return
+	}
+	for _, name := range names {
+		if err = writeSnapshotFile(bw, dataDir, name); err != nil {
+			return fmt.Errorf("snapshot file[%v] err[%v]", name, err)
+		}
+	}
+	if err = binary.Write(bw, binary.BigEndian, uint16(0)); err != nil {
+		return
+	}
+
+	return bw.Flush()
+}
+
+func writeSnapshotFile(w io.Writer, dataDir, name string) (err error) {
+	var (
+		fp    *os.File
+		finfo os.FileInfo
+	)
+	if fp, err = os.Open(path.Join(dataDir, name)); err != nil {
+		return
+	}
+	defer fp.Close()
+	if finfo, err = fp.Stat(); err != nil {
+		return
+	}
+	if err = binary.Write(w, binary.BigEndian, uint16(len(name))); err != nil {
+		return
+	}
+	if _, err = io.WriteString(w, name); err != nil {
+		return
+	}
+	if err = binary.Write(w, binary.BigEndian, uint64(finfo.Size())); err != nil {
+		return
+	}
+	crc := crc32.NewIEEE()
+	if _, err = io.CopyN(io.MultiWriter(w, crc), fp, finfo.Size()); err != nil {
+		return
+	}
+
+	return binary.Write(w, binary.BigEndian, crc.Sum32())
+}
+
+// ReadSnapshotHeader reads the header of the snapshot stream, the files are
+// read by ImportSnapshot after.
+func ReadSnapshotHeader(r io.Reader) (h *SnapshotHeader, err error) {
+	var labelLen uint16
+	head := make([]byte, len(snapshotMagic)+2)
+	if _, err = io.ReadFull(r, head); err != nil {
+		return
+	}
+	if !bytes.Equal(head[:len(snapshotMagic)], snapshotMagic) {
+		return nil, ErrorSnapshotFormat
+	}
+	h = &SnapshotHeader{Version: head[len(snapshotMagic)], StoreType: head[len(snapshotMagic)+1]}
+	if h.Version != SnapshotVersion || (h.StoreType != SnapshotExtentStore && h.StoreType != SnapshotTinyStore) {
+		return nil, ErrorSnapshotFormat
+	}
+	if err = binary.Read(r, binary.BigEndian, &labelLen); err != nil {
+		return nil, err
+	}
+	label := make([]byte, labelLen)
+	if _, err = io.ReadFull(r, label); err != nil {
+		return nil, err
+	}
+	h.Label = string(label)
+
+	return
+}
+
+// ImportSnapshot writes the files of the snapshot stream into dataDir, which
+// must not exist. The files are written into a temporary directory first,
+// which is renamed to dataDir once the stream crc of every file is checked
+// and every file is synced, so a failed import leaves nothing behind.
+func ImportSnapshot(r io.Reader, h *SnapshotHeader, dataDir string) (err error) {
+	if _, err = os.Stat(dataDir); err == nil {
+		return fmt.Errorf("ImportSnapshot [%v] exists", dataDir)
+	}
+	tmpDir := dataDir + snapshotImportDir
+	if err = os.Mkdir(tmpDir, 0755); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmpDir)
+		}
+	}()
+	for {
+		var nameLen uint16
+		if err = binary.Read(r, binary.BigEndian, &nameLen); err != nil {
+			return
+		}
+		if nameLen == 0 {
+			break
+		}
+		if err = readSnapshotFile(r, tmpDir, nameLen); err != nil {
+			return
+		}
+	}
+	if h.StoreType == SnapshotTinyStore {
+		for chunkId := 1; chunkId <= ChunkCount; chunkId++ {
+			if err = resetCheckpoint(path.Join(tmpDir, strconv.Itoa(chunkId))); err != nil {
+				return
+			}
+		}
+	}
+	if err = syncDir(tmpDir); err != nil {
+		return
+	}
+
+	return os.Rename(tmpDir, dataDir)
+}
+
+func readSnapshotFile(r io.Reader, dir string, nameLen uint16) (err error) {
+	var (
+		size    uint64
+		fileCrc uint32
+		fp      *os.File
+	)
+	name := make([]byte, nameLen)
+	if _, err = io.ReadFull(r, name); err != nil {
+		return
+	}
+	if nameLen > maxSnapshotName || strings.ContainsAny(string(name), "/\x00") ||
+		string(name) == "." || string(name) == ".." {
+		return ErrorSnapshotFormat
+	}
+	if err = binary.Read(r, binary.BigEndian, &size); err != nil {
+		return
+	}
+	if fp, err = os.OpenFile(path.Join(dir, string(name)), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666); err != nil {
+		return
+	}
+	defer fp.Close()
+	crc := crc32.NewIEEE()
+	if _, err = io.CopyN(io.MultiWriter(fp, crc), r, int64(size)); err != nil {
+		return
+	}
+	if err = binary.Read(r, binary.BigEndian, &fileCrc); err != nil {
+		return
+	}
+	if fileCrc != crc.Sum32() {
+		return fmt.Errorf("file[%v] %v", string(name), ErrorSnapshotCorrupt)
+	}
+
+	return fp.Sync()
+}
+
+func syncDir(dir string) (err error) {
+	fp, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer fp.Close()
+
+	return fp.Sync()
+}
+
+// Verify checks every block of the extents not deleted with the block crcs.
+func (s *ExtentStore) Verify() (err error) {
+	extents, err := s.GetAllWatermark()
+	if err != nil {
+		return
+	}
+	for _, ei := range extents {
+		for blockNo := int64(0); ; blockNo++ {
+			size, e := s.VerifyBlock(ei.ExtentId, blockNo)
+			if e == ErrorHasDelete {
+				break
+			}
+			if e != nil {
+				return fmt.Errorf("extent[%v] block[%v] err[%v]", ei.ExtentId, blockNo, e)
+			}
+			if size == 0 {
+				break
+			}
+		}
+	}
+
+	return
+}
+
+// Verify checks every object not deleted with the object crcs.
+func (s *TinyStore) Verify() (err error) {
+	for chunkId := 1; chunkId <= ChunkCount; chunkId++ {
+		var oids []uint64
+		if oids, err = s.GetLiveObjects(uint32(chunkId)); err != nil {
+			return
+		}
+		for _, oid := range oids {
+			if _, e := s.VerifyObject(uint32(chunkId), oid); e != nil {
+				return fmt.Errorf("chunk[%v] object[%v] err[%v]", chunkId, oid, e)
+			}
+		}
+	}
+
+	return
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bytes"
 	"container/list"
 	"encoding/binary"
 	"fmt"
@@ -13,8 +14,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"syscall"
-
-	"github.com/juju/errors"
+	"time"
 )
 
 var (
@@ -32,22 +32,42 @@ const (
 )
 
 type ExtentStore struct {
-	dataDir      string
-	lock         sync.Mutex
-	extents      map[uint64]*Extent
-	fdlist       *list.List
-	baseExtentId uint64
+	dataDir       string
+	blockSize     int64
+	lock          sync.Mutex
+	refsDrained   *sync.Cond // signalled on s.lock when an extent is put back
+	extents       map[uint64]*Extent
+	deleting      map[uint64]bool // the extents out of the cache being deleted
+	fdlist        *list.List
+	cacheCapacity int
+	committer     *groupCommitter
+	ioMode        IoMode
+	baseExtentId  uint64
+	hits          uint64
+	misses        uint64
+	evictions     uint64
+	freezer
 }
 
-func NewExtentStore(dataDir string, newMode bool) (s *ExtentStore, err error) {
+// NewExtentStore opens the extent store in dataDir, the new extents are
+// created in the v2 format with the blockSize. At most cacheCapacity extents
+// are kept open, it is unlimited if cacheCapacity is 0.
+func NewExtentStore(dataDir string, blockSize, cacheCapacity int, newMode bool) (s *ExtentStore, err error) {
+	if !validBlockSize(blockSize) {
+		return nil, fmt.Errorf("NewExtentStore [%v] error block size[%v]", dataDir, blockSize)
+	}
 	s = new(ExtentStore)
 	s.dataDir = dataDir
+	s.blockSize = int64(blockSize)
+	s.cacheCapacity = cacheCapacity
 	if err = CheckAndCreateSubdir(dataDir, newMode); err != nil {
 		return nil, fmt.Errorf("NewExtentStore [%v] err[%v]", dataDir, err)
 	}
 
 	s.extents = make(map[uint64]*Extent, 0)
+	s.deleting = make(map[uint64]bool)
 	s.fdlist = list.New()
+	s.refsDrained = sync.NewCond(&s.lock)
 	if err = s.initBaseFileId(); err != nil {
 		return nil, fmt.Errorf("NewExtentStore [%v] err[%v]", dataDir, err)
 	}
@@ -56,6 +76,9 @@ func NewExtentStore(dataDir string, newMode bool) (s *ExtentStore, err error) {
 }
 
 func (s *ExtentStore) DeleteStore() {
+	if s.committer != nil {
+		s.committer.stop()
+	}
 	s.ClearAllCache()
 	os.RemoveAll(s.dataDir)
 
@@ -63,60 +86,104 @@ func (s *ExtentStore) DeleteStore() {
 }
 
 func (s *ExtentStore) Create() (extentId uint64, err error) {
-	var e *Extent
+	if err = s.enter(); err != nil {
+		return
+	}
+	defer s.exit()
 	fileId := atomic.AddUint64(&s.baseExtentId, 1)
-	emptyCrc := crc32.ChecksumIEEE(make([]byte, BlockSize))
-	if e, err = s.createExtent(fileId); err != nil {
+	if err = s.create(fileId, s.blockSize); err != nil {
 		return
 	}
+	extentId = fileId
 
-	for blockNo := 0; blockNo < BlockCount; blockNo++ {
-		binary.BigEndian.PutUint32(e.blocksCrc[blockNo*PerBlockCrcSize:(blockNo+1)*PerBlockCrcSize], emptyCrc)
+	return
+}
+
+// CreateWithId creates the extent with the id allocated by the leader of the
+// volume group, it is used by the followers of the replication chain.
+func (s *ExtentStore) CreateWithId(extentId uint64) (err error) {
+	return s.CreateWithBlockSize(extentId, s.blockSize)
+}
+
+// CreateWithBlockSize creates the extent with the id and the block size of
+// another replica, so the block crcs of the two replicas are comparable.
+func (s *ExtentStore) CreateWithBlockSize(extentId uint64, blockSize int64) (err error) {
+	if !validBlockSize(int(blockSize)) {
+		return ErrorUnmatchPara
+	}
+	if err = s.enter(); err != nil {
+		return
+	}
+	defer s.exit()
+	for {
+		baseExtentId := atomic.LoadUint64(&s.baseExtentId)
+		if extentId <= baseExtentId || atomic.CompareAndSwapUint64(&s.baseExtentId, baseExtentId, extentId) {
+			break
+		}
 	}
 
-	if _, err = e.file.WriteAt(e.blocksCrc, 0); err != nil {
+	return s.create(extentId, blockSize)
+}
+
+func (s *ExtentStore) create(fileId uint64, blockSize int64) (err error) {
+	var e *Extent
+	if e, err = s.createExtent(fileId, blockSize); err != nil {
 		return
 	}
-	if err = e.file.Sync(); err != nil {
+	if err = e.sync(); err != nil {
+		e.closeExtent()
 		return
 	}
-	s.addExtentToCache(e)
-	extentId = fileId
+	if e, err = s.addExtentToCache(e); err != nil {
+		return
+	}
+	s.putExtent(e)
 
 	return
 }
 
-func (s *ExtentStore) createExtent(extentId uint64) (e *Extent, err error) {
+func (s *ExtentStore) createExtent(extentId uint64, blockSize int64) (e *Extent, err error) {
 	name := s.dataDir + "/" + strconv.Itoa((int)(extentId))
 
 	e = NewExtentInCore(name, extentId)
-	if e.file, err = os.OpenFile(e.filePath, ExtentOpenOpt, 0666); err != nil {
+	e.initHeader(blockSize)
+	if e.file, err = os.OpenFile(e.filePath, ExtentOpenOpt|s.ioMode.openFlag(), 0666); err != nil {
+		return nil, err
+	}
+	if e.crcFile, err = os.OpenFile(e.crcFilePath(), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666); err != nil {
+		e.file.Close()
 		return nil, err
 	}
-	if err = os.Truncate(name, BlockCrcHeaderSize); err != nil {
+	e.directFile = s.ioMode.openDirect(e.filePath)
+	if _, err = e.file.WriteAt(e.header, 0); err != nil {
+		e.closeExtent()
 		return nil, err
 	}
 
 	return
 }
 
+// getExtent returns the open extent, the extent evicted from the cache is
+// opened again.
 func (s *ExtentStore) getExtent(extentId uint64) (e *Extent, err error) {
 	var ok bool
-	if e, ok = s.getExtentFromCache(extentId); !ok {
-		e, err = s.loadExtentFromDisk(extentId)
+	if e, ok = s.getExtentFromCache(extentId); ok {
+		atomic.AddUint64(&s.hits, 1)
+		return
 	}
+	atomic.AddUint64(&s.misses, 1)
 
-	return e, err
+	return s.loadExtentFromDisk(extentId)
 }
 
 func (s *ExtentStore) loadExtentFromDisk(extentId uint64) (e *Extent, err error) {
 	name := s.dataDir + "/" + strconv.Itoa((int)(extentId))
 	e = NewExtentInCore(name, extentId)
-	if err = s.openExtentFromDisk(e); err == nil {
-		s.addExtentToCache(e)
+	if err = s.openExtentFromDisk(e); err != nil {
+		return
 	}
 
-	return
+	return s.addExtentToCache(e)
 }
 
 func (s *ExtentStore) initBaseFileId() error {
@@ -144,145 +211,330 @@ func (s *ExtentStore) openExtentFromDisk(e *Extent) (err error) {
 	e.writelock()
 	defer e.writeUnlock()
 
-	if e.file, err = os.OpenFile(e.filePath, os.O_RDWR, 0666); err != nil {
+	if e.file, err = os.OpenFile(e.filePath, os.O_RDWR|s.ioMode.openFlag(), 0666); err != nil {
 		if strings.Contains(err.Error(), syscall.ENOENT.Error()) {
 			err = ErrorChunkNotFound
 		}
 		return err
 	}
-	if _, err = e.file.ReadAt(e.blocksCrc, 0); err != nil {
+	if err = e.loadHeader(s.blockSize); err != nil {
+		e.file.Close()
+		if e.crcFile != nil {
+			e.crcFile.Close()
+		}
 		return
 	}
+	e.directFile = s.ioMode.openDirect(e.filePath)
 
 	return
 }
 
 func (s *ExtentStore) Write(extentId uint64, offset, size int64, data []byte, crc uint32) (err error) {
 	var e *Extent
+	if err = s.enter(); err != nil {
+		return
+	}
+	defer s.exit()
 	if e, err = s.getExtent(extentId); err != nil {
 		return
 	}
-	if err = s.checkOffsetAndSize(offset, size); err != nil {
+	defer s.putExtent(e)
+	if err = e.checkOffsetAndSize(offset, size); err != nil {
 		return
 	}
-	if e.blocksCrc[MarkDeleteIndex] == MarkDelete {
-		err = ErrorHasDelete
+
+	e.writelock()
+	if e.isMarkDelete() {
+		e.writeUnlock()
+		return ErrorHasDelete
+	}
+	if e.isSealed() {
+		e.writeUnlock()
+		return ErrorExtentSealed
+	}
+	if _, err = e.writeAt(data[:size], offset+e.dataOffset()); err == nil {
+		err = e.updateBlocksCrc(offset, size, data[:size], crc)
+	}
+	e.writeUnlock()
+	if err != nil || s.committer == nil {
 		return
 	}
 
+	return s.committer.commit(e, size)
+}
+
+// SetSyncMode sets how the writes are synced, it must be called before the
+// store serves the writes. The interval and maxBytes are the batch limits of
+// SyncModeGroupCommit.
+func (s *ExtentStore) SetSyncMode(mode SyncMode, interval time.Duration, maxBytes int64) {
+	if mode == SyncModeGroupCommit && s.committer == nil {
+		s.committer = newGroupCommitter(interval, maxBytes)
+	}
+}
+
+// SetIoMode sets how the data of the extents is read and written, it must be
+// called before the store opens any extent, an open extent keeps its mode.
+func (s *ExtentStore) SetIoMode(mode IoMode) {
+	s.ioMode = mode
+}
+
+func (s *ExtentStore) GetSyncStats() *SyncStats {
+	return syncStats(s.committer)
+}
+
+func (s *ExtentStore) Read(extentId uint64, offset, size int64, nbuf []byte) (crc uint32, err error) {
+	var e *Extent
+	if e, err = s.getExtent(extentId); err != nil {
+		return
+	}
+	defer s.putExtent(e)
+	if err = e.checkOffsetAndSize(offset, size); err != nil {
+		return
+	}
 	e.readlock()
 	defer e.readUnlock()
-	if _, err = e.file.WriteAt(data[:size], offset+BlockCrcHeaderSize); err != nil {
+	if e.isMarkDelete() {
+		err = ErrorHasDelete
 		return
 	}
-	offsetInBlock := offset % BlockSize
-	blockNo := offset / BlockSize
-	if offsetInBlock!=0 {
-		blockBuffer := make([]byte, BlockSize)
-		e.file.ReadAt(blockBuffer, (blockNo)*BlockSize+BlockCrcHeaderSize)
-		crc = crc32.ChecksumIEEE(blockBuffer)
+	if _, err = e.readAt(nbuf[:size], offset+e.dataOffset()); err != nil {
+		return
 	}
-	binary.BigEndian.PutUint32(e.blocksCrc[blockNo*PerBlockCrcSize:(blockNo+1)*PerBlockCrcSize], crc)
-	if _, err = e.file.WriteAt(e.blocksCrc[blockNo*PerBlockCrcSize:(blockNo+1)*PerBlockCrcSize], blockNo*PerBlockCrcSize); err != nil {
+	if offset%e.blockSize == 0 && size == e.blockSize {
+		crc = e.blockCrc(offset / e.blockSize)
+	} else {
+		crc = crc32.ChecksumIEEE(nbuf[:size])
+	}
+
+	return
+}
+
+func (s *ExtentStore) MarkDelete(extentId uint64, offset, size int64) (err error) {
+	var e *Extent
+	if err = s.enter(); err != nil {
 		return
 	}
-	if offsetInBlock+size<=BlockSize{
+	defer s.exit()
+	if e, err = s.getExtent(extentId); err != nil {
 		return
 	}
+	defer s.putExtent(e)
 
-	nextBlockNo:=blockNo+1
-	if  offsetInBlock+size>BlockSize {
-		nextBlockBuffer := make([]byte, BlockSize)
-		e.file.ReadAt(nextBlockBuffer, (nextBlockNo)*BlockSize+BlockCrcHeaderSize)
-		crc = crc32.ChecksumIEEE(nextBlockBuffer)
-		binary.BigEndian.PutUint32(e.blocksCrc[(nextBlockNo)*PerBlockCrcSize:(nextBlockNo+1)*PerBlockCrcSize], crc)
-		if _, err = e.file.WriteAt(e.blocksCrc[(nextBlockNo)*PerBlockCrcSize:(nextBlockNo+1)*PerBlockCrcSize], (nextBlockNo)*PerBlockCrcSize); err != nil {
-			return
-		}
-	}
+	e.writelock()
+	defer e.writeUnlock()
 
-	return
+	return e.markDelete()
 }
 
-func (s *ExtentStore) checkOffsetAndSize(offset, size int64) error {
-	if offset+size > BlockSize*BlockCount {
-		return ErrorUnmatchPara
+// Seal cuts the extent to size and refuses the writes to it after, size is
+// the commit length of the extent on the leader.
+func (s *ExtentStore) Seal(extentId uint64, size int64) (err error) {
+	var (
+		e     *Extent
+		finfo os.FileInfo
+	)
+	if err = s.enter(); err != nil {
+		return
 	}
-	if offset >= BlockCount*BlockSize || size == 0 {
-		return ErrorUnmatchPara
+	defer s.exit()
+	if e, err = s.getExtent(extentId); err != nil {
+		return
+	}
+	defer s.putExtent(e)
+	if e.version == ExtentVersionV1 {
+		return ErrorExtentVersion
 	}
 
-	if size > BlockSize{
+	e.writelock()
+	defer e.writeUnlock()
+	if finfo, err = e.file.Stat(); err != nil {
+		return
+	}
+	if size < 0 || size > finfo.Size()-e.dataOffset() {
 		return ErrorUnmatchPara
 	}
+	if err = e.truncate(size); err != nil {
+		return
+	}
+	e.crcLock.Lock()
+	e.pending = nil
+	err = e.setCommitLength(size)
+	e.crcLock.Unlock()
+	if err != nil {
+		return
+	}
+	if err = e.setSeal(ExtentSealed); err != nil {
+		return
+	}
 
-	return nil
+	return e.sync()
 }
 
-func (s *ExtentStore) Read(extentId uint64, offset, size int64, nbuf []byte) (crc uint32, err error) {
+func (s *ExtentStore) Unseal(extentId uint64) (err error) {
 	var e *Extent
-	if e, err = s.getExtent(extentId); err != nil {
+	if err = s.enter(); err != nil {
 		return
 	}
-	if err = s.checkOffsetAndSize(offset, size); err != nil {
+	defer s.exit()
+	if e, err = s.getExtent(extentId); err != nil {
 		return
 	}
-	if e.blocksCrc[MarkDeleteIndex] == MarkDelete {
-		err = ErrorHasDelete
+	defer s.putExtent(e)
+
+	e.writelock()
+	defer e.writeUnlock()
+	if err = e.setSeal(ExtentActive); err != nil {
 		return
 	}
-	offsetInBlock := offset % BlockSize
-	e.readlock()
-	defer e.readUnlock()
-	if _, err = e.file.ReadAt(nbuf[:size], offset+BlockCrcHeaderSize); err != nil {
+
+	return e.sync()
+}
+
+func (s *ExtentStore) IsSealed(extentId uint64) (sealed bool, err error) {
+	var e *Extent
+	if e, err = s.getExtent(extentId); err != nil {
 		return
 	}
-	blockNo := offset / BlockSize
-	if offsetInBlock == 0  && size==BlockSize{
-		crc = binary.BigEndian.Uint32(e.blocksCrc[blockNo*4 : (blockNo+1)*4])
-	} else {
-		crc = crc32.ChecksumIEEE(nbuf)
-	}
+	defer s.putExtent(e)
+	e.readlock()
+	sealed = e.isSealed()
+	e.readUnlock()
 
 	return
 }
 
-func (s *ExtentStore) MarkDelete(extentId uint64, offset, size int64) (err error) {
+// Commit records that every replica of the extent has the data in
+// [offset, end), it is called by the leader of the volume group. The commit
+// length moves forward to the end of the contiguous committed data.
+func (s *ExtentStore) Commit(extentId uint64, offset, end int64) (err error) {
 	var e *Extent
+	if err = s.enter(); err != nil {
+		return
+	}
+	defer s.exit()
 	if e, err = s.getExtent(extentId); err != nil {
 		return
 	}
+	defer s.putExtent(e)
 
-	e.readlock()
-	defer e.readUnlock()
-	e.blocksCrc[MarkDeleteIndex] = MarkDelete
-	if _, err = e.file.WriteAt(e.blocksCrc, 0); err != nil {
+	return e.commit(offset, end)
+}
+
+func (s *ExtentStore) GetCommitLength(extentId uint64) (length int64, err error) {
+	var e *Extent
+	if e, err = s.getExtent(extentId); err != nil {
 		return
 	}
+	defer s.putExtent(e)
+	length = e.getCommitLength()
 
 	return
 }
 
 func (s *ExtentStore) Delete(extentId uint64) (err error) {
 	var e *Extent
+	if err = s.enter(); err != nil {
+		return
+	}
+	defer s.exit()
 	if e, err = s.getExtent(extentId); err != nil {
-		return nil
+		if err != ErrorHasDelete {
+			err = nil
+		}
+		return
+	}
+	defer s.putExtent(e)
+	if err = s.delExtentFromCache(e); err != nil {
+		return
 	}
+	err = e.deleteExtent()
+	s.lock.Lock()
+	delete(s.deleting, extentId)
+	s.lock.Unlock()
+
+	return
+}
 
-	s.delExtentFromCache(e)
-	if err = e.deleteExtent(); err != nil {
-		return nil
+// DeleteExpired unlinks the extents marked deleted for longer than the grace
+// period in seconds, the ids of the extents unlinked are returned.
+func (s *ExtentStore) DeleteExpired(gracePeriod int64) (extents []uint64, err error) {
+	var finfos []os.FileInfo
+	if s.IsFrozen() {
+		return
+	}
+	if finfos, err = ioutil.ReadDir(s.dataDir); err != nil {
+		return
+	}
+	now := time.Now().Unix()
+	for _, finfo := range finfos {
+		extentId, e := strconv.ParseUint(finfo.Name(), 10, 64)
+		if e != nil {
+			continue
+		}
+		deleteTime, e := s.extentMarkDeleteTime(extentId)
+		if e != nil || deleteTime == 0 || now-deleteTime < gracePeriod {
+			continue
+		}
+		if e = s.Delete(extentId); e != nil {
+			continue
+		}
+		extents = append(extents, extentId)
 	}
 
 	return
 }
 
+// extentMarkDeleteTime reads the mark delete time of the extent, the extent
+// is not loaded into the cache for it. An extent marked deleted without the
+// time recorded gets the current time, its grace period starts from now.
+func (s *ExtentStore) extentMarkDeleteTime(extentId uint64) (deleteTime int64, err error) {
+	if e, ok := s.getExtentFromCache(extentId); ok {
+		defer s.putExtent(e)
+		e.writelock()
+		defer e.writeUnlock()
+		return recordMarkDeleteTime(e)
+	}
+	e := NewExtentInCore(s.dataDir+"/"+strconv.FormatUint(extentId, 10), extentId)
+	if e.file, err = os.OpenFile(e.filePath, os.O_RDWR, 0666); err != nil {
+		return
+	}
+	defer e.file.Close()
+	e.header = make([]byte, BlockCrcHeaderSize)
+	n, err := e.file.ReadAt(e.header, 0)
+	if err != nil && err != io.EOF {
+		return
+	}
+	err = nil
+	if n >= len(extentMagic) && bytes.Equal(e.header[extentMagicIndex:extentMagicIndex+len(extentMagic)], extentMagic) {
+		e.version = ExtentVersionV2
+	} else if n == BlockCrcHeaderSize {
+		e.version = ExtentVersionV1
+	} else {
+		return
+	}
+
+	return recordMarkDeleteTime(e)
+}
+
+func recordMarkDeleteTime(e *Extent) (deleteTime int64, err error) {
+	if deleteTime, err = e.markDeleteTime(); err != nil || deleteTime != 0 || !e.isMarkDelete() {
+		return
+	}
+	deleteTime = time.Now().Unix()
+	err = e.setMarkDeleteTime(deleteTime)
+
+	return
+}
+
 func (s *ExtentStore) IsMarkDelete(extentId uint64) (isMarkDelete bool, err error) {
 	var e *Extent
 	if e, err = s.getExtent(extentId); err != nil {
 		return
 	}
-	isMarkDelete = e.blocksCrc[MarkDeleteIndex] == MarkDelete
+	defer s.putExtent(e)
+	e.readlock()
+	isMarkDelete = e.isMarkDelete()
+	e.readUnlock()
 
 	return
 }
@@ -292,10 +544,11 @@ func (s *ExtentStore) Sync(extentId uint64) (err error) {
 	if e, err = s.getExtent(extentId); err != nil {
 		return
 	}
+	defer s.putExtent(e)
 	e.readlock()
 	defer e.readUnlock()
 
-	return e.file.Sync()
+	return e.sync()
 }
 
 func (s *ExtentStore) SyncAll() { /*notici this function must called on program exit or kill */
@@ -303,24 +556,82 @@ func (s *ExtentStore) SyncAll() { /*notici this function must called on program
 	defer s.lock.Unlock()
 	for _, v := range s.extents {
 		v.readlock()
-		v.file.Sync()
+		v.sync()
 		v.readUnlock()
 	}
 }
 
-func (s *ExtentStore) GetBlockCrcBuffer(extentId uint64, headerBuff []byte) (err error) {
-	var e *Extent
+// GetBlockCrcIndex returns a copy of the block crcs of the extent, the
+// extent is locked against the writes so the crcs match the size.
+func (s *ExtentStore) GetBlockCrcIndex(extentId uint64) (index *BlockCrcIndex, err error) {
+	var (
+		e     *Extent
+		finfo os.FileInfo
+	)
 	if e, err = s.getExtent(extentId); err != nil {
 		return
 	}
+	defer s.putExtent(e)
+	e.readlock()
+	defer e.readUnlock()
+	if finfo, err = e.file.Stat(); err != nil {
+		return
+	}
+	index = e.crcIndex()
+	index.Size = finfo.Size() - e.dataOffset()
 
-	if len(headerBuff) != BlockCrcHeaderSize {
-		return errors.New("header buff is not BlockCrcHeaderSize")
+	return
+}
+
+// VerifyBlock reads the block of the extent and checks it with the block crc,
+// the size read is returned. The writes, which update the data and the crc
+// under the write lock, wait for the read lock of the block only.
+func (s *ExtentStore) VerifyBlock(extentId uint64, blockNo int64) (size int, err error) {
+	var e *Extent
+	if e, err = s.getExtent(extentId); err != nil {
+		return
 	}
+	defer s.putExtent(e)
 
 	e.readlock()
-	_, err = e.file.ReadAt(headerBuff, 0)
-	e.readUnlock()
+	defer e.readUnlock()
+	if e.isMarkDelete() {
+		return 0, ErrorHasDelete
+	}
+	data := make([]byte, e.blockSize)
+	if size, err = e.readAt(data, blockNo*e.blockSize+e.dataOffset()); err != nil && err != io.EOF {
+		return
+	}
+	err = nil
+	if size == 0 {
+		return
+	}
+	if !matchBlockCrc(e.version, e.blockCrc(blockNo), crc32.ChecksumIEEE(data[:size]), int64(size), e.blockSize) {
+		err = ErrorCrcUnmatch
+	}
+
+	return
+}
+
+// GetBlockSize returns the block size the extent was created with.
+func (s *ExtentStore) GetBlockSize(extentId uint64) (blockSize int64, err error) {
+	var e *Extent
+	if e, err = s.getExtent(extentId); err != nil {
+		return
+	}
+	defer s.putExtent(e)
+	blockSize = e.blockSize
+
+	return
+}
+
+func (s *ExtentStore) GetBlockCrc(extentId uint64, blockNo int64) (crc uint32, err error) {
+	var e *Extent
+	if e, err = s.getExtent(extentId); err != nil {
+		return
+	}
+	defer s.putExtent(e)
+	crc = e.blockCrc(blockNo)
 
 	return
 }
@@ -333,6 +644,7 @@ func (s *ExtentStore) GetWatermark(extentId uint64) (size int64, err error) {
 	if e, err = s.getExtent(extentId); err != nil {
 		return
 	}
+	defer s.putExtent(e)
 	e.readlock()
 	defer e.readUnlock()
 
@@ -340,11 +652,56 @@ func (s *ExtentStore) GetWatermark(extentId uint64) (size int64, err error) {
 	if err != nil {
 		return
 	}
-	size = finfo.Size() - BlockCrcHeaderSize
+	size = finfo.Size() - e.dataOffset()
 
 	return
 }
 
+func (s *ExtentStore) GetAllWatermark() (extents []*ExtentInfo, err error) {
+	var finfos []os.FileInfo
+	extents = make([]*ExtentInfo, 0)
+	if finfos, err = ioutil.ReadDir(s.dataDir); err != nil {
+		return
+	}
+	for _, finfo := range finfos {
+		extentId, e := strconv.ParseUint(finfo.Name(), 10, 64)
+		if e != nil {
+			continue
+		}
+		dataOffset, e := s.extentDataOffset(extentId)
+		if e != nil || finfo.Size() < dataOffset {
+			continue
+		}
+		ei := &ExtentInfo{ExtentId: extentId, Size: finfo.Size() - dataOffset}
+		extents = append(extents, ei)
+	}
+
+	return
+}
+
+// extentDataOffset returns where the data begins in the extent file, the
+// extent is not loaded into the cache for it.
+func (s *ExtentStore) extentDataOffset(extentId uint64) (offset int64, err error) {
+	if e, ok := s.getExtentFromCache(extentId); ok {
+		s.putExtent(e)
+		return e.dataOffset(), nil
+	}
+	fp, err := os.Open(s.dataDir + "/" + strconv.FormatUint(extentId, 10))
+	if err != nil {
+		return
+	}
+	defer fp.Close()
+	magic := make([]byte, len(extentMagic))
+	if _, err = fp.ReadAt(magic, extentMagicIndex); err != nil {
+		return
+	}
+	if bytes.Equal(magic, extentMagic) {
+		return ExtentHeaderSize, nil
+	}
+
+	return BlockCrcHeaderSize, nil
+}
+
 func (s *ExtentStore) extentExist(extentId uint64) (exist bool) {
 	name := s.dataDir + "/" + strconv.Itoa((int)(extentId))
 	if _, err := os.Stat(name); err == nil {
@@ -376,16 +733,27 @@ func (s *ExtentStore) GetStoreFileCount() (files int, err error) {
 	var finfos []os.FileInfo
 
 	if finfos, err = ioutil.ReadDir(s.dataDir); err == nil {
-		files = len(finfos)
+		for _, finfo := range finfos {
+			if _, e := strconv.ParseUint(finfo.Name(), 10, 64); e == nil {
+				files++
+			}
+		}
 	}
 
 	return
 }
 
-func (s *ExtentStore) GetStoreUsedSize() (size int64) {
+// GetStoreUsedSize returns the size of the extent files and the disk space
+// allocated to them, which is less than the size for the sparse extents. The
+// crc and del files of the extents are not counted.
+func (s *ExtentStore) GetStoreUsedSize() (logical, physical int64) {
 	if finfoArray, err := ioutil.ReadDir(s.dataDir); err == nil {
 		for _, finfo := range finfoArray {
-			size += finfo.Size()
+			if _, e := strconv.ParseUint(finfo.Name(), 10, 64); e != nil {
+				continue
+			}
+			logical += finfo.Size()
+			physical += physicalSize(finfo)
 		}
 	}
 
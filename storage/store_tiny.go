@@ -2,6 +2,8 @@ package storage
 
 import (
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"strconv"
 	"syscall"
@@ -21,6 +23,7 @@ const (
 	ReBootStoreMode   = false
 	NewStoreMode      = true
 	MinWriteAbleChunk = 1
+	PunchHoleMinSize  = 64 * 1024
 )
 
 var (
@@ -34,12 +37,38 @@ var (
 	ErrorNewStoreMode   = errors.New("error new store mode ")
 	ErrExtentNameFormat = errors.New("extent filePath format error")
 	ErrSyscallNoSpace   = errors.New("no space left on device")
+	ErrSyscallIO        = errors.New("input/output error")
 	ErrorAgain          = errors.New("try again")
 	ErrorCompaction     = errors.New("compaction error")
 	ErrorCommit         = errors.New("commit error")
 	ErrObjectSmaller    = errors.New("object smaller error")
+	ErrorExtentSealed   = errors.New("extent sealed")
+	ErrorPastCommit     = errors.New("read past commit length")
+	ErrorExtentVersion  = errors.New("unsupported by extent version")
+	ErrorCrcUnmatch     = errors.New("crc unmatch")
+	ErrorObjectCorrupt  = errors.New("object corrupt")
 )
 
+// ConvertSyscallErr turns the EIO and ENOSPC of the file operations into
+// ErrSyscallIO and ErrSyscallNoSpace, the other errors are returned as is.
+func ConvertSyscallErr(err error) error {
+	cause := errors.Cause(err)
+	switch e := cause.(type) {
+	case *os.PathError:
+		cause = e.Err
+	case *os.SyscallError:
+		cause = e.Err
+	}
+	switch cause {
+	case syscall.EIO:
+		return ErrSyscallIO
+	case syscall.ENOSPC:
+		return ErrSyscallNoSpace
+	}
+
+	return err
+}
+
 /*
 tiny Store contains 40 chunkFiles,when write ,choose a avaliChunkFile append
 */
@@ -52,6 +81,8 @@ type TinyStore struct {
 	storeSize      int
 	chunkSize      int
 	fullChunks     *util.Set
+	committer      *groupCommitter
+	freezer
 }
 
 func NewTinyStore(dataDir string, storeSize int, newMode bool) (s *TinyStore, err error) {
@@ -86,9 +117,11 @@ func (s *TinyStore) GetStoreStatus() int {
 }
 
 func (s *TinyStore) DeleteStore() {
+	if s.committer != nil {
+		s.committer.stop()
+	}
 	for index, c := range s.chunks {
-		c.file.Close()
-		c.tree.idxFile.Close()
+		c.close()
 		delete(s.chunks, index)
 	}
 	os.RemoveAll(s.dataDir)
@@ -123,6 +156,10 @@ func (s *TinyStore) WriteDeleteDentry(objectId uint64, chunkId int) (err error)
 	if !ok {
 		return ErrorChunkNotFound
 	}
+	if err = s.enter(); err != nil {
+		return
+	}
+	defer s.exit()
 	if !c.compactLock.TryLock() {
 		return ErrorAgain
 	}
@@ -141,16 +178,30 @@ func (s *TinyStore) WriteDeleteDentry(objectId uint64, chunkId int) (err error)
 }
 
 func (s *TinyStore) Write(fileId uint32, offset, size int64, data []byte, crc uint32) (err error) {
-	var (
-		fi os.FileInfo
-	)
 	chunkId := int(fileId)
-	objectId := uint64(offset)
 	c, ok := s.chunks[chunkId]
 	if !ok {
 		return ErrorChunkNotFound
 	}
+	if err = s.enter(); err != nil {
+		return
+	}
+	defer s.exit()
+
+	if err = s.appendObject(c, chunkId, uint64(offset), size, data, crc); err != nil || s.committer == nil {
+		return
+	}
+	// The compaction may move the object before it is synced, the compacted
+	// chunk is synced before it replaces this one, so the write waits for the
+	// group commit without blocking the compaction and the other writes.
+	return s.committer.commit(c, size)
+}
 
+// appendObject appends the object to the chunk under the compact lock.
+func (s *TinyStore) appendObject(c *Chunk, chunkId int, objectId uint64, size int64, data []byte, crc uint32) (err error) {
+	var (
+		fi os.FileInfo
+	)
 	if !c.compactLock.TryLock() {
 		return ErrorAgain
 	}
@@ -167,8 +218,10 @@ func (s *TinyStore) Write(fileId uint32, offset, size int64, data []byte, crc ui
 		return
 	}
 
+	// The chunk file is opened in append mode, the object is written at the
+	// end of it.
 	newOffset := fi.Size()
-	if _, err = c.file.WriteAt(data[:size], newOffset); err != nil {
+	if _, err = c.file.Write(data[:size]); err != nil {
 		return
 	}
 
@@ -177,9 +230,35 @@ func (s *TinyStore) Write(fileId uint32, offset, size int64, data []byte, crc ui
 			c.storeLastOid(objectId)
 		}
 	}
+
+	return
+}
+
+// SetSyncMode sets how the writes are synced, it must be called before the
+// store serves the writes. The interval and maxBytes are the batch limits of
+// SyncModeGroupCommit.
+func (s *TinyStore) SetSyncMode(mode SyncMode, interval time.Duration, maxBytes int64) {
+	if mode == SyncModeGroupCommit && s.committer == nil {
+		s.committer = newGroupCommitter(interval, maxBytes)
+	}
+}
+
+// SetIoMode sets how the data of the chunks is read and written, it must be
+// called before the store serves the writes.
+func (s *TinyStore) SetIoMode(mode IoMode) (err error) {
+	for _, c := range s.chunks {
+		if err = c.setIoMode(mode); err != nil {
+			return
+		}
+	}
+
 	return
 }
 
+func (s *TinyStore) GetSyncStats() *SyncStats {
+	return syncStats(s.committer)
+}
+
 func (s *TinyStore) Read(fileId uint32, offset, size int64, nbuf []byte) (crc uint32, err error) {
 	chunkId := int(fileId)
 	objectId := uint64(offset)
@@ -206,13 +285,20 @@ func (s *TinyStore) Read(fileId uint32, offset, size int64, nbuf []byte) (crc ui
 		return 0, ErrorObjNotFound
 	}
 
-	if int64(o.Size) != size || int64(o.Offset)+size > fi.Size() {
+	if int64(o.Size) != size {
 		return 0, ErrorUnmatchPara
 	}
+	// The object cut off or not matching the crc in the index is corrupt.
+	if int64(o.Offset)+size > fi.Size() {
+		return 0, ErrorObjectCorrupt
+	}
 
-	if _, err = c.file.ReadAt(nbuf[:size], int64(o.Offset)); err != nil {
+	if _, err = c.readAt(nbuf[:size], int64(o.Offset)); err != nil {
 		return
 	}
+	if crc32.ChecksumIEEE(nbuf[:size]) != o.Crc {
+		return 0, ErrorObjectCorrupt
+	}
 	crc = o.Crc
 
 	return
@@ -225,12 +311,7 @@ func (s *TinyStore) Sync(fileId uint32) (err error) {
 		return ErrorChunkNotFound
 	}
 
-	err = c.tree.idxFile.Sync()
-	if err != nil {
-		return
-	}
-
-	return c.file.Sync()
+	return c.sync((*os.File).Sync)
 }
 
 func (s *TinyStore) GetAllWatermark() (chunks []*ChunkInfo, err error) {
@@ -254,12 +335,15 @@ func (s *TinyStore) GetWatermark(fileId uint32) (offset int64, err error) {
 	return
 }
 
-func (s *TinyStore) GetStoreUsedSize() (size int64) {
+// GetStoreUsedSize returns the size of the chunk files and the disk space
+// allocated to them, the holes punched by MarkDelete are not allocated.
+func (s *TinyStore) GetStoreUsedSize() (logical, physical int64) {
 	var err error
 	for _, c := range s.chunks {
 		var finfo os.FileInfo
 		if finfo, err = c.file.Stat(); err == nil {
-			size += finfo.Size()
+			logical += finfo.Size()
+			physical += physicalSize(finfo)
 		}
 	}
 
@@ -278,9 +362,21 @@ func (s *TinyStore) GetAvailChunk() (chunkId int, err error) {
 
 func (s *TinyStore) SyncAll() {
 	for _, chunkFp := range s.chunks {
-		chunkFp.tree.idxFile.Sync()
-		chunkFp.file.Sync()
+		chunkFp.sync((*os.File).Sync)
+	}
+}
+
+// GetRecoveryReports returns the reports of the chunks the recovery
+// discarded anything from when the store was opened.
+func (s *TinyStore) GetRecoveryReports() (reports []*RecoveryReport) {
+	reports = make([]*RecoveryReport, 0)
+	for _, c := range s.chunks {
+		if c.report != nil && !c.report.IsEmpty() {
+			reports = append(reports, c.report)
+		}
 	}
+
+	return
 }
 
 func (s *TinyStore) PutAvailChunk(chunkId int) {
@@ -312,8 +408,57 @@ func (s *TinyStore) MarkDelete(fileId uint32, offset, size int64) error {
 	if !ok {
 		return ErrorChunkNotFound
 	}
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.exit()
+
+	// The offset of the object is moved by the compaction, so the space is
+	// freed at once only with the compactLock held, or else by the holder of
+	// it once it is released.
+	if !c.compactLock.TryLock() {
+		if err := c.deletePending(objectId); err != nil {
+			return err
+		}
+		// The holder may have released the lock before the delete is pending.
+		if !c.compactLock.TryLock() {
+			return nil
+		}
+		defer c.compactLock.Unlock()
+		c.freePendingDeletes()
+		return nil
+	}
+	defer c.compactLock.Unlock()
+	c.freePendingDeletes()
+	o, ok := c.tree.get(objectId)
+	if err := c.tree.delete(objectId); err != nil {
+		return err
+	}
+	if ok && o.Size != TombstoneFileSize && o.Size >= PunchHoleMinSize {
+		// The tombstone is synced before the data is freed, or else the
+		// object would come back live with its data zeroed after a crash.
+		if err := fdatasync(c.tree.idxFile); err != nil {
+			return err
+		}
+		// The space left is reclaimed by the compaction if it fails.
+		punchHole(c.file, int64(o.Offset), int64(o.Size))
+	}
 
-	return c.tree.delete(objectId)
+	return nil
+}
+
+func (s *TinyStore) GetChunkCheckSum(chunkId int) (fullCRC uint32, syncLastOid uint64, count int, err error) {
+	c, ok := s.chunks[chunkId]
+	if !ok {
+		return 0, 0, 0, ErrorChunkNotFound
+	}
+	fullCRC, syncLastOid, count = c.getCheckSum()
+
+	return
+}
+
+func (s *TinyStore) IsFullChunk(chunkId int) bool {
+	return s.fullChunks.Has(chunkId)
 }
 
 func (s *TinyStore) GetUnAvailChanLen() (chanLen int) {
@@ -356,6 +501,81 @@ func (s *TinyStore) GetObject(fileId uint32, objectId uint64) (o *Object, err er
 	return
 }
 
+// GetLiveObjects returns the ids of the objects not deleted in the chunk.
+func (s *TinyStore) GetLiveObjects(fileId uint32) (oids []uint64, err error) {
+	c, ok := s.chunks[int(fileId)]
+	if !ok {
+		return nil, ErrorChunkNotFound
+	}
+	oids = c.tree.oids()
+
+	return
+}
+
+// VerifyObject reads the object and checks it with the crc in the index, the
+// size read is returned.
+func (s *TinyStore) VerifyObject(fileId uint32, objectId uint64) (size int, err error) {
+	c, ok := s.chunks[int(fileId)]
+	if !ok {
+		return 0, ErrorChunkNotFound
+	}
+
+	c.commitLock.RLock()
+	defer c.commitLock.RUnlock()
+	o, ok := c.tree.get(objectId)
+	if !ok || o.Size == TombstoneFileSize {
+		return
+	}
+	data := make([]byte, o.Size)
+	if size, err = c.readAt(data, int64(o.Offset)); err == io.EOF {
+		// The object is cut off.
+		return size, ErrorCrcUnmatch
+	} else if err != nil {
+		return
+	}
+	if crc32.ChecksumIEEE(data) != o.Crc {
+		err = ErrorCrcUnmatch
+	}
+
+	return
+}
+
+// RepairObject writes the data of a corrupt object in place, the data comes
+// from another replica and must match the crc in the index.
+func (s *TinyStore) RepairObject(fileId uint32, objectId uint64, data []byte, crc uint32) (err error) {
+	c, ok := s.chunks[int(fileId)]
+	if !ok {
+		return ErrorChunkNotFound
+	}
+	if err = s.enter(); err != nil {
+		return
+	}
+	defer s.exit()
+
+	if !c.compactLock.TryLock() {
+		return ErrorAgain
+	}
+	defer c.compactLock.Unlock()
+	o, ok := c.tree.get(objectId)
+	if !ok || o.Size == TombstoneFileSize {
+		return ErrorObjNotFound
+	}
+	if int(o.Size) != len(data) || o.Crc != crc || crc32.ChecksumIEEE(data) != crc {
+		return ErrorCrcUnmatch
+	}
+	// The chunk file is opened in append mode, which can not write at offset.
+	fp, err := os.OpenFile(c.file.Name(), os.O_RDWR, 0666)
+	if err != nil {
+		return
+	}
+	defer fp.Close()
+	if _, err = fp.WriteAt(data, int64(o.Offset)); err != nil {
+		return
+	}
+
+	return fp.Sync()
+}
+
 func (s *TinyStore) GetDelObjects(fileId uint32) (objects []uint64) {
 	objects = make([]uint64, 0)
 	c, ok := s.chunks[int(fileId)]
@@ -406,18 +626,24 @@ func (s *TinyStore) UpdateStoreInfo() {
 	return
 }
 
-func (s *TinyStore) DoCompactWork(chunkId int) (err error) {
+// DoCompactWork copies the live objects of the chunk to a new one, pace is
+// called with the size of every object copied to pace the IO, nil for none.
+func (s *TinyStore) DoCompactWork(chunkId int, pace func(size int64)) (err error) {
 	_, ok := s.chunks[chunkId]
 	if !ok {
 		return ErrorChunkNotFound
 	}
+	if err = s.enter(); err != nil {
+		return
+	}
+	defer s.exit()
 
 	ok = s.IsReadyToCompact(chunkId)
 	if !ok {
 		return nil
 	}
 
-	err = s.doCompactAndCommit(chunkId)
+	err = s.doCompactAndCommit(chunkId, pace)
 	if err != nil {
 		return err
 	}
@@ -446,14 +672,15 @@ func (s *TinyStore) IsReadyToCompact(chunkId int) bool {
 }
 
 // make sure chunkId is valid
-func (s *TinyStore) doCompactAndCommit(chunkId int) (err error) {
+func (s *TinyStore) doCompactAndCommit(chunkId int, pace func(size int64)) (err error) {
 	c := s.chunks[chunkId]
 	if !c.compactLock.TryLockTimed(CompactMaxWait) {
 		return nil
 	}
 	defer c.compactLock.Unlock()
+	defer c.freePendingDeletes()
 
-	if err = c.doCompact(); err != nil {
+	if err = c.doCompact(pace); err != nil {
 		return ErrorCompaction
 	}
 
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func newTestTinyStore(t *testing.T) (s *TinyStore, dir string) {
+	dir, err := ioutil.TempDir("", "tiny")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err = NewTinyStore(dir+"/tiny", ChunkCount*1024*1024, NewStoreMode); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return
+}
+
+func writeTestObject(t *testing.T, s *TinyStore, chunkId uint32, size int) uint64 {
+	data, crc := testData(size)
+	oid, err := s.AllocObjectId(chunkId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Write(chunkId, int64(oid), int64(len(data)), data, crc); err != nil {
+		t.Fatal(err)
+	}
+
+	return oid
+}
+
+// The object deleted while the chunk is compacted stays deleted after the
+// compaction copied it, and its space is freed by the compaction.
+func TestTinyMarkDeleteCompacting(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	const chunkId = 1
+	c := s.chunks[chunkId]
+	copied := writeTestObject(t, s, chunkId, PunchHoleMinSize)
+	waiting := writeTestObject(t, s, chunkId, PunchHoleMinSize)
+
+	c.compactLock.Lock()
+	if err := c.doCompact(nil); err != nil {
+		c.compactLock.Unlock()
+		t.Fatal(err)
+	}
+	if err := s.MarkDelete(chunkId, int64(copied), PunchHoleMinSize); err != nil {
+		c.compactLock.Unlock()
+		t.Fatal(err)
+	}
+	c.commitLock.Lock()
+	err := c.doCommit()
+	c.commitLock.Unlock()
+	if err != nil {
+		c.compactLock.Unlock()
+		t.Fatal(err)
+	}
+	if _, ok := c.tree.get(copied); !ok {
+		c.compactLock.Unlock()
+		t.Fatalf("object[%v] not copied by the compaction", copied)
+	}
+	c.freePendingDeletes()
+	if _, ok := c.tree.get(copied); ok {
+		c.compactLock.Unlock()
+		t.Fatalf("object[%v] deleted in compaction is back", copied)
+	}
+
+	// The delete made while the lock is held by others is freed by the next
+	// holder.
+	if err = s.MarkDelete(chunkId, int64(waiting), PunchHoleMinSize); err != nil {
+		c.compactLock.Unlock()
+		t.Fatal(err)
+	}
+	c.compactLock.Unlock()
+	if len(c.pendingDels) != 1 {
+		t.Fatalf("pending deletes[%v]", len(c.pendingDels))
+	}
+	other := writeTestObject(t, s, chunkId, PunchHoleMinSize)
+	if err = s.MarkDelete(chunkId, int64(other), PunchHoleMinSize); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.pendingDels) != 0 {
+		t.Fatalf("pending deletes[%v] left", len(c.pendingDels))
+	}
+	for _, oid := range []uint64{copied, waiting, other} {
+		if _, ok := c.tree.get(oid); ok {
+			t.Fatalf("object[%v] not deleted", oid)
+		}
+	}
+}
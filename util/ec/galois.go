@@ -0,0 +1,100 @@
+package ec
+
+// The arithmetic of GF(2^8) with the primitive polynomial x^8+x^4+x^3+x^2+1.
+const (
+	fieldSize      = 256
+	primitivePoly  = 0x11d
+	fieldGenerator = 2
+)
+
+var (
+	expTable [2 * fieldSize]byte
+	logTable [fieldSize]int
+	mulTable [fieldSize][fieldSize]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < fieldSize-1; i++ {
+		expTable[i] = byte(x)
+		logTable[x] = i
+		x *= fieldGenerator
+		if x >= fieldSize {
+			x ^= primitivePoly
+		}
+	}
+	for i := fieldSize - 1; i < len(expTable); i++ {
+		expTable[i] = expTable[i-(fieldSize-1)]
+	}
+	for a := 0; a < fieldSize; a++ {
+		for b := 0; b < fieldSize; b++ {
+			mulTable[a][b] = galMul(byte(a), byte(b))
+		}
+	}
+}
+
+func galMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+
+	return expTable[logTable[a]+logTable[b]]
+}
+
+// galInv returns the inverse of a, which must not be zero.
+func galInv(a byte) byte {
+	return expTable[fieldSize-1-logTable[a]]
+}
+
+// galMulAdd adds c*in to out byte by byte.
+func galMulAdd(c byte, in, out []byte) {
+	if c == 0 {
+		return
+	}
+	row := &mulTable[c]
+	for i, b := range in {
+		out[i] ^= row[b]
+	}
+}
+
+// invertMatrix returns the inverse of the square matrix m by the Gauss-Jordan
+// elimination, m is left unchanged.
+func invertMatrix(m [][]byte) (inv [][]byte, err error) {
+	n := len(m)
+	work := make([][]byte, n)
+	inv = make([][]byte, n)
+	for i := range m {
+		work[i] = make([]byte, n)
+		copy(work[i], m[i])
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, ErrSingularMatrix
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+		if c := work[col][col]; c != 1 {
+			c = galInv(c)
+			for j := 0; j < n; j++ {
+				work[col][j] = galMul(work[col][j], c)
+				inv[col][j] = galMul(inv[col][j], c)
+			}
+		}
+		for row := 0; row < n; row++ {
+			if row == col || work[row][col] == 0 {
+				continue
+			}
+			c := work[row][col]
+			galMulAdd(c, work[col], work[row])
+			galMulAdd(c, inv[col], inv[row])
+		}
+	}
+
+	return
+}
@@ -0,0 +1,144 @@
+// Package ec implements the Reed-Solomon erasure code of the erasure coded
+// volumes, and the layout of an extent in the shards of its stripes.
+package ec
+
+import (
+	"errors"
+)
+
+var (
+	ErrInvalidShardNum = errors.New("invalid shard num")
+	ErrShardSize       = errors.New("shards of different size")
+	ErrTooFewShards    = errors.New("too few shards to reconstruct")
+	ErrSingularMatrix  = errors.New("singular matrix")
+)
+
+// Encoder encodes dataNum data shards into parityNum parity shards. The code
+// is systematic, the encoding matrix is the identity on top of a Cauchy
+// matrix, so any dataNum shards of the dataNum+parityNum reconstruct the rest.
+type Encoder struct {
+	dataNum   int
+	parityNum int
+	matrix    [][]byte
+}
+
+func NewEncoder(dataNum, parityNum int) (e *Encoder, err error) {
+	if dataNum <= 0 || parityNum < 0 || dataNum+parityNum > fieldSize {
+		return nil, ErrInvalidShardNum
+	}
+	e = &Encoder{dataNum: dataNum, parityNum: parityNum}
+	e.matrix = make([][]byte, dataNum+parityNum)
+	for i := range e.matrix {
+		e.matrix[i] = make([]byte, dataNum)
+		if i < dataNum {
+			e.matrix[i][i] = 1
+			continue
+		}
+		// 1/(x_i+y_j) with x_i = i and y_j = j, they never meet since i >= dataNum.
+		for j := 0; j < dataNum; j++ {
+			e.matrix[i][j] = galInv(byte(i) ^ byte(j))
+		}
+	}
+
+	return
+}
+
+func (e *Encoder) DataNum() int {
+	return e.dataNum
+}
+
+func (e *Encoder) ParityNum() int {
+	return e.parityNum
+}
+
+// Encode computes the parity shards from the data shards, shards are the
+// dataNum data shards followed by the parityNum parity shards. A nil parity
+// shard is allocated.
+func (e *Encoder) Encode(shards [][]byte) (err error) {
+	if len(shards) != e.dataNum+e.parityNum {
+		return ErrInvalidShardNum
+	}
+	size := len(shards[0])
+	for i, shard := range shards {
+		if shard == nil && i >= e.dataNum {
+			shards[i] = make([]byte, size)
+			continue
+		}
+		if len(shard) != size {
+			return ErrShardSize
+		}
+	}
+	for i := e.dataNum; i < len(shards); i++ {
+		e.encodeShard(i, shards)
+	}
+
+	return
+}
+
+// encodeShard computes the shard i from the data shards.
+func (e *Encoder) encodeShard(i int, shards [][]byte) {
+	out := shards[i]
+	for b := range out {
+		out[b] = 0
+	}
+	for j := 0; j < e.dataNum; j++ {
+		galMulAdd(e.matrix[i][j], shards[j], out)
+	}
+}
+
+// Reconstruct fills the missing shards, a missing shard is nil or empty. At
+// least dataNum shards must be present and they must be of the same size.
+func (e *Encoder) Reconstruct(shards [][]byte) (err error) {
+	if len(shards) != e.dataNum+e.parityNum {
+		return ErrInvalidShardNum
+	}
+	var (
+		size    = -1
+		present = make([]int, 0, e.dataNum)
+	)
+	for i, shard := range shards {
+		if len(shard) == 0 {
+			continue
+		}
+		if size >= 0 && len(shard) != size {
+			return ErrShardSize
+		}
+		size = len(shard)
+		if len(present) < e.dataNum {
+			present = append(present, i)
+		}
+	}
+	if len(present) < e.dataNum {
+		return ErrTooFewShards
+	}
+
+	// The rows of the present shards map the data to them, the inverse maps
+	// them back to the data.
+	sub := make([][]byte, e.dataNum)
+	for r, i := range present {
+		sub[r] = e.matrix[i]
+	}
+	inv, err := invertMatrix(sub)
+	if err != nil {
+		return
+	}
+	for j := 0; j < e.dataNum; j++ {
+		if len(shards[j]) != 0 {
+			continue
+		}
+		out := make([]byte, size)
+		for r, i := range present {
+			galMulAdd(inv[j][r], shards[i], out)
+		}
+		shards[j] = out
+	}
+	for i := e.dataNum; i < len(shards); i++ {
+		if len(shards[i]) != 0 {
+			continue
+		}
+		shards[i] = make([]byte, size)
+		e.encodeShard(i, shards)
+	}
+
+	return
+}
@@ -0,0 +1,111 @@
+package ec
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func testShards(e *Encoder, size int) (shards [][]byte) {
+	shards = make([][]byte, e.DataNum()+e.ParityNum())
+	for j := 0; j < e.DataNum(); j++ {
+		shards[j] = make([]byte, size)
+		rand.Read(shards[j])
+	}
+
+	return
+}
+
+func copyShards(shards [][]byte) (copied [][]byte) {
+	copied = make([][]byte, len(shards))
+	for i, shard := range shards {
+		copied[i] = append([]byte(nil), shard...)
+	}
+
+	return
+}
+
+// forErasures calls fn with every set of the shards of at most max erased.
+func forErasures(n, max int, fn func(erased []int)) {
+	var walk func(from int, erased []int)
+	walk = func(from int, erased []int) {
+		fn(erased)
+		if len(erased) == max {
+			return
+		}
+		for i := from; i < n; i++ {
+			walk(i+1, append(erased, i))
+		}
+	}
+	walk(0, nil)
+}
+
+// Any ParityNum shards erased are reconstructed, the data shards are kept by
+// the encoding as they are.
+func TestReconstruct(t *testing.T) {
+	for _, c := range []struct{ dataNum, parityNum int }{{DefaultDataNum, DefaultParityNum}, {1, 1}, {6, 3}, {10, 4}} {
+		e, err := NewEncoder(c.dataNum, c.parityNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shards := testShards(e, 1000)
+		data := copyShards(shards[:c.dataNum])
+		if err = e.Encode(shards); err != nil {
+			t.Fatal(err)
+		}
+		for j := range data {
+			if !bytes.Equal(shards[j], data[j]) {
+				t.Fatalf("%v+%v data shard[%v] changed by the encoding", c.dataNum, c.parityNum, j)
+			}
+		}
+		forErasures(len(shards), c.parityNum, func(erased []int) {
+			damaged := copyShards(shards)
+			for _, i := range erased {
+				damaged[i] = nil
+			}
+			if err := e.Reconstruct(damaged); err != nil {
+				t.Fatalf("%v+%v erased%v: %v", c.dataNum, c.parityNum, erased, err)
+			}
+			for i := range shards {
+				if !bytes.Equal(damaged[i], shards[i]) {
+					t.Fatalf("%v+%v erased%v: shard[%v] reconstructed wrong", c.dataNum, c.parityNum, erased, i)
+				}
+			}
+		})
+	}
+}
+
+func TestReconstructTooManyErasures(t *testing.T) {
+	e, err := NewEncoder(DefaultDataNum, DefaultParityNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards := testShards(e, 100)
+	if err = e.Encode(shards); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= DefaultParityNum; i++ {
+		shards[i*2] = nil
+	}
+	if err = e.Reconstruct(shards); err != ErrTooFewShards {
+		t.Fatalf("reconstruct with %v shards erased: %v", DefaultParityNum+1, err)
+	}
+}
+
+func TestEncodeInvalid(t *testing.T) {
+	if _, err := NewEncoder(0, 2); err != ErrInvalidShardNum {
+		t.Fatalf("encoder of 0 data shards: %v", err)
+	}
+	if _, err := NewEncoder(200, 57); err != ErrInvalidShardNum {
+		t.Fatalf("encoder of 257 shards: %v", err)
+	}
+	e, _ := NewEncoder(DefaultDataNum, DefaultParityNum)
+	shards := testShards(e, 100)
+	shards[1] = shards[1][:99]
+	if err := e.Encode(shards); err != ErrShardSize {
+		t.Fatalf("encode shards of different size: %v", err)
+	}
+	if err := e.Encode(shards[:DefaultDataNum]); err != ErrInvalidShardNum {
+		t.Fatalf("encode without parity shards: %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package ec
+
+const (
+	CellSize         = 64 * 1024
+	DefaultDataNum   = 4
+	DefaultParityNum = 2
+)
+
+// An extent is cut into stripes of dataNum cells, the j-th cell of a stripe
+// is kept by the j-th data shard and the parity cells of the stripe by the
+// parity shards, at the same offset of every shard:
+//
+//	extent offset o -> stripe o/(dataNum*CellSize), shard (o%(dataNum*CellSize))/CellSize
+//	shard offset    -> stripe*CellSize + o%CellSize
+//
+// The last stripe is padded with zeros.
+
+// Piece is the part of a range of the extent kept in one cell.
+type Piece struct {
+	Shard       int
+	ShardOffset int64
+	Offset      int64 // offset in the extent
+	Size        int
+}
+
+// Locate splits the range [offset, offset+size) of the extent into the
+// pieces of the cells it covers.
+func Locate(dataNum int, offset, size int64) (pieces []Piece) {
+	stripeSize := int64(dataNum) * CellSize
+	for end := offset + size; offset < end; {
+		stripe := offset / stripeSize
+		inStripe := offset % stripeSize
+		inCell := inStripe % CellSize
+		n := CellSize - inCell
+		if n > end-offset {
+			n = end - offset
+		}
+		pieces = append(pieces, Piece{
+			Shard:       int(inStripe / CellSize),
+			ShardOffset: stripe*CellSize + inCell,
+			Offset:      offset,
+			Size:        int(n),
+		})
+		offset += n
+	}
+
+	return
+}
+
+// StripeCount returns the stripes of an extent of size bytes.
+func StripeCount(dataNum int, size int64) int64 {
+	stripeSize := int64(dataNum) * CellSize
+	return (size + stripeSize - 1) / stripeSize
+}
+
+// ShardSize returns the size of every shard of an extent of size bytes.
+func ShardSize(dataNum int, size int64) int64 {
+	return StripeCount(dataNum, size) * CellSize
+}
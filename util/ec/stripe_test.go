@@ -0,0 +1,39 @@
+package ec
+
+import (
+	"testing"
+)
+
+// The pieces of a range cover it in order, each in one cell at the shard
+// offset of its stripe.
+func TestLocate(t *testing.T) {
+	const dataNum = DefaultDataNum
+	stripeSize := int64(dataNum * CellSize)
+	for _, r := range []struct{ offset, size int64 }{
+		{0, 1}, {0, CellSize}, {CellSize - 1, 2}, {100, 3 * stripeSize}, {stripeSize - 10, 10}, {2*stripeSize + CellSize, CellSize / 2},
+	} {
+		next := r.offset
+		for _, p := range Locate(dataNum, r.offset, r.size) {
+			if p.Offset != next || p.Size <= 0 || p.Size > CellSize {
+				t.Fatalf("range %+v: piece %+v, expected at %v", r, p, next)
+			}
+			stripe := p.Offset / stripeSize
+			if shard := int(p.Offset % stripeSize / CellSize); shard != p.Shard {
+				t.Fatalf("range %+v: piece %+v in shard %v", r, p, shard)
+			}
+			if p.ShardOffset != stripe*CellSize+p.Offset%CellSize || p.ShardOffset%CellSize+int64(p.Size) > CellSize {
+				t.Fatalf("range %+v: piece %+v out of its cell", r, p)
+			}
+			next += int64(p.Size)
+		}
+		if next != r.offset+r.size {
+			t.Fatalf("range %+v covered to %v", r, next)
+		}
+	}
+	if n := StripeCount(dataNum, stripeSize+1); n != 2 {
+		t.Fatalf("%v stripes of %v bytes", n, stripeSize+1)
+	}
+	if size := ShardSize(dataNum, 1); size != CellSize {
+		t.Fatalf("shard size %v of 1 byte", size)
+	}
+}
@@ -0,0 +1,63 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket allows rate tokens per second with a burst of one second. A
+// request is allowed while the bucket is not empty and takes all its tokens,
+// the bucket may go into debt, so a request larger than the rate is allowed
+// and the ones after it wait for the debt to be paid.
+type TokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate int64) (b *TokenBucket) {
+	b = &TokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+	return
+}
+
+// Allow takes n tokens if the bucket is not empty.
+func (b *TokenBucket) Allow(n int64) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.ready() {
+		return false
+	}
+	b.tokens -= float64(n)
+
+	return true
+}
+
+// Ready reports whether the bucket is not empty, no token is taken. The
+// request limited by several buckets takes the tokens by Take after every
+// bucket is ready.
+func (b *TokenBucket) Ready() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.ready()
+}
+
+// Take takes n tokens, the bucket may go into debt.
+func (b *TokenBucket) Take(n int64) {
+	b.lock.Lock()
+	b.ready()
+	b.tokens -= float64(n)
+	b.lock.Unlock()
+}
+
+// ready refills the bucket, it must be called with the lock held.
+func (b *TokenBucket) ready() bool {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+
+	return b.tokens > 0
+}